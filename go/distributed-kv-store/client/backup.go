@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// exportPage is the number of keys Export reads and Import writes per request.
+const exportPage = 100
+
+// ExportedEntry is one line of an export: a key and its live siblings.
+type ExportedEntry struct {
+	Key      string            `json:"key"`
+	Siblings []ExportedVersion `json:"siblings"`
+}
+
+// ExportedVersion is a sibling in an export. Values that are valid UTF-8
+// are written as text, any other value as base64.
+type ExportedVersion struct {
+	Value       *string       `json:"value,omitempty"`
+	ValueBase64 []byte        `json:"value_base64,omitempty"`
+	Clock       vclock.VClock `json:"clock"`
+	Timestamp   int64         `json:"timestamp"`
+	ExpiresAt   int64         `json:"expires_at,omitempty"`
+}
+
+// Backup asks node to write a consistent snapshot of its store to the file
+// called name in the node's backup directory. With base set, the snapshot
+// is incremental on top of the backup in the file called base there.
+func (c *Client) Backup(node, name, base string) (*rpc.BackupReply, error) {
+	var reply rpc.BackupReply
+	if err := c.call(node, "KVStore.Backup", &rpc.BackupArgs{Path: name, Base: base}, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Restore asks node to merge the backup in the file called name in its
+// backup directory into its store.
+func (c *Client) Restore(node, name string) (*rpc.BackupReply, error) {
+	var reply rpc.BackupReply
+	if err := c.call(node, "KVStore.Restore", &rpc.RestoreArgs{Path: name}, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Export writes every live key with prefix to w as JSON lines, one
+// ExportedEntry per key, in ascending key order, and returns the number of
+// keys written. Keys written while the export runs may or may not be in it.
+func (c *Client) Export(w io.Writer, prefix string) (int, error) {
+	enc := json.NewEncoder(w)
+	args := rpc.ScanArgs{Prefix: prefix, Limit: exportPage, Policy: store.PolicyMerge}
+	n := 0
+	for {
+		entries, err := c.Scan(args)
+		if err != nil {
+			return n, err
+		}
+		for _, e := range entries {
+			if err := enc.Encode(exportEntry(e)); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(entries) < exportPage {
+			return n, nil
+		}
+		args.Start = entries[len(entries)-1].Key + "\x00"
+	}
+}
+
+// Import reads JSON lines written by Export from r and writes their keys
+// with their original versions, which merge with any versions the cluster
+// already holds. It returns the number of keys imported.
+func (c *Client) Import(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20) // lines hold whole values in base64
+	n, line := 0, 0
+	var batch []store.Entry
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var reply cluster.ImportReply
+		err := c.do(c.route(batch[0].Key), "Cluster.Import", &cluster.ImportArgs{Entries: batch}, &reply)
+		n += reply.Imported
+		batch = batch[:0]
+		return err
+	}
+
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e ExportedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Key == "" {
+			return n, fmt.Errorf("line %d: missing key", line)
+		}
+		batch = append(batch, importEntry(e))
+		if len(batch) >= exportPage {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// exportEntry converts an entry to its exported form.
+func exportEntry(e store.Entry) ExportedEntry {
+	out := ExportedEntry{Key: e.Key, Siblings: make([]ExportedVersion, len(e.Siblings))}
+	for i, v := range e.Siblings {
+		ev := ExportedVersion{Clock: v.Clock, Timestamp: v.Timestamp, ExpiresAt: v.ExpiresAt}
+		if utf8.Valid(v.Value) {
+			s := string(v.Value)
+			ev.Value = &s
+		} else {
+			ev.ValueBase64 = v.Value
+		}
+		out.Siblings[i] = ev
+	}
+	return out
+}
+
+// importEntry converts an exported entry back to an entry.
+func importEntry(e ExportedEntry) store.Entry {
+	out := store.Entry{Key: e.Key, Siblings: make([]store.Versioned, len(e.Siblings))}
+	for i, ev := range e.Siblings {
+		v := store.Versioned{Value: ev.ValueBase64, Clock: ev.Clock, Timestamp: ev.Timestamp, ExpiresAt: ev.ExpiresAt}
+		if ev.Value != nil {
+			v.Value = []byte(*ev.Value)
+		}
+		if v.Clock == nil {
+			v.Clock = vclock.New()
+		}
+		out.Siblings[i] = v
+	}
+	return out
+}
@@ -0,0 +1,426 @@
+// Package client is a Go client for a distributed-kv-store cluster.
+//
+// A Client learns the cluster layout from any of its seed servers and sends
+// each request to a node that replicates the key, so the coordinating node
+// can serve its own replica locally. Requests that fail because a node is
+// unreachable or a quorum could not be reached are retried on the key's
+// other replicas with exponential backoff.
+package client
+
+import (
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/ring"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	stdrpc "net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the zero values of Config.
+const (
+	DefaultTimeout         = 5 * time.Second
+	DefaultRetries         = 2
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxRetryBackoff = 2 * time.Second
+	DefaultPoolSize        = 4
+	DefaultRefreshInterval = 30 * time.Second
+	DefaultChunkSize       = 1 << 20
+)
+
+// ErrClosed is returned by requests made after Close.
+var ErrClosed = errors.New("client is closed")
+
+// Config holds the settings of a Client.
+type Config struct {
+	Servers         []string      // seed nodes used to discover the cluster
+	Timeout         time.Duration // per-request timeout, dialing included
+	Retries         int           // extra attempts after a retryable failure; negative disables retries
+	RetryBackoff    time.Duration // wait before the first retry, doubled after each attempt
+	MaxRetryBackoff time.Duration // longest wait between two attempts
+	PoolSize        int           // idle connections kept per node
+	RefreshInterval time.Duration // how often the cluster layout is reloaded
+	Policy          string        // conflict resolution for reads; empty uses the server's default
+	ChunkSize       int           // bytes sent per request by PutStream and GetStream
+}
+
+// Client talks to a distributed-kv-store cluster. It is safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	mu        sync.Mutex
+	pools     map[string]*pool
+	ring      *ring.Ring
+	n         int
+	refreshed time.Time
+	closed    bool
+}
+
+// New creates a client for the cluster reachable through cfg.Servers and
+// loads the cluster layout from the first server that answers.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no servers given")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	} else if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.MaxRetryBackoff <= 0 {
+		cfg.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = DefaultPoolSize
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultChunkSize
+	}
+
+	c := &Client{
+		cfg:   cfg,
+		pools: make(map[string]*pool),
+	}
+	if err := c.Refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh reloads the cluster layout from the first node that answers.
+func (c *Client) Refresh() error {
+	var lastErr error
+	for _, node := range c.nodes() {
+		var status cluster.StatusReply
+		if err := c.call(node, "Cluster.Status", &cluster.StatusArgs{}, &status); err != nil {
+			lastErr = err
+			continue
+		}
+		r := ring.New(status.VirtualNodes)
+		for _, n := range status.Nodes {
+			r.Add(n)
+		}
+		c.mu.Lock()
+		c.ring, c.n, c.refreshed = r, status.N, time.Now()
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("failed to load cluster layout: %w", lastErr)
+}
+
+// Get reads a key and returns its siblings along with the context to pass
+// to a following Put or Delete. It returns store.ErrKeyNotFound when the
+// key does not exist.
+func (c *Client) Get(key string) ([]store.Versioned, vclock.VClock, error) {
+	var reply rpc.Reply
+	err := c.do(c.route(key), "Cluster.Get", &rpc.Args{Key: key, Policy: c.cfg.Policy}, &reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Siblings, reply.Context, nil
+}
+
+// Put writes value to a key. ctx is the context returned by a previous Get;
+// the new value supersedes every sibling it covers. With a nil ctx it
+// supersedes whatever the key holds when the write arrives. A positive ttl
+// makes the value expire after that long.
+func (c *Client) Put(key string, value []byte, ctx vclock.VClock, ttl time.Duration) error {
+	var reply rpc.Reply
+	return c.do(c.route(key), "Cluster.Put", &rpc.Args{Key: key, Value: value, Context: ctx, TTL: ttl}, &reply)
+}
+
+// Delete deletes a key, superseding the siblings covered by ctx.
+func (c *Client) Delete(key string, ctx vclock.VClock) error {
+	var reply rpc.Reply
+	return c.do(c.route(key), "Cluster.Delete", &rpc.Args{Key: key, Context: ctx}, &reply)
+}
+
+// CompareAndSwap writes value to key if the key is still at the expected
+// version: the context returned by Get, or nil if the key must not exist.
+// It returns an error wrapping store.ErrConflict if the key has changed.
+func (c *Client) CompareAndSwap(key string, expected vclock.VClock, value []byte, ttl time.Duration) error {
+	var reply rpc.Reply
+	return c.do(c.route(key), "Cluster.CompareAndSwap", &rpc.Args{Key: key, Value: value, Expected: expected, TTL: ttl}, &reply)
+}
+
+// Batch applies a set of writes atomically. Each op sets Key and Value,
+// or Delete, and optionally TTL; ops with Check set make the whole batch
+// conditional on their key being at Expected.
+func (c *Client) Batch(ops []rpc.Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	var reply rpc.Reply
+	return c.do(c.route(ops[0].Key), "Cluster.Batch", &rpc.BatchArgs{Ops: ops}, &reply)
+}
+
+// Scan lists live keys across the cluster in ascending order.
+func (c *Client) Scan(args rpc.ScanArgs) ([]store.Entry, error) {
+	if args.Policy == "" {
+		args.Policy = c.cfg.Policy
+	}
+	var reply rpc.ScanReply
+	if err := c.do(c.nodes(), "Cluster.Scan", &args, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
+
+// Status returns a node's view of the cluster, including its membership
+// list. An empty node asks any node.
+func (c *Client) Status(node string) (*cluster.StatusReply, error) {
+	nodes := []string{node}
+	if node == "" {
+		nodes = c.nodes()
+	}
+	var reply cluster.StatusReply
+	if err := c.do(nodes, "Cluster.Status", &cluster.StatusArgs{Verbose: true}, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Close closes all pooled connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for _, p := range c.pools {
+		p.close()
+	}
+	c.pools = make(map[string]*pool)
+	return nil
+}
+
+// route returns the nodes to try for key: its replicas in preference order,
+// followed by every other known node.
+func (c *Client) route(key string) []string {
+	c.mu.Lock()
+	stale := c.ring == nil || time.Since(c.refreshed) > c.cfg.RefreshInterval
+	c.mu.Unlock()
+	if stale {
+		c.Refresh() // keep routing with the old layout if no node answers
+	}
+
+	c.mu.Lock()
+	var replicas []string
+	if c.ring != nil {
+		replicas = c.ring.Replicas(key, c.n)
+	}
+	c.mu.Unlock()
+	return appendMissing(replicas, c.nodes()...)
+}
+
+// nodes returns the seed servers followed by the other nodes on the ring.
+func (c *Client) nodes() []string {
+	nodes := appendMissing(nil, c.cfg.Servers...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring != nil {
+		nodes = appendMissing(nodes, c.ring.Nodes()...)
+	}
+	return nodes
+}
+
+// do calls method on the first of nodes, moving on to the next node after
+// each retryable failure until the retries are used up.
+func (c *Client) do(nodes []string, method string, args, reply interface{}) error {
+	_, err := c.doNode(nodes, method, args, reply)
+	return err
+}
+
+// doNode is like do, and also returns the node that handled the request.
+func (c *Client) doNode(nodes []string, method string, args, reply interface{}) (string, error) {
+	if len(nodes) == 0 {
+		return "", errors.New("no nodes to send the request to")
+	}
+
+	backoff := c.cfg.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= c.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			// Jitter keeps clients that failed together from retrying together
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			if backoff *= 2; backoff > c.cfg.MaxRetryBackoff {
+				backoff = c.cfg.MaxRetryBackoff
+			}
+		}
+		node := nodes[attempt%len(nodes)]
+		err = c.call(node, method, args, reply)
+		if err == nil || !retryable(err) {
+			return node, err
+		}
+	}
+	return "", err
+}
+
+// call invokes method on node over a pooled connection, giving up after the
+// configured timeout. Errors returned by the server are translated back
+// into the errors of the store and cluster packages where possible.
+func (c *Client) call(node, method string, args, reply interface{}) error {
+	p, err := c.pool(node)
+	if err != nil {
+		return err
+	}
+	client, err := p.get(c.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *stdrpc.Call, 1))
+	select {
+	case <-call.Done:
+		err := call.Error
+		if _, ok := err.(stdrpc.ServerError); !ok && err != nil {
+			client.Close() // the connection is broken
+			return fmt.Errorf("%s to %s failed: %w", method, node, err)
+		}
+		p.put(client)
+		return serverError(err)
+	case <-time.After(c.cfg.Timeout):
+		client.Close()
+		return fmt.Errorf("%s to %s timed out after %v", method, node, c.cfg.Timeout)
+	}
+}
+
+// pool returns the connection pool for node, creating it if needed.
+func (c *Client) pool(node string) (*pool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	p, ok := c.pools[node]
+	if !ok {
+		p = &pool{addr: node, size: c.cfg.PoolSize}
+		c.pools[node] = p
+	}
+	return p, nil
+}
+
+// serverError maps an error returned by a server to the matching package
+// error, since net/rpc only carries error messages.
+func serverError(err error) error {
+	serr, ok := err.(stdrpc.ServerError)
+	if !ok {
+		return err
+	}
+	msg := string(serr)
+	switch msg {
+	case store.ErrKeyNotFound.Error():
+		return store.ErrKeyNotFound
+	case store.ErrCompacted.Error():
+		return store.ErrCompacted
+	case cluster.ErrNoStream.Error():
+		return cluster.ErrNoStream
+	}
+	for _, known := range []error{cluster.ErrQuorum, cluster.ErrTooLarge, store.ErrConflict, store.ErrLocked} {
+		if rest := strings.TrimPrefix(msg, known.Error()); rest != msg {
+			return fmt.Errorf("%w%s", known, rest)
+		}
+	}
+	return err
+}
+
+// retryable reports whether a request that failed with err may succeed on
+// another attempt: the node could not be reached, did not reach a quorum
+// or found a key locked by a concurrent transaction.
+func retryable(err error) bool {
+	if errors.Is(err, store.ErrKeyNotFound) || errors.Is(err, store.ErrConflict) ||
+		errors.Is(err, store.ErrCompacted) || errors.Is(err, ErrClosed) ||
+		errors.Is(err, cluster.ErrTooLarge) || errors.Is(err, cluster.ErrNoStream) {
+		return false
+	}
+	if errors.Is(err, cluster.ErrQuorum) || errors.Is(err, store.ErrLocked) {
+		return true
+	}
+	_, isServerError := err.(stdrpc.ServerError)
+	return !isServerError
+}
+
+// appendMissing appends the nodes not already in list.
+func appendMissing(list []string, nodes ...string) []string {
+	for _, n := range nodes {
+		found := false
+		for _, m := range list {
+			if m == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, n)
+		}
+	}
+	return list
+}
+
+// pool keeps idle connections to one node.
+type pool struct {
+	addr string
+	size int
+
+	mu     sync.Mutex
+	idle   []*stdrpc.Client
+	closed bool
+}
+
+// get returns an idle connection or dials a new one.
+func (p *pool) get(timeout time.Duration) (*stdrpc.Client, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		client := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return client, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", p.addr, err)
+	}
+	return stdrpc.NewClient(conn), nil
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is full.
+func (p *pool) put(client *stdrpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.size {
+		client.Close()
+		return
+	}
+	p.idle = append(p.idle, client)
+}
+
+// close closes every idle connection.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, client := range p.idle {
+		client.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/vclock"
+	"io"
+	"time"
+)
+
+// PutStream writes the contents of r to key, sending it in chunks of
+// ChunkSize bytes so that large values never have to be held in one
+// request. Like Put, ctx is the context returned by a previous read and a
+// positive ttl makes the value expire. The chunks are gathered on one node,
+// which writes the value with quorum once r is exhausted; the whole value
+// must fit the cluster's size limit.
+func (c *Client) PutStream(key string, r io.Reader, ctx vclock.VClock, ttl time.Duration) error {
+	buf := make([]byte, c.cfg.ChunkSize)
+	var node, id string
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		if n > 0 || id == "" {
+			var reply cluster.UploadReply
+			args := &cluster.UploadArgs{ID: id, Data: buf[:n]}
+			var err error
+			if node == "" {
+				node, err = c.doNode(c.route(key), "Cluster.Upload", args, &reply)
+			} else {
+				err = c.call(node, "Cluster.Upload", args, &reply)
+			}
+			if err != nil {
+				return err
+			}
+			id = reply.ID
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	var reply rpc.Reply
+	return c.call(node, "Cluster.Put", &rpc.Args{Key: key, Upload: id, Context: ctx, TTL: ttl}, &reply)
+}
+
+// GetStream reads the value of key in chunks of ChunkSize bytes. It
+// returns a reader for the value, which must be closed, and the context to
+// pass to a following write. Every chunk comes from the same version of the
+// value. A key with concurrent siblings cannot be streamed and fails with
+// an error wrapping store.ErrConflict; read it with Get instead.
+func (c *Client) GetStream(key string) (io.ReadCloser, vclock.VClock, error) {
+	var reply cluster.DownloadReply
+	args := &cluster.DownloadArgs{Key: key, Policy: c.cfg.Policy, Length: c.cfg.ChunkSize}
+	node, err := c.doNode(c.route(key), "Cluster.Download", args, &reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &blobReader{c: c, node: node, id: reply.ID, size: reply.Size, offset: len(reply.Data), buf: reply.Data}, reply.Context, nil
+}
+
+// blobReader reads a value downloaded in chunks from one node.
+type blobReader struct {
+	c      *Client
+	node   string
+	id     string
+	size   int    // size of the whole value
+	offset int    // offset of the end of buf in the value
+	buf    []byte // received but not yet read
+}
+
+// Read returns the next bytes of the value, downloading another chunk when
+// the previous one has been read.
+func (b *blobReader) Read(p []byte) (int, error) {
+	if len(b.buf) == 0 {
+		if b.offset >= b.size {
+			return 0, io.EOF
+		}
+		var reply cluster.DownloadReply
+		args := &cluster.DownloadArgs{ID: b.id, Offset: b.offset, Length: b.c.cfg.ChunkSize}
+		if err := b.c.call(b.node, "Cluster.Download", args, &reply); err != nil {
+			return 0, err
+		}
+		if len(reply.Data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		b.buf = reply.Data
+		b.offset += len(reply.Data)
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Close ends the download. The node forgets unfinished downloads after a
+// while on its own.
+func (b *blobReader) Close() error {
+	b.buf = nil
+	b.offset = b.size
+	return nil
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"errors"
+	"fmt"
+	"net"
+	stdrpc "net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultWatchPollTimeout is how long each long-poll of a watch waits for changes.
+const DefaultWatchPollTimeout = 30 * time.Second
+
+// WatchOptions selects what a watch reports.
+type WatchOptions struct {
+	Key    string // watch a single key
+	Prefix string // watch every key with this prefix when Key is empty
+
+	// Revisions holds the revision to resume from on each node: the
+	// Revision of the last event received from the node, plus one. Nodes
+	// without a revision are watched from now on.
+	Revisions map[string]uint64
+
+	PollTimeout time.Duration // how long each long-poll waits; zero uses DefaultWatchPollTimeout
+}
+
+// WatchEvent is a change reported by Watch. Each node numbers the changes
+// to its own store, so Revision is only meaningful together with Node.
+type WatchEvent struct {
+	store.Event
+	Node string
+
+	// Err is set on events that report a problem instead of a change.
+	// store.ErrCompacted means changes on Node may have been missed; the
+	// watch continues from the node's latest revision.
+	Err error
+}
+
+// Watch reports changes to a key or prefix until ctx is cancelled, then
+// closes the returned channel. It keeps a long-lived connection to every
+// node that replicates the watched keys and long-polls each node's change
+// log. Since every replica logs the same write, an event is only delivered
+// if it carries a version not delivered before, so each key's changes
+// arrive once and in causal order. A value that expires is reported by a
+// delete event without siblings once a node sweeps its key. Nodes that
+// join the cluster after the watch starts are not watched.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions) (<-chan WatchEvent, error) {
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = DefaultWatchPollTimeout
+	}
+
+	var nodes []string
+	if opts.Key != "" {
+		c.mu.Lock()
+		if c.ring != nil {
+			nodes = c.ring.Replicas(opts.Key, c.n)
+		}
+		c.mu.Unlock()
+	} else {
+		nodes = c.nodes()
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes to watch")
+	}
+
+	events := make(chan WatchEvent)
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		args := rpc.WatchArgs{
+			Key:      opts.Key,
+			Prefix:   opts.Prefix,
+			Revision: opts.Revisions[node],
+			Timeout:  opts.PollTimeout,
+		}
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			c.watchNode(ctx, node, args, events)
+		}(node)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	out := make(chan WatchEvent)
+	go func() {
+		defer close(out)
+		seen := make(map[string]*keyVersions)
+		for e := range events {
+			if e.Err == nil {
+				kv, ok := seen[e.Key]
+				if !ok {
+					kv = &keyVersions{}
+					seen[e.Key] = kv
+				}
+				if !kv.add(e.Siblings) {
+					continue
+				}
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out, nil
+}
+
+// watchNode long-polls the change log of one node over a dedicated
+// connection and sends its events to events until ctx is cancelled.
+func (c *Client) watchNode(ctx context.Context, node string, args rpc.WatchArgs, events chan<- WatchEvent) {
+	var client *stdrpc.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	backoff := c.cfg.RetryBackoff
+	for ctx.Err() == nil {
+		if client == nil {
+			conn, err := net.DialTimeout("tcp", node, c.cfg.Timeout)
+			if err != nil {
+				sleep(ctx, backoff)
+				if backoff *= 2; backoff > c.cfg.MaxRetryBackoff {
+					backoff = c.cfg.MaxRetryBackoff
+				}
+				continue
+			}
+			client = stdrpc.NewClient(conn)
+			backoff = c.cfg.RetryBackoff
+		}
+
+		var reply rpc.WatchReply
+		call := client.Go("KVStore.Watch", &args, &reply, make(chan *stdrpc.Call, 1))
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(args.Timeout + c.cfg.Timeout):
+			err = fmt.Errorf("watch on %s timed out", node)
+		}
+
+		if err != nil {
+			if _, ok := err.(stdrpc.ServerError); !ok {
+				client.Close() // the connection is broken
+				client = nil
+				continue
+			}
+			if err = serverError(err); errors.Is(err, store.ErrCompacted) {
+				args.Revision = 0
+				send(ctx, events, WatchEvent{Node: node, Err: err})
+				continue
+			}
+			sleep(ctx, c.cfg.MaxRetryBackoff)
+			continue
+		}
+
+		for _, e := range reply.Events {
+			if !send(ctx, events, WatchEvent{Event: e, Node: node}) {
+				return
+			}
+		}
+		args.Revision = reply.Revision
+	}
+}
+
+// keyVersions remembers the versions of a key a watch has delivered.
+type keyVersions struct {
+	clock   vclock.VClock // merged clocks of every delivered version
+	latest  int64         // timestamp of the newest delivered version
+	removed bool          // the latest delivered event removed the key
+}
+
+// add records siblings and reports whether any of them is new: neither
+// covered by the delivered clocks nor older than the newest delivered
+// version. The timestamp catches keys recreated with a fresh clock after
+// their tombstone was purged. No siblings at all mean the key was removed
+// once its value expired, which is new unless a removal was delivered
+// since the key's latest version.
+func (kv *keyVersions) add(siblings []store.Versioned) bool {
+	if len(siblings) == 0 {
+		fresh := !kv.removed
+		kv.removed = true
+		return fresh
+	}
+	fresh := false
+	for _, v := range siblings {
+		if !kv.clock.Descends(v.Clock) || v.Timestamp > kv.latest {
+			fresh = true
+		}
+	}
+	for _, v := range siblings {
+		kv.clock = kv.clock.Merge(v.Clock)
+		if v.Timestamp > kv.latest {
+			kv.latest = v.Timestamp
+		}
+	}
+	if fresh {
+		kv.removed = false
+	}
+	return fresh
+}
+
+// send delivers e unless ctx is cancelled first.
+func send(ctx context.Context, events chan<- WatchEvent, e WatchEvent) bool {
+	select {
+	case events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"testing"
+)
+
+func TestKeyVersionsAdd(t *testing.T) {
+	put := func(node string, n uint64, ts int64) []store.Versioned {
+		return []store.Versioned{{Value: []byte("v"), Clock: vclock.VClock{node: n}, Timestamp: ts}}
+	}
+	var kv keyVersions
+	for i, step := range []struct {
+		name     string
+		siblings []store.Versioned
+		fresh    bool
+	}{
+		{"first write", put("a", 1, 10), true},
+		{"same write from another replica", put("a", 1, 10), false},
+		{"newer write", put("a", 2, 20), true},
+		{"expiry swept by one replica", nil, true},
+		{"expiry swept by another replica", nil, false},
+		{"late event for a delivered write", put("a", 2, 20), false},
+		{"key written again", put("a", 3, 30), true},
+		{"expiry of the new value", nil, true},
+		{"recreated with a fresh clock", put("b", 1, 40), true},
+	} {
+		if got := kv.add(step.siblings); got != step.fresh {
+			t.Errorf("step %d, %s: fresh = %t, want %t", i, step.name, got, step.fresh)
+		}
+	}
+
+	// A removal is the first event a watch sees of a key written before it started.
+	var unseen keyVersions
+	if !unseen.add(nil) {
+		t.Error("the removal of a key not seen before was filtered")
+	}
+}
@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"distributed-kv-store/merkle"
+	"distributed-kv-store/ring"
+	"distributed-kv-store/store"
+	"fmt"
+	"log"
+)
+
+// MerkleArgs asks a node for the Merkle tree of the keys it shares with Peer.
+type MerkleArgs struct {
+	Peer  string
+	Depth int
+}
+
+// MerkleReply carries a Merkle tree.
+type MerkleReply struct {
+	Tree merkle.Tree
+}
+
+// BucketArgs asks a node for its entries in some buckets of the keys it
+// shares with Peer.
+type BucketArgs struct {
+	Peer    string
+	Depth   int
+	Buckets []int
+}
+
+// EntriesReply carries raw entries, tombstones included.
+type EntriesReply struct {
+	Entries []store.Entry
+}
+
+// ApplyArgs carries entries to merge into a node's local store.
+type ApplyArgs struct {
+	Entries []store.Entry
+}
+
+// ApplyReply is the reply to an Apply call.
+type ApplyReply struct {
+	Applied int
+}
+
+// sharedEntries returns the local entries that both this node and peer
+// replicate, limited to the given buckets when buckets is not nil.
+func (c *Coordinator) sharedEntries(peer string, depth int, buckets map[int]bool) ([]store.Entry, error) {
+	entries, err := c.local.Scan("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []store.Entry
+	for _, e := range entries {
+		if buckets != nil && !buckets[merkle.Bucket(ring.Hash(e.Key), depth)] {
+			continue
+		}
+		owners := c.ring.Replicas(e.Key, c.cfg.N)
+		if contains(owners, c.cfg.Self) && contains(owners, peer) {
+			shared = append(shared, e)
+		}
+	}
+	return shared, nil
+}
+
+// merkleTree builds the Merkle tree of the keys this node shares with peer.
+// Each leaf hashes the keys in its bucket, in key order, with a digest of
+// their siblings.
+func (c *Coordinator) merkleTree(peer string, depth int) (*merkle.Tree, error) {
+	entries, err := c.sharedEntries(peer, depth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := make([][]byte, merkle.Buckets(depth))
+	hashers := make(map[int][]byte)
+	for _, e := range entries { // Scan returns keys in order
+		b := merkle.Bucket(ring.Hash(e.Key), depth)
+		h := sha256.New()
+		h.Write(hashers[b])
+		fmt.Fprintf(h, "%d:%s", len(e.Key), e.Key)
+		h.Write(store.Digest(e.Siblings))
+		hashers[b] = h.Sum(nil)
+	}
+	for b, sum := range hashers {
+		leaves[b] = sum
+	}
+	return merkle.Build(depth, leaves), nil
+}
+
+// applyEntries merges entries into the local store.
+func (c *Coordinator) applyEntries(entries []store.Entry) (int, error) {
+	applied := 0
+	for _, e := range entries {
+		for _, v := range e.Siblings {
+			if err := c.local.Put(e.Key, v); err != nil {
+				return applied, err
+			}
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// antiEntropy synchronizes this node with every other node on the ring.
+func (c *Coordinator) antiEntropy() {
+	for _, peer := range c.ring.Nodes() {
+		if peer == c.cfg.Self {
+			continue
+		}
+		if err := c.syncWith(peer); err != nil {
+			log.Printf("Anti-entropy with %s failed: %v\n", peer, err)
+		}
+	}
+}
+
+// syncWith compares Merkle trees with peer and exchanges the entries of
+// every bucket that differs, in both directions.
+func (c *Coordinator) syncWith(peer string) error {
+	depth := c.cfg.MerkleDepth
+	local, err := c.merkleTree(peer, depth)
+	if err != nil {
+		return err
+	}
+
+	var remote MerkleReply
+	if err := c.call(peer, "Cluster.MerkleTree", &MerkleArgs{Peer: c.cfg.Self, Depth: depth}, &remote); err != nil {
+		return err
+	}
+
+	diff := merkle.Diff(local, &remote.Tree)
+	if len(diff) == 0 {
+		return nil
+	}
+
+	var theirs EntriesReply
+	if err := c.call(peer, "Cluster.BucketEntries", &BucketArgs{Peer: c.cfg.Self, Depth: depth, Buckets: diff}, &theirs); err != nil {
+		return err
+	}
+	buckets := make(map[int]bool, len(diff))
+	for _, b := range diff {
+		buckets[b] = true
+	}
+	ours, err := c.sharedEntries(peer, depth, buckets)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.applyEntries(theirs.Entries); err != nil {
+		return err
+	}
+	var reply ApplyReply
+	if err := c.call(peer, "Cluster.Apply", &ApplyArgs{Entries: ours}, &reply); err != nil {
+		return err
+	}
+	log.Printf("Anti-entropy with %s repaired %d buckets (%d keys received, %d sent)\n", peer, len(diff), len(theirs.Entries), len(ours))
+	return nil
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
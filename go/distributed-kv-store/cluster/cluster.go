@@ -0,0 +1,574 @@
+package cluster
+
+import (
+	"bytes"
+	"distributed-kv-store/ring"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	stdrpc "net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrQuorum is returned when fewer replicas than required answered a request.
+var ErrQuorum = errors.New("quorum not reached")
+
+// Config holds the replication settings of a coordinator.
+type Config struct {
+	Self    string        // address of the local node as it appears on the ring
+	N       int           // replication factor
+	R       int           // replicas that must answer a read
+	W       int           // replicas that must acknowledge a write
+	Timeout time.Duration // per-replica request timeout
+	Policy  string        // conflict resolution for client reads that do not pick one
+
+	HintInterval        time.Duration // how often queued hints are redelivered
+	MaxHintsPerNode     int           // hints kept per unreachable node before the oldest are dropped
+	AntiEntropyInterval time.Duration // how often replicas compare Merkle trees; zero disables it
+	MerkleDepth         int           // depth of the Merkle trees, giving 1<<MerkleDepth buckets
+	LockTimeout         time.Duration // how long replicas hold the locks of an unfinished transaction
+	RebalanceDelay      time.Duration // how long the ring must be stable before keys move to new owners
+	TransferBatch       int           // keys sent per request when moving keys
+	TransferRate        int           // keys moved per second; zero means no limit
+	MaxKeySize          int           // longest key a client may write, in bytes
+	MaxValueSize        int           // largest value a client may write, in bytes
+	StreamTimeout       time.Duration // how long an unused upload or download is kept
+}
+
+// Default size limits.
+const (
+	DefaultMaxKeySize   = 4 << 10
+	DefaultMaxValueSize = 16 << 20
+)
+
+// Validate checks that the quorum settings are consistent.
+func (c Config) Validate() error {
+	if c.N < 1 {
+		return fmt.Errorf("replication factor N must be at least 1, got %d", c.N)
+	}
+	if c.R < 1 || c.R > c.N {
+		return fmt.Errorf("read quorum R must be between 1 and N=%d, got %d", c.N, c.R)
+	}
+	if c.W < 1 || c.W > c.N {
+		return fmt.Errorf("write quorum W must be between 1 and N=%d, got %d", c.N, c.W)
+	}
+	if c.Policy != "" && c.Policy != store.PolicyMerge && c.Policy != store.PolicyLWW {
+		return fmt.Errorf("unknown conflict resolution policy %q", c.Policy)
+	}
+	return nil
+}
+
+// Coordinator routes reads and writes to the replicas that own a key.
+type Coordinator struct {
+	cfg   Config
+	ring  *ring.Ring
+	local *store.Store
+
+	mu      sync.Mutex
+	clients map[string]*stdrpc.Client
+
+	streamMu sync.Mutex
+	streams  map[string]*stream // uploads and downloads in progress
+
+	hints     *hintQueue
+	rebalance *rebalancer
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewCoordinator creates a coordinator for the nodes on r, serving the
+// local replica directly from local.
+func NewCoordinator(cfg Config, r *ring.Ring, local *store.Store) *Coordinator {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.HintInterval <= 0 {
+		cfg.HintInterval = 5 * time.Second
+	}
+	if cfg.MaxHintsPerNode <= 0 {
+		cfg.MaxHintsPerNode = 10000
+	}
+	if cfg.MerkleDepth <= 0 {
+		cfg.MerkleDepth = 10
+	}
+	if cfg.LockTimeout <= 0 {
+		cfg.LockTimeout = 5 * cfg.Timeout
+	}
+	if cfg.RebalanceDelay <= 0 {
+		cfg.RebalanceDelay = 2 * time.Second
+	}
+	if cfg.TransferBatch <= 0 {
+		cfg.TransferBatch = 100
+	}
+	if cfg.MaxKeySize <= 0 {
+		cfg.MaxKeySize = DefaultMaxKeySize
+	}
+	if cfg.MaxValueSize <= 0 {
+		cfg.MaxValueSize = DefaultMaxValueSize
+	}
+	if cfg.StreamTimeout <= 0 {
+		cfg.StreamTimeout = time.Minute
+	}
+	return &Coordinator{
+		cfg:     cfg,
+		ring:    r,
+		local:   local,
+		clients: make(map[string]*stdrpc.Client),
+		streams: make(map[string]*stream),
+		hints:   newHintQueue(cfg.MaxHintsPerNode),
+		rebalance: &rebalancer{
+			trigger: make(chan struct{}, 1),
+			placed:  r.Clone(),
+			joining: true,
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// Start runs hinted handoff delivery, rebalancing, expiry of unused
+// uploads and downloads and, if configured, anti-entropy in the background
+// until Stop is called.
+func (c *Coordinator) Start() {
+	c.runEvery(c.cfg.HintInterval, c.deliverHints)
+	c.runEvery(c.cfg.StreamTimeout, c.expireStreams)
+	c.wg.Add(1)
+	go c.rebalanceLoop()
+	if c.cfg.AntiEntropyInterval > 0 {
+		c.runEvery(c.cfg.AntiEntropyInterval, c.antiEntropy)
+	}
+}
+
+// Stop ends the background work started by Start.
+func (c *Coordinator) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+// runEvery calls fn every interval in its own goroutine until Stop is called.
+func (c *Coordinator) runEvery(interval time.Duration, fn func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// Put writes value to the key's N replicas and returns once W of them have
+// acknowledged the write. ctx is the context returned by a previous Get; the
+// new version supersedes every sibling that context covers. With an empty
+// ctx the key's current context is read from R replicas first, so that the
+// write supersedes the siblings they hold. A positive ttl makes the value
+// expire after that long.
+func (c *Coordinator) Put(key string, value []byte, ctx vclock.VClock, ttl time.Duration) error {
+	if err := c.checkSize(key, value); err != nil {
+		return err
+	}
+	if len(ctx) == 0 {
+		var err error
+		if ctx, err = c.currentContext(key); err != nil {
+			return err
+		}
+	}
+	v := c.newVersion(ctx)
+	v.Value = value
+	if ttl > 0 {
+		v.ExpiresAt = v.Timestamp + int64(ttl)
+	}
+	return c.write(key, v)
+}
+
+// Delete writes a tombstone superseding the siblings covered by ctx to the
+// key's N replicas and returns once W of them have acknowledged it. Like
+// Put, it reads the current context of the key if ctx is empty.
+func (c *Coordinator) Delete(key string, ctx vclock.VClock) error {
+	if len(ctx) == 0 {
+		var err error
+		if ctx, err = c.currentContext(key); err != nil {
+			return err
+		}
+	}
+	v := c.newVersion(ctx)
+	v.Deleted = true
+	return c.write(key, v)
+}
+
+// currentContext reads the merged context of the siblings of key from R
+// replicas, for a write made without one. A write with an empty clock
+// would be superseded by, and silently lose to, any sibling this node
+// wrote before.
+func (c *Coordinator) currentContext(key string) (vclock.VClock, error) {
+	_, ctx, err := c.Get(key, store.PolicyMerge)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, fmt.Errorf("failed to read the version of %s: %w", key, err)
+	}
+	return ctx, nil
+}
+
+// newVersion returns a version whose clock advances ctx on this node.
+func (c *Coordinator) newVersion(ctx vclock.VClock) store.Versioned {
+	if ctx == nil {
+		ctx = vclock.New()
+	}
+	return store.Versioned{Clock: ctx.Increment(c.cfg.Self), Timestamp: time.Now().UnixNano()}
+}
+
+// write sends v to the key's N replicas and waits for W acknowledgements.
+// Writes that fail on a remote replica, or on any replica because a
+// prepared transaction holds the key, are queued as hints and delivered
+// once the replica is reachable or the key unlocked again. If locked
+// replicas keep W from being reached, write returns store.ErrLocked.
+func (c *Coordinator) write(key string, v store.Versioned) error {
+	replicas := c.ring.Replicas(key, c.cfg.N)
+	if len(replicas) < c.cfg.W {
+		return fmt.Errorf("%w: only %d replicas available for W=%d", ErrQuorum, len(replicas), c.cfg.W)
+	}
+
+	results := make(chan error, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			err := c.putReplica(node, key, v)
+			if err != nil && (node != c.cfg.Self || isLocked(err)) {
+				c.hints.add(node, key, v)
+			}
+			results <- err
+		}(node)
+	}
+
+	acks, failures, locked := 0, 0, 0
+	for range replicas {
+		err := <-results
+		if err != nil {
+			failures++
+			if isLocked(err) {
+				locked++
+			}
+			log.Printf("Error writing %s to replica: %v\n", key, err)
+		} else {
+			acks++
+		}
+		if acks >= c.cfg.W {
+			return nil
+		}
+		if failures > len(replicas)-c.cfg.W {
+			break
+		}
+	}
+	if locked > 0 {
+		return store.ErrLocked
+	}
+	return fmt.Errorf("%w: %d of %d write acknowledgements", ErrQuorum, acks, c.cfg.W)
+}
+
+// isLocked reports whether err, possibly returned by another node, is
+// store.ErrLocked.
+func isLocked(err error) bool {
+	return err.Error() == store.ErrLocked.Error()
+}
+
+// Get reads key from R of its replicas and reconciles their siblings. It
+// returns the live siblings resolved with policy and the merged context of
+// all siblings seen, including tombstones, which a following Put or Delete
+// should pass back. A key whose siblings are all deleted or expired is
+// reported as not found, together with its context.
+func (c *Coordinator) Get(key, policy string) ([]store.Versioned, vclock.VClock, error) {
+	replicas := c.ring.Replicas(key, c.cfg.N)
+	if len(replicas) < c.cfg.R {
+		return nil, nil, fmt.Errorf("%w: only %d replicas available for R=%d", ErrQuorum, len(replicas), c.cfg.R)
+	}
+
+	results := make(chan replicaResult, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			siblings, err := c.getReplica(node, key)
+			results <- replicaResult{node, siblings, err}
+		}(node)
+	}
+	// While a rebalance is pending the key may not have reached its new
+	// owners yet, so the nodes that owned it before are asked as well.
+	sources := c.handoffSources(key, replicas)
+	moved := make(chan replicaResult, len(sources))
+	for _, node := range sources {
+		go func(node string) {
+			siblings, err := c.getReplica(node, key)
+			moved <- replicaResult{node, siblings, err}
+		}(node)
+	}
+
+	var siblings []store.Versioned
+	var seen []replicaResult
+	answered, failures := 0, 0
+	for range replicas {
+		res := <-results
+		switch {
+		case res.err == nil:
+			siblings = store.Reconcile(siblings, res.siblings)
+			seen = append(seen, res)
+			answered++
+		case res.err.Error() == store.ErrKeyNotFound.Error():
+			res.err = nil
+			seen = append(seen, res)
+			answered++
+		default:
+			failures++
+			log.Printf("Error reading %s from replica: %v\n", key, res.err)
+		}
+		if answered >= c.cfg.R || failures > len(replicas)-c.cfg.R {
+			break
+		}
+	}
+	if answered < c.cfg.R {
+		return nil, nil, fmt.Errorf("%w: %d of %d read responses", ErrQuorum, answered, c.cfg.R)
+	}
+	for range sources {
+		if res := <-moved; res.err == nil {
+			siblings = store.Reconcile(siblings, res.siblings)
+		}
+	}
+
+	// Bring stale replicas up to date, including the ones that answer late.
+	go c.readRepair(key, siblings, seen, results, len(replicas)-answered-failures)
+
+	if len(siblings) == 0 {
+		return nil, nil, store.ErrKeyNotFound
+	}
+	ctx := store.Context(siblings)
+	live := store.Live(store.Resolve(siblings, policy), time.Now())
+	if len(live) == 0 {
+		return nil, ctx, store.ErrKeyNotFound
+	}
+	return live, ctx, nil
+}
+
+// replicaResult is one replica's answer to a read.
+type replicaResult struct {
+	node     string
+	siblings []store.Versioned
+	err      error
+}
+
+// readRepair waits for up to pending more replica answers and then writes
+// the reconciled siblings to every replica whose answer differed from them.
+func (c *Coordinator) readRepair(key string, siblings []store.Versioned, seen []replicaResult, results <-chan replicaResult, pending int) {
+	timeout := time.After(c.cfg.Timeout)
+	for ; pending > 0; pending-- {
+		select {
+		case res := <-results:
+			if res.err != nil && res.err.Error() != store.ErrKeyNotFound.Error() {
+				continue
+			}
+			res.err = nil
+			siblings = store.Reconcile(siblings, res.siblings)
+			seen = append(seen, res)
+		case <-timeout:
+			pending = 0
+		}
+	}
+	if len(siblings) == 0 {
+		return
+	}
+
+	want := store.Digest(siblings)
+	for _, res := range seen {
+		if bytes.Equal(store.Digest(res.siblings), want) {
+			continue
+		}
+		log.Printf("Read repair of %s on %s\n", key, res.node)
+		for _, v := range siblings {
+			if err := c.putReplica(res.node, key, v); err != nil {
+				log.Printf("Error repairing %s on %s: %v\n", key, res.node, err)
+				break
+			}
+		}
+	}
+}
+
+// Scan returns up to limit live keys in [start, end) across the cluster,
+// in ascending order, with their siblings resolved with policy. Every node
+// is asked for its keys; since each key lives on N nodes, the scan
+// succeeds as long as fewer than N nodes fail to answer.
+func (c *Coordinator) Scan(start, end string, limit int, policy string) ([]store.Entry, error) {
+	nodes := c.ring.Nodes()
+	pageSize := limit
+	if pageSize <= 0 || pageSize > 1000 {
+		pageSize = 1000
+	}
+
+	var result []store.Entry
+	for {
+		type page struct {
+			entries []store.Entry
+			err     error
+		}
+		pages := make(chan page, len(nodes))
+		for _, node := range nodes {
+			go func(node string) {
+				entries, err := c.scanReplica(node, start, end, pageSize)
+				pages <- page{entries, err}
+			}(node)
+		}
+
+		merged := make(map[string][]store.Versioned)
+		cutoff, more, failures := "", false, 0
+		for range nodes {
+			p := <-pages
+			if p.err != nil {
+				failures++
+				log.Printf("Error scanning replica: %v\n", p.err)
+				continue
+			}
+			for _, e := range p.entries {
+				merged[e.Key] = store.Reconcile(merged[e.Key], e.Siblings)
+			}
+			// A full page may have more keys after its last one, so only
+			// keys up to the smallest such last key are complete.
+			if len(p.entries) == pageSize {
+				last := p.entries[len(p.entries)-1].Key
+				if !more || last < cutoff {
+					cutoff = last
+				}
+				more = true
+			}
+		}
+		if failures >= c.cfg.N || failures == len(nodes) {
+			return nil, fmt.Errorf("%w: %d of %d nodes failed to scan", ErrQuorum, failures, len(nodes))
+		}
+
+		keys := make([]string, 0, len(merged))
+		for key := range merged {
+			if !more || key <= cutoff {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		now := time.Now()
+		for _, key := range keys {
+			live := store.Live(store.Resolve(merged[key], policy), now)
+			if len(live) == 0 {
+				continue
+			}
+			result = append(result, store.Entry{Key: key, Siblings: live})
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+		if !more {
+			return result, nil
+		}
+		start = cutoff + "\x00"
+	}
+}
+
+// putReplica writes a versioned value or tombstone to a single replica.
+func (c *Coordinator) putReplica(node, key string, v store.Versioned) error {
+	if node == c.cfg.Self {
+		return c.local.Put(key, v)
+	}
+	var reply rpc.Reply
+	args := &rpc.Args{Key: key, Value: v.Value, Context: v.Clock, Timestamp: v.Timestamp, ExpiresAt: v.ExpiresAt}
+	if v.Deleted {
+		return c.call(node, "KVStore.Delete", args, &reply)
+	}
+	return c.call(node, "KVStore.Put", args, &reply)
+}
+
+// getReplica reads the siblings of key from a single replica.
+func (c *Coordinator) getReplica(node, key string) ([]store.Versioned, error) {
+	if node == c.cfg.Self {
+		return c.local.Get(key)
+	}
+	var reply rpc.Reply
+	if err := c.call(node, "KVStore.Get", &rpc.Args{Key: key, Policy: store.PolicyMerge, Raw: true}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Siblings, nil
+}
+
+// scanReplica lists the raw entries of a single replica in [start, end).
+func (c *Coordinator) scanReplica(node, start, end string, limit int) ([]store.Entry, error) {
+	if node == c.cfg.Self {
+		return c.local.Scan(start, end, limit)
+	}
+	var reply rpc.ScanReply
+	args := &rpc.ScanArgs{Start: start, End: end, Limit: limit, Raw: true}
+	if err := c.call(node, "KVStore.Scan", args, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
+
+// call invokes an RPC method on node, reusing a cached connection and
+// giving up after the configured timeout.
+func (c *Coordinator) call(node, method string, args, reply interface{}) error {
+	client, err := c.client(node)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *stdrpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == stdrpc.ErrShutdown {
+			c.dropClient(node, client)
+		}
+		return call.Error
+	case <-time.After(c.cfg.Timeout):
+		c.dropClient(node, client)
+		return fmt.Errorf("%s to %s timed out after %v", method, node, c.cfg.Timeout)
+	}
+}
+
+// client returns a cached connection to node, dialing it if needed. The
+// dial happens without holding c.mu, so that a slow or unreachable node
+// does not hold up calls to the others.
+func (c *Coordinator) client(node string) (*stdrpc.Client, error) {
+	c.mu.Lock()
+	client, ok := c.clients[node]
+	c.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", node, c.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", node, err)
+	}
+	client = stdrpc.NewClient(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Keep the connection of a concurrent call that dialed first.
+	if cached, ok := c.clients[node]; ok {
+		client.Close()
+		return cached, nil
+	}
+	c.clients[node] = client
+	return client, nil
+}
+
+// dropClient closes and forgets a broken connection to node.
+func (c *Coordinator) dropClient(node string, client *stdrpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients[node] == client {
+		delete(c.clients, node)
+	}
+	client.Close()
+}
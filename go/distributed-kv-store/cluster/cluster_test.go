@@ -0,0 +1,408 @@
+package cluster
+
+import (
+	"distributed-kv-store/ring"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"errors"
+	"net"
+	stdrpc "net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newLocalCoordinator returns a coordinator for a cluster of one node,
+// which serves every key from its local store.
+func newLocalCoordinator(t *testing.T) *Coordinator {
+	t.Helper()
+	r := ring.New(0)
+	r.Add("self")
+	return NewCoordinator(Config{Self: "self", N: 1, R: 1, W: 1}, r, store.NewStore())
+}
+
+// get returns the live values of key, or nil if it is not found.
+func get(t *testing.T, c *Coordinator, key string) []string {
+	t.Helper()
+	siblings, _, err := c.Get(key, store.PolicyMerge)
+	if err == store.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	var values []string
+	for _, v := range siblings {
+		values = append(values, string(v.Value))
+	}
+	return values
+}
+
+func TestBlindWritesSupersede(t *testing.T) {
+	c := newLocalCoordinator(t)
+	for _, value := range []string{"a", "b", "c"} {
+		if err := c.Put("k", []byte(value), nil, 0); err != nil {
+			t.Fatalf("Put(%s): %v", value, err)
+		}
+		if got := get(t, c, "k"); len(got) != 1 || got[0] != value {
+			t.Fatalf("after a blind write of %s, Get = %q", value, got)
+		}
+	}
+
+	if err := c.Delete("k", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, c, "k"); got != nil {
+		t.Fatalf("after a blind delete, Get = %q", got)
+	}
+	if err := c.Put("k", []byte("d"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, c, "k"); len(got) != 1 || got[0] != "d" {
+		t.Fatalf("after a blind write over a tombstone, Get = %q", got)
+	}
+}
+
+func TestContextWritesKeepConcurrentSiblings(t *testing.T) {
+	c := newLocalCoordinator(t)
+	if err := c.Put("k", []byte("a"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, ctx, err := c.Get("k", store.PolicyMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A write from another coordinator that saw the same version.
+	other := store.Versioned{Value: []byte("b"), Clock: ctx.Increment("other")}
+	if err := c.local.Put("k", other); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("k", []byte("c"), ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, c, "k"); len(got) != 2 {
+		t.Fatalf("Get = %q, want the two concurrent siblings", got)
+	}
+
+	_, ctx, _ = c.Get("k", store.PolicyMerge)
+	if err := c.Put("k", []byte("d"), ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, c, "k"); len(got) != 1 || got[0] != "d" {
+		t.Fatalf("Get = %q, want the write that saw both siblings", got)
+	}
+}
+
+// testNode is a node of an in-process cluster, serving its replica and the
+// cluster service over RPC on a local port.
+type testNode struct {
+	addr  string
+	store *store.Store
+	c     *Coordinator
+	srv   *stdrpc.Server
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns []net.Conn
+}
+
+// newTestCluster starts size nodes that replicate with cfg, all on one ring.
+func newTestCluster(t *testing.T, size int, cfg Config) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = &testNode{addr: ln.Addr().String(), store: store.NewStore(), ln: ln}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second
+	}
+	for _, n := range nodes {
+		r := ring.New(0)
+		for _, other := range nodes {
+			r.Add(other.addr)
+		}
+		nodeCfg := cfg
+		nodeCfg.Self = n.addr
+		n.c = NewCoordinator(nodeCfg, r, n.store)
+		n.srv = stdrpc.NewServer()
+		n.srv.RegisterName("KVStore", rpc.NewKVStore(n.store))
+		n.srv.RegisterName("Cluster", NewService(n.c, nil, nil))
+		n.serve()
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	})
+	return nodes
+}
+
+// serve accepts connections until the node is stopped.
+func (n *testNode) serve() {
+	n.mu.Lock()
+	ln, srv := n.ln, n.srv
+	n.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.conns = append(n.conns, conn)
+			n.mu.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+}
+
+// stop makes the node unreachable, as if it crashed, keeping its store.
+func (n *testNode) stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ln != nil {
+		n.ln.Close()
+		n.ln = nil
+	}
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.conns = nil
+}
+
+// start makes a stopped node reachable again on the same address.
+func (n *testNode) start(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.mu.Lock()
+	n.ln = ln
+	n.mu.Unlock()
+	n.serve()
+}
+
+// localValues returns the live values the node's own replica holds for key.
+func (n *testNode) localValues(key string) []string {
+	siblings, err := n.store.Get(key)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, v := range store.Live(siblings, time.Now()) {
+		values = append(values, string(v.Value))
+	}
+	sort.Strings(values)
+	return values
+}
+
+// eventually retries check for a while, for work that finishes in the background.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !check(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuorumWritesReachEveryReplica(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 2, W: 2})
+	if err := nodes[0].c.Put("k", []byte("a"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if got := get(t, n.c, "k"); len(got) != 1 || got[0] != "a" {
+			t.Errorf("Get through %s = %q", n.addr, got)
+		}
+		eventually(t, "every replica holds the write", func() bool { return len(n.localValues("k")) == 1 })
+	}
+}
+
+func TestConcurrentWritesBecomeSiblings(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 3, W: 3})
+	if err := nodes[0].c.Put("k", []byte("a"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, ctx, err := nodes[0].c.Get("k", store.PolicyMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two clients write on top of the same read through different nodes.
+	if err := nodes[0].c.Put("k", []byte("b"), ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].c.Put("k", []byte("c"), ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got := get(t, nodes[2].c, "k")
+	sort.Strings(got)
+	if strings.Join(got, ",") != "b,c" {
+		t.Fatalf("siblings = %q, want b and c", got)
+	}
+	lww, _, err := nodes[2].c.Get("k", store.PolicyLWW)
+	if err != nil || len(lww) != 1 || string(lww[0].Value) != "c" {
+		t.Fatalf("last writer wins = %v, %v, want c", lww, err)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 2, W: 2})
+	down := nodes[2]
+	down.stop()
+
+	if err := nodes[0].c.Put("k", []byte("a"), nil, 0); err != nil {
+		t.Fatalf("a write with one replica down: %v", err)
+	}
+	if got := get(t, nodes[1].c, "k"); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("Get with one replica down = %q", got)
+	}
+	eventually(t, "the write for the down replica is queued", func() bool { return nodes[0].c.PendingHints() == 1 })
+
+	nodes[0].c.deliverHints() // fails, the node is still down
+	if nodes[0].c.PendingHints() != 1 {
+		t.Fatal("a hint for a node that is down was dropped")
+	}
+	down.start(t)
+	nodes[0].c.deliverHints()
+	if nodes[0].c.PendingHints() != 0 {
+		t.Fatal("hints were not delivered to the node once it was back")
+	}
+	if got := down.localValues("k"); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("the node that was down holds %q", got)
+	}
+}
+
+func TestQuorumNotReached(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 2, W: 2})
+	nodes[1].stop()
+	nodes[2].stop()
+
+	if err := nodes[0].c.Put("k", []byte("a"), vclock.VClock{"x": 1}, 0); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Put with two of three replicas down: %v, want ErrQuorum", err)
+	}
+	if _, _, err := nodes[0].c.Get("k", store.PolicyMerge); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Get with two of three replicas down: %v, want ErrQuorum", err)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 3, W: 3})
+	if err := nodes[0].c.Put("k", []byte("a"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, ctx, _ := nodes[0].c.Get("k", store.PolicyMerge)
+
+	// A newer version that only one replica got.
+	newer := store.Versioned{Value: []byte("b"), Clock: ctx.Increment("elsewhere"), Timestamp: time.Now().UnixNano()}
+	if err := nodes[1].store.Put("k", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := get(t, nodes[0].c, "k"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("Get = %q, want the newer version", got)
+	}
+	for _, n := range nodes {
+		eventually(t, "read repair updates "+n.addr, func() bool {
+			got := n.localValues("k")
+			return len(got) == 1 && got[0] == "b"
+		})
+	}
+}
+
+// rivalCommits is a replica whose first commit arrives after its locks
+// expired and another transaction, "rival", locked the keys.
+type rivalCommits struct {
+	*rpc.KVStore
+	store *store.Store
+	late  time.Duration
+	raced int32 // set once the rival has locked the keys
+}
+
+func (r *rivalCommits) Commit(args *rpc.CommitArgs, reply *rpc.Reply) error {
+	if atomic.CompareAndSwapInt32(&r.raced, 0, 1) {
+		time.Sleep(r.late)
+		keys := make([]string, len(args.Ops))
+		for i, op := range args.Ops {
+			keys[i] = op.Key
+		}
+		if _, err := r.store.Prepare("rival", keys, time.Minute); err != nil {
+			return err
+		}
+	}
+	return r.KVStore.Commit(args, reply)
+}
+
+func TestBatchCommitsReachReplicasThatRefusedThem(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 2, W: 2, LockTimeout: 50 * time.Millisecond})
+	late := nodes[2]
+	rival := &rivalCommits{KVStore: rpc.NewKVStore(late.store), store: late.store, late: 100 * time.Millisecond}
+	late.stop()
+	late.mu.Lock()
+	late.srv = stdrpc.NewServer()
+	late.srv.RegisterName("KVStore", rival)
+	late.mu.Unlock()
+	late.start(t)
+
+	err := nodes[0].c.Batch([]rpc.Op{
+		{Args: rpc.Args{Key: "a", Value: []byte("1")}},
+		{Args: rpc.Args{Key: "b", Value: []byte("2")}},
+	})
+	if err != nil {
+		t.Fatalf("Batch with one late replica: %v", err)
+	}
+	if got := late.localValues("a"); got != nil {
+		t.Fatalf("the late replica applied part of the batch while locked: a = %q", got)
+	}
+	if nodes[0].c.PendingHints() != 1 {
+		t.Fatalf("%d hints queued, want the refused commit", nodes[0].c.PendingHints())
+	}
+
+	nodes[0].c.deliverHints() // fails, the rival still holds the keys
+	if nodes[0].c.PendingHints() != 1 {
+		t.Fatal("the commit was dropped while the keys were locked")
+	}
+	late.store.Abort("rival")
+	nodes[0].c.deliverHints()
+	if nodes[0].c.PendingHints() != 0 {
+		t.Fatal("the commit was not delivered once the keys were unlocked")
+	}
+	for _, n := range nodes {
+		if a, b := n.localValues("a"), n.localValues("b"); len(a) != 1 || a[0] != "1" || len(b) != 1 || b[0] != "2" {
+			t.Fatalf("%s holds a = %q, b = %q", n.addr, a, b)
+		}
+	}
+}
+
+func TestWritesWaitForPreparedTransactions(t *testing.T) {
+	nodes := newTestCluster(t, 3, Config{N: 3, R: 3, W: 3})
+	locked := nodes[1]
+	if _, err := locked.store.Prepare("txn", []string{"k"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nodes[0].c.Put("k", []byte("a"), nil, 0); !errors.Is(err, store.ErrLocked) {
+		t.Fatalf("Put on a key locked on one of W replicas = %v, want ErrLocked", err)
+	}
+	if got := locked.localValues("k"); got != nil {
+		t.Fatalf("the locked replica took the write: %q", got)
+	}
+	eventually(t, "the write for the locked replica is queued", func() bool { return nodes[0].c.PendingHints() == 1 })
+
+	locked.store.Abort("txn")
+	nodes[0].c.deliverHints()
+	if got := locked.localValues("k"); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("the replica holds %q once unlocked", got)
+	}
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"distributed-kv-store/store"
+	"log"
+	"strings"
+	"sync"
+)
+
+// hint is a write that could not be delivered to its replica: a single
+// version of key, or the commit of the transaction txn, whose writes to
+// the replica are in versions.
+type hint struct {
+	key     string
+	version store.Versioned
+
+	txn      string
+	keys     []string
+	versions map[string]store.Versioned
+}
+
+// hintQueue holds undelivered writes per replica, in the order they were made.
+type hintQueue struct {
+	mu      sync.Mutex
+	max     int
+	pending map[string][]hint // map[node]hints
+}
+
+// newHintQueue creates a queue that keeps at most max hints per node.
+func newHintQueue(max int) *hintQueue {
+	return &hintQueue{
+		max:     max,
+		pending: make(map[string][]hint),
+	}
+}
+
+// add queues a write for node, dropping the oldest hint if the node's queue is full.
+func (q *hintQueue) add(node, key string, v store.Versioned) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.push(node, hint{key: key, version: v})
+}
+
+// addCommit queues the commit of txn's writes to keys for node.
+func (q *hintQueue) addCommit(node, txn string, keys []string, versions map[string]store.Versioned) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.push(node, hint{key: strings.Join(keys, ","), txn: txn, keys: keys, versions: versions})
+}
+
+// push appends h to node's queue, dropping the oldest hint if the queue is
+// full. The caller must hold q.mu.
+func (q *hintQueue) push(node string, h hint) {
+	hints := append(q.pending[node], h)
+	if len(hints) > q.max {
+		log.Printf("Hint queue for %s is full, dropping hint for %s\n", node, hints[0].key)
+		hints = hints[1:]
+	}
+	q.pending[node] = hints
+}
+
+// nodes returns the nodes that have hints waiting.
+func (q *hintQueue) nodes() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	nodes := make([]string, 0, len(q.pending))
+	for node := range q.pending {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// peek returns the oldest hint for node.
+func (q *hintQueue) peek(node string) (hint, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	hints := q.pending[node]
+	if len(hints) == 0 {
+		return hint{}, false
+	}
+	return hints[0], true
+}
+
+// pop removes the oldest hint for node.
+func (q *hintQueue) pop(node string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	hints := q.pending[node]
+	if len(hints) <= 1 {
+		delete(q.pending, node)
+		return
+	}
+	q.pending[node] = hints[1:]
+}
+
+// len returns the total number of queued hints.
+func (q *hintQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, hints := range q.pending {
+		n += len(hints)
+	}
+	return n
+}
+
+// PendingHints returns the number of writes and transaction commits queued
+// for unreachable or locked replicas.
+func (c *Coordinator) PendingHints() int {
+	return c.hints.len()
+}
+
+// deliverHints replays queued writes and commits to every node that has
+// hints, in order, stopping at the first failure for each node.
+func (c *Coordinator) deliverHints() {
+	for _, node := range c.hints.nodes() {
+		delivered := 0
+		for {
+			h, ok := c.hints.peek(node)
+			if !ok {
+				break
+			}
+			var err error
+			if h.txn != "" {
+				err = c.commitReplica(node, h.txn, h.keys, h.versions)
+			} else {
+				err = c.putReplica(node, h.key, h.version)
+			}
+			if err != nil {
+				break
+			}
+			c.hints.pop(node)
+			delivered++
+		}
+		if delivered > 0 {
+			log.Printf("Delivered %d hinted writes to %s\n", delivered, node)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+)
+
+// ImportArgs carries keys exported from another cluster, with their
+// siblings as they were stored there.
+type ImportArgs struct {
+	Entries []store.Entry
+}
+
+// ImportReply reports how many keys an Import wrote.
+type ImportReply struct {
+	Imported int
+}
+
+// Import writes each sibling of entries to its key's N replicas as-is,
+// keeping its clock, timestamp and expiry, and waits for W
+// acknowledgements of each. Siblings merge with what the cluster already
+// holds, like writes from another coordinator. It returns the number of
+// keys written before the first failure.
+func (c *Coordinator) Import(entries []store.Entry) (int, error) {
+	for i, e := range entries {
+		for _, v := range e.Siblings {
+			if err := c.checkSize(e.Key, v.Value); err != nil {
+				return i, err
+			}
+			if v.Clock == nil {
+				v.Clock = vclock.New() // gob drops empty clocks
+			}
+			if err := c.write(e.Key, v); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,421 @@
+package cluster
+
+import (
+	"distributed-kv-store/ring"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RebalanceStatus reports the progress of the latest rebalance of a node.
+type RebalanceStatus struct {
+	Active      bool
+	Started     time.Time
+	Finished    time.Time // zero while the rebalance is running
+	Ranges      int       // ring ranges this node has to move
+	RangesDone  int       // ranges moved so far
+	KeysSent    int       // keys copied to their new owners
+	KeysDropped int       // keys removed after moving to their new owners
+	Error       string    // why the latest rebalance failed, if it did
+	Ring        []string  // nodes on the ring the latest successful rebalance moved keys for
+}
+
+// rebalancer tracks the data a node moves when the ring changes.
+type rebalancer struct {
+	trigger chan struct{}
+	running sync.Mutex // held while data is moved
+
+	mu     sync.Mutex
+	placed *ring.Ring // the ring the local keys are placed by
+	status RebalanceStatus
+
+	// Reads also consult the owners of keys on the ring before the latest
+	// change, until every node has moved its keys. A joining node does not
+	// know that ring, so it takes it to be the current ring without itself.
+	prev    *ring.Ring
+	joining bool
+}
+
+// transfer copies the local keys in some ranges to the nodes in to, and
+// removes them afterwards if drop is set.
+type transfer struct {
+	ranges []ring.Range
+	to     []string
+	drop   bool
+}
+
+// RingChanged tells the coordinator that nodes were added to or removed
+// from the ring, so keys have to move to their new owners. The rebalance
+// starts after RebalanceDelay, letting a burst of changes settle.
+func (c *Coordinator) RingChanged() {
+	c.rebalance.mu.Lock()
+	if c.rebalance.prev == nil && !c.rebalance.joining {
+		c.rebalance.prev = c.rebalance.placed
+	}
+	c.rebalance.mu.Unlock()
+
+	select {
+	case c.rebalance.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Rebalance returns the progress of the latest rebalance.
+func (c *Coordinator) Rebalance() RebalanceStatus {
+	c.rebalance.mu.Lock()
+	defer c.rebalance.mu.Unlock()
+
+	return c.rebalance.status
+}
+
+// Drain moves every key this node owns to the nodes that will own it once
+// this node leaves the ring. It is meant to be called before leaving the
+// cluster, so that data survives even with a single replica.
+func (c *Coordinator) Drain() error {
+	c.rebalance.running.Lock()
+	defer c.rebalance.running.Unlock()
+
+	cur := c.ring.Clone()
+	next := cur.Clone()
+	next.Remove(c.cfg.Self)
+	return c.move(cur, next)
+}
+
+// rebalanceLoop moves data every time the ring changes, retrying failed
+// rebalances every HintInterval and checking every RebalanceDelay whether
+// the other nodes are done, until Stop is called.
+func (c *Coordinator) rebalanceLoop() {
+	defer c.wg.Done()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.rebalance.trigger:
+		case <-retry:
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.cfg.RebalanceDelay):
+		}
+
+		retry = nil
+		settled, err := c.rebalanceOnce()
+		switch {
+		case err != nil:
+			log.Printf("Rebalancing failed, retrying in %v: %v\n", c.cfg.HintInterval, err)
+			retry = time.After(c.cfg.HintInterval)
+		case !settled:
+			retry = time.After(0)
+		}
+	}
+}
+
+// rebalanceOnce moves the keys whose owners differ between the ring the
+// local keys were placed by and the current ring. It reports whether every
+// node on the ring has finished moving keys for the current ring, after
+// which reads no longer consult the previous owners.
+func (c *Coordinator) rebalanceOnce() (bool, error) {
+	c.rebalance.running.Lock()
+	defer c.rebalance.running.Unlock()
+
+	c.rebalance.mu.Lock()
+	placed := c.rebalance.placed
+	c.rebalance.mu.Unlock()
+
+	cur := c.ring.Clone()
+	if err := c.move(placed, cur); err != nil {
+		return false, err
+	}
+	nodes := cur.Nodes()
+	c.rebalance.mu.Lock()
+	c.rebalance.placed = cur
+	c.rebalance.status.Ring = nodes
+	c.rebalance.status.Error = ""
+	c.rebalance.mu.Unlock()
+
+	for _, node := range nodes {
+		if node == c.cfg.Self {
+			continue
+		}
+		var status StatusReply
+		if err := c.call(node, "Cluster.Status", &StatusArgs{}, &status); err != nil {
+			continue // the node is probably leaving the ring
+		}
+		r := status.Rebalance
+		if r.Active || r.Error != "" || strings.Join(r.Ring, ",") != strings.Join(nodes, ",") {
+			return false, nil
+		}
+	}
+
+	c.rebalance.mu.Lock()
+	defer c.rebalance.mu.Unlock()
+	if strings.Join(c.ring.Nodes(), ",") == strings.Join(nodes, ",") {
+		c.rebalance.prev = nil
+		c.rebalance.joining = false
+	}
+	return true, nil
+}
+
+// move carries out the transfers this node is responsible for when the
+// ring changes from prev to next, recording its progress.
+func (c *Coordinator) move(prev, next *ring.Ring) error {
+	transfers := planTransfers(prev, next, c.cfg.N, c.cfg.Self)
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	ranges := 0
+	for _, t := range transfers {
+		ranges += len(t.ranges)
+	}
+	c.updateRebalance(func(s *RebalanceStatus) {
+		*s = RebalanceStatus{Active: true, Started: time.Now(), Ranges: ranges}
+	})
+	log.Printf("Rebalancing: moving %d ranges in %d transfers\n", ranges, len(transfers))
+
+	var failed []string
+	for _, t := range transfers {
+		if err := c.transfer(t); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		c.updateRebalance(func(s *RebalanceStatus) { s.RangesDone += len(t.ranges) })
+	}
+
+	var err error
+	if len(failed) > 0 {
+		err = errors.New(strings.Join(failed, "; "))
+	}
+	c.updateRebalance(func(s *RebalanceStatus) {
+		s.Active = false
+		s.Finished = time.Now()
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+	if err == nil {
+		status := c.Rebalance()
+		log.Printf("Rebalancing done in %v: %d keys sent, %d dropped\n",
+			status.Finished.Sub(status.Started).Round(time.Millisecond), status.KeysSent, status.KeysDropped)
+	}
+	return err
+}
+
+// transfer streams the local keys in t's ranges to its nodes in batches of
+// TransferBatch keys, no faster than TransferRate keys per second. Keys
+// keep being served while they move: writes already go to the new owners,
+// and reads also consult the previous owners until the rebalance is done.
+func (c *Coordinator) transfer(t transfer) error {
+	match := func(key string) bool {
+		h := ring.Hash(key)
+		for _, rg := range t.ranges {
+			if rg.Contains(h) {
+				return true
+			}
+		}
+		return false
+	}
+
+	throttle := newThrottle(c.cfg.TransferRate)
+	start := ""
+	for {
+		select {
+		case <-c.stop:
+			return errors.New("coordinator stopped")
+		default:
+		}
+
+		entries, err := c.local.ScanMatching(start, c.cfg.TransferBatch, match)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		for _, node := range t.to {
+			var reply ApplyReply
+			if err := c.call(node, "Cluster.Apply", &ApplyArgs{Entries: entries}, &reply); err != nil {
+				return fmt.Errorf("sending %d keys to %s: %w", len(entries), node, err)
+			}
+		}
+		dropped := 0
+		if t.drop {
+			if dropped, err = c.local.Release(entries); err != nil {
+				return err
+			}
+		}
+		c.updateRebalance(func(s *RebalanceStatus) {
+			s.KeysSent += len(entries)
+			s.KeysDropped += dropped
+		})
+
+		start = entries[len(entries)-1].Key + "\x00"
+		throttle.wait(len(entries), c.stop)
+	}
+}
+
+// updateRebalance applies fn to the rebalance status.
+func (c *Coordinator) updateRebalance(fn func(s *RebalanceStatus)) {
+	c.rebalance.mu.Lock()
+	defer c.rebalance.mu.Unlock()
+
+	fn(&c.rebalance.status)
+}
+
+// handoffSources returns the nodes that owned key before the ring changed
+// and still hold it while a rebalance is pending, leaving out the given
+// replicas and nodes that are no longer on the ring.
+func (c *Coordinator) handoffSources(key string, replicas []string) []string {
+	c.rebalance.mu.Lock()
+	prev, joining := c.rebalance.prev, c.rebalance.joining
+	c.rebalance.mu.Unlock()
+
+	var owners []string
+	switch {
+	case joining:
+		// Without this node, the next node along the ring owns the key.
+		for _, node := range c.ring.Replicas(key, c.cfg.N+1) {
+			if node != c.cfg.Self && len(owners) < c.cfg.N {
+				owners = append(owners, node)
+			}
+		}
+	case prev != nil:
+		owners = prev.Replicas(key, c.cfg.N)
+	default:
+		return nil
+	}
+
+	nodes := c.ring.Nodes()
+	var sources []string
+	for _, node := range owners {
+		if !contains(replicas, node) && contains(nodes, node) {
+			sources = append(sources, node)
+		}
+	}
+	return sources
+}
+
+// planTransfers works out which keys self has to send where when the ring
+// changes from prev to next. Each range between adjacent points of either
+// ring has the same owners throughout, so the ranges are compared one by
+// one. A node that stops owning a range sends it to all of its new
+// owners and then drops it. If every such node has left the ring, the
+// first previous owner still on the ring sends it to the new owners
+// instead, and keeps it.
+func planTransfers(prev, next *ring.Ring, n int, self string) []transfer {
+	points := append(prev.Points(), next.Points()...)
+	if len(points) == 0 {
+		return nil
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	nodes := next.Nodes()
+	byTarget := make(map[string]*transfer)
+	var order []string
+	for i, end := range points {
+		start := points[(i+len(points)-1)%len(points)]
+		if i > 0 && start == end {
+			continue // the same point on both rings
+		}
+
+		before := prev.ReplicasOf(end, n)
+		after := next.ReplicasOf(end, n)
+		if !contains(before, self) {
+			continue
+		}
+
+		var to []string
+		drop := !contains(after, self)
+		if drop {
+			// Other replicas may have missed writes this copy has, so it
+			// goes to every new owner before it is dropped.
+			if len(after) == 0 {
+				continue // nowhere to move it
+			}
+			to = after
+		} else {
+			for _, node := range after {
+				if !contains(before, node) {
+					to = append(to, node)
+				}
+			}
+			if len(to) == 0 || !firstSender(before, after, nodes, self) {
+				continue
+			}
+		}
+
+		id := fmt.Sprintf("%s|%t", strings.Join(to, ","), drop)
+		t, ok := byTarget[id]
+		if !ok {
+			t = &transfer{to: to, drop: drop}
+			byTarget[id] = t
+			order = append(order, id)
+		}
+		rg := ring.Range{Start: start, End: end}
+		if last := len(t.ranges) - 1; last >= 0 && t.ranges[last].End == start {
+			t.ranges[last].End = end
+		} else {
+			t.ranges = append(t.ranges, rg)
+		}
+	}
+
+	transfers := make([]transfer, 0, len(order))
+	for _, id := range order {
+		transfers = append(transfers, *byTarget[id])
+	}
+	return transfers
+}
+
+// firstSender reports whether self has to send a range that changed owners
+// from before to after while keeping its copy: it does when every previous
+// owner that gave the range up has left the ring and self is the first
+// previous owner still on it.
+func firstSender(before, after, nodes []string, self string) bool {
+	for _, node := range before {
+		if !contains(after, node) && contains(nodes, node) {
+			return false // that node sends it
+		}
+	}
+	for _, node := range before {
+		if contains(nodes, node) {
+			return node == self
+		}
+	}
+	return false
+}
+
+// throttle limits a transfer to a number of keys per second.
+type throttle struct {
+	rate  int
+	start time.Time
+	sent  int
+}
+
+// newThrottle creates a throttle for rate keys per second; zero or less
+// means no limit.
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait records that n more keys were sent and sleeps until sending them
+// fits the rate, or until stop is closed.
+func (t *throttle) wait(n int, stop <-chan struct{}) {
+	if t.rate <= 0 {
+		return
+	}
+	t.sent += n
+	due := t.start.Add(time.Duration(t.sent) * time.Second / time.Duration(t.rate))
+	if d := time.Until(due); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-stop:
+		}
+	}
+}
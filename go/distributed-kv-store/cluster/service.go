@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"distributed-kv-store/membership"
+	"distributed-kv-store/metrics"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Service is the RPC service for cluster-wide operations. Clients use its
+// Get, Put, Delete, CompareAndSwap, Batch, Upload, Download, Scan, Import
+// and Status methods, which run through the coordinator with quorum
+// replication; nodes use the rest to coordinate with each other. It is
+// registered under the name "Cluster".
+type Service struct {
+	c       *Coordinator
+	members *membership.List
+	metrics *metrics.Registry
+}
+
+// NewService creates the cluster RPC service for a coordinator and the
+// membership list it follows. Client requests are recorded in reg, if not nil.
+func NewService(c *Coordinator, members *membership.List, reg *metrics.Registry) *Service {
+	return &Service{c: c, members: members, metrics: reg}
+}
+
+// StatusReply describes a node's view of the cluster.
+type StatusReply struct {
+	Self         string
+	N, R, W      int
+	VirtualNodes int
+	Nodes        []string // nodes on the hash ring
+	Members      []membership.Member
+	Keys         int    // keys held by this node, tombstones included
+	Revision     uint64 // revision of the latest change to this node's store
+	PendingHints int    // writes queued for unreachable replicas
+	Rebalance    RebalanceStatus
+}
+
+// StatusArgs is the argument of a Status call.
+type StatusArgs struct {
+	// Verbose adds the membership list to the reply.
+	Verbose bool
+}
+
+// Get reads a key with quorum and returns its live siblings resolved with
+// args.Policy, together with the context to pass to a following write.
+func (s *Service) Get(args *rpc.Args, reply *rpc.Reply) (err error) {
+	defer s.observe("get", time.Now(), &err)
+
+	siblings, ctx, err := s.c.Get(args.Key, s.policy(args.Policy))
+	reply.Context = ctx
+	if err != nil {
+		return err
+	}
+	reply.Siblings = siblings
+	if len(siblings) == 1 {
+		reply.Value = siblings[0].Value
+	}
+	return nil
+}
+
+// Put writes a key with quorum, superseding the siblings in args.Context.
+func (s *Service) Put(args *rpc.Args, reply *rpc.Reply) (err error) {
+	defer s.observe("put", time.Now(), &err)
+
+	value, err := s.value(args)
+	if err != nil {
+		return err
+	}
+	if err := s.c.Put(args.Key, value, args.Context, args.TTL); err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Delete deletes a key with quorum, superseding the siblings in args.Context.
+func (s *Service) Delete(args *rpc.Args, reply *rpc.Reply) (err error) {
+	defer s.observe("delete", time.Now(), &err)
+
+	if err := s.c.Delete(args.Key, args.Context); err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// CompareAndSwap writes a key with quorum if it is still at args.Expected.
+func (s *Service) CompareAndSwap(args *rpc.Args, reply *rpc.Reply) (err error) {
+	defer s.observe("cas", time.Now(), &err)
+
+	value, err := s.value(args)
+	if err != nil {
+		return err
+	}
+	if err := s.c.CompareAndSwap(args.Key, args.Expected, value, args.TTL); err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Batch applies a set of writes atomically across the cluster, if all of
+// their checks hold.
+func (s *Service) Batch(args *rpc.BatchArgs, reply *rpc.Reply) (err error) {
+	defer s.observe("batch", time.Now(), &err)
+
+	ops := make([]rpc.Op, len(args.Ops))
+	for i, op := range args.Ops {
+		if op.Value, err = s.value(&op.Args); err != nil {
+			return err
+		}
+		op.Upload = ""
+		ops[i] = op
+	}
+	if err := s.c.Batch(ops); err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Upload receives a chunk of a value to write with a later Put,
+// CompareAndSwap or Batch on the same node.
+func (s *Service) Upload(args *UploadArgs, reply *UploadReply) (err error) {
+	defer s.observe("upload", time.Now(), &err)
+
+	reply.ID, reply.Size, err = s.c.Upload(args.ID, args.Data)
+	return err
+}
+
+// Download returns a chunk of the value of a key, read with quorum when
+// the download starts.
+func (s *Service) Download(args *DownloadArgs, reply *DownloadReply) (err error) {
+	defer s.observe("download", time.Now(), &err)
+
+	*reply, err = s.c.Download(args.Key, s.policy(args.Policy), args.ID, args.Offset, args.Length)
+	return err
+}
+
+// Import writes keys exported from another cluster, keeping their versions.
+func (s *Service) Import(args *ImportArgs, reply *ImportReply) (err error) {
+	defer s.observe("import", time.Now(), &err)
+
+	reply.Imported, err = s.c.Import(args.Entries)
+	return err
+}
+
+// value returns the value a write carries inline or was uploaded ahead of it.
+func (s *Service) value(args *rpc.Args) ([]byte, error) {
+	if args.Upload == "" {
+		return args.Value, nil
+	}
+	return s.c.TakeUpload(args.Upload)
+}
+
+// Scan lists live keys across the cluster in ascending order.
+func (s *Service) Scan(args *rpc.ScanArgs, reply *rpc.ScanReply) (err error) {
+	defer s.observe("scan", time.Now(), &err)
+
+	start, end := rpc.ScanRange(args)
+	entries, err := s.c.Scan(start, end, args.Limit, s.policy(args.Policy))
+	if err != nil {
+		return err
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// Status reports the node's configuration, ring and membership.
+func (s *Service) Status(args *StatusArgs, reply *StatusReply) error {
+	reply.Self = s.c.cfg.Self
+	reply.N, reply.R, reply.W = s.c.cfg.N, s.c.cfg.R, s.c.cfg.W
+	reply.VirtualNodes = s.c.ring.VirtualNodes()
+	reply.Nodes = s.c.ring.Nodes()
+	if args.Verbose && s.members != nil {
+		reply.Members = s.members.Members()
+	}
+	reply.Keys = s.c.local.Len()
+	reply.Revision = s.c.local.Revision()
+	reply.PendingHints = s.c.PendingHints()
+	reply.Rebalance = s.c.Rebalance()
+	return nil
+}
+
+// observe records a client request that started at start and failed with
+// *err, if it failed.
+func (s *Service) observe(op string, start time.Time, err *error) {
+	if s.metrics != nil {
+		s.metrics.Observe(op, Result(*err), time.Since(start))
+	}
+}
+
+// Result classifies the outcome of a client request for metrics.
+func Result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, store.ErrKeyNotFound):
+		return "not_found"
+	case errors.Is(err, store.ErrConflict):
+		return "conflict"
+	case errors.Is(err, store.ErrLocked):
+		return "locked"
+	case errors.Is(err, ErrQuorum):
+		return "quorum_failed"
+	case errors.Is(err, ErrTooLarge):
+		return "too_large"
+	}
+	return "error"
+}
+
+// policy returns the conflict resolution policy for a client request,
+// falling back to the node's configured default.
+func (s *Service) policy(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return s.c.cfg.Policy
+}
+
+// maxMerkleDepth bounds the size of trees a peer may ask for.
+const maxMerkleDepth = 20
+
+// MerkleTree returns the Merkle tree of the keys this node shares with the caller.
+func (s *Service) MerkleTree(args *MerkleArgs, reply *MerkleReply) error {
+	if args.Depth < 0 || args.Depth > maxMerkleDepth {
+		return fmt.Errorf("invalid Merkle depth %d", args.Depth)
+	}
+	tree, err := s.c.merkleTree(args.Peer, args.Depth)
+	if err != nil {
+		return err
+	}
+	reply.Tree = *tree
+	return nil
+}
+
+// BucketEntries returns this node's entries in the requested buckets of the
+// keys it shares with the caller.
+func (s *Service) BucketEntries(args *BucketArgs, reply *EntriesReply) error {
+	if args.Depth < 0 || args.Depth > maxMerkleDepth {
+		return fmt.Errorf("invalid Merkle depth %d", args.Depth)
+	}
+	buckets := make(map[int]bool, len(args.Buckets))
+	for _, b := range args.Buckets {
+		buckets[b] = true
+	}
+	entries, err := s.c.sharedEntries(args.Peer, args.Depth, buckets)
+	if err != nil {
+		return err
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// Apply merges the given entries into this node's local store.
+func (s *Service) Apply(args *ApplyArgs, reply *ApplyReply) error {
+	n, err := s.c.applyEntries(args.Entries)
+	reply.Applied = n
+	return err
+}
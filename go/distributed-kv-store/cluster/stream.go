@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTooLarge is returned when a key or value exceeds the configured size limits.
+var ErrTooLarge = errors.New("size limit exceeded")
+
+// ErrNoStream is returned when an upload or download is not known to the
+// node, because it expired, was used up or was started on another node.
+var ErrNoStream = errors.New("no such upload or download")
+
+// UploadArgs carries a chunk of a value uploaded ahead of a write. An
+// empty ID starts a new upload.
+type UploadArgs struct {
+	ID   string
+	Data []byte
+}
+
+// UploadReply identifies an upload and reports how much of it arrived.
+// Pass the ID as rpc.Args.Upload to write the uploaded value.
+type UploadReply struct {
+	ID   string
+	Size int
+}
+
+// DownloadArgs asks for a chunk of a value. An empty ID reads the key
+// with quorum and starts a download of its value; later chunks of the same
+// download must pass its ID.
+type DownloadArgs struct {
+	Key    string
+	Policy string
+	ID     string
+	Offset int
+	Length int
+}
+
+// DownloadReply carries a chunk of a value, the total size of the value and
+// the context of the read that returned it.
+type DownloadReply struct {
+	ID      string
+	Data    []byte
+	Size    int
+	Context vclock.VClock
+}
+
+// stream is a value being uploaded or downloaded in chunks. Streams are
+// held in memory by the node they were started on.
+type stream struct {
+	data    []byte
+	ctx     vclock.VClock
+	touched time.Time
+}
+
+// checkSize enforces the key and value size limits on a write.
+func (c *Coordinator) checkSize(key string, value []byte) error {
+	if len(key) > c.cfg.MaxKeySize {
+		return fmt.Errorf("%w: key of %d bytes, limit is %d", ErrTooLarge, len(key), c.cfg.MaxKeySize)
+	}
+	if len(value) > c.cfg.MaxValueSize {
+		return fmt.Errorf("%w: value of %d bytes for key %s, limit is %d", ErrTooLarge, len(value), key, c.cfg.MaxValueSize)
+	}
+	return nil
+}
+
+// Upload appends a chunk to an upload, starting a new one if id is empty,
+// and returns the upload's ID and size so far.
+func (c *Coordinator) Upload(id string, data []byte) (string, int, error) {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if id == "" {
+		id = newStreamID()
+		c.streams[id] = &stream{}
+	}
+	s, ok := c.streams[id]
+	if !ok || s.ctx != nil {
+		return "", 0, ErrNoStream
+	}
+	if len(s.data)+len(data) > c.cfg.MaxValueSize {
+		delete(c.streams, id)
+		return "", 0, fmt.Errorf("%w: upload of more than %d bytes", ErrTooLarge, c.cfg.MaxValueSize)
+	}
+	s.data = append(s.data, data...)
+	s.touched = time.Now()
+	return id, len(s.data), nil
+}
+
+// TakeUpload returns the value of a finished upload and forgets it.
+func (c *Coordinator) TakeUpload(id string) ([]byte, error) {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	s, ok := c.streams[id]
+	if !ok || s.ctx != nil {
+		return nil, ErrNoStream
+	}
+	delete(c.streams, id)
+	return s.data, nil
+}
+
+// Download returns up to length bytes of a value from offset on. With an
+// empty id, it reads key with quorum and keeps its value for the rest of
+// the download, so that every chunk comes from the same version. A key
+// with more than one live sibling after resolution with policy cannot be
+// downloaded. The download is forgotten once its last chunk is returned.
+func (c *Coordinator) Download(key, policy, id string, offset, length int) (DownloadReply, error) {
+	if id == "" {
+		siblings, ctx, err := c.Get(key, policy)
+		if err != nil {
+			return DownloadReply{}, err
+		}
+		if len(siblings) > 1 {
+			return DownloadReply{}, fmt.Errorf("%w on key %s: %d concurrent versions, read it with Get", store.ErrConflict, key, len(siblings))
+		}
+		id = newStreamID()
+		c.streamMu.Lock()
+		c.streams[id] = &stream{data: siblings[0].Value, ctx: ctx, touched: time.Now()}
+		c.streamMu.Unlock()
+	}
+
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	s, ok := c.streams[id]
+	if !ok || s.ctx == nil {
+		return DownloadReply{}, ErrNoStream
+	}
+	if offset < 0 || offset > len(s.data) {
+		return DownloadReply{}, fmt.Errorf("offset %d is outside the value of %d bytes", offset, len(s.data))
+	}
+	end := len(s.data)
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	s.touched = time.Now()
+	if end == len(s.data) {
+		delete(c.streams, id)
+	}
+	return DownloadReply{ID: id, Data: s.data[offset:end], Size: len(s.data), Context: s.ctx}, nil
+}
+
+// expireStreams forgets uploads and downloads that were not used for
+// StreamTimeout.
+func (c *Coordinator) expireStreams() {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	for id, s := range c.streams {
+		if time.Since(s.touched) > c.cfg.StreamTimeout {
+			delete(c.streams, id)
+		}
+	}
+}
+
+// newStreamID returns a random identifier for an upload or download.
+func newStreamID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
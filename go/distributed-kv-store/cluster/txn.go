@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// txnSeq numbers the transactions coordinated by this process.
+var txnSeq uint64
+
+// CompareAndSwap writes value to key if the key is still at the expected
+// version: the context returned by a Get, or nil if the key must not exist.
+// It returns an error wrapping store.ErrConflict if the key has changed.
+func (c *Coordinator) CompareAndSwap(key string, expected vclock.VClock, value []byte, ttl time.Duration) error {
+	return c.Batch([]rpc.Op{{
+		Args:  rpc.Args{Key: key, Value: value, Expected: expected, TTL: ttl},
+		Check: true,
+	}})
+}
+
+// Batch applies ops atomically across their replicas with two-phase commit.
+// In the prepare phase every replica of every key is locked and returns its
+// siblings; the batch fails with store.ErrLocked if a concurrent
+// transaction holds one of the keys. Once a quorum of replicas of each key
+// is locked, the checks of the batch are evaluated against their
+// reconciled siblings. If they all hold, every locked replica commits the
+// writes, each superseding the siblings seen; otherwise the batch is
+// aborted and nothing is written. Replicas that could not be locked are
+// sent the writes like ordinary puts, with hinted handoff if they are down.
+//
+// The decision to commit is final: a locked replica that cannot be reached
+// or that finds a key locked by another transaction, its own lock having
+// expired, gets the commit again with the hints until it applies it. So
+// when fewer than W replicas of a key acknowledge the commit, the batch
+// fails with ErrQuorum but is still applied to every replica eventually.
+func (c *Coordinator) Batch(ops []rpc.Op) error {
+	// A majority keeps two transactions from locking the same key at once,
+	// and R or W replicas are needed to see and make durable the latest write.
+	quorum := c.cfg.N/2 + 1
+	if c.cfg.R > quorum {
+		quorum = c.cfg.R
+	}
+	if c.cfg.W > quorum {
+		quorum = c.cfg.W
+	}
+
+	replicas := make(map[string][]string) // map[key]replicas
+	keysByNode := make(map[string][]string)
+	for _, op := range ops {
+		if _, dup := replicas[op.Key]; dup {
+			return fmt.Errorf("key %s appears more than once in the batch", op.Key)
+		}
+		if err := c.checkSize(op.Key, op.Value); err != nil {
+			return err
+		}
+		nodes := c.ring.Replicas(op.Key, c.cfg.N)
+		if len(nodes) < quorum {
+			return fmt.Errorf("%w: only %d replicas available for a transaction on %s", ErrQuorum, len(nodes), op.Key)
+		}
+		replicas[op.Key] = nodes
+		for _, node := range nodes {
+			keysByNode[node] = append(keysByNode[node], op.Key)
+		}
+	}
+	txn := fmt.Sprintf("%s/%d/%d", c.cfg.Self, time.Now().UnixNano(), atomic.AddUint64(&txnSeq, 1))
+
+	// Phase one: lock the keys on every replica. Replicas are locked one at
+	// a time in a fixed order, so that of two transactions on the same key
+	// the one that locks the first replica wins and the other gives up
+	// instead of both holding part of the locks and aborting each other.
+	nodes := make([]string, 0, len(keysByNode))
+	for node := range keysByNode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	prepared := make(map[string]bool)
+	siblings := make(map[string][]store.Versioned)
+	for _, node := range nodes {
+		entries, err := c.prepareReplica(node, txn, keysByNode[node])
+		if err != nil && isLocked(err) {
+			c.abort(txn, prepared)
+			return store.ErrLocked
+		}
+		if err != nil {
+			log.Printf("Error preparing transaction %s on %s: %v\n", txn, node, err)
+			continue
+		}
+		prepared[node] = true
+		for _, e := range entries {
+			siblings[e.Key] = store.Reconcile(siblings[e.Key], e.Siblings)
+		}
+	}
+
+	// Decide: every key needs a quorum of locked replicas and its check must hold.
+	now := time.Now()
+	for _, op := range ops {
+		locks := 0
+		for _, node := range replicas[op.Key] {
+			if prepared[node] {
+				locks++
+			}
+		}
+		if locks < quorum {
+			c.abort(txn, prepared)
+			return fmt.Errorf("%w: %d of %d replicas of %s prepared", ErrQuorum, locks, quorum, op.Key)
+		}
+		if op.Check && !store.Matches(siblings[op.Key], op.Expected, now) {
+			c.abort(txn, prepared)
+			return fmt.Errorf("%w on key %s", store.ErrConflict, op.Key)
+		}
+	}
+
+	// Phase two: commit the writes on every locked replica.
+	versions := make(map[string]store.Versioned, len(ops))
+	for _, op := range ops {
+		v := c.newVersion(store.Context(siblings[op.Key]))
+		v.Value = op.Value
+		v.Deleted = op.Delete
+		if op.TTL > 0 && !op.Delete {
+			v.ExpiresAt = v.Timestamp + int64(op.TTL)
+		}
+		versions[op.Key] = v
+	}
+
+	type result struct {
+		node string
+		err  error
+	}
+	results := make(chan result, len(keysByNode))
+	for node, keys := range keysByNode {
+		go func(node string, keys []string) {
+			var err error
+			if prepared[node] {
+				err = c.commitReplica(node, txn, keys, versions)
+			} else {
+				for _, key := range keys {
+					if err = c.putReplica(node, key, versions[key]); err != nil {
+						break
+					}
+				}
+			}
+			switch {
+			case err == nil:
+			case prepared[node]:
+				c.hints.addCommit(node, txn, keys, versions)
+			case node != c.cfg.Self || isLocked(err):
+				for _, key := range keys {
+					c.hints.add(node, key, versions[key])
+				}
+			}
+			results <- result{node, err}
+		}(node, keys)
+	}
+	acks := make(map[string]int, len(ops))
+	for range keysByNode {
+		r := <-results
+		if r.err != nil {
+			log.Printf("Error committing transaction %s on %s: %v\n", txn, r.node, r.err)
+			continue
+		}
+		for _, key := range keysByNode[r.node] {
+			acks[key]++
+		}
+	}
+	for _, op := range ops {
+		if acks[op.Key] < c.cfg.W {
+			return fmt.Errorf("%w: %d of %d commit acknowledgements for %s, the rest will follow", ErrQuorum, acks[op.Key], c.cfg.W, op.Key)
+		}
+	}
+	return nil
+}
+
+// abort releases the locks of txn on the prepared replicas. Replicas that
+// miss the abort release the locks when they expire.
+func (c *Coordinator) abort(txn string, prepared map[string]bool) {
+	for node := range prepared {
+		if err := c.abortReplica(node, txn); err != nil {
+			log.Printf("Error aborting transaction %s on %s: %v\n", txn, node, err)
+		}
+	}
+}
+
+// prepareReplica locks keys for txn on a single replica.
+func (c *Coordinator) prepareReplica(node, txn string, keys []string) ([]store.Entry, error) {
+	if node == c.cfg.Self {
+		return c.local.Prepare(txn, keys, c.cfg.LockTimeout)
+	}
+	var reply rpc.PrepareReply
+	args := &rpc.PrepareArgs{TxnID: txn, Keys: keys, TTL: c.cfg.LockTimeout}
+	if err := c.call(node, "KVStore.Prepare", args, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
+
+// commitReplica commits the writes of txn to keys on a single replica.
+func (c *Coordinator) commitReplica(node, txn string, keys []string, versions map[string]store.Versioned) error {
+	if node == c.cfg.Self {
+		ops := make([]store.Op, len(keys))
+		for i, key := range keys {
+			ops[i] = store.Op{Key: key, Version: versions[key]}
+		}
+		return c.local.Commit(txn, ops)
+	}
+	ops := make([]rpc.Op, len(keys))
+	for i, key := range keys {
+		v := versions[key]
+		ops[i] = rpc.Op{
+			Args:   rpc.Args{Key: key, Value: v.Value, Context: v.Clock, Timestamp: v.Timestamp, ExpiresAt: v.ExpiresAt},
+			Delete: v.Deleted,
+		}
+	}
+	var reply rpc.Reply
+	return c.call(node, "KVStore.Commit", &rpc.CommitArgs{TxnID: txn, Ops: ops}, &reply)
+}
+
+// abortReplica releases the locks of txn on a single replica.
+func (c *Coordinator) abortReplica(node, txn string) error {
+	if node == c.cfg.Self {
+		c.local.Abort(txn)
+		return nil
+	}
+	var reply rpc.Reply
+	return c.call(node, "KVStore.Abort", &rpc.TxnArgs{TxnID: txn}, &reply)
+}
@@ -0,0 +1,465 @@
+// Command kvctl reads and writes keys in a distributed-kv-store cluster.
+package main
+
+import (
+	"bufio"
+	"context"
+	"distributed-kv-store/client"
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/membership"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// adminTimeout is the default timeout of backup and restore, which take
+// as long as reading or writing the whole store.
+const adminTimeout = 10 * time.Minute
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: kvctl [flags] <command> [args]
+
+Commands:
+  get <key>               Print the value of a key
+  cat <key>               Stream the raw value of a key to stdout
+  put <key> <value>       Write a key, superseding the values last read
+  put <key> -             Stream the value of a key from stdin
+  delete <key>            Delete a key
+  cas <key> <old> <new>   Set a key to new if its value is still old ("-" if unset)
+  incr <key> [delta]      Atomically add delta (default 1) to an integer key
+  batch <op>...           Apply put <key> <value> and delete <key> ops atomically
+  watch <key>             Print changes to a key as they happen (-prefix for a prefix)
+  scan [prefix]           List keys with a prefix
+  scan <start> <end>      List keys in [start, end)
+  status                  Show the cluster layout and membership
+  backup <name> [base]    Snapshot -node's store to a file in its -backup-dir, incrementally on top of base
+  restore <name>...       Merge backups in -node's -backup-dir into its store, in order
+  export [prefix]         Write live keys to stdout as JSON lines
+  import [file]           Write keys exported from another cluster, keeping their versions
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	servers := flag.String("servers", "localhost:8080", "Comma-separated list of nodes to contact")
+	timeout := flag.Duration("timeout", client.DefaultTimeout, "Timeout for each request")
+	retries := flag.Int("retries", client.DefaultRetries, "Retries after a node is unreachable or misses its quorum")
+	policy := flag.String("policy", "", "Conflict resolution for reads with concurrent versions (merge, lww; default: the server's)")
+	ttl := flag.Duration("ttl", 0, "Time to live for values written with put (0 means never expire)")
+	limit := flag.Int("limit", 100, "Maximum number of keys returned by scan")
+	prefix := flag.Bool("prefix", false, "Make watch report changes to every key with the given prefix")
+	from := flag.String("from", "", "Comma-separated node=revision list to resume a watch from")
+	node := flag.String("node", "", "Node to back up or restore (default: the first of -servers)")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *retries == 0 {
+		*retries = -1 // the client treats zero as the default
+	}
+	if (args[0] == "backup" || args[0] == "restore") && !flagSet("timeout") {
+		*timeout = adminTimeout
+	}
+
+	var seeds []string
+	for _, s := range strings.Split(*servers, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			seeds = append(seeds, s)
+		}
+	}
+	c, err := client.New(client.Config{
+		Servers: seeds,
+		Timeout: *timeout,
+		Retries: *retries,
+		Policy:  *policy,
+	})
+	if err != nil {
+		log.Fatalf("Error connecting to cluster: %v", err)
+	}
+	defer c.Close()
+
+	if *node == "" {
+		*node = seeds[0]
+	}
+	switch args[0] {
+	case "watch":
+		err = watch(c, args[1:], *prefix, *from)
+	case "backup", "restore", "export", "import":
+		err = admin(c, args, *node)
+	default:
+		err = run(c, args, *ttl, *limit)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+}
+
+// run executes a single command.
+func run(c *client.Client, args []string, ttl time.Duration, limit int) error {
+	command, args := args[0], args[1:]
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kvctl get <key>")
+		}
+		siblings, ctx, err := c.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if len(siblings) == 1 {
+			fmt.Printf("%s\n", siblings[0].Value)
+			return nil
+		}
+		fmt.Printf("%d conflicting values (context %v):\n", len(siblings), ctx)
+		for _, v := range siblings {
+			fmt.Printf("  %s %v\n", v.Value, v.Clock)
+		}
+
+	case "cat":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kvctl cat <key>")
+		}
+		r, _, err := c.GetStream(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			return err
+		}
+
+	case "put":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: kvctl put <key> <value|->")
+		}
+		// Read the current context first so the write supersedes what we saw
+		_, ctx, err := c.Get(args[0])
+		if err != nil && err != store.ErrKeyNotFound {
+			return fmt.Errorf("failed to read context: %w", err)
+		}
+		if args[1] == "-" {
+			err = c.PutStream(args[0], os.Stdin, ctx, ttl)
+		} else {
+			err = c.Put(args[0], []byte(args[1]), ctx, ttl)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kvctl delete <key>")
+		}
+		_, ctx, err := c.Get(args[0])
+		if err == store.ErrKeyNotFound {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read context: %w", err)
+		}
+		if err := c.Delete(args[0], ctx); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "cas":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: kvctl cas <key> <old> <new>")
+		}
+		siblings, ctx, err := c.Get(args[0])
+		if err == store.ErrKeyNotFound {
+			ctx = nil
+		} else if err != nil {
+			return err
+		}
+		if current := valueOf(siblings); current != args[1] {
+			return fmt.Errorf("%w: %s is %q, not %q", store.ErrConflict, args[0], current, args[1])
+		}
+		if err := c.CompareAndSwap(args[0], ctx, []byte(args[2]), ttl); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "incr":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: kvctl incr <key> [delta]")
+		}
+		delta := int64(1)
+		if len(args) == 2 {
+			d, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid delta %q: %w", args[1], err)
+			}
+			delta = d
+		}
+		// Retry until no other writer changes the key between the read and the swap
+		for {
+			siblings, ctx, err := c.Get(args[0])
+			if err == store.ErrKeyNotFound {
+				ctx = nil
+			} else if err != nil {
+				return err
+			}
+			n := int64(0)
+			if current := valueOf(siblings); current != "-" {
+				if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+					return fmt.Errorf("%s is not an integer: %q", args[0], current)
+				}
+			}
+			err = c.CompareAndSwap(args[0], ctx, []byte(strconv.FormatInt(n+delta, 10)), ttl)
+			if errors.Is(err, store.ErrConflict) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(n + delta)
+			return nil
+		}
+
+	case "batch":
+		var ops []rpc.Op
+		for len(args) > 0 {
+			switch {
+			case args[0] == "put" && len(args) >= 3:
+				ops = append(ops, rpc.Op{Args: rpc.Args{Key: args[1], Value: []byte(args[2]), TTL: ttl}})
+				args = args[3:]
+			case args[0] == "delete" && len(args) >= 2:
+				ops = append(ops, rpc.Op{Args: rpc.Args{Key: args[1]}, Delete: true})
+				args = args[2:]
+			default:
+				return fmt.Errorf("usage: kvctl batch put <key> <value> | delete <key> ...")
+			}
+		}
+		if err := c.Batch(ops); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "scan":
+		scan := rpc.ScanArgs{Limit: limit}
+		switch len(args) {
+		case 0:
+		case 1:
+			scan.Prefix = args[0]
+		case 2:
+			scan.Start, scan.End = args[0], args[1]
+		default:
+			return fmt.Errorf("usage: kvctl scan [prefix] | kvctl scan <start> <end>")
+		}
+		entries, err := c.Scan(scan)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			for _, v := range e.Siblings {
+				fmt.Printf("%s=%s\n", e.Key, v.Value)
+			}
+		}
+
+	case "status":
+		status, err := c.Status("")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Cluster as seen by %s: N=%d R=%d W=%d, %d virtual nodes per node\n",
+			status.Self, status.N, status.R, status.W, status.VirtualNodes)
+		fmt.Printf("%-24s %-8s %-12s %8s %8s %10s  %s\n", "NODE", "STATE", "INCARNATION", "KEYS", "HINTS", "REVISION", "REBALANCE")
+		for _, m := range status.Members {
+			keys, hints, rev, moves := "-", "-", "-", "-"
+			if m.State == membership.Alive { // don't wait for nodes that are probably down
+				if node, err := c.Status(m.Addr); err == nil {
+					keys, hints, rev = fmt.Sprint(node.Keys), fmt.Sprint(node.PendingHints), fmt.Sprint(node.Revision)
+					moves = rebalanceState(node.Rebalance)
+				}
+			}
+			fmt.Printf("%-24s %-8s %-12d %8s %8s %10s  %s\n", m.Addr, m.State, m.Incarnation, keys, hints, rev, moves)
+		}
+
+	default:
+		return fmt.Errorf("unknown command %q; use get, cat, put, delete, cas, incr, batch, watch, scan, status, backup, restore, export or import", command)
+	}
+	return nil
+}
+
+// admin runs a backup, restore, export or import command.
+func admin(c *client.Client, args []string, node string) error {
+	command, args := args[0], args[1:]
+	switch command {
+	case "backup":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: kvctl [-node addr] backup <name> [base]")
+		}
+		base := ""
+		if len(args) == 2 {
+			base = args[1]
+		}
+		reply, err := c.Backup(node, args[0], base)
+		if err != nil {
+			return err
+		}
+		kind := "Full"
+		if reply.Header.Incremental {
+			kind = "Incremental"
+		}
+		fmt.Printf("%s backup of %s written to %s: %d keys at revision %d, log position %s\n",
+			kind, node, args[0], reply.Keys, reply.Header.Revision, reply.Header.Position)
+
+	case "restore":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: kvctl [-node addr] restore <name>...")
+		}
+		for _, name := range args {
+			reply, err := c.Restore(node, name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restored %d keys from %s (taken %s) to %s\n",
+				reply.Keys, name, reply.Header.Created.Format(time.RFC3339), node)
+		}
+
+	case "export":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: kvctl export [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		w := bufio.NewWriter(os.Stdout)
+		n, err := c.Export(w, prefix)
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d keys\n", n)
+
+	case "import":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: kvctl import [file]")
+		}
+		var r io.Reader = os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		n, err := c.Import(r)
+		if err != nil {
+			return fmt.Errorf("imported %d keys before failing: %w", n, err)
+		}
+		fmt.Printf("Imported %d keys\n", n)
+	}
+	return nil
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// valueOf returns the single value of a key, or "-" if it has none. Keys
+// with conflicting values never match, so cas and incr fail on them.
+func valueOf(siblings []store.Versioned) string {
+	switch len(siblings) {
+	case 0:
+		return "-"
+	case 1:
+		return string(siblings[0].Value)
+	}
+	return fmt.Sprintf("<%d conflicting values>", len(siblings))
+}
+
+// watch prints changes to a key or prefix until interrupted. Each line
+// starts with the node and revision the change was logged at, which can be
+// passed back with -from to resume.
+func watch(c *client.Client, args []string, prefix bool, from string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: kvctl [-prefix] [-from node=rev,...] watch <key|prefix>")
+	}
+	opts := client.WatchOptions{Key: args[0], Revisions: make(map[string]uint64)}
+	if prefix {
+		opts.Key, opts.Prefix = "", args[0]
+	}
+	for _, pair := range strings.Split(from, ",") {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid -from entry %q, want node=revision", pair)
+		}
+		rev, err := strconv.ParseUint(pair[i+1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid revision in %q: %w", pair, err)
+		}
+		opts.Revisions[pair[:i]] = rev
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	events, err := c.Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for e := range events {
+		if e.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", e.Node, e.Err)
+			continue
+		}
+		live := store.Live(e.Siblings, time.Now())
+		switch {
+		case e.Type == store.EventDelete:
+			fmt.Printf("%s=%d delete %s\n", e.Node, e.Revision, e.Key)
+		case len(live) == 1:
+			fmt.Printf("%s=%d put %s=%s\n", e.Node, e.Revision, e.Key, live[0].Value)
+		default:
+			fmt.Printf("%s=%d put %s with %d conflicting values\n", e.Node, e.Revision, e.Key, len(live))
+		}
+	}
+	return nil
+}
+
+// rebalanceState summarizes the progress of a node's latest rebalance.
+func rebalanceState(r cluster.RebalanceStatus) string {
+	switch {
+	case r.Active:
+		return fmt.Sprintf("moving %d/%d ranges, %d keys sent", r.RangesDone, r.Ranges, r.KeysSent)
+	case r.Error != "":
+		return "failed: " + r.Error
+	case r.Started.IsZero():
+		return "idle"
+	}
+	return fmt.Sprintf("done %s ago, %d keys sent, %d dropped",
+		time.Since(r.Finished).Round(time.Second), r.KeysSent, r.KeysDropped)
+}
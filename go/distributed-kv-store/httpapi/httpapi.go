@@ -0,0 +1,586 @@
+// Package httpapi serves the key-value store over HTTP with JSON bodies,
+// for clients that cannot speak Go's net/rpc. Every endpoint maps onto the
+// same operations as the Cluster and KVStore RPC services.
+package httpapi
+
+import (
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/metrics"
+	"distributed-kv-store/rpc"
+	"distributed-kv-store/store"
+	"distributed-kv-store/vclock"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Server serves the HTTP API of a node.
+type Server struct {
+	Cluster *cluster.Service
+	KV      *rpc.KVStore
+	Metrics *metrics.Registry
+	// Ready reports whether the node can serve requests; /readyz fails
+	// while it returns an error.
+	Ready func() error
+}
+
+// Values are opaque bytes. The API carries values that are valid UTF-8
+// as "value" strings and any other value base64-encoded as "value_base64";
+// writes may use either. The /v1/blob/{key} endpoint reads and writes raw
+// values without JSON, streaming them in chunks.
+
+// Version is a value as returned by the API.
+type Version struct {
+	Value       *string       `json:"value,omitempty"`
+	ValueBase64 []byte        `json:"value_base64,omitempty"`
+	Clock       vclock.VClock `json:"clock"`
+	Timestamp   int64         `json:"timestamp"`
+	Deleted     bool          `json:"deleted,omitempty"`
+	ExpiresAt   int64         `json:"expires_at,omitempty"`
+}
+
+// GetResponse is the body returned by GET /v1/kv/{key}.
+type GetResponse struct {
+	Key string `json:"key"`
+	// Value or ValueBase64 is set when the key has exactly one value.
+	Value       *string   `json:"value,omitempty"`
+	ValueBase64 []byte    `json:"value_base64,omitempty"`
+	Siblings    []Version `json:"siblings"`
+	// Context is passed back in a following write to supersede the values read.
+	Context vclock.VClock `json:"context"`
+}
+
+// WriteRequest is the body accepted by PUT and DELETE /v1/kv/{key} and
+// POST /v1/cas/{key}.
+type WriteRequest struct {
+	Value       string `json:"value"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	// Context is the context of a read, whose values the write supersedes.
+	// Without one, the node reads the current context of the key first, so
+	// that the write supersedes whatever the key holds.
+	Context vclock.VClock `json:"context,omitempty"`
+	// Expected is the version a compare-and-swap requires: a context
+	// returned by a read, or null if the key must not exist.
+	Expected vclock.VClock `json:"expected,omitempty"`
+	TTL      string        `json:"ttl,omitempty"` // a Go duration such as "30s"
+}
+
+// BatchRequest is the body accepted by POST /v1/batch.
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// BatchOp is one write of a batch.
+type BatchOp struct {
+	Key         string        `json:"key"`
+	Value       string        `json:"value"`
+	ValueBase64 []byte        `json:"value_base64,omitempty"`
+	Delete      bool          `json:"delete,omitempty"`
+	TTL         string        `json:"ttl,omitempty"`
+	Check       bool          `json:"check,omitempty"`
+	Expected    vclock.VClock `json:"expected,omitempty"`
+}
+
+// Entry is a key returned by a scan.
+type Entry struct {
+	Key      string    `json:"key"`
+	Siblings []Version `json:"siblings"`
+}
+
+// WatchEvent is a change returned by GET /v1/watch.
+type WatchEvent struct {
+	Revision uint64    `json:"revision"`
+	Key      string    `json:"key"`
+	Type     string    `json:"type"`
+	Siblings []Version `json:"siblings"`
+}
+
+// WatchResponse is the body returned by GET /v1/watch.
+type WatchResponse struct {
+	Events []WatchEvent `json:"events"`
+	// Revision is passed as the revision parameter of the next call.
+	Revision uint64 `json:"revision"`
+}
+
+// StatusResponse is the body returned by GET /v1/status.
+type StatusResponse struct {
+	Self         string    `json:"self"`
+	N            int       `json:"n"`
+	R            int       `json:"r"`
+	W            int       `json:"w"`
+	VirtualNodes int       `json:"virtual_nodes"`
+	Nodes        []string  `json:"nodes"`
+	Members      []Member  `json:"members"`
+	Keys         int       `json:"keys"`
+	Revision     uint64    `json:"revision"`
+	PendingHints int       `json:"pending_hints"`
+	Rebalance    Rebalance `json:"rebalance"`
+}
+
+// Rebalance is the progress of a node's latest rebalance.
+type Rebalance struct {
+	Active      bool       `json:"active"`
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Ranges      int        `json:"ranges"`
+	RangesDone  int        `json:"ranges_done"`
+	KeysSent    int        `json:"keys_sent"`
+	KeysDropped int        `json:"keys_dropped"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Member is a cluster member as seen by the node.
+type Member struct {
+	Addr        string `json:"addr"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// Handler returns the HTTP handler for the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", s.handleKey)
+	mux.HandleFunc("/v1/blob/", s.handleBlob)
+	mux.HandleFunc("/v1/cas/", s.handleCAS)
+	mux.HandleFunc("/v1/batch", s.handleBatch)
+	mux.HandleFunc("/v1/scan", s.handleScan)
+	mux.HandleFunc("/v1/watch", s.handleWatch)
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	return mux
+}
+
+// ListenAndServe serves the API on addr until an error occurs.
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// handleKey reads, writes and deletes a single key.
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var reply rpc.Reply
+		err := s.Cluster.Get(&rpc.Args{Key: key, Policy: r.URL.Query().Get("policy")}, &reply)
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		resp := GetResponse{Key: key, Siblings: versions(reply.Siblings), Context: reply.Context}
+		if len(reply.Siblings) == 1 {
+			resp.Value, resp.ValueBase64 = encodeValue(reply.Siblings[0].Value)
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case "PUT":
+		req, ttl, ok := readWrite(w, r)
+		if !ok {
+			return
+		}
+		var reply rpc.Reply
+		if err := s.Cluster.Put(&rpc.Args{Key: key, Value: bytesOf(req.Value, req.ValueBase64), Context: req.Context, TTL: ttl}, &reply); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		req, _, ok := readWrite(w, r)
+		if !ok {
+			return
+		}
+		var reply rpc.Reply
+		if err := s.Cluster.Delete(&rpc.Args{Key: key, Context: req.Context}, &reply); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleBlob streams the raw value of a key. GET writes the value as the
+// response body and its context, as JSON, in the X-Context header. PUT
+// stores the request body, superseding the context in the X-Context
+// header, or the current value without one, with an optional ttl query
+// parameter.
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/blob/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		args := &cluster.DownloadArgs{Key: key, Policy: r.URL.Query().Get("policy"), Length: blobChunkSize}
+		var reply cluster.DownloadReply
+		if err := s.Cluster.Download(args, &reply); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		ctx, _ := json.Marshal(reply.Context)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(reply.Size))
+		w.Header().Set("X-Context", string(ctx))
+		for offset := 0; ; {
+			if _, err := w.Write(reply.Data); err != nil {
+				return // the client went away; the download expires
+			}
+			if offset += len(reply.Data); offset >= reply.Size {
+				return
+			}
+			args = &cluster.DownloadArgs{ID: reply.ID, Offset: offset, Length: blobChunkSize}
+			reply = cluster.DownloadReply{}
+			if err := s.Cluster.Download(args, &reply); err != nil {
+				log.Printf("Error streaming %s: %v\n", key, err)
+				return
+			}
+		}
+
+	case "PUT":
+		var ctx vclock.VClock
+		if h := r.Header.Get("X-Context"); h != "" {
+			if err := json.Unmarshal([]byte(h), &ctx); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid X-Context header: %w", err))
+				return
+			}
+		}
+		ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var upload cluster.UploadReply
+		buf := make([]byte, blobChunkSize)
+		for {
+			n, readErr := io.ReadFull(r.Body, buf)
+			if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read body: %w", readErr))
+				return
+			}
+			if n > 0 || upload.ID == "" {
+				if err := s.Cluster.Upload(&cluster.UploadArgs{ID: upload.ID, Data: buf[:n]}, &upload); err != nil {
+					writeError(w, statusOf(err), err)
+					return
+				}
+			}
+			if readErr != nil {
+				break
+			}
+		}
+		var reply rpc.Reply
+		if err := s.Cluster.Put(&rpc.Args{Key: key, Upload: upload.ID, Context: ctx, TTL: ttl}, &reply); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// blobChunkSize is how much of a raw value is moved at a time.
+const blobChunkSize = 1 << 20
+
+// handleCAS writes a key if it is still at the expected version.
+func (s *Server) handleCAS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/cas/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+	req, ttl, ok := readWrite(w, r)
+	if !ok {
+		return
+	}
+	var reply rpc.Reply
+	if err := s.Cluster.CompareAndSwap(&rpc.Args{Key: key, Value: bytesOf(req.Value, req.ValueBase64), Expected: req.Expected, TTL: ttl}, &reply); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBatch applies a set of writes atomically.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+
+	args := &rpc.BatchArgs{Ops: make([]rpc.Op, len(req.Ops))}
+	for i, op := range req.Ops {
+		ttl, err := parseTTL(op.TTL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		args.Ops[i] = rpc.Op{
+			Args:   rpc.Args{Key: op.Key, Value: bytesOf(op.Value, op.ValueBase64), Expected: op.Expected, TTL: ttl},
+			Delete: op.Delete,
+			Check:  op.Check,
+		}
+	}
+	var reply rpc.Reply
+	if err := s.Cluster.Batch(args, &reply); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleScan lists keys in a range or with a prefix.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	q := r.URL.Query()
+	args := &rpc.ScanArgs{Prefix: q.Get("prefix"), Start: q.Get("start"), End: q.Get("end"), Policy: q.Get("policy"), Limit: 100}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+		args.Limit = n
+	}
+
+	var reply rpc.ScanReply
+	if err := s.Cluster.Scan(args, &reply); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	entries := make([]Entry, len(reply.Entries))
+	for i, e := range reply.Entries {
+		entries[i] = Entry{Key: e.Key, Siblings: versions(e.Siblings)}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleWatch long-polls the change log of this node.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	q := r.URL.Query()
+	args := &rpc.WatchArgs{Key: q.Get("key"), Prefix: q.Get("prefix"), Timeout: 30 * time.Second}
+	var err error
+	if v := q.Get("revision"); v != "" {
+		if args.Revision, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid revision %q", v))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if args.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if args.Timeout, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", v))
+			return
+		}
+	}
+
+	var reply rpc.WatchReply
+	if err := s.KV.Watch(args, &reply); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	resp := WatchResponse{Events: make([]WatchEvent, len(reply.Events)), Revision: reply.Revision}
+	for i, e := range reply.Events {
+		resp.Events[i] = WatchEvent{Revision: e.Revision, Key: e.Key, Type: string(e.Type), Siblings: versions(e.Siblings)}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStatus reports the node's view of the cluster.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var reply cluster.StatusReply
+	if err := s.Cluster.Status(&cluster.StatusArgs{Verbose: true}, &reply); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	resp := StatusResponse{
+		Self:         reply.Self,
+		N:            reply.N,
+		R:            reply.R,
+		W:            reply.W,
+		VirtualNodes: reply.VirtualNodes,
+		Nodes:        reply.Nodes,
+		Members:      make([]Member, len(reply.Members)),
+		Keys:         reply.Keys,
+		Revision:     reply.Revision,
+		PendingHints: reply.PendingHints,
+		Rebalance: Rebalance{
+			Active:      reply.Rebalance.Active,
+			Ranges:      reply.Rebalance.Ranges,
+			RangesDone:  reply.Rebalance.RangesDone,
+			KeysSent:    reply.Rebalance.KeysSent,
+			KeysDropped: reply.Rebalance.KeysDropped,
+			Error:       reply.Rebalance.Error,
+		},
+	}
+	if t := reply.Rebalance.Started; !t.IsZero() {
+		resp.Rebalance.Started = &t
+	}
+	if t := reply.Rebalance.Finished; !t.IsZero() {
+		resp.Rebalance.Finished = &t
+	}
+	for i, m := range reply.Members {
+		resp.Members[i] = Member{Addr: m.Addr, State: m.State.String(), Incarnation: m.Incarnation}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleMetrics exposes the node's metrics to Prometheus.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := s.Metrics.WritePrometheus(w); err != nil {
+		log.Printf("Error writing metrics: %v\n", err)
+	}
+}
+
+// handleHealth reports that the process is up.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether the node can serve requests.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.Ready != nil {
+		if err := s.Ready(); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// readWrite decodes an optional WriteRequest body, writing an error
+// response if it is invalid.
+func readWrite(w http.ResponseWriter, r *http.Request) (WriteRequest, time.Duration, bool) {
+	var req WriteRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+			return req, 0, false
+		}
+	}
+	ttl, err := parseTTL(req.TTL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return req, 0, false
+	}
+	return req, ttl, true
+}
+
+// parseTTL parses an optional duration.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return ttl, nil
+}
+
+// versions converts store versions for the API.
+func versions(siblings []store.Versioned) []Version {
+	out := make([]Version, len(siblings))
+	for i, v := range siblings {
+		out[i] = Version{Clock: v.Clock, Timestamp: v.Timestamp, Deleted: v.Deleted, ExpiresAt: v.ExpiresAt}
+		out[i].Value, out[i].ValueBase64 = encodeValue(v.Value)
+	}
+	return out
+}
+
+// encodeValue returns a value as a string if it is valid UTF-8, and as
+// bytes to be base64-encoded otherwise.
+func encodeValue(b []byte) (*string, []byte) {
+	if utf8.Valid(b) {
+		s := string(b)
+		return &s, nil
+	}
+	return nil, b
+}
+
+// bytesOf returns the value of a write, preferring the base64 form.
+func bytesOf(s string, b []byte) []byte {
+	if b != nil {
+		return b
+	}
+	return []byte(s)
+}
+
+// statusOf maps an error from the store or cluster to an HTTP status.
+func statusOf(err error) int {
+	switch cluster.Result(err) {
+	case "not_found":
+		return http.StatusNotFound
+	case "conflict":
+		return http.StatusConflict
+	case "locked":
+		return http.StatusLocked
+	case "quorum_failed":
+		return http.StatusServiceUnavailable
+	case "too_large":
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, store.ErrCompacted) {
+		return http.StatusGone
+	}
+	return http.StatusInternalServerError
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// writeError writes err as a JSON error response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,93 @@
+package httpapi
+
+import (
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/ring"
+	"distributed-kv-store/store"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves the API of a cluster of one node.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	r := ring.New(0)
+	r.Add("self")
+	c := cluster.NewCoordinator(cluster.Config{Self: "self", N: 1, R: 1, W: 1}, r, store.NewStore())
+	srv := httptest.NewServer((&Server{Cluster: cluster.NewService(c, nil, nil)}).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// do sends a request and checks its status, returning the response body.
+func do(t *testing.T, method, url, body string, header http.Header, want int) []byte {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, url, resp.StatusCode, want, data)
+	}
+	return data
+}
+
+// getValues returns the values of the siblings of key.
+func getValues(t *testing.T, srv *httptest.Server, key string) []string {
+	t.Helper()
+	var resp GetResponse
+	if err := json.Unmarshal(do(t, "GET", srv.URL+"/v1/kv/"+key, "", nil, http.StatusOK), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, v := range resp.Siblings {
+		values = append(values, *v.Value)
+	}
+	return values
+}
+
+func TestWritesWithoutContext(t *testing.T) {
+	srv := newTestServer(t)
+	for _, value := range []string{"a", "b"} {
+		do(t, "PUT", srv.URL+"/v1/kv/k", `{"value":"`+value+`"}`, nil, http.StatusNoContent)
+		if got := getValues(t, srv, "k"); len(got) != 1 || got[0] != value {
+			t.Fatalf("after PUT %s without a context, values = %q", value, got)
+		}
+	}
+
+	do(t, "PUT", srv.URL+"/v1/blob/k", "c", nil, http.StatusNoContent)
+	if got := string(do(t, "GET", srv.URL+"/v1/blob/k", "", nil, http.StatusOK)); got != "c" {
+		t.Fatalf("after a blob PUT without a context, value = %q", got)
+	}
+
+	do(t, "DELETE", srv.URL+"/v1/kv/k", "", nil, http.StatusNoContent)
+	do(t, "GET", srv.URL+"/v1/kv/k", "", nil, http.StatusNotFound)
+}
+
+func TestWritesWithContext(t *testing.T) {
+	srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/v1/kv/k", `{"value":"a"}`, nil, http.StatusNoContent)
+	var resp GetResponse
+	json.Unmarshal(do(t, "GET", srv.URL+"/v1/kv/k", "", nil, http.StatusOK), &resp)
+	ctx, _ := json.Marshal(resp.Context)
+
+	do(t, "PUT", srv.URL+"/v1/blob/k", "b", http.Header{"X-Context": {string(ctx)}}, http.StatusNoContent)
+	if got := getValues(t, srv, "k"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("after a blob PUT with the context read, values = %q", got)
+	}
+	do(t, "PUT", srv.URL+"/v1/blob/k", "c", http.Header{"X-Context": {"not json"}}, http.StatusBadRequest)
+	do(t, "PUT", srv.URL+"/v1/kv/k", `{"value":"c","ttl":"soon"}`, nil, http.StatusBadRequest)
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"distributed-kv-store/cluster"
+	"distributed-kv-store/httpapi"
+	"distributed-kv-store/membership"
+	"distributed-kv-store/metrics"
+	"distributed-kv-store/ring"
 	"distributed-kv-store/rpc"
 	"distributed-kv-store/store"
 	"flag"
@@ -9,19 +14,84 @@ import (
 	"net"
 	stdrpc "net/rpc"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
-	peersStr := flag.String("peers", "", "Comma-separated list of peer addresses (e.g., localhost:8081,localhost:8082)")
+	addr := flag.String("addr", "", "Address other nodes use to reach this node (default localhost:<port>)")
+	joinStr := flag.String("join", "", "Comma-separated list of seed nodes to join the cluster through (e.g., localhost:8081,localhost:8082)")
+	replicas := flag.Int("n", 3, "Replication factor: number of nodes that store each key")
+	readQuorum := flag.Int("r", 2, "Number of replicas that must answer a read")
+	writeQuorum := flag.Int("w", 2, "Number of replicas that must acknowledge a write")
+	vnodes := flag.Int("vnodes", ring.DefaultVirtualNodes, "Virtual nodes per node on the hash ring")
+	timeout := flag.Duration("timeout", 2*time.Second, "Timeout for requests to replicas")
+	policy := flag.String("conflict", store.PolicyMerge, "Default conflict resolution for client reads with concurrent versions (merge, lww)")
+	dataDir := flag.String("data-dir", "", "Directory for the durable append-only log (default: keep data in memory)")
+	syncWrites := flag.Bool("sync", false, "Flush the log to disk after every write")
+	compressThreshold := flag.Int("compress-threshold", 0, "Compress values in the log whose encoded versions exceed this many bytes (0 disables compression)")
+	compactInterval := flag.Duration("compact-interval", time.Minute, "How often to check whether the log needs compaction")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Second, "How often to purge expired keys and old tombstones")
+	tombstoneGrace := flag.Duration("tombstone-grace", time.Hour, "How long deleted keys keep their tombstones before being purged")
+	hintInterval := flag.Duration("hint-interval", 5*time.Second, "How often writes queued for unreachable replicas are retried")
+	antiEntropyInterval := flag.Duration("anti-entropy-interval", 30*time.Second, "How often replicas compare Merkle trees (0 disables anti-entropy)")
+	probeInterval := flag.Duration("probe-interval", time.Second, "How often a random member is probed for failure detection")
+	httpAddr := flag.String("http", "", "Address to serve the HTTP/JSON API, metrics and health checks on (e.g., :9080; default: disabled)")
+	suspectTimeout := flag.Duration("suspect-timeout", 5*time.Second, "How long a member stays suspect before it is declared dead")
+	rebalanceDelay := flag.Duration("rebalance-delay", 2*time.Second, "How long membership must be stable before keys move to their new owners")
+	transferBatch := flag.Int("transfer-batch", 100, "Keys sent per request when moving keys between nodes")
+	maxKeySize := flag.Int("max-key-size", cluster.DefaultMaxKeySize, "Longest key clients may write, in bytes")
+	maxValueSize := flag.Int("max-value-size", cluster.DefaultMaxValueSize, "Largest value clients may write, in bytes")
+	restore := flag.String("restore", "", "Comma-separated backups to restore into the store, in order, before joining the cluster")
+	backupDir := flag.String("backup-dir", "", "Directory that backups and restores requested over RPC use, by file name (default: refuse them)")
+	transferRate := flag.Int("transfer-rate", 0, "Keys moved per second when rebalancing (0 means no limit)")
 	flag.Parse()
 
+	self := *addr
+	if self == "" {
+		self = fmt.Sprintf("localhost:%d", *port)
+	}
+
 	// Initialize the local key-value store
 	localStore := store.NewStore()
+	if *dataDir != "" {
+		engine, err := store.OpenLogEngine(*dataDir, store.LogOptions{
+			SyncWrites:        *syncWrites,
+			CompactInterval:   *compactInterval,
+			CompressThreshold: *compressThreshold,
+		})
+		if err != nil {
+			log.Fatalf("Error opening data directory: %v", err)
+		}
+		localStore, err = store.New(engine)
+		if err != nil {
+			log.Fatalf("Error loading store: %v", err)
+		}
+		log.Printf("Storing data in %s\n", *dataDir)
+	}
+	for _, path := range strings.Split(*restore, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		header, n, err := localStore.RestoreFile(path)
+		if err != nil {
+			log.Fatalf("Error restoring backup: %v", err)
+		}
+		log.Printf("Restored %d keys from %s, taken %s\n", n, path, header.Created.Format(time.RFC3339))
+	}
+	localStore.StartSweeper(*sweepInterval, *tombstoneGrace)
 
 	// Register the RPC server
 	kvRPC := rpc.NewKVStore(localStore)
+	if *backupDir != "" {
+		if err := os.MkdirAll(*backupDir, 0755); err != nil {
+			log.Fatalf("Error creating backup directory: %v", err)
+		}
+		kvRPC.SetBackupDir(*backupDir)
+	}
 	stdrpc.Register(kvRPC)
 
 	// Start listening for RPC connections
@@ -33,10 +103,77 @@ func main() {
 
 	log.Printf("Node listening on port %d\n", *port)
 
-	// Handle peer connections (simplified replication)
-	peers := []string{}
-	if *peersStr != "" {
-		peers = strings.Split(*peersStr, ",")
+	// Keep the hash ring in step with the live members of the cluster, and
+	// move keys to their new owners whenever it changes
+	hashRing := ring.New(*vnodes)
+	hashRing.Add(self)
+	var coordinator *cluster.Coordinator
+	members := membership.New(membership.Config{
+		Self:           self,
+		ProbeInterval:  *probeInterval,
+		ProbeTimeout:   *probeInterval / 2,
+		SuspectTimeout: *suspectTimeout,
+		OnChange: func(m membership.Member) {
+			switch m.State {
+			case membership.Alive, membership.Suspect:
+				hashRing.Add(m.Addr)
+			case membership.Dead, membership.Left:
+				hashRing.Remove(m.Addr)
+			}
+			if coordinator != nil {
+				coordinator.RingChanged()
+			}
+		},
+	})
+	stdrpc.RegisterName("Gossip", membership.NewService(members))
+
+	cfg := cluster.Config{
+		Self:                self,
+		N:                   *replicas,
+		R:                   *readQuorum,
+		W:                   *writeQuorum,
+		Timeout:             *timeout,
+		Policy:              *policy,
+		HintInterval:        *hintInterval,
+		AntiEntropyInterval: *antiEntropyInterval,
+		RebalanceDelay:      *rebalanceDelay,
+		TransferBatch:       *transferBatch,
+		TransferRate:        *transferRate,
+		MaxKeySize:          *maxKeySize,
+		MaxValueSize:        *maxValueSize,
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid replication settings: %v", err)
+	}
+	coordinator = cluster.NewCoordinator(cfg, hashRing, localStore)
+	reg := metrics.New()
+	clusterService := cluster.NewService(coordinator, members, reg)
+	stdrpc.RegisterName("Cluster", clusterService)
+	coordinator.Start()
+
+	if *httpAddr != "" {
+		registerGauges(reg, localStore, coordinator, hashRing, members)
+		api := &httpapi.Server{
+			Cluster: clusterService,
+			KV:      kvRPC,
+			Metrics: reg,
+			Ready: func() error {
+				needed := cfg.R
+				if cfg.W > needed {
+					needed = cfg.W
+				}
+				if n := len(hashRing.Nodes()); n < needed {
+					return fmt.Errorf("only %d nodes on the ring, need %d for quorum", n, needed)
+				}
+				return nil
+			},
+		}
+		go func() {
+			log.Printf("Serving HTTP API on %s\n", *httpAddr)
+			if err := api.ListenAndServe(*httpAddr); err != nil {
+				log.Fatalf("Error serving HTTP API: %v", err)
+			}
+		}()
 	}
 
 	go func() {
@@ -50,57 +187,67 @@ func main() {
 		}
 	}()
 
-	// Simple client for testing (can be expanded into a separate client CLI)
-	if len(flag.Args()) > 0 {
-		command := flag.Args()[0]
-		switch command {
-		case "put":
-			if len(flag.Args()) < 3 {
-				fmt.Println("Usage: go run main.go -port <port> put <key> <value>")
-				os.Exit(1)
-			}
-			key := flag.Args()[1]
-			value := flag.Args()[2]
-
-			// Simulate replication to peers
-			for _, peerAddr := range peers {
-				client, err := stdrpc.Dial("tcp", peerAddr)
-				if err != nil {
-					log.Printf("Error connecting to peer %s: %v\n", peerAddr, err)
-					continue
-				}
-				defer client.Close()
-
-				args := rpc.Args{Key: key, Value: value}
-				var reply rpc.Reply
-				err = client.Call("KVStore.Put", args, &reply)
-				if err != nil {
-					log.Printf("Error replicating Put to %s: %v\n", peerAddr, err)
-				} else {
-					log.Printf("Replicated Put to %s: %s\n", peerAddr, reply.Value)
-				}
-			}
-			// Also put to local store
-			localStore.Put(key, value)
-			fmt.Printf("Put %s=%s locally and replicated.\n", key, value)
-
-		case "get":
-			if len(flag.Args()) < 2 {
-				fmt.Println("Usage: go run main.go -port <port> get <key>")
-				os.Exit(1)
-			}
-			key := flag.Args()[1]
-			val, err := localStore.Get(key)
-			if err != nil {
-				fmt.Printf("Error getting key %s: %v\n", key, err)
-			} else {
-				fmt.Printf("Get %s=%s\n", key, val)
-			}
-		default:
-			fmt.Println("Unknown command. Use 'put' or 'get'.")
+	// Join the cluster through the seed nodes and start failure detection
+	var seeds []string
+	if *joinStr != "" {
+		for _, seed := range strings.Split(*joinStr, ",") {
+			seeds = append(seeds, strings.TrimSpace(seed))
 		}
 	}
+	if err := members.Join(seeds); err != nil {
+		log.Printf("Error joining cluster, starting alone until another node joins us: %v\n", err)
+	}
+	members.Start()
+
+	// Close the store cleanly on interrupt so the log is flushed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := coordinator.Drain(); err != nil {
+			log.Printf("Error moving keys to other nodes before leaving: %v\n", err)
+		}
+		members.Leave()
+		coordinator.Stop()
+		if err := localStore.Close(); err != nil {
+			log.Printf("Error closing store: %v\n", err)
+		}
+		os.Exit(0)
+	}()
 
 	// Keep the main goroutine alive for the server to run
 	select {}
-}
\ No newline at end of file
+}
+
+// registerGauges exposes the size of the keyspace and the state of the
+// cluster as metrics.
+func registerGauges(reg *metrics.Registry, s *store.Store, c *cluster.Coordinator, r *ring.Ring, members *membership.List) {
+	reg.Gauge("kv_keys", "Keys held by this node, including keys with only tombstones left.", func() float64 {
+		return float64(s.Len())
+	})
+	reg.Gauge("kv_revision", "Revision of the latest change to this node's store.", func() float64 {
+		return float64(s.Revision())
+	})
+	reg.Gauge("kv_pending_hints", "Writes queued for unreachable replicas.", func() float64 {
+		return float64(c.PendingHints())
+	})
+	reg.Gauge("kv_rebalance_active", "Whether keys are being moved to their new owners.", func() float64 {
+		if c.Rebalance().Active {
+			return 1
+		}
+		return 0
+	})
+	reg.Gauge("kv_rebalance_keys_sent", "Keys sent to their new owners in the latest rebalance.", func() float64 {
+		return float64(c.Rebalance().KeysSent)
+	})
+	reg.Gauge("kv_ring_nodes", "Nodes on the hash ring.", func() float64 {
+		return float64(len(r.Nodes()))
+	})
+	reg.GaugeVec("kv_members", "Cluster members by state.", "state", func() map[string]float64 {
+		counts := make(map[string]float64)
+		for _, m := range members.Members() {
+			counts[m.State.String()]++
+		}
+		return counts
+	})
+}
@@ -0,0 +1,510 @@
+package membership
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	stdrpc "net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the health of a member as seen by this node.
+type State int
+
+const (
+	Alive   State = iota // answering probes
+	Suspect              // missed a probe; will be declared dead unless it refutes
+	Dead                 // confirmed unreachable
+	Left                 // left the cluster gracefully
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Member is a node of the cluster and what is known about its health.
+// Incarnation is bumped only by the member itself, to refute suspicion.
+type Member struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// Config configures the membership protocol.
+type Config struct {
+	Self           string        // address of this node
+	ProbeInterval  time.Duration // time between probes of random members
+	ProbeTimeout   time.Duration // how long to wait for a direct or indirect ack
+	IndirectProbes int           // members asked to probe a target that missed a direct ping
+	SuspectTimeout time.Duration // how long a member stays suspect before it is declared dead
+	// OnChange is called, without locks held, whenever a member's state changes.
+	OnChange func(Member)
+}
+
+// update is a membership change waiting to be piggybacked on messages.
+type update struct {
+	member    Member
+	transmits int
+}
+
+// List is a SWIM-style membership list. Every probe interval it pings a
+// member; a member that does not answer, directly or through other
+// members, becomes suspect and is declared dead after a timeout unless it
+// refutes the suspicion. Changes spread by piggybacking on pings. Each
+// round of probes also pings one dead member, so that a member declared
+// dead while it was cut off learns of it once it is reachable again and
+// refutes it.
+type List struct {
+	cfg Config
+
+	mu        sync.Mutex
+	members   map[string]*Member
+	suspected map[string]time.Time // when each suspect member was suspected
+	updates   []*update
+	probeList []string
+	probeIdx  int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a membership list containing only this node.
+func New(cfg Config) *List {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 500 * time.Millisecond
+	}
+	if cfg.IndirectProbes <= 0 {
+		cfg.IndirectProbes = 3
+	}
+	if cfg.SuspectTimeout <= 0 {
+		cfg.SuspectTimeout = 5 * cfg.ProbeInterval
+	}
+
+	l := &List{
+		cfg:       cfg,
+		members:   make(map[string]*Member),
+		suspected: make(map[string]time.Time),
+	}
+	// Starting from the clock makes a restarted node's incarnation higher
+	// than whatever the cluster remembers about its previous life.
+	self := &Member{Addr: cfg.Self, State: Alive, Incarnation: uint64(time.Now().Unix())}
+	l.members[cfg.Self] = self
+	l.enqueue(*self)
+	return l
+}
+
+// Members returns every known member, including dead ones, sorted by address.
+func (l *List) Members() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	members := make([]Member, 0, len(l.members))
+	for _, m := range l.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+// Live returns the addresses of the members that are alive or suspect.
+func (l *List) Live() []string {
+	var live []string
+	for _, m := range l.Members() {
+		if m.State == Alive || m.State == Suspect {
+			live = append(live, m.Addr)
+		}
+	}
+	return live
+}
+
+// Join contacts the seed nodes and merges their member lists. It succeeds
+// if at least one seed answers; an empty seed list starts a new cluster.
+func (l *List) Join(seeds []string) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	joined := 0
+	var lastErr error
+	for _, seed := range seeds {
+		if seed == "" || seed == l.cfg.Self {
+			continue
+		}
+		var reply JoinReply
+		if err := l.call(seed, "Gossip.Join", &JoinArgs{Member: l.self()}, &reply); err != nil {
+			lastErr = err
+			log.Printf("Error joining through %s: %v\n", seed, err)
+			continue
+		}
+		l.merge(reply.Members)
+		joined++
+	}
+	if joined == 0 && lastErr != nil {
+		return fmt.Errorf("no seed node answered: %w", lastErr)
+	}
+	return nil
+}
+
+// Start runs the failure detector in the background until Leave or Stop.
+func (l *List) Start() {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(l.cfg.ProbeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.probe()
+				l.expireSuspects()
+			}
+		}
+	}()
+}
+
+// Stop ends the failure detector without telling the cluster.
+func (l *List) Stop() {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+}
+
+// Leave tells a few members that this node is leaving and stops probing.
+func (l *List) Leave() {
+	l.mu.Lock()
+	self := l.members[l.cfg.Self]
+	self.Incarnation++
+	self.State = Left
+	l.enqueue(*self)
+	l.mu.Unlock()
+
+	for _, addr := range l.randomMembers(l.cfg.IndirectProbes, "") {
+		var reply PingReply
+		l.call(addr, "Gossip.Ping", l.pingArgs(addr), &reply)
+	}
+	l.Stop()
+}
+
+// self returns this node's own entry.
+func (l *List) self() Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return *l.members[l.cfg.Self]
+}
+
+// probe pings the next member in the shuffled probe order, falling back to
+// indirect probes, and suspects it if nobody gets an answer.
+func (l *List) probe() {
+	target, ok := l.nextTarget()
+	if !ok {
+		return
+	}
+
+	var reply PingReply
+	err := l.call(target, "Gossip.Ping", l.pingArgs(target), &reply)
+	if err == nil {
+		l.merge(reply.Updates)
+		l.heardFrom(target, reply.Incarnation)
+		return
+	}
+	l.mu.Lock()
+	dead := l.members[target].State == Dead
+	l.mu.Unlock()
+	if dead {
+		return // still unreachable, as expected
+	}
+
+	acks := make(chan bool, l.cfg.IndirectProbes)
+	helpers := l.randomMembers(l.cfg.IndirectProbes, target)
+	for _, helper := range helpers {
+		go func(helper string) {
+			var reply PingReply
+			err := l.call(helper, "Gossip.PingReq", &PingReqArgs{From: l.cfg.Self, Target: target, Updates: l.piggyback()}, &reply)
+			if err == nil {
+				l.merge(reply.Updates)
+			}
+			acks <- err == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+
+	l.mu.Lock()
+	m, ok := l.members[target]
+	if !ok || m.State != Alive {
+		l.mu.Unlock()
+		return
+	}
+	suspect := Member{Addr: target, State: Suspect, Incarnation: m.Incarnation}
+	l.mu.Unlock()
+
+	log.Printf("Member %s did not answer probes, suspecting it\n", target)
+	l.merge([]Member{suspect})
+}
+
+// nextTarget returns the next member to probe, reshuffling the probe order
+// after every full round. Each round holds the live members and one random
+// dead member.
+func (l *List) nextTarget() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for l.probeIdx < len(l.probeList) {
+			addr := l.probeList[l.probeIdx]
+			l.probeIdx++
+			if m, ok := l.members[addr]; ok && m.State != Left {
+				return addr, true
+			}
+		}
+
+		l.probeList = l.probeList[:0]
+		var dead []string
+		for addr, m := range l.members {
+			switch {
+			case addr == l.cfg.Self:
+			case m.State == Alive || m.State == Suspect:
+				l.probeList = append(l.probeList, addr)
+			case m.State == Dead:
+				dead = append(dead, addr)
+			}
+		}
+		if len(dead) > 0 {
+			l.probeList = append(l.probeList, dead[rand.Intn(len(dead))])
+		}
+		rand.Shuffle(len(l.probeList), func(i, j int) {
+			l.probeList[i], l.probeList[j] = l.probeList[j], l.probeList[i]
+		})
+		l.probeIdx = 0
+	}
+	return "", false
+}
+
+// randomMembers returns up to k random live members other than this node and exclude.
+func (l *List) randomMembers(k int, exclude string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var candidates []string
+	for addr, m := range l.members {
+		if addr != l.cfg.Self && addr != exclude && m.State == Alive {
+			candidates = append(candidates, addr)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// expireSuspects declares dead every member that stayed suspect for too long.
+func (l *List) expireSuspects() {
+	l.mu.Lock()
+	var dead []Member
+	for addr, since := range l.suspected {
+		if time.Since(since) < l.cfg.SuspectTimeout {
+			continue
+		}
+		if m, ok := l.members[addr]; ok && m.State == Suspect {
+			dead = append(dead, Member{Addr: addr, State: Dead, Incarnation: m.Incarnation})
+		}
+	}
+	l.mu.Unlock()
+
+	for _, m := range dead {
+		log.Printf("Member %s stayed suspect for %v, declaring it dead\n", m.Addr, l.cfg.SuspectTimeout)
+	}
+	l.merge(dead)
+}
+
+// merge applies membership updates using SWIM's precedence rules and
+// queues the ones that changed something for further gossip.
+func (l *List) merge(updates []Member) {
+	var changed []Member
+
+	l.mu.Lock()
+	for _, u := range updates {
+		if u.Addr == l.cfg.Self {
+			// Refute any rumour that this node is suspect or dead.
+			self := l.members[l.cfg.Self]
+			if u.State != Alive && self.State != Left && u.Incarnation >= self.Incarnation {
+				self.Incarnation = u.Incarnation + 1
+				l.enqueue(*self)
+				log.Printf("Refuting %s rumour about this node with incarnation %d\n", u.State, self.Incarnation)
+			}
+			continue
+		}
+
+		cur, ok := l.members[u.Addr]
+		if ok && !overrides(u, *cur) {
+			continue
+		}
+		m := u
+		l.members[u.Addr] = &m
+		if m.State == Suspect {
+			if _, already := l.suspected[m.Addr]; !already {
+				l.suspected[m.Addr] = time.Now()
+			}
+		} else {
+			delete(l.suspected, m.Addr)
+		}
+		l.enqueue(m)
+		if !ok || cur.State != m.State {
+			changed = append(changed, m)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, m := range changed {
+		log.Printf("Member %s is now %s (incarnation %d)\n", m.Addr, m.State, m.Incarnation)
+		if l.cfg.OnChange != nil {
+			l.cfg.OnChange(m)
+		}
+	}
+}
+
+// pingArgs returns a probe of target with piggybacked updates. If target is
+// thought to be suspect or dead, the probe says so, so that a target that
+// is in fact alive refutes it in its reply.
+func (l *List) pingArgs(target string) *PingArgs {
+	updates := l.piggyback()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m, ok := l.members[target]; ok && (m.State == Suspect || m.State == Dead) {
+		updates = append(updates, *m)
+	}
+	return &PingArgs{From: l.cfg.Self, Incarnation: l.members[l.cfg.Self].Incarnation, Updates: updates}
+}
+
+// heardFrom records that addr answered, or sent a probe, at incarnation.
+// That refutes a rumour of it being suspect or dead at an older
+// incarnation. If a rumour about addr still stands, heardFrom returns it,
+// to be sent back so that addr can refute it.
+func (l *List) heardFrom(addr string, incarnation uint64) []Member {
+	if addr == "" || addr == l.cfg.Self {
+		return nil
+	}
+	l.merge([]Member{{Addr: addr, State: Alive, Incarnation: incarnation}})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m, ok := l.members[addr]; ok && m.State != Alive {
+		return []Member{*m}
+	}
+	return nil
+}
+
+// overrides reports whether update u should replace the current entry cur.
+func overrides(u, cur Member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > cur.Incarnation
+	case Suspect:
+		if cur.State == Alive {
+			return u.Incarnation >= cur.Incarnation
+		}
+		return u.Incarnation > cur.Incarnation && cur.State == Suspect
+	default: // Dead or Left
+		if cur.State == Dead || cur.State == Left {
+			return u.Incarnation > cur.Incarnation
+		}
+		return u.Incarnation >= cur.Incarnation
+	}
+}
+
+// enqueue schedules m to be piggybacked on outgoing messages, replacing any
+// older pending update about the same member. The caller must hold l.mu.
+func (l *List) enqueue(m Member) {
+	for i, u := range l.updates {
+		if u.member.Addr == m.Addr {
+			l.updates = append(l.updates[:i], l.updates[i+1:]...)
+			break
+		}
+	}
+	l.updates = append(l.updates, &update{member: m})
+}
+
+// maxPiggyback is the number of updates attached to a single message.
+const maxPiggyback = 16
+
+// piggyback returns the updates to attach to an outgoing message. Each
+// update is sent a number of times that grows with the log of the cluster
+// size, which is enough for it to reach every member with high probability.
+func (l *List) piggyback() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := 3
+	for n := len(l.members); n > 1; n /= 2 {
+		limit++
+	}
+
+	// Least-transmitted updates go first.
+	sort.SliceStable(l.updates, func(i, j int) bool { return l.updates[i].transmits < l.updates[j].transmits })
+
+	var out []Member
+	kept := l.updates[:0]
+	for _, u := range l.updates {
+		if len(out) < maxPiggyback {
+			out = append(out, u.member)
+			u.transmits++
+		}
+		if u.transmits < limit {
+			kept = append(kept, u)
+		}
+	}
+	l.updates = kept
+	return out
+}
+
+// call invokes a gossip RPC on addr with the probe timeout. Indirect
+// probes get twice as long, since the helper must probe the target first.
+func (l *List) call(addr, method string, args, reply interface{}) error {
+	timeout := l.cfg.ProbeTimeout
+	if method == "Gossip.PingReq" {
+		timeout *= 2
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	client := stdrpc.NewClient(conn)
+	defer client.Close()
+
+	call := client.Go(method, args, reply, make(chan *stdrpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("timed out")
+	}
+}
@@ -0,0 +1,148 @@
+package membership
+
+import (
+	"net"
+	stdrpc "net/rpc"
+	"testing"
+	"time"
+)
+
+// startNode serves the gossip service of a new membership list on a
+// local port. The failure detector is not started; tests probe by hand.
+func startNode(t *testing.T) *List {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(Config{Self: ln.Addr().String(), ProbeTimeout: time.Second})
+	srv := stdrpc.NewServer()
+	if err := srv.RegisterName("Gossip", NewService(l)); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Accept(ln)
+	t.Cleanup(func() { ln.Close() })
+	return l
+}
+
+// state returns what l thinks of addr.
+func state(l *List, addr string) Member {
+	for _, m := range l.Members() {
+		if m.Addr == addr {
+			return m
+		}
+	}
+	return Member{Addr: addr, State: -1}
+}
+
+// declareDead makes l believe addr died at its current incarnation.
+func declareDead(l *List, addr string) {
+	m := state(l, addr)
+	l.merge([]Member{{Addr: addr, State: Dead, Incarnation: m.Incarnation}})
+}
+
+func TestJoin(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	if err := b.Join([]string{a.cfg.Self}); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Live(); len(got) != 2 {
+		t.Errorf("a sees %v alive, want both nodes", got)
+	}
+	if got := b.Live(); len(got) != 2 {
+		t.Errorf("b sees %v alive, want both nodes", got)
+	}
+}
+
+func TestPingFromDeadMemberWithNewerIncarnation(t *testing.T) {
+	a := New(Config{Self: "a"})
+	a.merge([]Member{{Addr: "b", State: Dead, Incarnation: 5}})
+
+	var reply PingReply
+	NewService(a).Ping(&PingArgs{From: "b", Incarnation: 6}, &reply)
+	if m := state(a, "b"); m.State != Alive || m.Incarnation != 6 {
+		t.Errorf("after a ping at incarnation 6, b is %s at %d, want alive at 6", m.State, m.Incarnation)
+	}
+}
+
+func TestPingFromDeadMemberGetsTheRumour(t *testing.T) {
+	a := New(Config{Self: "a"})
+	a.merge([]Member{{Addr: "b", State: Dead, Incarnation: 5}})
+
+	var reply PingReply
+	NewService(a).Ping(&PingArgs{From: "b", Incarnation: 5}, &reply)
+	if m := state(a, "b"); m.State != Dead {
+		t.Errorf("a ping at the dead incarnation made b %s", m.State)
+	}
+	found := false
+	for _, m := range reply.Updates {
+		found = found || (m.Addr == "b" && m.State == Dead)
+	}
+	if !found {
+		t.Errorf("the reply %v does not tell b it is thought dead", reply.Updates)
+	}
+
+	// b refutes the rumour it was sent, and its next ping revives it.
+	b := New(Config{Self: "b"})
+	b.members["b"].Incarnation = 5
+	b.merge(reply.Updates)
+	NewService(a).Ping(b.pingArgs("a"), &reply)
+	if m := state(a, "b"); m.State != Alive || m.Incarnation != 6 {
+		t.Errorf("after b refuted, b is %s at %d, want alive at 6", m.State, m.Incarnation)
+	}
+}
+
+func TestPartitionedMembersRevive(t *testing.T) {
+	a, b, c := startNode(t), startNode(t), startNode(t)
+	for _, l := range []*List{b, c} {
+		if err := l.Join([]string{a.cfg.Self}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Join([]string{c.cfg.Self})
+
+	// A partition cut c off: a and b declared it dead, and it declared
+	// them dead. Nobody probes a member it thinks alive any more.
+	declareDead(a, c.cfg.Self)
+	declareDead(b, c.cfg.Self)
+	declareDead(c, a.cfg.Self)
+	declareDead(c, b.cfg.Self)
+
+	// Once the partition heals, probing brings everyone back.
+	for round := 0; round < 10; round++ {
+		for _, l := range []*List{a, b, c} {
+			l.probe()
+		}
+	}
+	for _, l := range []*List{a, b, c} {
+		if got := l.Live(); len(got) != 3 {
+			t.Errorf("%s sees %v alive, want all three nodes", l.cfg.Self, got)
+		}
+	}
+}
+
+func TestProbeSuspectsUnreachableMember(t *testing.T) {
+	a := startNode(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := ln.Addr().String()
+	ln.Close()
+	a.merge([]Member{{Addr: gone, State: Alive, Incarnation: 1}})
+
+	a.probe()
+	if m := state(a, gone); m.State != Suspect {
+		t.Fatalf("an unreachable member is %s, want suspect", m.State)
+	}
+	a.cfg.SuspectTimeout = 0
+	a.expireSuspects()
+	if m := state(a, gone); m.State != Dead {
+		t.Fatalf("an expired suspect is %s, want dead", m.State)
+	}
+	// Probing it again, as a dead member, does not change anything.
+	a.probe()
+	if m := state(a, gone); m.State != Dead {
+		t.Fatalf("a dead member that still does not answer is %s", m.State)
+	}
+}
@@ -0,0 +1,74 @@
+package membership
+
+// PingArgs is a direct probe carrying piggybacked membership updates.
+type PingArgs struct {
+	From        string
+	Incarnation uint64 // of the sender, which is alive at it
+	Updates     []Member
+}
+
+// PingReply acknowledges a probe and carries updates back.
+type PingReply struct {
+	Incarnation uint64 // of the probed member, which is alive at it
+	Updates     []Member
+}
+
+// PingReqArgs asks a member to probe Target on the sender's behalf.
+type PingReqArgs struct {
+	From    string
+	Target  string
+	Updates []Member
+}
+
+// JoinArgs announces a new member.
+type JoinArgs struct {
+	Member Member
+}
+
+// JoinReply carries the full member list to a joining node.
+type JoinReply struct {
+	Members []Member
+}
+
+// Service is the RPC service of the membership protocol. It is registered
+// under the name "Gossip".
+type Service struct {
+	list *List
+}
+
+// NewService creates the gossip RPC service for a membership list.
+func NewService(l *List) *Service {
+	return &Service{list: l}
+}
+
+// Ping answers a direct probe. A probe from a member thought to be dead
+// at an older incarnation brings it back to life; otherwise the reply
+// tells the sender what is thought of it, so that it can refute that.
+func (s *Service) Ping(args *PingArgs, reply *PingReply) error {
+	s.list.merge(args.Updates)
+	stale := s.list.heardFrom(args.From, args.Incarnation)
+	reply.Incarnation = s.list.self().Incarnation
+	reply.Updates = append(s.list.piggyback(), stale...)
+	return nil
+}
+
+// PingReq probes Target for the sender and succeeds only if Target answers.
+func (s *Service) PingReq(args *PingReqArgs, reply *PingReply) error {
+	s.list.merge(args.Updates)
+
+	var ack PingReply
+	if err := s.list.call(args.Target, "Gossip.Ping", s.list.pingArgs(args.Target), &ack); err != nil {
+		return err
+	}
+	s.list.merge(ack.Updates)
+	s.list.heardFrom(args.Target, ack.Incarnation)
+	reply.Updates = s.list.piggyback()
+	return nil
+}
+
+// Join adds the caller to the membership list and returns every member.
+func (s *Service) Join(args *JoinArgs, reply *JoinReply) error {
+	s.list.merge([]Member{args.Member})
+	reply.Members = s.list.Members()
+	return nil
+}
@@ -0,0 +1,77 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Tree is a complete binary hash tree stored in heap order: the root is at
+// index 0 and the children of node i are at 2i+1 and 2i+2. The last
+// 1<<Depth nodes are the leaves, one per bucket of the key space.
+type Tree struct {
+	Depth int
+	Nodes [][]byte
+}
+
+// Buckets returns the number of leaf buckets in a tree of the given depth.
+func Buckets(depth int) int {
+	return 1 << depth
+}
+
+// Bucket maps a 64-bit key hash to its leaf bucket using the hash's top bits.
+func Bucket(h uint64, depth int) int {
+	if depth == 0 {
+		return 0
+	}
+	return int(h >> (64 - uint(depth)))
+}
+
+// Build creates a tree from the leaf hashes of every bucket. A nil leaf
+// stands for an empty bucket.
+func Build(depth int, leaves [][]byte) *Tree {
+	n := Buckets(depth)
+	t := &Tree{Depth: depth, Nodes: make([][]byte, 2*n-1)}
+	copy(t.Nodes[n-1:], leaves)
+
+	for i := n - 2; i >= 0; i-- {
+		left, right := t.Nodes[2*i+1], t.Nodes[2*i+2]
+		if left == nil && right == nil {
+			continue
+		}
+		h := sha256.New()
+		h.Write(left)
+		h.Write(right)
+		t.Nodes[i] = h.Sum(nil)
+	}
+	return t
+}
+
+// Diff returns the buckets whose contents differ between a and b, descending
+// only into subtrees whose hashes differ. Trees of different depths are
+// treated as entirely different.
+func Diff(a, b *Tree) []int {
+	if a.Depth != b.Depth || len(a.Nodes) != len(b.Nodes) {
+		all := make([]int, Buckets(a.Depth))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	var buckets []int
+	firstLeaf := Buckets(a.Depth) - 1
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if bytes.Equal(a.Nodes[i], b.Nodes[i]) {
+			continue
+		}
+		if i >= firstLeaf {
+			buckets = append(buckets, i-firstLeaf)
+			continue
+		}
+		stack = append(stack, 2*i+2, 2*i+1)
+	}
+	return buckets
+}
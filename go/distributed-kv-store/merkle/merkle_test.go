@@ -0,0 +1,51 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	for _, tc := range []struct {
+		h     uint64
+		depth int
+		want  int
+	}{
+		{0, 0, 0},
+		{^uint64(0), 0, 0},
+		{0, 4, 0},
+		{^uint64(0), 4, 15},
+		{1 << 63, 1, 1},
+		{1<<63 - 1, 1, 0},
+	} {
+		if got := Bucket(tc.h, tc.depth); got != tc.want {
+			t.Errorf("Bucket(%#x, %d) = %d, want %d", tc.h, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func leaves(depth int, set map[int]string) [][]byte {
+	l := make([][]byte, Buckets(depth))
+	for i, v := range set {
+		l[i] = []byte(v)
+	}
+	return l
+}
+
+func TestDiff(t *testing.T) {
+	const depth = 4
+	a := Build(depth, leaves(depth, map[int]string{1: "x", 7: "y", 12: "z"}))
+	if got := Diff(a, Build(depth, leaves(depth, map[int]string{1: "x", 7: "y", 12: "z"}))); len(got) != 0 {
+		t.Errorf("identical trees differ in %v", got)
+	}
+	b := Build(depth, leaves(depth, map[int]string{1: "x", 7: "changed", 12: "z", 15: "new"}))
+	if got := fmt.Sprint(Diff(a, b)); got != "[7 15]" {
+		t.Errorf("Diff = %s, want [7 15]", got)
+	}
+	if got := Diff(Build(depth, nil), Build(depth, nil)); len(got) != 0 {
+		t.Errorf("empty trees differ in %v", got)
+	}
+	if got := Diff(a, Build(2, nil)); len(got) != Buckets(depth) {
+		t.Errorf("trees of different depths differ in %d buckets, want all", len(got))
+	}
+}
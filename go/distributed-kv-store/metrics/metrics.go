@@ -0,0 +1,155 @@
+// Package metrics records request metrics and exposes them, along with
+// gauges read on demand, in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets are the upper bounds, in seconds, of the request latency histogram.
+var Buckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of a node. It is safe for concurrent use.
+type Registry struct {
+	mu        sync.Mutex
+	requests  map[[2]string]uint64 // map[{op, result}]count
+	latencies map[string]*histogram
+	gauges    []gauge
+}
+
+// histogram counts observations per bucket.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// gauge is a value read when the metrics are written. fn returns one value
+// per label set, keyed by the label value.
+type gauge struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+// New creates an empty registry.
+func New() *Registry {
+	return &Registry{
+		requests:  make(map[[2]string]uint64),
+		latencies: make(map[string]*histogram),
+	}
+}
+
+// Observe records a request for op that took d and ended with result, such
+// as "ok" or "not_found".
+func (r *Registry) Observe(op, result string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests[[2]string{op, result}]++
+	h, ok := r.latencies[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(Buckets)+1)}
+		r.latencies[op] = h
+	}
+	s := d.Seconds()
+	i := sort.SearchFloat64s(Buckets, s)
+	h.counts[i]++
+	h.sum += s
+	h.count++
+}
+
+// Gauge registers a gauge whose value is read from fn each time the
+// metrics are written.
+func (r *Registry) Gauge(name, help string, fn func() float64) {
+	r.GaugeVec(name, help, "", func() map[string]float64 { return map[string]float64{"": fn()} })
+}
+
+// GaugeVec registers a gauge with one label, whose values are read from fn
+// each time the metrics are written.
+func (r *Registry) GaugeVec(name, help, label string, fn func() map[string]float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gauges = append(r.gauges, gauge{name: name, help: help, label: label, fn: fn})
+}
+
+// WritePrometheus writes every metric in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	var b strings.Builder
+
+	b.WriteString("# HELP kv_requests_total Client requests by operation and result.\n")
+	b.WriteString("# TYPE kv_requests_total counter\n")
+	keys := make([][2]string, 0, len(r.requests))
+	for k := range r.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "kv_requests_total{op=%q,result=%q} %d\n", k[0], k[1], r.requests[k])
+	}
+
+	b.WriteString("# HELP kv_request_duration_seconds Client request latency by operation.\n")
+	b.WriteString("# TYPE kv_request_duration_seconds histogram\n")
+	ops := make([]string, 0, len(r.latencies))
+	for op := range r.latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := r.latencies[op]
+		var cumulative uint64
+		for i, le := range Buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "kv_request_duration_seconds_bucket{op=%q,le=%q} %d\n", op, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(&b, "kv_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(&b, "kv_request_duration_seconds_sum{op=%q} %s\n", op, formatFloat(h.sum))
+		fmt.Fprintf(&b, "kv_request_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+	gauges := append([]gauge(nil), r.gauges...)
+	r.mu.Unlock()
+
+	// Gauges are read without holding the lock, since they may be slow.
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		values := g.fn()
+		labels := make([]string, 0, len(values))
+		for l := range values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			if g.label == "" {
+				fmt.Fprintf(&b, "%s %s\n", g.name, formatFloat(values[l]))
+			} else {
+				fmt.Fprintf(&b, "%s{%s=%q} %s\n", g.name, g.label, l, formatFloat(values[l]))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// formatFloat formats a value the way Prometheus expects.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(f)
+}
@@ -0,0 +1,170 @@
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points each node gets on the ring.
+const DefaultVirtualNodes = 64
+
+// Ring is a consistent-hash ring with virtual nodes.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	points []uint64          // sorted hashes of all virtual nodes
+	owners map[uint64]string // map[point]node
+	nodes  map[string]bool
+}
+
+// New creates an empty ring that places vnodes points per node.
+func New(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		vnodes: vnodes,
+		owners: make(map[uint64]string),
+		nodes:  make(map[string]bool),
+	}
+}
+
+// VirtualNodes returns the number of points each node gets on the ring.
+func (r *Ring) VirtualNodes() int {
+	return r.vnodes
+}
+
+// Hash returns the ring position of a key.
+func Hash(key string) uint64 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add places a node on the ring. Adding a node twice has no effect.
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		p := Hash(node + "#" + strconv.Itoa(i))
+		r.owners[p] = node
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes a node and all its virtual nodes off the ring.
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if r.owners[p] == node {
+			delete(r.owners, p)
+			continue
+		}
+		points = append(points, p)
+	}
+	r.points = points
+}
+
+// Nodes returns the nodes on the ring in sorted order.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Replicas returns the preference list for key: the first n distinct nodes
+// found walking clockwise from the key's position. Fewer than n nodes are
+// returned when the ring is smaller than n.
+func (r *Ring) Replicas(key string, n int) []string {
+	return r.ReplicasOf(Hash(key), n)
+}
+
+// ReplicasOf returns the preference list for the ring position h.
+func (r *Ring) ReplicasOf(h uint64, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	replicas := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(replicas) < n && i < len(r.points); i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[node] {
+			seen[node] = true
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// Points returns the positions of every virtual node, in ascending order.
+func (r *Ring) Points() []uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]uint64(nil), r.points...)
+}
+
+// Clone returns a copy of the ring that later changes to r do not affect.
+func (r *Ring) Clone() *Ring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c := &Ring{
+		vnodes: r.vnodes,
+		points: append([]uint64(nil), r.points...),
+		owners: make(map[uint64]string, len(r.owners)),
+		nodes:  make(map[string]bool, len(r.nodes)),
+	}
+	for p, node := range r.owners {
+		c.owners[p] = node
+	}
+	for node := range r.nodes {
+		c.nodes[node] = true
+	}
+	return c
+}
+
+// Range is an arc of the ring: the positions h with Start < h <= End,
+// wrapping around zero when Start >= End. The keys hashed into a range
+// between two adjacent points all have the same preference list.
+type Range struct {
+	Start, End uint64
+}
+
+// Contains reports whether the ring position h lies in the range.
+func (rg Range) Contains(h uint64) bool {
+	if rg.Start < rg.End {
+		return rg.Start < h && h <= rg.End
+	}
+	return h > rg.Start || h <= rg.End
+}
@@ -0,0 +1,110 @@
+package ring
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func newRing(vnodes int, nodes ...string) *Ring {
+	r := New(vnodes)
+	for _, n := range nodes {
+		r.Add(n)
+	}
+	return r
+}
+
+func TestReplicasWalkClockwise(t *testing.T) {
+	r := newRing(16, "a", "b", "c", "d")
+	points := r.Points()
+	if len(points) != 4*16 {
+		t.Fatalf("%d points, want 16 per node", len(points))
+	}
+	if !sort.SliceIsSorted(points, func(i, j int) bool { return points[i] < points[j] }) {
+		t.Fatal("points are not sorted")
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		replicas := r.Replicas(key, 3)
+		if len(replicas) != 3 {
+			t.Fatalf("%s: replicas %v, want 3", key, replicas)
+		}
+		seen := map[string]bool{}
+		for _, n := range replicas {
+			if seen[n] {
+				t.Fatalf("%s: replicas %v repeat a node", key, replicas)
+			}
+			seen[n] = true
+		}
+
+		// The first replica owns the first point at or after the key,
+		// wrapping around to the first point.
+		h := Hash(key)
+		j := sort.Search(len(points), func(i int) bool { return points[i] >= h })
+		if j == len(points) {
+			j = 0
+		}
+		if owner := r.ReplicasOf(points[j], 1)[0]; replicas[0] != owner {
+			t.Fatalf("%s: first replica %s, want %s, the owner of the successor point", key, replicas[0], owner)
+		}
+	}
+}
+
+func TestReplicasOfSmallRings(t *testing.T) {
+	if got := New(0).Replicas("k", 3); got != nil {
+		t.Errorf("empty ring: replicas %v", got)
+	}
+	if got := newRing(0, "a", "b").Replicas("k", 3); len(got) != 2 {
+		t.Errorf("two nodes: replicas %v, want both", got)
+	}
+	if got := newRing(0, "a").Replicas("k", 0); got != nil {
+		t.Errorf("n=0: replicas %v", got)
+	}
+	if vn := New(0).VirtualNodes(); vn != DefaultVirtualNodes {
+		t.Errorf("default virtual nodes = %d", vn)
+	}
+}
+
+func TestVirtualNodesSpreadKeys(t *testing.T) {
+	r := newRing(0, "a", "b", "c", "d", "e")
+	counts := map[string]int{}
+	const keys = 50000
+	for i := 0; i < keys; i++ {
+		counts[r.Replicas(fmt.Sprintf("key-%d", i), 1)[0]]++
+	}
+	for node, n := range counts {
+		if share := float64(n) / keys; share < 0.12 || share > 0.28 {
+			t.Errorf("%s owns %.1f%% of the keys, want about 20%%", node, 100*share)
+		}
+	}
+}
+
+func TestAddAndRemoveOnlyMoveTheirKeys(t *testing.T) {
+	before := newRing(0, "a", "b", "c")
+	after := before.Clone()
+	after.Add("d")
+	if len(before.Nodes()) != 3 {
+		t.Fatal("adding to a clone changed the original")
+	}
+	after.Add("d") // adding twice has no effect
+	if got := len(after.Points()); got != 4*DefaultVirtualNodes {
+		t.Fatalf("%d points after adding a node twice", got)
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		was, is := before.Replicas(key, 1)[0], after.Replicas(key, 1)[0]
+		if was != is && is != "d" {
+			t.Fatalf("%s moved from %s to %s, not to the new node", key, was, is)
+		}
+	}
+
+	after.Remove("d")
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if was, is := before.Replicas(key, 3), after.Replicas(key, 3); fmt.Sprint(was) != fmt.Sprint(is) {
+			t.Fatalf("%s: replicas %v after removing the new node, were %v", key, is, was)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"distributed-kv-store/store"
+	"errors"
+	"log"
+)
+
+// errBackupsDisabled is returned for backups and restores requested of a
+// node without a backup directory.
+var errBackupsDisabled = errors.New("backups are disabled on this node; start it with -backup-dir")
+
+// BackupArgs asks a node to back up its store to a file in its backup
+// directory. Path is the name of the file, without directories. With Base
+// set, the backup is incremental on top of the backup in the file of that
+// name, also in the backup directory.
+type BackupArgs struct {
+	Path string
+	Base string
+}
+
+// RestoreArgs asks a node to restore a backup from the file named Path in
+// its backup directory.
+type RestoreArgs struct {
+	Path string
+}
+
+// BackupReply describes a backup that was taken or restored.
+type BackupReply struct {
+	Header store.BackupHeader
+	Keys   int
+}
+
+// SetBackupDir lets Backup and Restore read and write the files in dir.
+// Until it is called, they are refused.
+func (k *KVStore) SetBackupDir(dir string) {
+	k.backupDir = dir
+}
+
+// backupPath resolves the name of a backup file in the backup directory.
+func (k *KVStore) backupPath(name string) (string, error) {
+	if k.backupDir == "" {
+		return "", errBackupsDisabled
+	}
+	return store.BackupPath(k.backupDir, name)
+}
+
+// Backup writes a consistent snapshot of the node's store to the file
+// named args.Path.
+func (k *KVStore) Backup(args *BackupArgs, reply *BackupReply) error {
+	log.Printf("RPC Backup request to %q, base: %q\n", args.Path, args.Base)
+	path, err := k.backupPath(args.Path)
+	if err != nil {
+		return err
+	}
+	base := ""
+	if args.Base != "" {
+		if base, err = k.backupPath(args.Base); err != nil {
+			return err
+		}
+	}
+	header, n, err := k.store.BackupFile(path, base)
+	if err != nil {
+		return err
+	}
+	reply.Header, reply.Keys = header, n
+	return nil
+}
+
+// Restore merges the backup in the file named args.Path into the node's store.
+func (k *KVStore) Restore(args *RestoreArgs, reply *BackupReply) error {
+	log.Printf("RPC Restore request from %q\n", args.Path)
+	path, err := k.backupPath(args.Path)
+	if err != nil {
+		return err
+	}
+	header, n, err := k.store.RestoreFile(path)
+	reply.Header, reply.Keys = header, n
+	return err
+}
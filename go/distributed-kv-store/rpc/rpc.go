@@ -2,24 +2,73 @@ package rpc
 
 import (
 	"distributed-kv-store/store"
-	"errors"
+	"distributed-kv-store/vclock"
 	"log"
+	"time"
 )
 
 // Args represents the arguments for RPC calls.
 type Args struct {
 	Key   string
-	Value string
+	Value []byte
+	// Upload names a value sent ahead in chunks with Cluster.Upload, which
+	// Cluster.Put, CompareAndSwap and Batch write instead of Value.
+	Upload string
+
+	// Context is the vector clock of the version being written. Replicas
+	// store it as-is; coordinators advance it before replicating.
+	Context vclock.VClock
+	// Timestamp is the wall-clock time of the write, used for last-writer-wins.
+	Timestamp int64
+	// ExpiresAt is the Unix nanosecond time at which a written value expires.
+	// Zero means it never expires.
+	ExpiresAt int64
+	// Expected is the version a CompareAndSwap requires the key to be at: the
+	// context returned by a read, or empty if the key must not exist.
+	Expected vclock.VClock
+	// TTL is how long a value written through Cluster.Put lives. The
+	// coordinator turns it into ExpiresAt.
+	TTL time.Duration
+	// Policy selects how Get resolves conflicting siblings (store.PolicyMerge
+	// or store.PolicyLWW). An empty policy returns all siblings.
+	Policy string
+	// Raw makes Get return tombstones and expired versions as well. Replicas
+	// use it to reconcile deletes.
+	Raw bool
 }
 
 // Reply represents the reply for RPC calls.
 type Reply struct {
-	Value string
+	// Value is set when the key has exactly one sibling after resolution.
+	Value    []byte
+	Siblings []store.Versioned
+	// Context is the merged clock of all siblings, before resolution; pass
+	// it back in Args.Context to write a value that supersedes all of them.
+	Context vclock.VClock
+}
+
+// ScanArgs represents the arguments for a Scan call. Keys are returned in
+// [Start, End) in ascending order; Prefix, when set, narrows the range to
+// keys with that prefix.
+type ScanArgs struct {
+	Prefix string
+	Start  string
+	End    string
+	Limit  int
+	Raw    bool
+	// Policy selects conflict resolution for Cluster.Scan.
+	Policy string
+}
+
+// ScanReply represents the reply for a Scan call.
+type ScanReply struct {
+	Entries []store.Entry
 }
 
 // KVStore represents the RPC server for the key-value store.
 type KVStore struct {
-	store *store.Store
+	store     *store.Store
+	backupDir string // where Backup and Restore may read and write; "" refuses them
 }
 
 // NewKVStore creates and returns a new KVStore RPC server instance.
@@ -29,25 +78,101 @@ func NewKVStore(s *store.Store) *KVStore {
 	}
 }
 
-// Get retrieves a value from the store.
+// Get retrieves the siblings of a key from the store.
 func (k *KVStore) Get(args *Args, reply *Reply) error {
 	log.Printf("RPC Get request for key: %s\n", args.Key)
-	val, err := k.store.Get(args.Key)
+	siblings, err := k.store.Get(args.Key)
 	if err != nil {
-		return errors.New("key not found")
+		return err
+	}
+	reply.Context = store.Context(siblings)
+	siblings = store.Resolve(siblings, args.Policy)
+	if !args.Raw {
+		siblings = store.Live(siblings, time.Now())
+		if len(siblings) == 0 {
+			return store.ErrKeyNotFound
+		}
+	}
+	reply.Siblings = siblings
+	if len(siblings) == 1 {
+		reply.Value = siblings[0].Value
 	}
-	reply.Value = val
 	return nil
 }
 
-// Put stores a key-value pair in the store.
+// Put stores a versioned value in the store.
 func (k *KVStore) Put(args *Args, reply *Reply) error {
-	log.Printf("RPC Put request for key: %s, value: %s\n", args.Key, args.Value)
-	err := k.store.Put(args.Key, args.Value)
+	log.Printf("RPC Put request for key: %s, value: %d bytes, clock: %v\n", args.Key, len(args.Value), args.Context)
+	err := k.store.Put(args.Key, versionFromArgs(args, false))
+	if err != nil {
+		return err
+	}
+	reply.Value = []byte("OK") // Indicate success
+	return nil
+}
+
+// Delete stores a tombstone for a key. Like Put, the caller is responsible
+// for advancing the clock in Args.Context.
+func (k *KVStore) Delete(args *Args, reply *Reply) error {
+	log.Printf("RPC Delete request for key: %s, clock: %v\n", args.Key, args.Context)
+	err := k.store.Put(args.Key, versionFromArgs(args, true))
 	if err != nil {
 		return err
 	}
-	reply.Value = "OK" // Indicate success
+	reply.Value = []byte("OK")
 	return nil
 }
 
+// Scan lists keys in a range in ascending order.
+func (k *KVStore) Scan(args *ScanArgs, reply *ScanReply) error {
+	log.Printf("RPC Scan request for prefix: %q, range: [%q, %q), limit: %d\n", args.Prefix, args.Start, args.End, args.Limit)
+	start, end := ScanRange(args)
+	entries, err := k.store.Scan(start, end, args.Limit)
+	if err != nil {
+		return err
+	}
+	if !args.Raw {
+		now := time.Now()
+		live := entries[:0]
+		for _, e := range entries {
+			if e.Siblings = store.Live(e.Siblings, now); len(e.Siblings) > 0 {
+				live = append(live, e)
+			}
+		}
+		entries = live
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// ScanRange combines the prefix and bounds of args into a single [start, end) range.
+func ScanRange(args *ScanArgs) (string, string) {
+	start, end := args.Start, args.End
+	if args.Prefix != "" {
+		if start < args.Prefix {
+			start = args.Prefix
+		}
+		if pe := store.PrefixEnd(args.Prefix); pe != "" && (end == "" || pe < end) {
+			end = pe
+		}
+	}
+	return start, end
+}
+
+// versionFromArgs builds the version a Put or Delete stores.
+func versionFromArgs(args *Args, deleted bool) store.Versioned {
+	v := store.Versioned{
+		Value:     args.Value,
+		Clock:     args.Context,
+		Timestamp: args.Timestamp,
+		Deleted:   deleted,
+		ExpiresAt: args.ExpiresAt,
+	}
+	if v.Clock == nil {
+		v.Clock = vclock.New()
+	}
+	if v.Timestamp == 0 {
+		v.Timestamp = time.Now().UnixNano()
+	}
+	return v
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"distributed-kv-store/store"
+	"log"
+	"time"
+)
+
+// Op is one write of a batch. Args holds the key and the version to write;
+// Delete makes the write a tombstone. When Check is set, the whole batch
+// only applies if the key is still at Args.Expected.
+type Op struct {
+	Args
+	Delete bool
+	Check  bool
+}
+
+// BatchArgs represents the arguments for a Batch call.
+type BatchArgs struct {
+	Ops []Op
+}
+
+// PrepareArgs asks a replica to lock keys for a transaction.
+type PrepareArgs struct {
+	TxnID string
+	Keys  []string
+	// TTL is how long the replica holds the locks if the transaction is
+	// neither committed nor aborted.
+	TTL time.Duration
+}
+
+// PrepareReply carries the raw entries of the locked keys that exist.
+type PrepareReply struct {
+	Entries []store.Entry
+}
+
+// CommitArgs carries the writes of a prepared transaction. Like Put, the
+// caller is responsible for advancing the clock of each write.
+type CommitArgs struct {
+	TxnID string
+	Ops   []Op
+}
+
+// TxnArgs identifies a transaction.
+type TxnArgs struct {
+	TxnID string
+}
+
+// CompareAndSwap stores a versioned value if the key is still at
+// args.Expected.
+func (k *KVStore) CompareAndSwap(args *Args, reply *Reply) error {
+	log.Printf("RPC CompareAndSwap request for key: %s, expected: %v, clock: %v\n", args.Key, args.Expected, args.Context)
+	err := k.store.CompareAndSwap(args.Key, args.Expected, versionFromArgs(args, false))
+	if err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Batch applies a set of writes atomically, if all of their checks hold.
+func (k *KVStore) Batch(args *BatchArgs, reply *Reply) error {
+	log.Printf("RPC Batch request with %d ops\n", len(args.Ops))
+	err := k.store.Batch(storeOps(args.Ops))
+	if err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Prepare locks keys for a transaction and returns their raw entries.
+func (k *KVStore) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	log.Printf("RPC Prepare request for transaction %s on %d keys\n", args.TxnID, len(args.Keys))
+	entries, err := k.store.Prepare(args.TxnID, args.Keys, args.TTL)
+	if err != nil {
+		return err
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// Commit applies the writes of a prepared transaction and releases its locks.
+func (k *KVStore) Commit(args *CommitArgs, reply *Reply) error {
+	log.Printf("RPC Commit request for transaction %s with %d ops\n", args.TxnID, len(args.Ops))
+	err := k.store.Commit(args.TxnID, storeOps(args.Ops))
+	if err != nil {
+		return err
+	}
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// Abort releases the locks of a prepared transaction.
+func (k *KVStore) Abort(args *TxnArgs, reply *Reply) error {
+	log.Printf("RPC Abort request for transaction %s\n", args.TxnID)
+	k.store.Abort(args.TxnID)
+	reply.Value = []byte("OK")
+	return nil
+}
+
+// storeOps converts batch ops into store ops, storing each version as-is.
+func storeOps(ops []Op) []store.Op {
+	storeOps := make([]store.Op, len(ops))
+	for i := range ops {
+		storeOps[i] = store.Op{
+			Key:      ops[i].Key,
+			Version:  versionFromArgs(&ops[i].Args, ops[i].Delete),
+			Check:    ops[i].Check,
+			Expected: ops[i].Expected,
+		}
+	}
+	return storeOps
+}
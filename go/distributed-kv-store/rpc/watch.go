@@ -0,0 +1,51 @@
+package rpc
+
+import (
+	"distributed-kv-store/store"
+	"strings"
+	"time"
+)
+
+// MaxWatchTimeout bounds how long a Watch call waits for changes.
+const MaxWatchTimeout = time.Minute
+
+// WatchArgs represents the arguments for a Watch call. It watches a single
+// Key, or every key starting with Prefix when Key is empty.
+type WatchArgs struct {
+	Key    string
+	Prefix string
+	// Revision is the first revision to return; zero starts after the
+	// latest change.
+	Revision uint64
+	Limit    int
+	// Timeout is how long to wait for a change before returning no events.
+	Timeout time.Duration
+}
+
+// WatchReply represents the reply for a Watch call.
+type WatchReply struct {
+	Events []store.Event
+	// Revision is the revision to pass in the next call to continue the watch.
+	Revision uint64
+}
+
+// Watch waits for changes to a key or prefix in the local store and returns
+// them in revision order. Revisions are local to the node.
+func (k *KVStore) Watch(args *WatchArgs, reply *WatchReply) error {
+	match := func(key string) bool { return strings.HasPrefix(key, args.Prefix) }
+	if args.Key != "" {
+		match = func(key string) bool { return key == args.Key }
+	}
+	timeout := args.Timeout
+	if timeout <= 0 || timeout > MaxWatchTimeout {
+		timeout = MaxWatchTimeout
+	}
+
+	events, next, err := k.store.Watch(args.Revision, match, args.Limit, timeout)
+	if err != nil {
+		return err
+	}
+	reply.Events = events
+	reply.Revision = next
+	return nil
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupFormat identifies the backup file format in BackupHeader.Format.
+const backupFormat = "kvs-backup/1"
+
+// ErrStalePosition is returned for an incremental backup whose base is not
+// a position in the engine's current log, because the log was compacted or
+// replaced since. A full backup is needed instead.
+var ErrStalePosition = errors.New("backup base is not in the current log")
+
+// ErrNoReplay is returned for an incremental backup of a store whose engine
+// cannot replay its writes, such as a MemEngine.
+var ErrNoReplay = errors.New("incremental backups need a durable log")
+
+// LogPosition is a point in the log of an engine, from which the writes
+// after it can be replayed.
+type LogPosition struct {
+	Log    string // ID of the log
+	Offset int64
+}
+
+// String formats the position as log:offset.
+func (p LogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.Log, p.Offset)
+}
+
+// Replayer is implemented by engines that can replay the writes made
+// since a position of their log, which enables incremental backups. Like
+// Load, its methods are called concurrently under the Store's read lock.
+type Replayer interface {
+	// Position returns the current end of the log.
+	Position() LogPosition
+	// Replay calls fn for each write after since, with nil siblings for a
+	// removed key, and returns the position it stopped at.
+	Replay(since LogPosition, fn func(key string, siblings []Versioned) error) (LogPosition, error)
+}
+
+// BackupHeader starts a backup. A full backup holds every key of the store;
+// an incremental one holds the writes between Since and Position and must
+// be restored on top of the backups it builds on, in order.
+type BackupHeader struct {
+	Format      string
+	Incremental bool
+	Created     time.Time
+	Since       LogPosition // start of an incremental backup
+	Position    LogPosition // position of the log the backup is consistent with, if the engine has one
+	Revision    uint64
+}
+
+// backupRecord is a key and its siblings in a backup. Removed marks a key
+// that an incremental backup deletes, and End the last record, so that a
+// truncated backup is detected.
+type backupRecord struct {
+	Key      string
+	Siblings []Versioned
+	Removed  bool
+	End      bool
+}
+
+// Backup writes a consistent snapshot of the store to w and returns its
+// header and number of keys. With since nil the backup is full, otherwise
+// it only holds what was written after since, which must be the Position
+// of an earlier backup. Writes wait until the backup is done.
+func (s *Store) Backup(w io.Writer, since *LogPosition) (BackupHeader, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	replayer, ok := s.engine.(Replayer)
+	if since != nil && !ok {
+		return BackupHeader{}, 0, ErrNoReplay
+	}
+	header := BackupHeader{Format: backupFormat, Created: time.Now(), Revision: s.revision}
+	if ok {
+		header.Position = replayer.Position()
+	}
+	if since != nil {
+		header.Incremental, header.Since = true, *since
+	}
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to write backup: %w", err)
+	}
+	n := 0
+	write := func(key string, siblings []Versioned) error {
+		n++
+		if err := enc.Encode(backupRecord{Key: key, Siblings: siblings, Removed: siblings == nil}); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		return nil
+	}
+	if since != nil {
+		// Keys written several times since are kept once, at their latest.
+		latest := make(map[string][]Versioned)
+		if _, err := replayer.Replay(*since, func(key string, siblings []Versioned) error {
+			latest[key] = siblings
+			return nil
+		}); err != nil {
+			return BackupHeader{}, 0, err
+		}
+		keys := make([]string, 0, len(latest))
+		for key := range latest {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := write(key, latest[key]); err != nil {
+				return BackupHeader{}, 0, err
+			}
+		}
+	} else {
+		for _, key := range s.index {
+			siblings, ok, err := s.engine.Load(key)
+			if err != nil {
+				return BackupHeader{}, 0, err
+			}
+			if !ok {
+				continue
+			}
+			if siblings == nil {
+				siblings = []Versioned{}
+			}
+			if err := write(key, siblings); err != nil {
+				return BackupHeader{}, 0, err
+			}
+		}
+	}
+	if err := enc.Encode(backupRecord{End: true}); err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return header, n, nil
+}
+
+// ReadBackupHeader reads the header of a backup from r.
+func ReadBackupHeader(r io.Reader) (BackupHeader, error) {
+	var header BackupHeader
+	if err := gob.NewDecoder(r).Decode(&header); err != nil {
+		return BackupHeader{}, fmt.Errorf("failed to read backup header: %w", err)
+	}
+	if header.Format != backupFormat {
+		return BackupHeader{}, fmt.Errorf("unknown backup format %q", header.Format)
+	}
+	return header, nil
+}
+
+// Restore reads a backup from r into the store and returns its header and
+// number of keys. Restored siblings are merged with the ones the store
+// holds, as replicas would be, and keys an incremental backup removes are
+// removed. Restore a full backup first, then the incremental backups taken
+// after it in order.
+func (s *Store) Restore(r io.Reader) (BackupHeader, int, error) {
+	dec := gob.NewDecoder(r)
+	var header BackupHeader
+	if err := dec.Decode(&header); err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to read backup header: %w", err)
+	}
+	if header.Format != backupFormat {
+		return BackupHeader{}, 0, fmt.Errorf("unknown backup format %q", header.Format)
+	}
+
+	n := 0
+	for {
+		var rec backupRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return header, n, fmt.Errorf("failed to read backup after %d keys: %w", n, err)
+		}
+		if rec.End {
+			return header, n, nil
+		}
+		if err := s.restore(rec); err != nil {
+			return header, n, err
+		}
+		n++
+	}
+}
+
+// restore applies one record of a backup.
+func (s *Store) restore(rec backupRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !rec.Removed {
+		ops := make([]Op, len(rec.Siblings))
+		for i, v := range rec.Siblings {
+			ops[i] = Op{Key: rec.Key, Version: v}
+		}
+		return s.apply(ops)
+	}
+	if _, ok, err := s.engine.Load(rec.Key); err != nil || !ok {
+		return err
+	}
+	if err := s.engine.Delete(rec.Key); err != nil {
+		return err
+	}
+	s.indexRemove(rec.Key)
+	return nil
+}
+
+// BackupPath returns the path of the backup file name in dir. Name must be
+// a plain file name: absolute paths, directories and ".." are rejected, so
+// that a name sent over the network cannot reach outside dir.
+func BackupPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.IsAbs(name) ||
+		strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid backup name %q: use a file name without directories", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// BackupFile writes a backup of the store to path, replacing it only once
+// the backup is complete. With base set, the backup is incremental on top
+// of the backup in the file base.
+func (s *Store) BackupFile(path, base string) (BackupHeader, int, error) {
+	var since *LogPosition
+	if base != "" {
+		f, err := os.Open(base)
+		if err != nil {
+			return BackupHeader{}, 0, fmt.Errorf("failed to open base backup: %w", err)
+		}
+		h, err := ReadBackupHeader(f)
+		f.Close()
+		if err != nil {
+			return BackupHeader{}, 0, fmt.Errorf("%s: %w", base, err)
+		}
+		since = &h.Position
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to create backup: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+
+	w := bufio.NewWriter(tmp)
+	header, n, err := s.Backup(w, since)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return BackupHeader{}, 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return header, n, nil
+}
+
+// RestoreFile restores the backup in the file at path into the store.
+func (s *Store) RestoreFile(path string) (BackupHeader, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return BackupHeader{}, 0, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	header, n, err := s.Restore(bufio.NewReader(f))
+	if err != nil {
+		return header, n, fmt.Errorf("%s: %w", path, err)
+	}
+	return header, n, nil
+}
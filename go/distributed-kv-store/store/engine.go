@@ -0,0 +1,64 @@
+package store
+
+// Engine persists the siblings of each key. The Store calls Load
+// concurrently from readers holding its read lock, so Load must be safe
+// for concurrent use; Save, Delete and Keys are never called concurrently
+// with any other method. Engines that do background work must also guard
+// their state against it.
+type Engine interface {
+	// Load returns the siblings stored for key and whether the key exists.
+	Load(key string) ([]Versioned, bool, error)
+	// Save replaces the siblings stored for key.
+	Save(key string, siblings []Versioned) error
+	// Delete removes key and its siblings.
+	Delete(key string) error
+	// Keys returns every stored key, in no particular order.
+	Keys() ([]string, error)
+	// Close releases the engine's resources.
+	Close() error
+}
+
+// MemEngine is an Engine that keeps everything in a map in memory. Only
+// Load runs concurrently, and concurrent reads of a map are safe.
+type MemEngine struct {
+	data map[string][]Versioned
+}
+
+// NewMemEngine creates and returns an empty MemEngine.
+func NewMemEngine() *MemEngine {
+	return &MemEngine{
+		data: make(map[string][]Versioned),
+	}
+}
+
+// Load returns the siblings stored for key.
+func (m *MemEngine) Load(key string) ([]Versioned, bool, error) {
+	siblings, ok := m.data[key]
+	return siblings, ok, nil
+}
+
+// Save replaces the siblings stored for key.
+func (m *MemEngine) Save(key string, siblings []Versioned) error {
+	m.data[key] = siblings
+	return nil
+}
+
+// Delete removes key from the map.
+func (m *MemEngine) Delete(key string) error {
+	delete(m.data, key)
+	return nil
+}
+
+// Keys returns every key in the map.
+func (m *MemEngine) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Close is a no-op for the in-memory engine.
+func (m *MemEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,665 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"distributed-kv-store/vclock"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	logFileName     = "data.log"
+	compactFileName = "data.log.compact"
+	idFileName      = "data.log.id"
+
+	// headerSize is the length of a record header: CRC, key length and value length.
+	headerSize = 12
+	// maxBodySize bounds the key and value of a record, so that a corrupt
+	// header cannot make recovery allocate an absurd buffer.
+	maxBodySize = 1 << 30
+
+	// The top bits of the value length describe how the value is encoded.
+	// Records written before values became byte slices have neither bit
+	// set and hold string values.
+	flagBytes      = 1 << 30 // siblings hold []byte values
+	flagCompressed = 1 << 31 // the value is DEFLATE-compressed
+	lengthMask     = flagBytes - 1
+)
+
+// errCorrupt marks a record whose checksum or lengths do not match.
+var errCorrupt = errors.New("corrupt record")
+
+// openFile opens the log file. Tests replace it to make opening fail.
+var openFile = os.OpenFile
+
+// LogOptions configures a LogEngine.
+type LogOptions struct {
+	// SyncWrites flushes the log to disk after every write.
+	SyncWrites bool
+	// CompactInterval is how often the engine checks whether to compact.
+	// Zero disables background compaction.
+	CompactInterval time.Duration
+	// CompactMinGarbage is the fraction of the log that must be stale
+	// before a compaction runs. Defaults to 0.5.
+	CompactMinGarbage float64
+	// CompressThreshold is the encoded size above which the siblings of a
+	// key are stored compressed with DEFLATE. Zero disables compression.
+	CompressThreshold int
+}
+
+// logEntry locates the latest record of a key in the log.
+type logEntry struct {
+	offset int64
+	size   int64
+}
+
+// LogEngine is a Bitcask-style Engine. Every write is appended to a single
+// log file and an in-memory key directory points at the latest record of
+// each key. Compaction rewrites the log with only the live records.
+//
+// Each record is laid out as:
+//
+//	crc32 (4) | key length (4) | flags + value length (4) | key | gob-encoded siblings
+//
+// The checksum covers everything after it. The top two bits of the value
+// length flag values that are byte slices and values compressed with
+// DEFLATE; compression is transparent to the Store. A record with an
+// empty value marks the key as removed. On open, a torn or corrupt
+// record at the end of the log is treated as an interrupted write and
+// truncated away; a corrupt record before the end fails the open. If the
+// compacted log cannot be reopened, every later call returns that error.
+type LogEngine struct {
+	mu     sync.Mutex
+	dir    string
+	opts   LogOptions
+	file   *os.File
+	size   int64 // offset of the end of the log
+	live   int64 // bytes taken by the latest record of every key
+	keydir map[string]logEntry
+	id     string // identifies the log; compaction gives it a new one
+	// err is set when the log could not be reopened after a compaction,
+	// which leaves the engine without a usable file. Every later call
+	// fails with it.
+	err error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenLogEngine opens or creates the log in dir and rebuilds the key
+// directory from it.
+func OpenLogEngine(dir string, opts LogOptions) (*LogEngine, error) {
+	if opts.CompactMinGarbage <= 0 {
+		opts.CompactMinGarbage = 0.5
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %q: %w", dir, err)
+	}
+	// A leftover compaction file means a compaction was interrupted before
+	// the rename; the original log is still authoritative.
+	os.Remove(filepath.Join(dir, compactFileName))
+
+	e := &LogEngine{
+		dir:    dir,
+		opts:   opts,
+		keydir: make(map[string]logEntry),
+	}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	if err := e.loadID(); err != nil {
+		e.file.Close()
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		e.stop = make(chan struct{})
+		e.done = make(chan struct{})
+		go e.compactLoop()
+	}
+	return e, nil
+}
+
+// open opens the log file and replays it into the key directory. The
+// engine is left as it was if open fails.
+func (e *LogEngine) open() error {
+	path := filepath.Join(e.dir, logFileName)
+	file, err := openFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log %q: %w", path, err)
+	}
+
+	keydir := make(map[string]logEntry)
+	var live int64
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		key, size, deleted, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			torn, terr := tornTail(file, offset)
+			if terr != nil || !torn {
+				file.Close()
+				if terr != nil {
+					return fmt.Errorf("failed to read log %q: %w", path, terr)
+				}
+				return fmt.Errorf("log %q is corrupt at offset %d, before its end: %w", path, offset, err)
+			}
+			log.Printf("Truncating log %q at offset %d: %v\n", path, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to truncate log %q: %w", path, err)
+			}
+			break
+		}
+		if old, ok := keydir[key]; ok {
+			live -= old.size
+		}
+		if deleted {
+			delete(keydir, key)
+		} else {
+			keydir[key] = logEntry{offset: offset, size: size}
+			live += size
+		}
+		offset += size
+	}
+
+	e.file, e.keydir = file, keydir
+	e.size, e.live = offset, live
+	return nil
+}
+
+// tornTail reports whether the bad record at offset is the last one in
+// file, as an interrupted append leaves it: too short for a header, with
+// a header whose lengths reach the end of the file, or followed by nothing
+// but the zeros a crash can leave in a file grown before its data landed.
+func tornTail(file *os.File, offset int64) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	rest := info.Size() - offset
+	if rest < headerSize {
+		return true, nil
+	}
+	var header [headerSize]byte
+	if _, err := file.ReadAt(header[:], offset); err != nil {
+		return false, err
+	}
+	keyLen := binary.BigEndian.Uint32(header[4:8])
+	valLen := binary.BigEndian.Uint32(header[8:12]) & lengthMask
+	if offset+headerSize+int64(keyLen)+int64(valLen) >= info.Size() {
+		return true, nil
+	}
+
+	buf := make([]byte, 32*1024)
+	for pos := offset; pos < info.Size(); {
+		n, err := file.ReadAt(buf, pos)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readRecord reads one whole record from r, verifying its checksum. It
+// returns the record's key, its total size and whether it is a deletion.
+func readRecord(r io.Reader) (string, int64, bool, error) {
+	key, _, val, size, err := readRecordValue(r)
+	return key, size, len(val) == 0, err
+}
+
+// readRecordValue reads one whole record from r like readRecord, returning
+// its key, the flags and bytes of its value and its total size.
+func readRecordValue(r io.Reader) (string, uint32, []byte, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return "", 0, nil, 0, fmt.Errorf("%w: torn header", errCorrupt)
+		}
+		return "", 0, nil, 0, err
+	}
+	sum := binary.BigEndian.Uint32(header[0:4])
+	keyLen := binary.BigEndian.Uint32(header[4:8])
+	valLen := binary.BigEndian.Uint32(header[8:12]) & lengthMask
+	flags := binary.BigEndian.Uint32(header[8:12]) &^ lengthMask
+	if uint64(keyLen)+uint64(valLen) > maxBodySize {
+		return "", 0, nil, 0, fmt.Errorf("%w: record of %d bytes", errCorrupt, uint64(keyLen)+uint64(valLen))
+	}
+
+	body := make([]byte, int(keyLen)+int(valLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", 0, nil, 0, fmt.Errorf("%w: torn body", errCorrupt)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != sum {
+		return "", 0, nil, 0, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+	return string(body[:keyLen]), flags, body[keyLen:], int64(headerSize + len(body)), nil
+}
+
+// encodeRecord builds the on-disk representation of key=siblings,
+// compressing values larger than compressThreshold if that makes them
+// smaller. A nil siblings list produces a deletion record with an empty
+// value.
+func encodeRecord(key string, siblings []Versioned, compressThreshold int) ([]byte, error) {
+	var val bytes.Buffer
+	var flags uint32
+	if siblings != nil {
+		if err := gob.NewEncoder(&val).Encode(siblings); err != nil {
+			return nil, fmt.Errorf("failed to encode value for %q: %w", key, err)
+		}
+		flags = flagBytes
+	}
+	if compressThreshold > 0 && val.Len() > compressThreshold {
+		var compressed bytes.Buffer
+		w, _ := flate.NewWriter(&compressed, flate.DefaultCompression) // the level is valid
+		w.Write(val.Bytes())
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress value for %q: %w", key, err)
+		}
+		if compressed.Len() < val.Len() {
+			val = compressed
+			flags |= flagCompressed
+		}
+	}
+	if len(key)+val.Len() > maxBodySize {
+		return nil, fmt.Errorf("record for %q is %d bytes, more than the log allows", key, len(key)+val.Len())
+	}
+
+	rec := make([]byte, headerSize, headerSize+len(key)+val.Len())
+	binary.BigEndian.PutUint32(rec[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[8:12], flags|uint32(val.Len()))
+	rec = append(rec, key...)
+	rec = append(rec, val.Bytes()...)
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[4:]))
+	return rec, nil
+}
+
+// Load reads the latest record of key from the log.
+func (e *LogEngine) Load(key string) ([]Versioned, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return nil, false, e.err
+	}
+	entry, ok := e.keydir[key]
+	if !ok {
+		return nil, false, nil
+	}
+	siblings, err := e.readValue(entry)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %q: %w", key, err)
+	}
+	return siblings, true, nil
+}
+
+// readValue decodes the siblings of the record at entry.
+func (e *LogEngine) readValue(entry logEntry) ([]Versioned, error) {
+	rec := make([]byte, entry.size)
+	if _, err := e.file.ReadAt(rec, entry.offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(rec[4:]) != binary.BigEndian.Uint32(rec[0:4]) {
+		return nil, errCorrupt
+	}
+	keyLen := binary.BigEndian.Uint32(rec[4:8])
+	flags := binary.BigEndian.Uint32(rec[8:12]) &^ lengthMask
+	return decodeValue(flags, rec[headerSize+keyLen:])
+}
+
+// decodeValue decodes the siblings in the value of a record with flags.
+func decodeValue(flags uint32, val []byte) ([]Versioned, error) {
+	var r io.Reader = bytes.NewReader(val)
+	if flags&flagCompressed != 0 {
+		fr := flate.NewReader(r)
+		defer fr.Close()
+		r = fr
+	}
+	if flags&flagBytes == 0 {
+		return decodeStringSiblings(r)
+	}
+	var siblings []Versioned
+	if err := gob.NewDecoder(r).Decode(&siblings); err != nil {
+		return nil, err
+	}
+	return siblings, nil
+}
+
+// stringVersioned is a Versioned as logged before values became byte slices.
+type stringVersioned struct {
+	Value     string
+	Clock     vclock.VClock
+	Timestamp int64
+	Deleted   bool
+	ExpiresAt int64
+}
+
+// decodeStringSiblings decodes siblings logged with string values.
+func decodeStringSiblings(r io.Reader) ([]Versioned, error) {
+	var old []stringVersioned
+	if err := gob.NewDecoder(r).Decode(&old); err != nil {
+		return nil, err
+	}
+	siblings := make([]Versioned, len(old))
+	for i, v := range old {
+		siblings[i] = Versioned{Value: []byte(v.Value), Clock: v.Clock, Timestamp: v.Timestamp, Deleted: v.Deleted, ExpiresAt: v.ExpiresAt}
+	}
+	return siblings, nil
+}
+
+// Save appends a new record for key to the log.
+func (e *LogEngine) Save(key string, siblings []Versioned) error {
+	if siblings == nil {
+		siblings = []Versioned{}
+	}
+	return e.append(key, siblings)
+}
+
+// Delete appends a deletion record for key to the log.
+func (e *LogEngine) Delete(key string) error {
+	e.mu.Lock()
+	_, ok := e.keydir[key]
+	err := e.err
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return e.append(key, nil)
+}
+
+// Keys returns every key in the key directory.
+func (e *LogEngine) Keys() ([]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	keys := make([]string, 0, len(e.keydir))
+	for key := range e.keydir {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// append writes a record for key to the end of the log and points the key
+// directory at it. A nil siblings list removes the key.
+func (e *LogEngine) append(key string, siblings []Versioned) error {
+	rec, err := encodeRecord(key, siblings, e.opts.CompressThreshold)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+	if _, err := e.file.WriteAt(rec, e.size); err != nil {
+		// Drop whatever part of the record made it to disk.
+		e.file.Truncate(e.size)
+		return fmt.Errorf("failed to append %q to log: %w", key, err)
+	}
+	if e.opts.SyncWrites {
+		if err := e.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log: %w", err)
+		}
+	}
+
+	if old, ok := e.keydir[key]; ok {
+		e.live -= old.size
+	}
+	if siblings == nil {
+		delete(e.keydir, key)
+	} else {
+		e.keydir[key] = logEntry{offset: e.size, size: int64(len(rec))}
+		e.live += int64(len(rec))
+	}
+	e.size += int64(len(rec))
+	return nil
+}
+
+// Compact rewrites the log so it only holds the latest record of each key.
+// The new log is synced and renamed over the old one, so a crash at any
+// point leaves either the old or the new log intact.
+func (e *LogEngine) Compact() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+	path := filepath.Join(e.dir, logFileName)
+	tmpPath := filepath.Join(e.dir, compactFileName)
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", tmpPath, err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, entry := range e.keydir {
+		rec := make([]byte, entry.size)
+		if _, err := e.file.ReadAt(rec, entry.offset); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to read record during compaction: %w", err)
+		}
+		if _, err := w.Write(rec); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to write %q: %w", tmpPath, err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %q: %w", tmpPath, err)
+	}
+	tmp.Close()
+
+	// Offsets into the old log mean nothing in the new one, so the log
+	// must not keep its ID across the rename. The ID is removed before it
+	// and a new one saved after; a crash in between leaves a log without
+	// an ID, which gets a new one on open and only costs incremental
+	// backups their base.
+	idPath := filepath.Join(e.dir, idFileName)
+	if err := os.Remove(idPath); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to remove log ID %q: %w", idPath, err)
+	}
+	syncDir(e.dir)
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		if err := e.saveID(e.id); err != nil {
+			log.Printf("Error restoring log ID: %v\n", err)
+		}
+		return fmt.Errorf("failed to replace log with compacted log: %w", err)
+	}
+	syncDir(e.dir)
+	e.id = newLogID()
+	idErr := e.saveID(e.id)
+
+	// The old file is unlinked now: writes to it would be lost, so if the
+	// new log cannot be opened the engine is unusable until restarted.
+	before, old := e.size, e.file
+	err = e.open()
+	old.Close()
+	if err != nil {
+		e.err = fmt.Errorf("log engine unusable after compaction: %w", err)
+		return e.err
+	}
+	if idErr != nil {
+		return idErr
+	}
+	log.Printf("Compacted log %q from %d to %d bytes\n", path, before, e.size)
+	return nil
+}
+
+// loadID reads the ID of the log, creating one for a log that has none.
+func (e *LogEngine) loadID() error {
+	path := filepath.Join(e.dir, idFileName)
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) > 0 {
+		e.id = string(bytes.TrimSpace(data))
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read log ID %q: %w", path, err)
+	}
+	e.id = newLogID()
+	return e.saveID(e.id)
+}
+
+// saveID atomically replaces the ID of the log on disk.
+func (e *LogEngine) saveID(id string) error {
+	path := filepath.Join(e.dir, idFileName)
+	if err := os.WriteFile(path+".tmp", []byte(id+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write log ID %q: %w", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write log ID %q: %w", path, err)
+	}
+	syncDir(e.dir)
+	return nil
+}
+
+// newLogID returns a random log ID.
+func newLogID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Position returns the current end of the log.
+func (e *LogEngine) Position() LogPosition {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return LogPosition{Log: e.id, Offset: e.size}
+}
+
+// Replay calls fn for every record appended to the log from since on, in
+// order, with nil siblings for a removed key. It returns the position it
+// stopped at. Since must have been returned by Position on the same log
+// and must not predate its latest compaction.
+func (e *LogEngine) Replay(since LogPosition, fn func(key string, siblings []Versioned) error) (LogPosition, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return LogPosition{}, e.err
+	}
+	if since.Log != e.id || since.Offset < 0 || since.Offset > e.size {
+		return LogPosition{}, fmt.Errorf("%w: base is %s, log is at %s:%d", ErrStalePosition, since, e.id, e.size)
+	}
+	r := bufio.NewReader(io.NewSectionReader(e.file, since.Offset, e.size-since.Offset))
+	for offset := since.Offset; offset < e.size; {
+		key, flags, val, size, err := readRecordValue(r)
+		if err != nil {
+			return LogPosition{}, fmt.Errorf("failed to read log at offset %d: %w", offset, err)
+		}
+		var siblings []Versioned
+		if len(val) > 0 {
+			if siblings, err = decodeValue(flags, val); err != nil {
+				return LogPosition{}, fmt.Errorf("failed to decode %q at offset %d: %w", key, offset, err)
+			}
+			if siblings == nil {
+				siblings = []Versioned{}
+			}
+		}
+		if err := fn(key, siblings); err != nil {
+			return LogPosition{}, err
+		}
+		offset += size
+	}
+	return LogPosition{Log: e.id, Offset: e.size}, nil
+}
+
+// compactLoop compacts the log whenever enough of it has become stale.
+func (e *LogEngine) compactLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.mu.Lock()
+			size, live, broken := e.size, e.live, e.err != nil
+			e.mu.Unlock()
+			if broken || size == 0 || float64(size-live)/float64(size) < e.opts.CompactMinGarbage {
+				continue
+			}
+			if err := e.Compact(); err != nil {
+				log.Printf("Error compacting log: %v\n", err)
+			}
+		}
+	}
+}
+
+// Close stops background compaction and closes the log file.
+func (e *LogEngine) Close() error {
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err // the file was closed when the engine broke
+	}
+	if err := e.file.Sync(); err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
+
+// syncDir flushes a directory entry change such as a rename to disk.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
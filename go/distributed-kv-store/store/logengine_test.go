@@ -0,0 +1,333 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The crash tests run the test binary again as a child that writes to a
+// log and prints each write once Save has returned. The parent kills it
+// with SIGKILL, reopens the log and checks every printed write survived.
+const (
+	crashModeEnv = "KVS_CRASH_MODE"
+	crashDirEnv  = "KVS_CRASH_DIR"
+
+	crashKeys = 500
+)
+
+// crashValue is the value of key in round, padded so that appends and
+// compactions take long enough to be interrupted.
+func crashValue(key string, round int) []byte {
+	return []byte(fmt.Sprintf("%s@%d|%s", key, round, strings.Repeat("x", 2048)))
+}
+
+// crashRound returns the round a crashValue was written in.
+func crashRound(value []byte) (int, error) {
+	_, rest, ok := bytes.Cut(value, []byte("@"))
+	if !ok {
+		return 0, fmt.Errorf("malformed value %.40q", value)
+	}
+	round, _, _ := bytes.Cut(rest, []byte("|"))
+	return strconv.Atoi(string(round))
+}
+
+// TestLogEngineCrashChild is the child of the crash tests. It does nothing
+// when run on its own.
+func TestLogEngineCrashChild(t *testing.T) {
+	mode := os.Getenv(crashModeEnv)
+	if mode == "" {
+		t.Skip("only runs as the child of a crash test")
+	}
+	e, err := OpenLogEngine(os.Getenv(crashDirEnv), LogOptions{SyncWrites: true})
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+
+	// Stdout is unbuffered, so a line printed is a line the parent can read.
+	ack := func(format string, args ...any) {
+		fmt.Printf(format+"\n", args...)
+	}
+	if mode == "compact" {
+		go func() {
+			for {
+				ack("compacting")
+				if err := e.Compact(); err != nil {
+					ack("error %v", err)
+					os.Exit(1)
+				}
+			}
+		}()
+	}
+	for round := 0; ; round++ {
+		for i := 0; i < crashKeys; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if err := e.Save(key, []Versioned{{Value: crashValue(key, round)}}); err != nil {
+				ack("error %v", err)
+				os.Exit(1)
+			}
+			ack("ack %s %d", key, round)
+		}
+	}
+}
+
+// crash runs the child in mode on dir, kills it once it has printed after
+// lines and returns the latest acknowledged round of each key.
+func crash(t *testing.T, dir, mode string, after int, delay time.Duration) map[string]int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLogEngineCrashChild$")
+	cmd.Env = append(os.Environ(), crashModeEnv+"="+mode, crashDirEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill a child that stalls rather than hang the test.
+	stall := time.AfterFunc(30*time.Second, func() { cmd.Process.Signal(syscall.SIGKILL) })
+	defer stall.Stop()
+
+	acked := make(map[string]int)
+	lines := 0
+	killed := false
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == "ack":
+			round, _ := strconv.Atoi(fields[2])
+			acked[fields[1]] = round
+		case len(fields) > 0 && fields[0] == "error":
+			t.Errorf("child: %s", sc.Text())
+		}
+		if lines++; lines == after && !killed {
+			killed = true
+			// The kill lands after a delay, somewhere in the middle of
+			// whatever the child is doing by then.
+			go func() {
+				time.Sleep(delay)
+				cmd.Process.Signal(syscall.SIGKILL)
+			}()
+		}
+	}
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+		t.Fatalf("child was not killed: %v", err)
+	}
+	return acked
+}
+
+// checkAcked reopens the store in dir and checks that every key holds the
+// round acknowledged for it, or a later one.
+func checkAcked(t *testing.T, dir string, acked map[string]int) {
+	t.Helper()
+	e, err := OpenLogEngine(dir, LogOptions{})
+	if err != nil {
+		t.Fatalf("reopening after the crash: %v", err)
+	}
+	s, err := New(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for key, want := range acked {
+		siblings, err := s.Get(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if len(siblings) != 1 {
+			t.Errorf("%s: %d siblings, want 1", key, len(siblings))
+			continue
+		}
+		round, err := crashRound(siblings[0].Value)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else if round < want {
+			t.Errorf("%s: round %d, want %d or later", key, round, want)
+		}
+	}
+}
+
+func TestLogEngineCrashDuringAppend(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs child processes")
+	}
+	dir := t.TempDir()
+	acked := make(map[string]int)
+	for i, delay := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond} {
+		// Each run carries on from the log the previous one left.
+		for key, round := range crash(t, dir, "append", 200+100*i, delay) {
+			acked[key] = round
+		}
+		checkAcked(t, dir, acked)
+	}
+	if len(acked) == 0 {
+		t.Fatal("the child acknowledged no writes")
+	}
+}
+
+func TestLogEngineCrashDuringCompaction(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs child processes")
+	}
+	dir := t.TempDir()
+	acked := make(map[string]int)
+	for i, delay := range []time.Duration{0, 2 * time.Millisecond, 10 * time.Millisecond, 30 * time.Millisecond} {
+		for key, round := range crash(t, dir, "compact", crashKeys+50*i, delay) {
+			acked[key] = round
+		}
+		checkAcked(t, dir, acked)
+		if _, err := os.Stat(filepath.Join(dir, compactFileName)); err == nil {
+			t.Errorf("the compaction file was left behind")
+		}
+	}
+}
+
+// writeLog writes a log of n keys to dir and returns its contents and the
+// size of each record.
+func writeLog(t *testing.T, dir string, n int) ([]byte, int) {
+	t.Helper()
+	e, err := OpenLogEngine(dir, LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if err := e.Save(key, []Versioned{{Value: crashValue(key, 0)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int(e.Position().Offset) / n
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, logFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, size
+}
+
+func TestLogEngineTruncatesTornTail(t *testing.T) {
+	for name, tail := range map[string]func(data []byte, size int) []byte{
+		"torn header": func(data []byte, size int) []byte { return data[:len(data)-size+5] },
+		"torn body":   func(data []byte, size int) []byte { return data[:len(data)-10] },
+		"zeroed": func(data []byte, size int) []byte {
+			return append(data[:len(data)-size], make([]byte, size+100)...)
+		},
+		"bad checksum": func(data []byte, size int) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			data, size := writeLog(t, dir, 10)
+			path := filepath.Join(dir, logFileName)
+			if err := os.WriteFile(path, tail(data, size), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := OpenLogEngine(dir, LogOptions{})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer e.Close()
+			keys, _ := e.Keys()
+			if len(keys) != 9 {
+				t.Errorf("%d keys, want 9", len(keys))
+			}
+			if _, ok, _ := e.Load("key-009"); ok {
+				t.Errorf("the torn record was kept")
+			}
+			if got := e.Position().Offset; got != int64(9*size) {
+				t.Errorf("log is %d bytes, want %d", got, 9*size)
+			}
+		})
+	}
+}
+
+func TestLogEngineRejectsCorruptionBeforeTail(t *testing.T) {
+	dir := t.TempDir()
+	data, size := writeLog(t, dir, 10)
+	data[3*size+headerSize+20] ^= 0xff
+	path := filepath.Join(dir, logFileName)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, err := OpenLogEngine(dir, LogOptions{}); err == nil {
+		e.Close()
+		t.Fatal("opened a log corrupt before its end")
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, data) {
+		t.Errorf("the corrupt log was modified: %d bytes, was %d", len(after), len(data))
+	}
+}
+
+func TestLogEngineFailsAfterReopenFails(t *testing.T) {
+	dir := t.TempDir()
+	e, err := OpenLogEngine(dir, LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Save("key", []Versioned{{Value: []byte{byte(i)}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopenErr := errors.New("no more files")
+	openFile = func(string, int, os.FileMode) (*os.File, error) { return nil, reopenErr }
+	err = e.Compact()
+	openFile = os.OpenFile
+	if !errors.Is(err, reopenErr) {
+		t.Fatalf("Compact: %v, want the reopen error", err)
+	}
+
+	if _, _, err := e.Load("key"); !errors.Is(err, reopenErr) {
+		t.Errorf("Load: %v, want the reopen error", err)
+	}
+	if err := e.Save("key", nil); !errors.Is(err, reopenErr) {
+		t.Errorf("Save: %v, want the reopen error", err)
+	}
+	if err := e.Delete("key"); !errors.Is(err, reopenErr) {
+		t.Errorf("Delete: %v, want the reopen error", err)
+	}
+	if _, err := e.Keys(); !errors.Is(err, reopenErr) {
+		t.Errorf("Keys: %v, want the reopen error", err)
+	}
+	if err := e.Compact(); !errors.Is(err, reopenErr) {
+		t.Errorf("Compact: %v, want the reopen error", err)
+	}
+	e.Close()
+
+	// The compacted log is intact, and a restart opens it.
+	e, err = OpenLogEngine(dir, LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if siblings, ok, err := e.Load("key"); err != nil || !ok || siblings[0].Value[0] != 2 {
+		t.Errorf("after a restart, Load = %v, %t, %v", siblings, ok, err)
+	}
+}
@@ -1,40 +1,357 @@
 package store
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"distributed-kv-store/vclock"
 	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
-// Store represents a simple in-memory key-value store.
+// ErrKeyNotFound is returned when a key is not present in the store.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Conflict resolution policies for keys with more than one sibling.
+const (
+	PolicyMerge = "merge" // return every sibling and let the client merge them
+	PolicyLWW   = "lww"   // keep only the sibling with the latest timestamp
+)
+
+// Versioned is a value tagged with the vector clock of the write that produced it.
+type Versioned struct {
+	Value     []byte // opaque to the store
+	Clock     vclock.VClock
+	Timestamp int64 // wall-clock time of the write in Unix nanoseconds, used by PolicyLWW
+
+	// Deleted marks a tombstone. Tombstones replicate like any other version
+	// so that a delete supersedes the values it has seen on every replica.
+	Deleted bool
+	// ExpiresAt is the Unix nanosecond time after which the value is no
+	// longer visible. Zero means the value never expires.
+	ExpiresAt int64
+}
+
+// Expired reports whether the version has passed its expiry time.
+func (v Versioned) Expired(now time.Time) bool {
+	return v.ExpiresAt != 0 && now.UnixNano() >= v.ExpiresAt
+}
+
+// Entry is a key and its siblings as returned by Scan.
+type Entry struct {
+	Key      string
+	Siblings []Versioned
+}
+
+// Store represents a key-value store on top of a storage Engine. Each key
+// holds one or more concurrent versions (siblings). A sorted index of keys
+// is kept in memory for range scans.
 type Store struct {
-	mu    sync.RWMutex
-	data  map[string]string
+	mu     sync.RWMutex
+	engine Engine
+	index  []string        // sorted keys
+	locks  map[string]lock // keys held by prepared transactions
+
+	revision uint64        // revision of the latest change
+	log      []Event       // recent changes, oldest first
+	changed  chan struct{} // closed and replaced on every change
+
+	stop chan struct{}
+	done chan struct{}
 }
 
-// NewStore creates and returns a new Store instance.
+// NewStore creates and returns a new in-memory Store instance.
 func NewStore() *Store {
-	return &Store{
-		data: make(map[string]string),
+	s, _ := New(NewMemEngine()) // an empty MemEngine cannot fail to list its keys
+	return s
+}
+
+// New creates and returns a Store backed by engine, building the key index
+// from the keys the engine already holds.
+func New(engine Engine) (*Store, error) {
+	keys, err := engine.Keys()
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(keys)
+	return &Store{
+		engine:  engine,
+		index:   keys,
+		locks:   make(map[string]lock),
+		changed: make(chan struct{}),
+	}, nil
 }
 
-// Get retrieves the value associated with a key.
-func (s *Store) Get(key string) (string, error) {
+// Get retrieves the siblings associated with a key, including tombstones
+// and expired versions. Use Live to filter them.
+func (s *Store) Get(key string) ([]Versioned, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	val, ok := s.data[key]
+	siblings, ok, err := s.engine.Load(key)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return "", errors.New("key not found")
+		return nil, ErrKeyNotFound
+	}
+	return append([]Versioned(nil), siblings...), nil
+}
+
+// Put stores a versioned value. Siblings that the new version descends from
+// are replaced; a version that is already superseded is ignored. Put fails
+// with ErrLocked while a prepared transaction holds the key.
+func (s *Store) Put(key string, v Versioned) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.locks[key]; ok && time.Now().Before(l.expires) {
+		return ErrLocked
+	}
+	return s.apply([]Op{{Key: key, Version: v}})
+}
+
+// Scan returns up to limit keys in [start, end) in ascending order, with
+// their raw siblings. An empty end means no upper bound and a limit of
+// zero or less means no limit.
+func (s *Store) Scan(start, end string, limit int) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []Entry
+	for i := sort.SearchStrings(s.index, start); i < len(s.index); i++ {
+		key := s.index[i]
+		if end != "" && key >= end {
+			break
+		}
+		siblings, ok, err := s.engine.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Key: key, Siblings: siblings})
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Len returns the number of keys held by the store, including keys that
+// only have tombstones left.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.index)
+}
+
+// Sweep drops expired versions and tombstones older than tombstoneGrace,
+// removing keys that have nothing left. Removing a key whose value expired
+// is logged as a delete for watchers. It returns the number of keys removed.
+func (s *Store) Sweep(now time.Time, tombstoneGrace time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	keys := append([]string(nil), s.index...)
+	for _, key := range keys {
+		siblings, ok, err := s.engine.Load(key)
+		if err != nil {
+			return removed, err
+		}
+		if !ok {
+			continue
+		}
+
+		var kept []Versioned
+		expired := false
+		for _, v := range siblings {
+			if v.Expired(now) {
+				expired = expired || !v.Deleted
+				continue
+			}
+			if v.Deleted && now.Sub(time.Unix(0, v.Timestamp)) > tombstoneGrace {
+				continue
+			}
+			kept = append(kept, v)
+		}
+
+		switch {
+		case len(kept) == len(siblings):
+		case len(kept) == 0:
+			if err := s.engine.Delete(key); err != nil {
+				return removed, err
+			}
+			s.indexRemove(key)
+			removed++
+			// Watchers saw tombstones when they were written, but not
+			// values expiring.
+			if expired {
+				s.record(key, siblings, nil)
+			}
+		default:
+			if err := s.engine.Save(key, kept); err != nil {
+				return removed, err
+			}
+		}
 	}
-	return val, nil
+	return removed, nil
+}
+
+// StartSweeper runs Sweep every interval in the background until the store
+// is closed. Tombstones are kept for tombstoneGrace so that replicas that
+// missed a delete can still learn about it.
+func (s *Store) StartSweeper(interval, tombstoneGrace time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case now := <-ticker.C:
+				n, err := s.Sweep(now, tombstoneGrace)
+				if err != nil {
+					log.Printf("Error sweeping expired keys: %v\n", err)
+				} else if n > 0 {
+					log.Printf("Swept %d expired or deleted keys\n", n)
+				}
+			}
+		}
+	}()
 }
 
-// Put stores a key-value pair.
-func (s *Store) Put(key, value string) error {
+// Close stops the sweeper and closes the underlying engine.
+func (s *Store) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.data[key] = value
-	return nil
+	return s.engine.Close()
+}
+
+// indexInsert adds key to the sorted index.
+func (s *Store) indexInsert(key string) {
+	i := sort.SearchStrings(s.index, key)
+	if i < len(s.index) && s.index[i] == key {
+		return
+	}
+	s.index = append(s.index, "")
+	copy(s.index[i+1:], s.index[i:])
+	s.index[i] = key
+}
+
+// indexRemove removes key from the sorted index.
+func (s *Store) indexRemove(key string) {
+	i := sort.SearchStrings(s.index, key)
+	if i < len(s.index) && s.index[i] == key {
+		s.index = append(s.index[:i], s.index[i+1:]...)
+	}
+}
+
+// PrefixEnd returns the smallest key greater than every key with the given
+// prefix, for use as the end of a scan. It returns "" if there is none.
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// Reconcile merges sibling lists, dropping every version that another
+// version descends from.
+func Reconcile(lists ...[]Versioned) []Versioned {
+	var result []Versioned
+	for _, list := range lists {
+		for _, v := range list {
+			result = addSibling(result, v)
+		}
+	}
+	return result
+}
+
+// addSibling adds v to siblings unless it is superseded, removing any
+// siblings that v supersedes.
+func addSibling(siblings []Versioned, v Versioned) []Versioned {
+	kept := make([]Versioned, 0, len(siblings)+1)
+	for _, sib := range siblings {
+		switch v.Clock.Compare(sib.Clock) {
+		case vclock.Before, vclock.Equal:
+			return siblings
+		case vclock.Concurrent:
+			kept = append(kept, sib)
+		}
+	}
+	return append(kept, v)
+}
+
+// Live returns the siblings that are neither tombstones nor expired.
+func Live(siblings []Versioned, now time.Time) []Versioned {
+	var live []Versioned
+	for _, v := range siblings {
+		if !v.Deleted && !v.Expired(now) {
+			live = append(live, v)
+		}
+	}
+	return live
+}
+
+// Resolve applies a conflict resolution policy to a list of siblings.
+// PolicyMerge returns the siblings unchanged.
+func Resolve(siblings []Versioned, policy string) []Versioned {
+	if policy != PolicyLWW || len(siblings) <= 1 {
+		return siblings
+	}
+	winner := siblings[0]
+	for _, v := range siblings[1:] {
+		if v.Timestamp > winner.Timestamp || (v.Timestamp == winner.Timestamp && bytes.Compare(v.Value, winner.Value) > 0) {
+			winner = v
+		}
+	}
+	return []Versioned{winner}
+}
+
+// Context returns the merged clock of all siblings. Writing with this
+// context supersedes every sibling it was computed from.
+func Context(siblings []Versioned) vclock.VClock {
+	ctx := vclock.New()
+	for _, v := range siblings {
+		ctx = ctx.Merge(v.Clock)
+	}
+	return ctx
+}
+
+// Digest returns a hash of a sibling list that does not depend on the
+// order of the siblings, so replicas can cheaply compare their versions.
+func Digest(siblings []Versioned) []byte {
+	parts := make([]string, len(siblings))
+	for i, v := range siblings {
+		parts[i] = fmt.Sprintf("%s|%t|%d|%d|%s", v.Clock, v.Deleted, v.ExpiresAt, v.Timestamp, v.Value)
+	}
+	sort.Strings(parts)
+
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	return h.Sum(nil)
 }
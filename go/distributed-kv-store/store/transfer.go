@@ -0,0 +1,66 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// ScanMatching returns up to limit keys from start on, in ascending order,
+// that match accepts, with their raw siblings. A limit of zero or less
+// means no limit. To continue, scan again from the last key plus "\x00".
+func (s *Store) ScanMatching(start string, limit int, match func(key string) bool) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []Entry
+	for i := sort.SearchStrings(s.index, start); i < len(s.index); i++ {
+		key := s.index[i]
+		if !match(key) {
+			continue
+		}
+		siblings, ok, err := s.engine.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Key: key, Siblings: siblings})
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Release removes entries that were copied to the nodes that now own them.
+// A key is kept if its siblings changed since the entry was read or a
+// transaction holds it, since the copy may then be out of date. Removing a
+// key this way is not a change to its value, so it is not logged for
+// watchers. It returns the number of keys removed.
+func (s *Store) Release(entries []Entry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for _, e := range entries {
+		if l, ok := s.locks[e.Key]; ok && now.Before(l.expires) {
+			continue
+		}
+		siblings, ok, err := s.engine.Load(e.Key)
+		if err != nil {
+			return removed, err
+		}
+		if !ok || !bytes.Equal(Digest(siblings), Digest(e.Siblings)) {
+			continue
+		}
+		if err := s.engine.Delete(e.Key); err != nil {
+			return removed, err
+		}
+		s.indexRemove(e.Key)
+		removed++
+	}
+	return removed, nil
+}
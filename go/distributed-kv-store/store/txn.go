@@ -0,0 +1,167 @@
+package store
+
+import (
+	"distributed-kv-store/vclock"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrConflict is returned when a conditional write finds a key at a version
+// other than the one it expected.
+var ErrConflict = errors.New("version conflict")
+
+// ErrLocked is returned when a key is locked by another transaction.
+var ErrLocked = errors.New("key is locked by another transaction")
+
+// Op is one write of a batch. When Check is set, the whole batch only
+// applies if the key is still at the version described by Expected (see
+// Matches).
+type Op struct {
+	Key     string
+	Version Versioned
+
+	Check    bool
+	Expected vclock.VClock
+}
+
+// lock is a key held by a prepared transaction.
+type lock struct {
+	txn     string
+	expires time.Time
+}
+
+// Matches reports whether a key with the given raw siblings is at the
+// version expected. A non-empty expected clock must equal the context of
+// the siblings, as returned by a read; an empty one requires the key to
+// have no live value.
+func Matches(siblings []Versioned, expected vclock.VClock, now time.Time) bool {
+	if len(expected) == 0 {
+		return len(Live(siblings, now)) == 0
+	}
+	return Context(siblings).Compare(expected) == vclock.Equal
+}
+
+// CompareAndSwap writes v to key if the key is still at the expected
+// version, and returns ErrConflict otherwise.
+func (s *Store) CompareAndSwap(key string, expected vclock.VClock, v Versioned) error {
+	return s.Batch([]Op{{Key: key, Version: v, Check: true, Expected: expected}})
+}
+
+// Batch checks the conditions of all ops and, if every one holds, applies
+// all of their writes. Readers never see part of a batch. Keys locked by a
+// prepared transaction make the batch fail with ErrLocked.
+func (s *Store) Batch(ops []Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, op := range ops {
+		if l, ok := s.locks[op.Key]; ok && now.Before(l.expires) {
+			return ErrLocked
+		}
+		if !op.Check {
+			continue
+		}
+		siblings, _, err := s.engine.Load(op.Key)
+		if err != nil {
+			return err
+		}
+		if !Matches(siblings, op.Expected, now) {
+			return fmt.Errorf("%w on key %s", ErrConflict, op.Key)
+		}
+	}
+	return s.apply(ops)
+}
+
+// Prepare locks keys for the transaction txn until ttl has passed, and
+// returns their raw siblings. It fails with ErrLocked, taking no locks, if
+// another transaction holds any of the keys. Preparing a transaction again
+// extends its locks.
+func (s *Store) Prepare(txn string, keys []string, ttl time.Duration) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if l, ok := s.locks[key]; ok && l.txn != txn && now.Before(l.expires) {
+			return nil, ErrLocked
+		}
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		siblings, ok, err := s.engine.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, Entry{Key: key, Siblings: append([]Versioned(nil), siblings...)})
+		}
+	}
+	for _, key := range keys {
+		s.locks[key] = lock{txn: txn, expires: now.Add(ttl)}
+	}
+	return entries, nil
+}
+
+// Commit applies the writes of a prepared transaction and releases its
+// locks. The coordinator decided to commit while the keys were locked, so
+// the conditions of the transaction are not checked again and the writes
+// apply even if the locks have expired since. Only if another transaction
+// has locked one of the keys in the meantime does Commit fail, with
+// ErrLocked and writing nothing, so that it can be retried once that
+// transaction is done.
+func (s *Store) Commit(txn string, ops []Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, op := range ops {
+		if l, ok := s.locks[op.Key]; ok && l.txn != txn && now.Before(l.expires) {
+			return ErrLocked
+		}
+	}
+	err := s.apply(ops)
+	s.unlock(txn)
+	return err
+}
+
+// Abort releases the locks held by the transaction txn.
+func (s *Store) Abort(txn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unlock(txn)
+}
+
+// apply stores the versions of ops and logs the changes they make. The
+// caller must hold s.mu.
+func (s *Store) apply(ops []Op) error {
+	for _, op := range ops {
+		siblings, existed, err := s.engine.Load(op.Key)
+		if err != nil {
+			return err
+		}
+		after := Reconcile(siblings, []Versioned{op.Version})
+		if err := s.engine.Save(op.Key, after); err != nil {
+			return err
+		}
+		if !existed {
+			s.indexInsert(op.Key)
+		}
+		s.record(op.Key, siblings, after)
+	}
+	return nil
+}
+
+// unlock releases every lock held by txn, along with any expired lock. The
+// caller must hold s.mu.
+func (s *Store) unlock(txn string) {
+	now := time.Now()
+	for key, l := range s.locks {
+		if l.txn == txn || !now.Before(l.expires) {
+			delete(s.locks, key)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"distributed-kv-store/vclock"
+	"errors"
+	"testing"
+	"time"
+)
+
+func version(value, node string) Versioned {
+	return Versioned{Value: []byte(value), Clock: vclock.New().Increment(node), Timestamp: time.Now().UnixNano()}
+}
+
+func TestPutWaitsForLocks(t *testing.T) {
+	s := NewStore()
+	if _, err := s.Prepare("txn", []string{"k"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("k", version("a", "n1")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Put on a locked key = %v, want ErrLocked", err)
+	}
+	s.Abort("txn")
+	if err := s.Put("k", version("a", "n1")); err != nil {
+		t.Fatalf("Put once the key is unlocked: %v", err)
+	}
+}
+
+func TestCommitAfterLockExpired(t *testing.T) {
+	s := NewStore()
+	if _, err := s.Prepare("txn", []string{"k"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := s.Commit("txn", []Op{{Key: "k", Version: version("a", "n1")}}); err != nil {
+		t.Fatalf("Commit after the lock expired: %v", err)
+	}
+	if _, err := s.Get("k"); err != nil {
+		t.Fatalf("the commit was not applied: %v", err)
+	}
+}
+
+func TestCommitWaitsForOtherTransaction(t *testing.T) {
+	s := NewStore()
+	if _, err := s.Prepare("txn", []string{"a", "b"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Prepare("rival", []string{"b"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []Op{{Key: "a", Version: version("1", "n1")}, {Key: "b", Version: version("2", "n1")}}
+	if err := s.Commit("txn", ops); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Commit of a key locked by another transaction = %v, want ErrLocked", err)
+	}
+	if _, err := s.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("part of a refused commit was applied: %v", err)
+	}
+
+	s.Abort("rival")
+	if err := s.Commit("txn", ops); err != nil {
+		t.Fatalf("Commit once the other transaction is done: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Get(key); err != nil {
+			t.Fatalf("Get(%s) after the commit: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ChangeLogSize is the minimum number of recent changes a store keeps for
+// watchers. Older changes are dropped in batches.
+const ChangeLogSize = 10000
+
+// ErrCompacted is returned when a watch asks for a revision the change log
+// no longer holds, or does not hold yet because the store was restarted.
+// The watcher has to read the current state again and watch from now on.
+var ErrCompacted = errors.New("revision is not in the change log")
+
+// EventType tells whether a change left a key with a live value.
+type EventType string
+
+// Event types.
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event is one change to a key in the change log. Siblings holds the raw
+// siblings of the key after the change.
+type Event struct {
+	Revision uint64
+	Key      string
+	Type     EventType
+	Siblings []Versioned
+}
+
+// Revision returns the revision of the latest change to the store. It
+// starts from zero whenever the store is opened.
+func (s *Store) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.revision
+}
+
+// Watch returns up to limit changes to keys accepted by match, starting at
+// revision from, along with the revision to pass as from to get the next
+// changes. A from of zero starts after the latest change. If there are no
+// such changes yet, Watch waits up to timeout for one before returning
+// none. An expired value is reported as a delete once Sweep removes its
+// key.
+func (s *Store) Watch(from uint64, match func(key string) bool, limit int, timeout time.Duration) ([]Event, uint64, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.RLock()
+		events, next, err := s.changes(from, match, limit)
+		changed := s.changed
+		s.mu.RUnlock()
+		if err != nil || len(events) > 0 {
+			return events, next, err
+		}
+
+		from = next
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, from, nil
+		}
+	}
+}
+
+// changes returns the logged changes from revision from that match. The
+// caller must hold s.mu.
+func (s *Store) changes(from uint64, match func(key string) bool, limit int) ([]Event, uint64, error) {
+	if from == 0 {
+		from = s.revision + 1
+	}
+	oldest := s.revision + 1
+	if len(s.log) > 0 {
+		oldest = s.log[0].Revision
+	}
+	if from < oldest || from > s.revision+1 {
+		return nil, from, ErrCompacted
+	}
+
+	var events []Event
+	next := from
+	for _, e := range s.log[from-oldest:] {
+		next = e.Revision + 1
+		if match == nil || match(e.Key) {
+			events = append(events, e)
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+		}
+	}
+	return events, next, nil
+}
+
+// record logs a change to key and wakes up watchers, unless the siblings
+// did not actually change. The caller must hold s.mu.
+func (s *Store) record(key string, before, after []Versioned) {
+	if len(before) == len(after) && bytes.Equal(Digest(before), Digest(after)) {
+		return
+	}
+
+	s.revision++
+	e := Event{Revision: s.revision, Key: key, Type: EventDelete, Siblings: after}
+	if len(Live(after, time.Now())) > 0 {
+		e.Type = EventPut
+	}
+	s.log = append(s.log, e)
+	if len(s.log) >= 2*ChangeLogSize {
+		s.log = append([]Event(nil), s.log[len(s.log)-ChangeLogSize:]...)
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
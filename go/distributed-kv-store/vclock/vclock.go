@@ -0,0 +1,101 @@
+package vclock
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Ordering describes how two vector clocks relate to each other.
+type Ordering int
+
+const (
+	Equal      Ordering = iota // both clocks describe the same version
+	Before                     // the first clock happened before the second
+	After                      // the first clock happened after the second
+	Concurrent                 // neither clock descends from the other
+)
+
+// VClock is a vector clock mapping node IDs to event counters.
+type VClock map[string]uint64
+
+// New returns an empty vector clock.
+func New() VClock {
+	return make(VClock)
+}
+
+// Copy returns an independent copy of the clock.
+func (vc VClock) Copy() VClock {
+	c := make(VClock, len(vc))
+	for node, n := range vc {
+		c[node] = n
+	}
+	return c
+}
+
+// Increment returns a copy of the clock with node's counter advanced by one.
+func (vc VClock) Increment(node string) VClock {
+	c := vc.Copy()
+	c[node]++
+	return c
+}
+
+// Merge returns the pointwise maximum of the two clocks.
+func (vc VClock) Merge(other VClock) VClock {
+	c := vc.Copy()
+	for node, n := range other {
+		if n > c[node] {
+			c[node] = n
+		}
+	}
+	return c
+}
+
+// Compare reports how vc is ordered relative to other.
+func (vc VClock) Compare(other VClock) Ordering {
+	less, greater := false, false
+	for node, n := range vc {
+		if m := other[node]; n > m {
+			greater = true
+		} else if n < m {
+			less = true
+		}
+	}
+	for node, m := range other {
+		if _, ok := vc[node]; !ok && m > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// Descends reports whether vc is equal to or happened after other.
+func (vc VClock) Descends(other VClock) bool {
+	o := vc.Compare(other)
+	return o == After || o == Equal
+}
+
+// String formats the clock with its nodes in sorted order.
+func (vc VClock) String() string {
+	nodes := make([]string, 0, len(vc))
+	for node := range vc {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("%s:%d", node, vc[node])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,65 @@
+package vclock
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b VClock
+		want Ordering
+	}{
+		{nil, nil, Equal},
+		{VClock{}, VClock{"a": 0}, Equal},
+		{VClock{"a": 1}, VClock{"a": 1}, Equal},
+		{VClock{"a": 1}, VClock{"a": 2}, Before},
+		{VClock{"a": 2}, VClock{"a": 1}, After},
+		{nil, VClock{"a": 1}, Before},
+		{VClock{"a": 1}, nil, After},
+		{VClock{"a": 1}, VClock{"a": 1, "b": 1}, Before},
+		{VClock{"a": 1, "b": 1}, VClock{"b": 1}, After},
+		{VClock{"a": 1}, VClock{"b": 1}, Concurrent},
+		{VClock{"a": 2, "b": 1}, VClock{"a": 1, "b": 2}, Concurrent},
+		{VClock{"a": 1, "b": 0}, VClock{"a": 1}, Equal},
+	} {
+		if got := tc.a.Compare(tc.b); got != tc.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got, want := tc.a.Descends(tc.b), tc.want == Equal || tc.want == After; got != want {
+			t.Errorf("%v.Descends(%v) = %t, want %t", tc.a, tc.b, got, want)
+		}
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	a := VClock{"a": 1}
+	b := a.Increment("a").Increment("b")
+	if a["a"] != 1 || len(a) != 1 {
+		t.Errorf("Increment changed the original clock to %v", a)
+	}
+	if b.String() != "{a:2, b:1}" {
+		t.Errorf("Increment = %v, want {a:2, b:1}", b)
+	}
+	if b.Compare(a) != After {
+		t.Errorf("%v is not after %v", b, a)
+	}
+	if got := VClock(nil).Increment("a"); got["a"] != 1 {
+		t.Errorf("incrementing a nil clock = %v", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := VClock{"a": 3, "b": 1}
+	b := VClock{"b": 2, "c": 1}
+	m := a.Merge(b)
+	if m.String() != "{a:3, b:2, c:1}" {
+		t.Errorf("Merge = %v, want {a:3, b:2, c:1}", m)
+	}
+	if !m.Descends(a) || !m.Descends(b) {
+		t.Errorf("the merge %v does not descend from both %v and %v", m, a, b)
+	}
+	if a.String() != "{a:3, b:1}" {
+		t.Errorf("Merge changed the original clock to %v", a)
+	}
+	if m.Increment("a").Compare(a) != After || a.Compare(b) != Concurrent {
+		t.Error("a write from the merged context does not supersede the clocks merged")
+	}
+}
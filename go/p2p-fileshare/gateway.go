@@ -0,0 +1,207 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// Gateway serves the web UI and a JSON API on top of a running node.
+type Gateway struct {
+	node      *Node
+	saveDir   string
+	scanHost  string
+	startPort int
+	endPort   int
+}
+
+// SearchResult is a file offered by a peer that matched a search.
+type SearchResult struct {
+	Peer string `json:"peer"`
+	FileMetadata
+}
+
+// downloadRequest is the body accepted by POST /api/downloads.
+type downloadRequest struct {
+	Peer     string `json:"peer"`
+	Filename string `json:"filename"`
+}
+
+// ListenAndServe serves the gateway on addr until an error occurs.
+func (g *Gateway) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.serveIndex)
+	mux.HandleFunc("/api/files", g.handleFiles)
+	mux.HandleFunc("/api/peers", g.handlePeers)
+	mux.HandleFunc("/api/peers/refresh", g.handleRefresh)
+	mux.HandleFunc("/api/search", g.handleSearch)
+	mux.HandleFunc("/api/downloads", g.handleDownloads)
+	mux.HandleFunc("/api/downloads/", g.handleDownload)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (g *Gateway) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
+
+// handleFiles lists the files shared by this node.
+func (g *Gateway) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	files := g.node.sharedFileMetadata()
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handlePeers lists the known peers and the files they share.
+func (g *Gateway) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peers := g.node.knownPeers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// handleRefresh rescans the configured port range and refreshes every known peer.
+func (g *Gateway) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addrs := g.node.scanPeers(g.scanHost, g.startPort, g.endPort)
+	for _, p := range g.node.knownPeers() {
+		addrs = append(addrs, p.Address)
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if err := g.node.refreshPeer(addr); err != nil {
+			log.Printf("Error refreshing peer %s: %v\n", addr, err)
+		}
+	}
+
+	peers := g.node.knownPeers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// handleSearch finds files on known peers by name substring (q) or exact hash.
+func (g *Gateway) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	hash := strings.ToLower(r.URL.Query().Get("hash"))
+	if q == "" && hash == "" {
+		http.Error(w, "Missing q or hash parameter", http.StatusBadRequest)
+		return
+	}
+
+	results := []SearchResult{}
+	for _, p := range g.node.knownPeers() {
+		for _, f := range p.Files {
+			if q != "" && !strings.Contains(strings.ToLower(f.Filename), q) {
+				continue
+			}
+			if hash != "" && f.Hash != hash {
+				continue
+			}
+			results = append(results, SearchResult{Peer: p.Address, FileMetadata: f})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Filename != results[j].Filename {
+			return results[i].Filename < results[j].Filename
+		}
+		return results[i].Peer < results[j].Peer
+	})
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleDownloads lists transfers (GET) or starts a new download (POST).
+func (g *Gateway) handleDownloads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, g.node.listTransfers())
+	case "POST":
+		var req downloadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Peer == "" || req.Filename == "" {
+			http.Error(w, "peer and filename are required", http.StatusBadRequest)
+			return
+		}
+
+		// Use the peer's listing, when known, to report size and verify the hash.
+		var size int64
+		var hash string
+		for _, p := range g.node.knownPeers() {
+			if p.Address != req.Peer {
+				continue
+			}
+			for _, f := range p.Files {
+				if f.Filename == req.Filename {
+					size, hash = f.Filesize, f.Hash
+				}
+			}
+		}
+
+		t := g.node.startDownload(req.Peer, req.Filename, size, hash, g.saveDir)
+		writeJSON(w, http.StatusAccepted, t)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDownload reports the progress of a single transfer.
+func (g *Gateway) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Path[len("/api/downloads/"):])
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	t, ok := g.node.getTransfer(id)
+	if !ok {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v\n", err)
+	}
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// chunkSize is the number of bytes requested per RequestChunk call.
+const chunkSize = 64 * 1024
+
 // FileMetadata represents information about a shared file.
 type FileMetadata struct {
-	Filename string
-	Filesize int64
+	Filename string `json:"filename"`
+	Filesize int64  `json:"filesize"`
+	Hash     string `json:"hash"` // hex-encoded SHA-256 of the file contents
 }
 
 // NodeInfo represents information about a peer node, including its shared files.
@@ -30,6 +38,13 @@ type FileRequest struct {
 	Filename string
 }
 
+// ChunkRequest represents a request for a byte range of a file.
+type ChunkRequest struct {
+	Filename string
+	Offset   int64
+	Length   int64
+}
+
 // FileChunk represents a chunk of a file being transferred.
 type FileChunk struct {
 	Filename string
@@ -40,21 +55,20 @@ type FileChunk struct {
 
 // P2PService is the RPC service for peer-to-peer communication.
 type P2PService struct {
-	mu          sync.RWMutex
-	sharedFiles map[string]string // map[filename]filepath
+	node *Node
 }
 
-// NewP2PService creates a new P2PService instance.
-func NewP2PService(sharedFiles map[string]string) *P2PService {
+// NewP2PService creates a new P2PService instance serving the files of node.
+func NewP2PService(node *Node) *P2PService {
 	return &P2PService{
-		sharedFiles: sharedFiles,
+		node: node,
 	}
 }
 
 // Announce is an RPC method for a node to announce its presence and shared files.
 func (s *P2PService) Announce(nodeInfo NodeInfo, reply *string) error {
 	log.Printf("Received Announce from %s. Shared files: %v\n", nodeInfo.Address, nodeInfo.SharedFiles)
-	// In a real system, you'd update a global peer list here.
+	s.node.recordPeer(nodeInfo.Address, nodeInfo.SharedFiles)
 	*reply = "ACK"
 	return nil
 }
@@ -62,19 +76,7 @@ func (s *P2PService) Announce(nodeInfo NodeInfo, reply *string) error {
 // ListSharedFiles is an RPC method to list files shared by this node.
 func (s *P2PService) ListSharedFiles(args string, reply *[]FileMetadata) error {
 	log.Printf("Received request to list shared files from %s\n", args)
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	var files []FileMetadata
-	for filename, filePath := range s.sharedFiles {
-		fileInfo, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("Warning: Could not get file info for %s: %v\n", filePath, err)
-			continue
-		}
-		files = append(files, FileMetadata{Filename: filename, Filesize: fileInfo.Size()})
-	}
-	*reply = files
+	*reply = s.node.sharedFileMetadata()
 	return nil
 }
 
@@ -82,10 +84,7 @@ func (s *P2PService) ListSharedFiles(args string, reply *[]FileMetadata) error {
 func (s *P2PService) RequestFile(req FileRequest, stream *FileChunk) error {
 	log.Printf("Received request for file: %s\n", req.Filename)
 
-	s.mu.RLock()
-	filePath, ok := s.sharedFiles[req.Filename]
-	s.mu.RUnlock()
-
+	filePath, ok := s.node.sharedFilePath(req.Filename)
 	if !ok {
 		return fmt.Errorf("file %q not found on this node", req.Filename)
 	}
@@ -112,11 +111,57 @@ func (s *P2PService) RequestFile(req FileRequest, stream *FileChunk) error {
 	return nil
 }
 
+// RequestChunk is an RPC method to request a byte range of a file from a peer.
+// The returned chunk has EOF set once the end of the file has been reached.
+func (s *P2PService) RequestChunk(req ChunkRequest, chunk *FileChunk) error {
+	filePath, ok := s.node.sharedFilePath(req.Filename)
+	if !ok {
+		return fmt.Errorf("file %q not found on this node", req.Filename)
+	}
+	if req.Offset < 0 || req.Length <= 0 {
+		return fmt.Errorf("invalid chunk range offset=%d length=%d", req.Offset, req.Length)
+	}
+	if req.Length > chunkSize {
+		req.Length = chunkSize
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", filePath, err)
+	}
+	defer file.Close()
+
+	data := make([]byte, req.Length)
+	n, err := file.ReadAt(data, req.Offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read file %q: %w", filePath, err)
+	}
+
+	chunk.Filename = req.Filename
+	chunk.Offset = req.Offset
+	chunk.Data = data[:n]
+	chunk.EOF = err == io.EOF || int64(n) < req.Length
+	return nil
+}
+
 // Node represents a peer in the P2P network
 type Node struct {
 	Address     string
 	SharedFiles map[string]string // map[filename]filepath
+	fileHashes  map[string]string // map[filename]sha256
+	peers       map[string]*PeerInfo
 	mu          sync.RWMutex
+
+	transfers      []*Transfer
+	transfersMu    sync.RWMutex
+	nextTransferID int
+}
+
+// PeerInfo represents what this node knows about another peer.
+type PeerInfo struct {
+	Address  string         `json:"address"`
+	Files    []FileMetadata `json:"files"`
+	LastSeen time.Time      `json:"last_seen"`
 }
 
 // NewNode creates a new P2P node
@@ -124,6 +169,8 @@ func NewNode(address string) *Node {
 	return &Node{
 		Address:     address,
 		SharedFiles: make(map[string]string),
+		fileHashes:  make(map[string]string),
+		peers:       make(map[string]*PeerInfo),
 	}
 }
 
@@ -140,13 +187,118 @@ func (n *Node) IndexFiles(dir string) error {
 	for _, file := range files {
 		if !file.IsDir() {
 			filePath := filepath.Join(dir, file.Name())
+			hash, err := hashFile(filePath)
+			if err != nil {
+				log.Printf("Warning: Could not hash %s: %v\n", filePath, err)
+				continue
+			}
 			n.SharedFiles[file.Name()] = filePath
+			n.fileHashes[file.Name()] = hash
 			log.Printf("Indexed file: %s (%s)\n", file.Name(), filePath)
 		}
 	}
 	return nil
 }
 
+// hashFile returns the hex-encoded SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sharedFilePath returns the local path of a shared file.
+func (n *Node) sharedFilePath(filename string) (string, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	filePath, ok := n.SharedFiles[filename]
+	return filePath, ok
+}
+
+// sharedFileMetadata returns metadata for every file shared by the node.
+func (n *Node) sharedFileMetadata() []FileMetadata {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var files []FileMetadata
+	for filename, filePath := range n.SharedFiles {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			log.Printf("Warning: Could not get file info for %s: %v\n", filePath, err)
+			continue
+		}
+		files = append(files, FileMetadata{Filename: filename, Filesize: fileInfo.Size(), Hash: n.fileHashes[filename]})
+	}
+	return files
+}
+
+// recordPeer stores or refreshes the file list of a known peer.
+func (n *Node) recordPeer(address string, files []FileMetadata) {
+	if address == "" || address == n.Address {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peers[address] = &PeerInfo{Address: address, Files: files, LastSeen: time.Now()}
+}
+
+// knownPeers returns a snapshot of the peers this node knows about.
+func (n *Node) knownPeers() []PeerInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// refreshPeer fetches the current file list of a peer and records it.
+func (n *Node) refreshPeer(peerAddress string) error {
+	client, err := rpc.Dial("tcp", peerAddress)
+	if err != nil {
+		return fmt.Errorf("failed to dial peer %q: %w", peerAddress, err)
+	}
+	defer client.Close()
+
+	var files []FileMetadata
+	err = client.Call("P2PService.ListSharedFiles", n.Address, &files)
+	if err != nil {
+		return fmt.Errorf("failed to list files from %q: %w", peerAddress, err)
+	}
+	n.recordPeer(peerAddress, files)
+	return nil
+}
+
+// scanPeers returns the addresses on scanHost in the port range that accept connections.
+func (n *Node) scanPeers(scanHost string, startPort, endPort int) []string {
+	var discoveredPeers []string
+
+	for p := startPort; p <= endPort; p++ {
+		peerAddr := net.JoinHostPort(scanHost, strconv.Itoa(p))
+		if peerAddr == n.Address {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", peerAddr, 500*time.Millisecond) // Short timeout
+		if err == nil {
+			conn.Close()
+			discoveredPeers = append(discoveredPeers, peerAddr)
+		}
+	}
+	return discoveredPeers
+}
+
 // listLocalFiles prints the files shared by the local node
 func (n *Node) listLocalFiles() {
 	n.mu.RLock()
@@ -171,21 +323,9 @@ func (n *Node) announceToPeer(peerAddress string) error {
 	}
 	defer client.Close()
 
-	var fileMetadata []FileMetadata
-	n.mu.RLock()
-	for filename, filePath := range n.SharedFiles {
-		fileInfo, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("Warning: Could not get file info for %s: %v\n", filePath, err)
-			continue
-		}
-		fileMetadata = append(fileMetadata, FileMetadata{Filename: filename, Filesize: fileInfo.Size()})
-	}
-	n.mu.RUnlock()
-
 	nodeInfo := NodeInfo{
 		Address:     n.Address,
-		SharedFiles: fileMetadata,
+		SharedFiles: n.sharedFileMetadata(),
 	}
 
 	var reply string
@@ -231,16 +371,7 @@ func (n *Node) requestFileFromPeer(peerAddress, filename, saveDir string) error
 // discoverPeers scans a range of ports on a host and lists shared files from discovered peers.
 func (n *Node) discoverPeers(scanHost string, startPort, endPort int) {
 	log.Printf("Discovering peers on %s from port %d to %d...\n", scanHost, startPort, endPort)
-	var discoveredPeers []string
-
-	for p := startPort; p <= endPort; p++ {
-		peerAddr := fmt.Sprintf("%s:%d", scanHost, p)
-		conn, err := net.DialTimeout("tcp", peerAddr, 500*time.Millisecond) // Short timeout
-		if err == nil {
-			conn.Close()
-			discoveredPeers = append(discoveredPeers, peerAddr)
-		}
-	}
+	discoveredPeers := n.scanPeers(scanHost, startPort, endPort)
 
 	if len(discoveredPeers) == 0 {
 		fmt.Printf("No peers found on %s in port range %d-%d.\n", scanHost, startPort, endPort)
@@ -277,16 +408,7 @@ func (n *Node) discoverPeers(scanHost string, startPort, endPort int) {
 // autoDownload scans for peers, lists their files, and downloads them.
 func (n *Node) autoDownload(scanHost string, startPort, endPort int, saveDir string) {
 	log.Printf("Initiating auto-download from peers on %s from port %d to %d...\n", scanHost, startPort, endPort)
-	var discoveredPeers []string
-
-	for p := startPort; p <= endPort; p++ {
-		peerAddr := fmt.Sprintf("%s:%d", scanHost, p)
-		conn, err := net.DialTimeout("tcp", peerAddr, 500*time.Millisecond)
-		if err == nil {
-			conn.Close()
-			discoveredPeers = append(discoveredPeers, peerAddr)
-		}
-	}
+	discoveredPeers := n.scanPeers(scanHost, startPort, endPort)
 
 	if len(discoveredPeers) == 0 {
 		fmt.Printf("No peers found on %s in port range %d-%d for auto-download.\n", scanHost, startPort, endPort)
@@ -336,6 +458,8 @@ func main() {
 	scanStartPort := flag.Int("scan-start-port", 8080, "Starting port for peer scan")
 	scanEndPort := flag.Int("scan-end-port", 8090, "Ending port for peer scan")
 
+	httpAddr := flag.String("http", "", "Address for the web UI and JSON API when running start (e.g., localhost:9080)")
+
 	flag.Parse()
 
 	address := fmt.Sprintf("localhost:%d", *port)
@@ -352,7 +476,7 @@ func main() {
 		log.Printf("Node starting on %s, sharing files from %s\n", node.Address, *shareDir)
 
 		// Register RPC service
-		rpcService := NewP2PService(node.SharedFiles)
+		rpcService := NewP2PService(node)
 		rpc.Register(rpcService)
 
 		// Start RPC listener
@@ -369,7 +493,7 @@ func main() {
 					log.Printf("Error accepting connection: %v", err)
 					continue
 				}
-				rpc.ServeConn(conn)
+				go rpc.ServeConn(conn)
 			}
 		}()
 
@@ -379,9 +503,28 @@ func main() {
 			err := node.announceToPeer(*peer)
 			if err != nil {
 				log.Printf("Error announcing to peer %q: %v\n", *peer, err)
+			} else if err := node.refreshPeer(*peer); err != nil {
+				log.Printf("Error listing files from peer %q: %v\n", *peer, err)
 			}
 		}
 
+		// Serve the web UI and JSON API if requested
+		if *httpAddr != "" {
+			gw := &Gateway{
+				node:      node,
+				saveDir:   *saveDir,
+				scanHost:  *scanHost,
+				startPort: *scanStartPort,
+				endPort:   *scanEndPort,
+			}
+			go func() {
+				log.Printf("Web UI and JSON API listening on http://%s\n", *httpAddr)
+				if err := gw.ListenAndServe(*httpAddr); err != nil {
+					log.Fatalf("Error serving HTTP on %s: %v\n", *httpAddr, err)
+				}
+			}()
+		}
+
 		select {} // Keep the main goroutine alive
 	case "list-files":
 		node.listLocalFiles()
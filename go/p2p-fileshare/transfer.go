@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Transfer states reported through the JSON API.
+const (
+	TransferPending     = "pending"
+	TransferDownloading = "downloading"
+	TransferDone        = "done"
+	TransferFailed      = "failed"
+)
+
+// Transfer tracks the progress of a single chunked download from a peer.
+type Transfer struct {
+	ID         int        `json:"id"`
+	Peer       string     `json:"peer"`
+	Filename   string     `json:"filename"`
+	Hash       string     `json:"hash,omitempty"`
+	SavePath   string     `json:"save_path"`
+	Size       int64      `json:"size"`
+	Received   int64      `json:"received"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// startDownload registers a new transfer and downloads the file in the background.
+// size and hash may be zero values when the peer's listing is not known.
+func (n *Node) startDownload(peerAddress, filename string, size int64, hash, saveDir string) Transfer {
+	n.transfersMu.Lock()
+	n.nextTransferID++
+	t := &Transfer{
+		ID:        n.nextTransferID,
+		Peer:      peerAddress,
+		Filename:  filename,
+		Hash:      hash,
+		SavePath:  filepath.Join(saveDir, filepath.Base(filename)),
+		Size:      size,
+		Status:    TransferPending,
+		StartedAt: time.Now(),
+	}
+	n.transfers = append(n.transfers, t)
+	snapshot := *t
+	n.transfersMu.Unlock()
+
+	go func() {
+		err := n.downloadChunks(t)
+		n.transfersMu.Lock()
+		defer n.transfersMu.Unlock()
+		now := time.Now()
+		t.FinishedAt = &now
+		if err != nil {
+			t.Status = TransferFailed
+			t.Error = err.Error()
+			log.Printf("Download of %q from %q failed: %v\n", t.Filename, t.Peer, err)
+			return
+		}
+		t.Status = TransferDone
+		log.Printf("Successfully downloaded and saved %q to %q\n", t.Filename, t.SavePath)
+	}()
+	return snapshot
+}
+
+// downloadChunks fetches the file for t chunk by chunk, updating its progress.
+func (n *Node) downloadChunks(t *Transfer) error {
+	client, err := rpc.Dial("tcp", t.Peer)
+	if err != nil {
+		return fmt.Errorf("failed to dial peer %q: %w", t.Peer, err)
+	}
+	defer client.Close()
+
+	// The download goes to a temporary file that only replaces SavePath once
+	// it is complete and its hash checks out.
+	file, err := os.CreateTemp(filepath.Dir(t.SavePath), filepath.Base(t.SavePath)+".*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", t.SavePath, err)
+	}
+	defer os.Remove(file.Name()) // fails harmlessly after the rename
+	defer file.Close()
+
+	n.setTransferStatus(t, TransferDownloading)
+
+	h := sha256.New()
+	var offset int64
+	for {
+		var chunk FileChunk
+		req := ChunkRequest{Filename: t.Filename, Offset: offset, Length: chunkSize}
+		if err := client.Call("P2PService.RequestChunk", req, &chunk); err != nil {
+			return fmt.Errorf("failed to request chunk at offset %d: %w", offset, err)
+		}
+		if _, err := file.Write(chunk.Data); err != nil {
+			return fmt.Errorf("failed to write %q: %w", t.SavePath, err)
+		}
+		h.Write(chunk.Data)
+		offset += int64(len(chunk.Data))
+
+		n.transfersMu.Lock()
+		t.Received = offset
+		if t.Size < offset {
+			t.Size = offset
+		}
+		n.transfersMu.Unlock()
+
+		if chunk.EOF {
+			break
+		}
+	}
+
+	if t.Hash != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != t.Hash {
+			return fmt.Errorf("hash mismatch: expected %s, got %s", t.Hash, sum)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %q: %w", t.SavePath, err)
+	}
+	if err := os.Rename(file.Name(), t.SavePath); err != nil {
+		return fmt.Errorf("failed to save %q: %w", t.SavePath, err)
+	}
+	return nil
+}
+
+// setTransferStatus updates the status of t under the transfers lock.
+func (n *Node) setTransferStatus(t *Transfer, status string) {
+	n.transfersMu.Lock()
+	defer n.transfersMu.Unlock()
+	t.Status = status
+}
+
+// listTransfers returns a snapshot of all transfers started by this node.
+func (n *Node) listTransfers() []Transfer {
+	n.transfersMu.RLock()
+	defer n.transfersMu.RUnlock()
+
+	transfers := make([]Transfer, 0, len(n.transfers))
+	for _, t := range n.transfers {
+		transfers = append(transfers, *t)
+	}
+	return transfers
+}
+
+// getTransfer returns a snapshot of the transfer with the given ID.
+func (n *Node) getTransfer(id int) (Transfer, bool) {
+	n.transfersMu.RLock()
+	defer n.transfersMu.RUnlock()
+
+	for _, t := range n.transfers {
+		if t.ID == id {
+			return *t, true
+		}
+	}
+	return Transfer{}, false
+}
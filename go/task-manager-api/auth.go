@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	// Passwords are hashed with PBKDF2-HMAC-SHA256 at the iteration count
+	// OWASP recommends.
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+
+	tokenTTL = 24 * time.Hour
+)
+
+// dummyPasswordHash is a well-formed hash that no password matches, checked
+// at the same cost as a real one.
+var dummyPasswordHash = fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, passwordSaltSize)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, passwordKeySize)))
+
+// User represents an account that owns tasks
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IsAdmin reports whether the user may see and change every task.
+func (u *User) IsAdmin() bool {
+	return u.Role == roleAdmin
+}
+
+// credentials is the body of POST /users and POST /login.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type userKey struct{}
+
+// currentUser returns the authenticated user of a request that went
+// through requireAuth.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+	return u
+}
+
+// requireAuth rejects requests without a valid "Authorization: Bearer
+// <token>" header and makes the caller available to next via currentUser.
+func (s *server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tasks"`)
+			writeError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		u, expires, err := s.users.SessionUser(r.Context(), hashToken(token))
+		if err == errSessionNotFound || (err == nil && time.Now().After(expires)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tasks", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		} else if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, &u)))
+	}
+}
+
+// requireAdmin is like requireAuth, and also rejects callers that are not admins.
+func (s *server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).IsAdmin() {
+			writeError(w, http.StatusForbidden, "Admin role required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// createUser registers a new account. The first account becomes an admin.
+func (s *server) createUser(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if !readJSON(w, r, "NewUser", &c) {
+		return
+	}
+	c.Username = strings.TrimSpace(c.Username)
+	if c.Username == "" {
+		writeValidationError(w, validationError{{"username", "must not be blank"}})
+		return
+	}
+
+	hash, err := hashPassword(c.Password)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	u, err := s.users.CreateUser(r.Context(), c.Username, hash)
+	if err == errUsernameTaken {
+		writeError(w, http.StatusConflict, "Username already taken")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	log.Printf("Created user %q with role %s\n", u.Username, u.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// login checks a username and password and issues a bearer token.
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if !readJSON(w, r, "Login", &c) {
+		return
+	}
+
+	id, hash, err := s.users.PasswordHash(r.Context(), strings.TrimSpace(c.Username))
+	if err != nil && err != errUserNotFound {
+		internalError(w, r, err)
+		return
+	}
+	if err == errUserNotFound {
+		// Checking a password takes as long for unknown users as for
+		// others, so that timing does not tell which usernames exist.
+		hash = dummyPasswordHash
+	}
+	if ok := checkPassword(c.Password, hash); err == errUserNotFound || !ok {
+		writeError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	expires := time.Now().Add(tokenTTL).UTC()
+	if err := s.users.CreateSession(r.Context(), hashToken(token), id, expires); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	// Expired sessions are cleaned up whenever someone logs in.
+	s.users.DeleteExpiredSessions(r.Context(), time.Now().UTC())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_at": expires,
+	})
+}
+
+// logout revokes the token the request was made with.
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err := s.users.DeleteSession(r.Context(), hashToken(token)); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMe returns the authenticated user.
+func (s *server) getMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentUser(r))
+}
+
+// getUsers lists every account. Admins only.
+func (s *server) getUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.users.ListUsers(r.Context())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// updateUserRole changes the role of an account. Admins only.
+func (s *server) updateUserRole(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(r.URL.Path[len("/users/"):], "/role")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if !readJSON(w, r, "RoleUpdate", &body) {
+		return
+	}
+
+	if err := s.users.SetRole(r.Context(), id, body.Role); err == errUserNotFound {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	log.Printf("User %d set the role of user %d to %s\n", currentUser(r).ID, id, body.Role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hashPassword returns an encoded PBKDF2 hash of password with a random salt.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash made by hashPassword.
+func checkPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// randomToken returns a new bearer token.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the form a token is stored in, so that a leaked
+// database does not leak usable tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
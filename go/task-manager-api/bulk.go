@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxImportSize  = 10 << 20
+	maxImportTasks = 10000
+)
+
+// exportColumns are the columns of a CSV export, in order. Lists of tags
+// and blockers are separated by semicolons, and cells that would start a
+// formula are quoted by quoteFormula.
+var exportColumns = []string{"id", "title", "description", "status", "priority", "due_date", "recurrence", "tags",
+	"assignee_id", "project_id", "parent_id", "blocked_by", "owner_id", "created_at", "updated_at", "version", "deleted_at"}
+
+// importColumns are the columns of a CSV import that are read. The other
+// columns of an export are accepted and ignored, so that an export can be
+// imported again.
+var importColumns = []string{"title", "description", "status", "priority", "due_date", "recurrence", "tags",
+	"assignee_id", "project_id", "parent_id", "blocked_by"}
+
+// exportTasks sends every task the caller can see that the parameters of
+// GET /tasks select, as JSON or, with format=csv or an Accept header of
+// text/csv, as CSV. limit and offset are ignored.
+func (s *server) exportTasks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseTaskQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid format %q: use json or csv", format))
+		return
+	}
+	if u := currentUser(r); !u.IsAdmin() {
+		q.UserID = u.ID
+	}
+	q.Offset, q.Limit = 0, math.MaxInt32
+
+	tasks, _, err := s.tasks.ListTasks(r.Context(), q)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	if format != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.json"`)
+		json.NewEncoder(w).Encode(tasks)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="tasks.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	for _, t := range tasks {
+		cw.Write(csvRecord(t))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error exporting tasks: %v\n", err)
+	}
+}
+
+// importTasks creates the tasks of a JSON array of TaskInput, or of a CSV
+// file with a header row naming its columns if the Content-Type is
+// text/csv, owned by the caller. Either every task is created or, if any
+// is invalid, none is, and every problem is reported with the field named
+// after the task's index: [0].title is the title of the first task, on
+// line 2 of a CSV file.
+//
+// Parents and blockers must be tasks that exist before the import.
+func (s *server) importTasks(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxImportSize)
+	if !ok {
+		return
+	}
+
+	var doc interface{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		var err error
+		if doc, err = csvTasks(body); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid CSV: "+err.Error())
+			return
+		}
+	} else if err := json.Unmarshal(body, &doc); err != nil {
+		writeError(w, http.StatusBadRequest, "Request body must be JSON: "+err.Error())
+		return
+	}
+	list, ok := doc.([]interface{})
+	switch {
+	case !ok:
+		writeValidationError(w, validationError{{"body", "must be an array of tasks"}})
+		return
+	case len(list) == 0:
+		writeValidationError(w, validationError{{"body", "must have at least one task"}})
+		return
+	case len(list) > maxImportTasks:
+		writeValidationError(w, validationError{{"body", fmt.Sprintf("must have at most %d tasks", maxImportTasks)}})
+		return
+	}
+	var errs validationError
+	for i, item := range list {
+		errs = append(errs, validateItem("TaskInput", item, i)...)
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	var tasks []Task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		// The schema should have caught this.
+		writeError(w, http.StatusBadRequest, "Request body does not match TaskInput: "+err.Error())
+		return
+	}
+
+	user := currentUser(r)
+	now := time.Now().UTC()
+	users := make(map[int]bool) // whether each assignee exists
+	for i := range tasks {
+		t := &tasks[i]
+		taskErrs := t.normalize()
+		if t.AssigneeID != nil {
+			exists, seen := users[*t.AssigneeID]
+			if !seen {
+				if exists, err = s.users.UserExists(r.Context(), *t.AssigneeID); err != nil {
+					internalError(w, r, err)
+					return
+				}
+				users[*t.AssigneeID] = exists
+			}
+			if !exists {
+				taskErrs = append(taskErrs, fieldError{"assignee_id", "must be the ID of an existing user"})
+			}
+		}
+		errs = append(errs, taskErrs.at(i)...)
+
+		// Exported tasks can be imported again as new tasks.
+		t.ID, t.DeletedAt = 0, nil
+		t.OwnerID = user.ID
+		t.CreatedAt, t.UpdatedAt = now, now
+		t.Version = 1
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	created, err := s.tasks.ImportTasks(r.Context(), user, tasks)
+	if verr, ok := err.(validationError); ok {
+		writeValidationError(w, verr)
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	log.Printf("User %d imported %d tasks\n", user.ID, len(created))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": len(created),
+		"tasks":    created,
+	})
+}
+
+// csvRecord returns the row of exportColumns for a task.
+func csvRecord(t Task) []string {
+	id := func(id *int) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.Itoa(*id)
+	}
+	timestamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	blockers := make([]string, len(t.BlockedBy))
+	for i, b := range t.BlockedBy {
+		blockers[i] = strconv.Itoa(b)
+	}
+	record := []string{strconv.Itoa(t.ID), t.Title, t.Description, t.Status, t.Priority, timestamp(t.DueDate), t.Recurrence,
+		strings.Join(t.Tags, ";"), id(t.AssigneeID), id(t.ProjectID), id(t.ParentID), strings.Join(blockers, ";"),
+		strconv.Itoa(t.OwnerID), timestamp(&t.CreatedAt), timestamp(&t.UpdatedAt), strconv.Itoa(t.Version), timestamp(t.DeletedAt)}
+	for i, cell := range record {
+		record[i] = quoteFormula(cell)
+	}
+	return record
+}
+
+// formulaStarts are the first characters of cells that spreadsheets run
+// as formulas, and the quote that stops them.
+const formulaStarts = "=+-@\t\r'"
+
+// quoteFormula prefixes a cell that a spreadsheet would run as a formula
+// with a quote, so that it is shown as text. Cells that start with a quote
+// get another, so that unquoteFormula can tell them apart.
+func quoteFormula(cell string) string {
+	if cell != "" && strings.IndexByte(formulaStarts, cell[0]) >= 0 {
+		return "'" + cell
+	}
+	return cell
+}
+
+// unquoteFormula undoes quoteFormula.
+func unquoteFormula(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.IndexByte(formulaStarts, cell[1]) >= 0 {
+		return cell[1:]
+	}
+	return cell
+}
+
+// csvTasks reads a CSV import into the JSON documents of its tasks, so
+// that they are checked like a JSON import. Cells quoted by quoteFormula
+// are unquoted and empty cells are left out.
+// Values of the wrong type are kept as strings for the schema to reject.
+func csvTasks(data []byte) ([]interface{}, error) {
+	// Spreadsheets often start UTF-8 CSV files with a byte order mark.
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("missing header row")
+	}
+
+	header := records[0]
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !contains(exportColumns, name) {
+			return nil, fmt.Errorf("unknown column %q; use %s", name, strings.Join(importColumns, ", "))
+		}
+		if contains(header[:i], name) {
+			return nil, fmt.Errorf("duplicate column %q", name)
+		}
+		header[i] = name
+	}
+
+	tasks := make([]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		task := make(map[string]interface{})
+		for i, cell := range record {
+			cell = unquoteFormula(cell)
+			if header[i] != "description" {
+				cell = strings.TrimSpace(cell)
+			}
+			if cell != "" && contains(importColumns, header[i]) {
+				task[header[i]] = csvValue(header[i], cell)
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// csvValue converts a cell of a CSV import into the JSON value of its column.
+func csvValue(column, cell string) interface{} {
+	number := func(s string) interface{} {
+		if n, err := strconv.Atoi(s); err == nil {
+			return float64(n)
+		}
+		return s
+	}
+	list := func(convert func(string) interface{}) []interface{} {
+		items := []interface{}{}
+		for _, item := range strings.Split(cell, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, convert(item))
+			}
+		}
+		return items
+	}
+
+	switch column {
+	case "assignee_id", "project_id", "parent_id":
+		return number(cell)
+	case "tags":
+		return list(func(s string) interface{} { return s })
+	case "blocked_by":
+		return list(number)
+	case "due_date":
+		// Spreadsheets tend to have dates without times.
+		if d, err := time.Parse(time.DateOnly, cell); err == nil {
+			return d.Format(time.RFC3339)
+		}
+	}
+	return cell
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "validation_failed", "message": "...", "fields": [...]}}
+//
+// Code is stable and meant for programs; message is meant for people.
+// Fields is only set for validation errors.
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// errorCodes are the codes of the statuses the API responds with.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// writeError responds with status and an error envelope.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorBody(w, status, apiError{Message: message})
+}
+
+// writeErrorBody responds with status and an error envelope holding e,
+// filling in its code from status if it has none.
+func writeErrorBody(w http.ResponseWriter, status int, e apiError) {
+	if e.Code == "" {
+		e.Code = errorCodes[status]
+		if e.Code == "" {
+			e.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+// writeValidationError responds 422 with the invalid fields of a request.
+func writeValidationError(w http.ResponseWriter, errs validationError) {
+	writeErrorBody(w, http.StatusUnprocessableEntity, apiError{Message: "Request validation failed", Fields: errs})
+}
+
+// internalError logs err and responds 500 without revealing it, since it
+// may hold SQL or other details of the server.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Error handling %s %s: %v\n", r.Method, r.URL.Path, err)
+	writeError(w, http.StatusInternalServerError, "Internal server error")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	eventPollInterval = time.Second
+	eventBatchSize    = 100
+	keepAliveInterval = 30 * time.Second
+)
+
+// taskEvent is a change to a task as sent to event streams and webhooks:
+// an entry of its history with a type of task.created, task.updated,
+// task.deleted, task.restored or task.reminder. The ID of the entry orders
+// events by when they were committed.
+type taskEvent struct {
+	Type string `json:"type"`
+	HistoryEntry
+}
+
+func newTaskEvent(e HistoryEntry) taskEvent {
+	return taskEvent{"task." + e.Action, e}
+}
+
+// notifier tells event streams and webhooks about changes to tasks. The
+// task history is the source of events, and is polled rather than watched
+// so that changes made by other servers sharing the database are seen too.
+type notifier struct {
+	tasks  TaskRepository
+	hooks  WebhookRepository
+	client *http.Client
+	// allowPrivate lets webhooks be sent to any address, such as a
+	// receiver on the same machine during development.
+	allowPrivate bool
+
+	mu      sync.Mutex
+	last    int           // latest history entry seen
+	changed chan struct{} // closed when an entry after last is seen
+}
+
+func newNotifier(tasks TaskRepository, hooks WebhookRepository) *notifier {
+	n := &notifier{
+		tasks:   tasks,
+		hooks:   hooks,
+		changed: make(chan struct{}),
+	}
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if n.allowPrivate {
+				return nil
+			}
+			return dialPublic(network, address, c)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Webhooks never go through a proxy, which would be the address the
+	// dialer checks instead of theirs.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	n.client = &http.Client{
+		Transport: transport,
+		Timeout:   webhookTimeout,
+		// A redirect is a failed delivery rather than a reason to send
+		// the event somewhere else.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return n
+}
+
+// run polls for changes every interval until ctx is done.
+func (n *notifier) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll wakes the event streams if there are new changes and sends the
+// webhook deliveries that are due.
+func (n *notifier) poll(ctx context.Context) {
+	last, err := n.tasks.LastEventID(ctx)
+	if err != nil {
+		log.Printf("Error polling task history: %v\n", err)
+		return
+	}
+	n.mu.Lock()
+	if last > n.last {
+		n.last = last
+		close(n.changed)
+		n.changed = make(chan struct{})
+	}
+	n.mu.Unlock()
+
+	n.deliver(ctx)
+}
+
+// changes returns a channel that is closed when a change is seen after
+// the call.
+func (n *notifier) changes() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.changed
+}
+
+// streamEvents sends the changes to the tasks the caller can see as
+// server-sent events, as they happen. A client that reconnects with a
+// Last-Event-ID header, or ?after=<id>, is sent the changes it missed first.
+func (s *server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	user := currentUser(r)
+
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+	var last int
+	if after != "" {
+		id, err := strconv.Atoi(after)
+		if err != nil || id < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid event ID")
+			return
+		}
+		last = id
+	} else {
+		id, err := s.tasks.LastEventID(r.Context())
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		last = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		// Subscribe before reading, so that no change slips in between.
+		changed := s.events.changes()
+		entries, err := s.tasks.TaskEvents(r.Context(), user, last, eventBatchSize)
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Error streaming events to user %d: %v\n", user.ID, err)
+			}
+			return
+		}
+		for _, e := range entries {
+			data, err := json.Marshal(newTaskEvent(e))
+			if err != nil {
+				log.Printf("Error encoding event %d: %v\n", e.ID, err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: task.%s\ndata: %s\n\n", e.ID, e.Action, data)
+			last = e.ID
+		}
+		flusher.Flush()
+		if len(entries) == eventBatchSize {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -2,4 +2,7 @@ module task-manager-api
 
 go 1.24.4
 
-require github.com/mattn/go-sqlite3 v1.14.28 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.28
+)
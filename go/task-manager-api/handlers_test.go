@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStores are the backends the handler tests run against. Postgres is
+// only tested if TEST_DATABASE_URL is set, to a database the tests may
+// wipe.
+var testStores = []struct {
+	name string
+	open func(t *testing.T) store
+}{
+	{"memory", func(t *testing.T) store { return newMemStore() }},
+	{"sqlite", func(t *testing.T) store {
+		st, err := openSQLite(filepath.Join(t.TempDir(), "tasks.db"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}},
+	{"postgres", func(t *testing.T) store {
+		url := os.Getenv("TEST_DATABASE_URL")
+		if url == "" {
+			t.Skip("TEST_DATABASE_URL is not set")
+		}
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+			t.Fatal(err)
+		}
+		st, err := openPostgres(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}},
+}
+
+// forEachStore runs test as a subtest against a server backed by each of
+// testStores.
+func forEachStore(t *testing.T, test func(t *testing.T, api *testAPI)) {
+	for _, ts := range testStores {
+		t.Run(ts.name, func(t *testing.T) {
+			test(t, newTestAPI(t, ts.open(t)))
+		})
+	}
+}
+
+// testAPI is a server backed by st, and the tokens of the users it was set
+// up with: alice, the first and so an admin, and bob.
+type testAPI struct {
+	t     *testing.T
+	s     *server
+	srv   *httptest.Server
+	alice string
+	bob   string
+}
+
+func newTestAPI(t *testing.T, st store) *testAPI {
+	t.Helper()
+	s := newServer(st, st, st, st)
+	s.limiter = newRateLimiter(0)
+	api := &testAPI{t: t, s: s, srv: httptest.NewServer(s.routes())}
+	t.Cleanup(func() {
+		api.srv.Close()
+		st.Close()
+	})
+
+	for _, name := range []string{"alice", "bob"} {
+		api.expect("", "POST", "/users", `{"username":"`+name+`","password":"secret123"}`, http.StatusCreated)
+	}
+	api.alice = api.login("alice", "secret123")
+	api.bob = api.login("bob", "secret123")
+	return api
+}
+
+// request sends a request with token, unless it is empty, and the other
+// headers given as name, value pairs.
+func (api *testAPI) request(token, method, path, body string, headers ...string) (*http.Response, []byte) {
+	api.t.Helper()
+	req, err := http.NewRequest(method, api.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	return resp, data
+}
+
+// expect sends a request like request and fails the test unless it gets
+// status. It returns the response body.
+func (api *testAPI) expect(token, method, path, body string, status int, headers ...string) []byte {
+	api.t.Helper()
+	resp, data := api.request(token, method, path, body, headers...)
+	if resp.StatusCode != status {
+		api.t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, status, data)
+	}
+	if status >= 400 {
+		var e struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.Unmarshal(data, &e); err != nil || e.Error.Code == "" || e.Error.Message == "" {
+			api.t.Fatalf("%s %s: %d without an error envelope: %s", method, path, status, data)
+		}
+	}
+	return data
+}
+
+// expectJSON is expect for a response decoded into v.
+func (api *testAPI) expectJSON(token, method, path, body string, status int, v interface{}, headers ...string) {
+	api.t.Helper()
+	data := api.expect(token, method, path, body, status, headers...)
+	if err := json.Unmarshal(data, v); err != nil {
+		api.t.Fatalf("%s %s: %v: %s", method, path, err, data)
+	}
+}
+
+func (api *testAPI) login(username, password string) string {
+	api.t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	api.expectJSON("", "POST", "/login", `{"username":"`+username+`","password":"`+password+`"}`, http.StatusOK, &resp)
+	if resp.Token == "" {
+		api.t.Fatal("login returned no token")
+	}
+	return resp.Token
+}
+
+// createTask creates a task as the owner of token and returns it.
+func (api *testAPI) createTask(token, body string) Task {
+	api.t.Helper()
+	var task Task
+	api.expectJSON(token, "POST", "/tasks", body, http.StatusOK, &task)
+	return task
+}
+
+// fields returns the names of the fields of a validation error.
+func fields(t *testing.T, data []byte) []string {
+	t.Helper()
+	var e struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range e.Error.Fields {
+		names = append(names, f.Field)
+	}
+	return names
+}
+
+func TestUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		var users []User
+		api.expectJSON(api.alice, "GET", "/users", "", http.StatusOK, &users)
+		if len(users) != 2 || users[0].Role != roleAdmin || users[1].Role != roleUser {
+			t.Fatalf("users = %+v, want alice as admin and bob as user", users)
+		}
+		api.expect(api.bob, "GET", "/users", "", http.StatusForbidden)
+		api.expect("", "GET", "/users", "", http.StatusUnauthorized)
+		api.expect("", "DELETE", "/users", "", http.StatusMethodNotAllowed)
+
+		api.expect("", "POST", "/users", `{"username":"alice","password":"other123"}`, http.StatusConflict)
+		data := api.expect("", "POST", "/users", `{"username":"  ","password":"secret123"}`, http.StatusUnprocessableEntity)
+		if got := fields(t, data); len(got) != 1 || got[0] != "username" {
+			t.Errorf("fields = %v, want [username]", got)
+		}
+		api.expect("", "POST", "/users", `{"username":`, http.StatusBadRequest)
+
+		var me User
+		api.expectJSON(api.bob, "GET", "/users/me", "", http.StatusOK, &me)
+		if me.Username != "bob" {
+			t.Errorf("me = %+v, want bob", me)
+		}
+		api.expect("not-a-token", "GET", "/users/me", "", http.StatusUnauthorized)
+		api.expect(api.bob, "POST", "/users/me", "", http.StatusMethodNotAllowed)
+
+		api.expect(api.alice, "PUT", "/users/"+strconv.Itoa(me.ID)+"/role", `{"role":"admin"}`, http.StatusNoContent)
+		api.expect(api.bob, "GET", "/users", "", http.StatusOK)
+		api.expect(api.alice, "PUT", "/users/999/role", `{"role":"admin"}`, http.StatusNotFound)
+		api.expect(api.alice, "PUT", "/users/x/role", `{"role":"admin"}`, http.StatusBadRequest)
+		api.expect(api.alice, "PUT", "/users/2/role", `{"role":"owner"}`, http.StatusUnprocessableEntity)
+		api.expect(api.alice, "GET", "/users/2/role", "", http.StatusMethodNotAllowed)
+	})
+}
+
+func TestLoginLogout(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		api.expect("", "POST", "/login", `{"username":"alice","password":"wrong"}`, http.StatusUnauthorized)
+		api.expect("", "POST", "/login", `{"username":"nobody","password":"secret123"}`, http.StatusUnauthorized)
+		api.expect("", "POST", "/login", `{}`, http.StatusUnprocessableEntity)
+		api.expect("", "GET", "/login", "", http.StatusMethodNotAllowed)
+
+		api.expect(api.bob, "GET", "/logout", "", http.StatusMethodNotAllowed)
+		api.expect(api.bob, "POST", "/logout", "", http.StatusNoContent)
+		api.expect(api.bob, "GET", "/users/me", "", http.StatusUnauthorized)
+		api.expect(api.bob, "POST", "/logout", "", http.StatusUnauthorized)
+		api.expect(api.alice, "GET", "/users/me", "", http.StatusOK)
+	})
+}
+
+func TestTasks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		task := api.createTask(api.alice, `{"title":"Write tests","priority":"high","tags":["Go","go","api"],"due_date":"2030-01-02T10:00:00Z"}`)
+		if task.ID == 0 || task.OwnerID != 1 || task.Status != statusTodo || task.Version != 1 {
+			t.Fatalf("created %+v", task)
+		}
+		if len(task.Tags) != 2 {
+			t.Errorf("tags = %v, want the duplicate dropped", task.Tags)
+		}
+		api.createTask(api.alice, `{"title":"Review tests","assignee_id":2}`)
+		api.createTask(api.bob, `{"title":"Bob's task"}`)
+		path := "/tasks/" + strconv.Itoa(task.ID)
+
+		data := api.expect(api.alice, "POST", "/tasks", `{"title":"  ","assignee_id":999}`, http.StatusUnprocessableEntity)
+		if got := strings.Join(fields(t, data), ","); got != "title,assignee_id" {
+			t.Errorf("fields = %s, want title,assignee_id", got)
+		}
+		// Search highlights mark matches with control characters.
+		data = api.expect(api.alice, "POST", "/tasks", `{"title":"a \u0002b\u0003","description":"tab\tand\r\nline \u0003"}`, http.StatusUnprocessableEntity)
+		if got := strings.Join(fields(t, data), ","); got != "title,description" {
+			t.Errorf("fields = %s, want title,description", got)
+		}
+		api.expect(api.alice, "POST", "/tasks", `[]`, http.StatusUnprocessableEntity)
+		api.expect(api.alice, "POST", "/tasks", `{`, http.StatusBadRequest)
+		api.expect("", "POST", "/tasks", `{"title":"anonymous"}`, http.StatusUnauthorized)
+		api.expect(api.alice, "DELETE", "/tasks", "", http.StatusMethodNotAllowed)
+
+		// Users see their own tasks and those assigned to them; admins see all.
+		var list []Task
+		resp, body := api.request(api.bob, "GET", "/tasks", "")
+		if err := json.Unmarshal(body, &list); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /tasks: %d %s", resp.StatusCode, body)
+		}
+		if len(list) != 2 || resp.Header.Get("X-Total-Count") != "2" {
+			t.Errorf("bob sees %d tasks, total %q, want 2", len(list), resp.Header.Get("X-Total-Count"))
+		}
+		api.expectJSON(api.alice, "GET", "/tasks?tag=go&sort=due_date&order=desc", "", http.StatusOK, &list)
+		if len(list) != 1 || list[0].ID != task.ID {
+			t.Errorf("tasks tagged go = %+v, want task %d", list, task.ID)
+		}
+		api.expect(api.alice, "GET", "/tasks?sort=color", "", http.StatusBadRequest)
+		api.expect(api.alice, "GET", "/tasks?limit=-1", "", http.StatusBadRequest)
+
+		// Get, with and without a matching ETag.
+		var got Task
+		api.expectJSON(api.alice, "GET", path, "", http.StatusOK, &got)
+		if got.Title != "Write tests" {
+			t.Errorf("got %+v", got)
+		}
+		api.expect(api.alice, "GET", path, "", http.StatusNotModified, "If-None-Match", `"1"`)
+		api.expect(api.bob, "GET", path, "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/tasks/999", "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/tasks/abc", "", http.StatusBadRequest)
+		api.expect(api.alice, "POST", path, "", http.StatusMethodNotAllowed)
+
+		// Updates are rejected unless they name the current version.
+		api.expectJSON(api.alice, "PUT", path, `{"title":"Write more tests","status":"in-progress"}`, http.StatusOK, &got, "If-Match", `"1"`)
+		if got.Version != 2 || got.Status != statusInProgress || got.DueDate != nil {
+			t.Errorf("put returned %+v", got)
+		}
+		api.expect(api.alice, "PUT", path, `{"title":"stale"}`, http.StatusPreconditionFailed, "If-Match", `"1"`)
+		api.expect(api.alice, "PUT", path, `{"title":"stale","version":1}`, http.StatusConflict)
+		api.expect(api.alice, "PUT", path, `{"title":"bad tag"}`, http.StatusPreconditionFailed, "If-Match", `xyz`)
+		api.expect(api.alice, "PUT", path, `{"title":"","status":"started"}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "PUT", path, `{"title":"not mine"}`, http.StatusNotFound)
+		api.expect(api.alice, "PUT", "/tasks/x", `{"title":"x"}`, http.StatusBadRequest)
+
+		// Patches change only the fields they name.
+		api.expectJSON(api.alice, "PATCH", path, `{"description":"All routes","tags":null}`, http.StatusOK, &got,
+			"Content-Type", "application/merge-patch+json")
+		if got.Title != "Write more tests" || got.Description != "All routes" || len(got.Tags) != 0 || got.Version != 3 {
+			t.Errorf("patch returned %+v", got)
+		}
+		api.expect(api.alice, "PATCH", path, `{"title":"x"}`, http.StatusUnsupportedMediaType, "Content-Type", "text/plain")
+		api.expect(api.alice, "PATCH", path, `{"title":"x"}`, http.StatusPreconditionFailed, "If-Match", `"1"`)
+		api.expect(api.alice, "PATCH", path, `{"priority":"urgent"}`, http.StatusUnprocessableEntity)
+		api.expect(api.alice, "PATCH", "/tasks/999", `{"title":"x"}`, http.StatusNotFound)
+
+		// Deletes.
+		api.expect(api.bob, "DELETE", path, "", http.StatusNotFound)
+		api.expect(api.alice, "DELETE", path, "", http.StatusPreconditionFailed, "If-Match", `"1"`)
+		api.expect(api.alice, "DELETE", path, "", http.StatusNoContent, "If-Match", `"3"`)
+		api.expect(api.alice, "DELETE", path, "", http.StatusNotFound)
+		api.expect(api.alice, "GET", path, "", http.StatusNotFound)
+		api.expect(api.alice, "DELETE", "/tasks/x", "", http.StatusBadRequest)
+
+		// Lengths are in characters, not bytes.
+		long := strings.Repeat("é", maxTitleLength)
+		if task := api.createTask(api.alice, `{"title":"`+long+`","tags":["`+strings.Repeat("ü", maxTagLength)+`"]}`); task.Title != long {
+			t.Errorf("title of %d characters saved as %q", maxTitleLength, task.Title)
+		}
+		data = api.expect(api.alice, "POST", "/tasks", `{"title":"`+long+`é"}`, http.StatusUnprocessableEntity)
+		if got := fields(t, data); len(got) != 1 || got[0] != "title" {
+			t.Errorf("fields = %v, want title", got)
+		}
+	})
+}
+
+func TestTaskTreeHistoryAndRestore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		parent := api.createTask(api.alice, `{"title":"Release"}`)
+		id := strconv.Itoa(parent.ID)
+		child := api.createTask(api.alice, `{"title":"Tag the release","parent_id":`+id+`}`)
+		api.createTask(api.alice, `{"title":"Write the notes","parent_id":`+strconv.Itoa(child.ID)+`}`)
+		api.expect(api.alice, "POST", "/tasks", `{"title":"Orphan","parent_id":999}`, http.StatusUnprocessableEntity)
+
+		var tree taskTree
+		api.expectJSON(api.alice, "GET", "/tasks/"+id+"/tree", "", http.StatusOK, &tree)
+		if len(tree.Subtasks) != 1 || tree.Subtasks[0].ID != child.ID || len(tree.Subtasks[0].Subtasks) != 1 {
+			t.Errorf("tree = %+v, want one subtask with one subtask", tree)
+		}
+		api.expect(api.bob, "GET", "/tasks/"+id+"/tree", "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/tasks/x/tree", "", http.StatusBadRequest)
+		api.expect(api.alice, "POST", "/tasks/"+id+"/tree", "", http.StatusMethodNotAllowed)
+
+		api.expect(api.alice, "PATCH", "/tasks/"+id, `{"title":"Release 1.0"}`, http.StatusOK)
+		api.expect(api.alice, "DELETE", "/tasks/"+id, "", http.StatusNoContent)
+
+		var history []HistoryEntry
+		api.expectJSON(api.alice, "GET", "/tasks/"+id+"/history", "", http.StatusOK, &history)
+		var actions []string
+		for _, e := range history {
+			actions = append(actions, e.Action)
+		}
+		if got := strings.Join(actions, ","); got != "created,updated,deleted" {
+			t.Errorf("history actions = %s, want created,updated,deleted", got)
+		}
+		if title := history[0].Changes["title"]; title.From != nil || title.To != "Release" {
+			t.Errorf("created title = %+v, want from null to Release", title)
+		}
+		if due, ok := history[0].Changes["due_date"]; ok {
+			t.Errorf("created due_date = %+v, want no change for a field without a value", due)
+		}
+		if title := history[1].Changes["title"]; title.From != "Release" || title.To != "Release 1.0" {
+			t.Errorf("title change = %+v", title)
+		}
+		api.expect(api.bob, "GET", "/tasks/"+id+"/history", "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/tasks/999/history", "", http.StatusNotFound)
+		api.expect(api.alice, "DELETE", "/tasks/"+id+"/history", "", http.StatusMethodNotAllowed)
+
+		// Subtasks deleted with their parent come back with it, but cannot
+		// come back before it.
+		api.expect(api.alice, "GET", "/tasks/"+strconv.Itoa(child.ID), "", http.StatusNotFound)
+		api.expect(api.alice, "POST", "/tasks/"+strconv.Itoa(child.ID)+"/restore", "", http.StatusConflict)
+		api.expect(api.bob, "POST", "/tasks/"+id+"/restore", "", http.StatusNotFound)
+		var restored Task
+		api.expectJSON(api.alice, "POST", "/tasks/"+id+"/restore", "", http.StatusOK, &restored)
+		if restored.DeletedAt != nil || restored.Title != "Release 1.0" {
+			t.Errorf("restored %+v", restored)
+		}
+		api.expect(api.alice, "GET", "/tasks/"+strconv.Itoa(child.ID), "", http.StatusOK)
+		api.expect(api.alice, "POST", "/tasks/"+id+"/restore", "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/tasks/"+id+"/restore", "", http.StatusMethodNotAllowed)
+	})
+}
+
+func TestSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		api.createTask(api.alice, `{"title":"Fix the login page","description":"Users cannot log in on mobile"}`)
+		api.createTask(api.alice, `{"title":"Write docs","description":"Explain how to log in"}`)
+		api.createTask(api.bob, `{"title":"Login for bob"}`)
+
+		var results []SearchResult
+		resp, body := api.request(api.bob, "GET", "/tasks/search?q=login", "")
+		if err := json.Unmarshal(body, &results); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("search: %d %s", resp.StatusCode, body)
+		}
+		if len(results) != 1 || resp.Header.Get("X-Total-Count") != "1" {
+			t.Errorf("bob found %d tasks, want only his own", len(results))
+		}
+		api.expectJSON(api.alice, "GET", "/tasks/search?q=log", "", http.StatusOK, &results)
+		if len(results) != 3 {
+			t.Fatalf("found %d tasks, want 3", len(results))
+		}
+		// How title matches rank against each other depends on the store,
+		// but they all rank above a match in the description alone.
+		if results[2].Title != "Write docs" {
+			t.Errorf("worst match %q, want the one matching only in its description", results[2].Title)
+		}
+		for i, r := range results {
+			if i > 0 && r.Rank > results[i-1].Rank {
+				t.Errorf("result %d ranks %v, above the one before it", i, r.Rank)
+			}
+			if r.Title == "Fix the login page" && r.Highlight.Title != "Fix the <mark>login</mark> page" {
+				t.Errorf("%q highlighted %q", r.Title, r.Highlight.Title)
+			}
+		}
+		// Highlights are HTML, so the text around the marks is escaped.
+		api.createTask(api.alice, `{"title":"<img src=x onerror=alert(1)> zebra & co","description":"<b>zebras</b>"}`)
+		api.expectJSON(api.alice, "GET", "/tasks/search?q=zebra", "", http.StatusOK, &results)
+		if len(results) != 1 {
+			t.Fatalf("found %d tasks, want 1", len(results))
+		}
+		if h := results[0].Highlight; h.Title != "&lt;img src=x onerror=alert(1)&gt; <mark>zebra</mark> &amp; co" ||
+			h.Description != "&lt;b&gt;<mark>zebras</mark>&lt;/b&gt;" {
+			t.Errorf("highlight = %+v, want the text escaped", h)
+		}
+		api.expect(api.alice, "GET", "/tasks/search", "", http.StatusBadRequest)
+		api.expect(api.alice, "GET", "/tasks/search?q=%21%21", "", http.StatusBadRequest)
+		api.expect(api.alice, "POST", "/tasks/search?q=login", "", http.StatusMethodNotAllowed)
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		api.createTask(api.alice, `{"title":"First","tags":["a","b"],"due_date":"2030-01-02T10:00:00Z"}`)
+		api.createTask(api.alice, `{"title":"Second, with a comma","description":"Line one\nline two"}`)
+		api.createTask(api.alice, `{"title":"=HYPERLINK(\"http://example.com\")","description":"'=1+1","tags":["-x"]}`)
+
+		var exported []Task
+		resp, body := api.request(api.alice, "GET", "/tasks/export", "")
+		if err := json.Unmarshal(body, &exported); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("export: %d %s", resp.StatusCode, body)
+		}
+		if len(exported) != 3 || !strings.Contains(resp.Header.Get("Content-Disposition"), "tasks.json") {
+			t.Errorf("exported %d tasks as %q", len(exported), resp.Header.Get("Content-Disposition"))
+		}
+		csvBody := api.expect(api.alice, "GET", "/tasks/export", "", http.StatusOK, "Accept", "text/csv")
+		rows, err := csv.NewReader(strings.NewReader(string(csvBody))).ReadAll()
+		if err != nil || len(rows) != 4 || strings.Join(rows[0], ",") != strings.Join(exportColumns, ",") {
+			t.Fatalf("csv export = %q, %v", rows, err)
+		}
+		// Cells that spreadsheets would run as formulas are quoted.
+		if got := rows[3][1:3]; got[0] != `'=HYPERLINK("http://example.com")` || got[1] != "''=1+1" || rows[3][7] != "'-x" {
+			t.Errorf("csv export of formulas = %q", rows[3])
+		}
+		api.expect(api.bob, "GET", "/tasks/export?format=xml", "", http.StatusBadRequest)
+		api.expect(api.alice, "POST", "/tasks/export", "", http.StatusMethodNotAllowed)
+
+		// Exports import again as new tasks, in both formats.
+		var imported struct {
+			Imported int    `json:"imported"`
+			Tasks    []Task `json:"tasks"`
+		}
+		data, _ := json.Marshal(exported)
+		api.expectJSON(api.bob, "POST", "/tasks/import", string(data), http.StatusCreated, &imported)
+		if imported.Imported != 3 || imported.Tasks[0].OwnerID != 2 || imported.Tasks[0].ID <= exported[1].ID {
+			t.Errorf("imported %+v", imported)
+		}
+		api.expectJSON(api.bob, "POST", "/tasks/import", string(csvBody), http.StatusCreated, &imported, "Content-Type", "text/csv")
+		if imported.Imported != 3 || imported.Tasks[1].Description != "Line one\nline two" || len(imported.Tasks[0].Tags) != 2 {
+			t.Errorf("imported %+v", imported)
+		}
+		if got := imported.Tasks[2]; got.Title != exported[2].Title || got.Description != "'=1+1" || got.Tags[0] != "-x" {
+			t.Errorf("imported formulas as %q, %q, %q", got.Title, got.Description, got.Tags)
+		}
+
+		// Nothing is imported unless everything is valid.
+		body = api.expect(api.bob, "POST", "/tasks/import", `[{"title":"ok"},{"title":""},{"title":"x","status":"later"}]`, http.StatusUnprocessableEntity)
+		if got := strings.Join(fields(t, body), ","); got != "[1].title,[2].status" {
+			t.Errorf("fields = %s, want [1].title,[2].status", got)
+		}
+		var list []Task
+		api.expectJSON(api.bob, "GET", "/tasks", "", http.StatusOK, &list)
+		if len(list) != 6 {
+			t.Errorf("bob has %d tasks after a failed import, want 6", len(list))
+		}
+		api.expect(api.bob, "POST", "/tasks/import", `[]`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "POST", "/tasks/import", `{"title":"x"}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "POST", "/tasks/import", `[{`, http.StatusBadRequest)
+		api.expect(api.bob, "POST", "/tasks/import", "title\n\"unterminated\n", http.StatusBadRequest, "Content-Type", "text/csv")
+		api.expect(api.bob, "GET", "/tasks/import", "", http.StatusMethodNotAllowed)
+	})
+}
+
+func TestProjects(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		var project Project
+		api.expectJSON(api.bob, "POST", "/projects", `{"name":"Launch","description":"Ship it"}`, http.StatusCreated, &project)
+		if project.ID == 0 || project.OwnerID != 2 {
+			t.Fatalf("created %+v", project)
+		}
+		api.expect(api.bob, "POST", "/projects", `{"name":" "}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "POST", "/projects", `{"name":"`+strings.Repeat("x", maxProjectNameLength+1)+`"}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "PUT", "/projects", "", http.StatusMethodNotAllowed)
+
+		var projects []Project
+		api.expectJSON(api.alice, "GET", "/projects", "", http.StatusOK, &projects)
+		if len(projects) != 1 {
+			t.Errorf("%d projects, want 1", len(projects))
+		}
+		path := "/projects/" + strconv.Itoa(project.ID)
+		api.expectJSON(api.alice, "GET", path, "", http.StatusOK, &project)
+		if project.Name != "Launch" {
+			t.Errorf("got %+v", project)
+		}
+		api.expect(api.alice, "GET", "/projects/999", "", http.StatusNotFound)
+		api.expect(api.alice, "GET", "/projects/x", "", http.StatusBadRequest)
+		api.expect(api.alice, "PUT", path, "", http.StatusMethodNotAllowed)
+
+		// The graph puts each task after its blockers.
+		pid := strconv.Itoa(project.ID)
+		last := api.createTask(api.bob, `{"title":"Announce","project_id":`+pid+`}`)
+		first := api.createTask(api.bob, `{"title":"Build","project_id":`+pid+`}`)
+		api.expect(api.bob, "PATCH", "/tasks/"+strconv.Itoa(last.ID), `{"blocked_by":[`+strconv.Itoa(first.ID)+`]}`, http.StatusOK)
+		api.expect(api.bob, "PATCH", "/tasks/"+strconv.Itoa(first.ID), `{"blocked_by":[`+strconv.Itoa(last.ID)+`]}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "POST", "/tasks", `{"title":"Nowhere","project_id":999}`, http.StatusUnprocessableEntity)
+		var graph struct {
+			Project Project `json:"project"`
+			Tasks   []Task  `json:"tasks"`
+		}
+		api.expectJSON(api.bob, "GET", path+"/graph", "", http.StatusOK, &graph)
+		if len(graph.Tasks) != 2 || graph.Tasks[0].ID != first.ID || graph.Tasks[1].ID != last.ID {
+			t.Errorf("graph = %+v, want Build before Announce", graph.Tasks)
+		}
+		api.expect(api.bob, "GET", "/projects/999/graph", "", http.StatusNotFound)
+		api.expect(api.bob, "POST", path+"/graph", "", http.StatusMethodNotAllowed)
+
+		// Only the owner and admins may delete a project; its tasks are kept.
+		api.createTask(api.alice, `{"title":"Alice's","project_id":`+pid+`}`)
+		var other Project
+		api.expectJSON(api.alice, "POST", "/projects", `{"name":"Other"}`, http.StatusCreated, &other)
+		api.expect(api.bob, "DELETE", "/projects/"+strconv.Itoa(other.ID), "", http.StatusForbidden)
+		api.expect(api.alice, "DELETE", path, "", http.StatusNoContent)
+		api.expect(api.alice, "DELETE", path, "", http.StatusNotFound)
+		api.expect(api.bob, "GET", "/tasks/"+strconv.Itoa(first.ID), "", http.StatusOK)
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		var hook Webhook
+		api.expectJSON(api.bob, "POST", "/webhooks", `{"url":"https://example.com/hooks"}`, http.StatusCreated, &hook)
+		if hook.ID == 0 || hook.Secret == "" || hook.OwnerID != 2 {
+			t.Fatalf("created %+v", hook)
+		}
+		for _, url := range []string{"ftp://example.com/", "/hooks", "not a url"} {
+			body := api.expect(api.bob, "POST", "/webhooks", `{"url":"`+url+`"}`, http.StatusUnprocessableEntity)
+			if got := fields(t, body); len(got) != 1 || got[0] != "url" {
+				t.Errorf("%s: fields = %v, want [url]", url, got)
+			}
+		}
+		// Webhooks cannot reach the server's own network.
+		for _, url := range []string{"http://127.0.0.1:8080/", "http://localhost/", "http://169.254.169.254/latest/meta-data",
+			"http://10.1.2.3/", "https://192.168.0.1/", "http://[::1]/", "http://[fd00::1]/", "http://0.0.0.0/", "http://100.64.0.1/"} {
+			api.expect(api.bob, "POST", "/webhooks", `{"url":"`+url+`"}`, http.StatusUnprocessableEntity)
+		}
+		api.expect(api.bob, "POST", "/webhooks", `{}`, http.StatusUnprocessableEntity)
+		api.expect(api.bob, "PUT", "/webhooks", "", http.StatusMethodNotAllowed)
+
+		var hooks []Webhook
+		api.expectJSON(api.bob, "GET", "/webhooks", "", http.StatusOK, &hooks)
+		if len(hooks) != 1 || hooks[0].Secret != "" {
+			t.Errorf("hooks = %+v, want one without its secret", hooks)
+		}
+		api.expectJSON(api.alice, "GET", "/webhooks", "", http.StatusOK, &hooks)
+		if len(hooks) != 0 {
+			t.Errorf("alice sees %d of bob's webhooks", len(hooks))
+		}
+
+		path := "/webhooks/" + strconv.Itoa(hook.ID)
+		api.expect(api.alice, "DELETE", path, "", http.StatusNotFound)
+		api.expect(api.bob, "GET", path, "", http.StatusMethodNotAllowed)
+		api.expect(api.bob, "DELETE", "/webhooks/x", "", http.StatusBadRequest)
+		api.expect(api.bob, "DELETE", path, "", http.StatusNoContent)
+		api.expect(api.bob, "DELETE", path, "", http.StatusNotFound)
+	})
+}
+
+func TestWebhookDialer(t *testing.T) {
+	// A name that resolves to a private address when it is sent to is
+	// refused too, whatever it resolved to when the webhook was created.
+	for _, address := range []string{"127.0.0.1:80", "[::1]:443", "169.254.169.254:80", "[::ffff:10.0.0.1]:80", "192.168.1.1:8080"} {
+		if err := dialPublic("tcp", address, nil); !errors.Is(err, errPrivateAddress) {
+			t.Errorf("dialing %s: %v, want errPrivateAddress", address, err)
+		}
+	}
+	for _, address := range []string{"93.184.215.14:443", "[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:80"} {
+		if err := dialPublic("tcp", address, nil); err != nil {
+			t.Errorf("dialing %s: %v", address, err)
+		}
+	}
+
+	st := newMemStore()
+	n := newNotifier(st, st)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	d := delivery{ID: 1, Webhook: Webhook{URL: receiver.URL}, Event: HistoryEntry{ID: 1, Action: actionCreated}}
+	if err := n.send(context.Background(), d); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("sending to %s: %v, want errPrivateAddress", receiver.URL, err)
+	}
+	n.allowPrivate = true
+	if err := n.send(context.Background(), d); err != nil {
+		t.Errorf("sending to %s with private addresses allowed: %v", receiver.URL, err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		task := api.createTask(api.bob, `{"title":"Watched"}`)
+		api.createTask(api.alice, `{"title":"Not bob's"}`)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", api.srv.URL+"/tasks/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+api.bob)
+		req.Header.Set("Last-Event-ID", "0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("events: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		// Bob is sent the creation of his task, then its update as it happens.
+		lines := bufio.NewScanner(resp.Body)
+		next := func() string {
+			t.Helper()
+			for lines.Scan() {
+				if event, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+					return event
+				}
+			}
+			t.Fatalf("stream ended: %v", lines.Err())
+			return ""
+		}
+		if event := next(); event != "task.created" {
+			t.Errorf("first event %s, want task.created", event)
+		}
+		api.expect(api.bob, "PATCH", "/tasks/"+strconv.Itoa(task.ID), `{"status":"done"}`, http.StatusOK)
+		api.s.events.poll(ctx) // as the notifier does every eventPollInterval
+		if event := next(); event != "task.updated" {
+			t.Errorf("second event %s, want task.updated", event)
+		}
+		cancel()
+
+		api.expect(api.bob, "GET", "/tasks/events?after=x", "", http.StatusBadRequest)
+		api.expect("", "GET", "/tasks/events", "", http.StatusUnauthorized)
+		api.expect(api.bob, "POST", "/tasks/events", "", http.StatusMethodNotAllowed)
+	})
+}
+
+func TestOpenAPIAndUnknownRoutes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		var spec struct {
+			OpenAPI string                 `json:"openapi"`
+			Paths   map[string]interface{} `json:"paths"`
+		}
+		api.expectJSON("", "GET", "/openapi.json", "", http.StatusOK, &spec)
+		if spec.OpenAPI == "" || spec.Paths["/tasks"] == nil {
+			t.Errorf("spec has version %q and %d paths", spec.OpenAPI, len(spec.Paths))
+		}
+		api.expect("", "POST", "/openapi.json", "", http.StatusMethodNotAllowed)
+		api.expect("", "GET", "/nowhere", "", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+const (
+	actionCreated  = "created"
+	actionUpdated  = "updated"
+	actionDeleted  = "deleted"
+	actionRestored = "restored"
+	actionReminder = "reminder" // not a change: the task falls due soon
+)
+
+// HistoryEntry records one change to a task, or a reminder that it falls
+// due soon. Entries are never changed or removed, not even when the task is
+// deleted.
+type HistoryEntry struct {
+	ID        int                    `json:"id"`
+	TaskID    int                    `json:"task_id"`
+	UserID    int                    `json:"user_id"`
+	Username  string                 `json:"username"`
+	Action    string                 `json:"action"`  // created, updated, deleted, restored or reminder
+	Changes   map[string]fieldChange `json:"changes"` // by field, as sent in JSON
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// fieldChange is the value of a field before and after a change.
+type fieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// untrackedFields are the fields of a task its history does not record,
+// since every change changes them.
+var untrackedFields = []string{"id", "owner_id", "created_at", "updated_at", "version", "deleted_at"}
+
+// taskChanges returns the fields that differ between two versions of a
+// task. A nil before stands for a task that did not exist, so that the
+// fields of after that have a value are recorded, each from null.
+func taskChanges(before *Task, after Task) map[string]fieldChange {
+	old := map[string]interface{}{}
+	if before != nil {
+		old = taskFields(*before)
+	}
+	changes := map[string]fieldChange{}
+	for field, value := range taskFields(after) {
+		if before == nil && !hasValue(value) {
+			continue
+		}
+		if !reflect.DeepEqual(old[field], value) {
+			changes[field] = fieldChange{old[field], value}
+		}
+	}
+	return changes
+}
+
+// hasValue reports whether a field decoded from JSON is set: not null, an
+// empty string or an empty list.
+func hasValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// taskFields returns the tracked fields of a task as they are sent in JSON.
+func taskFields(t Task) map[string]interface{} {
+	fields := map[string]interface{}{}
+	data, _ := json.Marshal(t)
+	json.Unmarshal(data, &fields)
+	for _, f := range untrackedFields {
+		delete(fields, f)
+	}
+	return fields
+}
+
+// getTaskHistory lists the changes made to a task, oldest first. It works
+// for deleted tasks too, so that it can tell who deleted them.
+func (s *server) getTaskHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "/history")
+	if !ok {
+		return
+	}
+	entries, err := s.tasks.TaskHistory(r.Context(), currentUser(r), id)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// restoreTask undoes the deletion of a task, and of the subtasks deleted
+// with it. Only the owner of the task and admins may restore it.
+func (s *server) restoreTask(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "/restore")
+	if !ok {
+		return
+	}
+	task, err := s.tasks.RestoreTask(r.Context(), currentUser(r), id)
+	switch {
+	case err == errTaskNotFound:
+		writeError(w, http.StatusNotFound, "Deleted task not found")
+		return
+	case err == errParentDeleted:
+		writeError(w, http.StatusConflict, "The parent of the task is deleted; restore it first")
+		return
+	case err != nil:
+		internalError(w, r, err)
+		return
+	}
+	writeTask(w, task)
+}
@@ -1,160 +1,397 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
-	
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-
-	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
 )
 
 // Task represents a single task item
 type Task struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Status      string `json:"status"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`   // todo, in-progress or done; rolled up from subtasks if there are any
+	Priority    string     `json:"priority"` // low, medium or high
+	DueDate     *time.Time `json:"due_date"`
+	Recurrence  string     `json:"recurrence"` // an RRULE such as FREQ=WEEKLY;INTERVAL=2, counted from the due date
+	Tags        []string   `json:"tags"`
+	AssigneeID  *int       `json:"assignee_id"`
+	ProjectID   *int       `json:"project_id"` // the parent's project for subtasks
+	ParentID    *int       `json:"parent_id"`
+	BlockedBy   []int      `json:"blocked_by"` // tasks that must be done first
+	OwnerID     int        `json:"owner_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Version     int        `json:"version"` // incremented by every update; also sent as the ETag
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
 }
 
-var db *sql.DB
+// server serves the API from the repositories it is given.
+type server struct {
+	tasks    TaskRepository
+	users    UserRepository
+	projects ProjectRepository
+	webhooks WebhookRepository
+	events   *notifier
+	schedule *scheduler
+	limiter  *rateLimiter
+}
 
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "./tasks.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS tasks (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		title TEXT NOT NULL,
-		description TEXT,
-		status TEXT
-	);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatalf("Error creating database table: %v", err)
+func newServer(tasks TaskRepository, users UserRepository, projects ProjectRepository, webhooks WebhookRepository) *server {
+	return &server{
+		tasks:    tasks,
+		users:    users,
+		projects: projects,
+		webhooks: webhooks,
+		events:   newNotifier(tasks, webhooks),
+		schedule: newScheduler(tasks),
+		limiter:  newRateLimiter(defaultRateLimit),
 	}
 }
 
-func createTask(w http.ResponseWriter, r *http.Request) {
-	var task Task
-	err := json.NewDecoder(r.Body).Decode(&task)
+// routes returns the handler for every route of the API, with requests
+// logged, panics recovered and clients rate limited.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "No such endpoint; see /openapi.json")
+	})
+
+	mux.HandleFunc("/openapi.json", allow("GET", getOpenAPI))
+
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.requireAdmin(s.getUsers)(w, r)
+		case "POST":
+			s.createUser(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/users/me", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.getMe(w, r)
+	}))
+
+	mux.HandleFunc("/users/", s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || !strings.HasSuffix(r.URL.Path, "/role") {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.updateUserRole(w, r)
+	}))
+
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.login(w, r)
+	})
+
+	mux.HandleFunc("/logout", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.logout(w, r)
+	}))
+
+	mux.HandleFunc("/tasks", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.getTasks(w, r)
+		case "POST":
+			s.createTask(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/tasks/", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/tasks/events":
+			allow("GET", s.streamEvents)(w, r)
+			return
+		case r.URL.Path == "/tasks/search":
+			allow("GET", s.searchTasks)(w, r)
+			return
+		case r.URL.Path == "/tasks/export":
+			allow("GET", s.exportTasks)(w, r)
+			return
+		case r.URL.Path == "/tasks/import":
+			allow("POST", s.importTasks)(w, r)
+			return
+		case strings.HasSuffix(r.URL.Path, "/tree"):
+			allow("GET", s.getTaskTree)(w, r)
+			return
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			allow("GET", s.getTaskHistory)(w, r)
+			return
+		case strings.HasSuffix(r.URL.Path, "/restore"):
+			allow("POST", s.restoreTask)(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getTask(w, r)
+		case "PUT":
+			s.updateTask(w, r)
+		case "PATCH":
+			s.patchTask(w, r)
+		case "DELETE":
+			s.deleteTask(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/projects", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.getProjects(w, r)
+		case "POST":
+			s.createProject(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/projects/", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/graph") {
+			allow("GET", s.getProjectGraph)(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getProject(w, r)
+		case "DELETE":
+			s.deleteProject(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/webhooks", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.getWebhooks(w, r)
+		case "POST":
+			s.createWebhook(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/webhooks/", s.requireAuth(allow("DELETE", s.deleteWebhook)))
+
+	return logRequests(recoverPanics(s.limiter.limit(mux)))
+}
+
+// allow rejects requests to next that do not use method.
+func allow(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkAssignee reports an error if a task's assignee is not a user.
+func (s *server) checkAssignee(r *http.Request, t *Task) (validationError, error) {
+	if t.AssigneeID == nil {
+		return nil, nil
+	}
+	exists, err := s.users.UserExists(r.Context(), *t.AssigneeID)
+	if err != nil || exists {
+		return nil, err
+	}
+	return validationError{{"assignee_id", "must be the ID of an existing user"}}, nil
+}
+
+// readTask decodes and checks the task in a request body. If it is not
+// valid, the error has been sent and ok is false.
+func (s *server) readTask(w http.ResponseWriter, r *http.Request) (task Task, ok bool) {
+	if !readJSON(w, r, "TaskInput", &task) {
+		return task, false
+	}
+	return task, s.checkTask(w, r, &task)
+}
+
+// checkTask normalizes and checks a task a client sent. If it is not
+// valid, the error has been sent and false is returned.
+func (s *server) checkTask(w http.ResponseWriter, r *http.Request, task *Task) bool {
+	errs := task.normalize()
+	assigneeErrs, err := s.checkAssignee(r, task)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		internalError(w, r, err)
+		return false
 	}
+	if errs = append(errs, assigneeErrs...); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return false
+	}
+	return true
+}
 
-	res, err := db.Exec("INSERT INTO tasks(title, description, status) VALUES(?, ?, ?)", task.Title, task.Description, task.Status)
+// taskID parses the task ID in a /tasks/ path, before suffix. If it is not
+// valid, the error has been sent and ok is false.
+func taskID(w http.ResponseWriter, r *http.Request, suffix string) (id int, ok bool) {
+	id, err := strconv.Atoi(strings.TrimSuffix(r.URL.Path[len("/tasks/"):], suffix))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, "Invalid task ID")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *server) createTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.readTask(w, r)
+	if !ok {
 		return
 	}
 
-	id, err := res.LastInsertId()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	task.OwnerID = currentUser(r).ID
+	task.CreatedAt = time.Now().UTC()
+	task.UpdatedAt = task.CreatedAt
+	task.Version = 1
+
+	task, err := s.tasks.CreateTask(r.Context(), currentUser(r), task)
+	if verr, ok := err.(validationError); ok {
+		writeValidationError(w, verr)
+		return
+	} else if err != nil {
+		internalError(w, r, err)
 		return
 	}
-	task.ID = int(id)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(task)
+	writeTask(w, task)
 }
 
-func getTasks(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, title, description, status FROM tasks")
+// getTasks lists tasks, filtered, sorted and paginated as described by
+// parseTaskQuery. The total number of matching tasks is returned in the
+// X-Total-Count header.
+func (s *server) getTasks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseTaskQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
+	if u := currentUser(r); !u.IsAdmin() {
+		q.UserID = u.ID
+	}
 
-	var tasks []Task
-	for rows.Next() {
-		var task Task
-		if err := rows.Scan(&task.ID, &task.Title, &task.Description, &task.Status); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		tasks = append(tasks, task)
+	tasks, total, err := s.tasks.ListTasks(r.Context(), q)
+	if err != nil {
+		internalError(w, r, err)
+		return
 	}
 
+	setPageHeaders(w, r, q, total)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tasks)
 }
 
-func getTask(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Path[len("/tasks/"):]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+func (s *server) getTask(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "")
+	if !ok {
 		return
 	}
 
-	var task Task
-	err = db.QueryRow("SELECT id, title, description, status FROM tasks WHERE id = ?", id).Scan(&task.ID, &task.Title, &task.Description, &task.Status)
-	if err == sql.ErrNoRows {
-		http.Error(w, "Task not found", http.StatusNotFound)
+	task, err := s.tasks.GetTask(r.Context(), currentUser(r), id)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
 		return
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, r, err)
+		return
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag(task.Version)) {
+		w.Header().Set("ETag", etag(task.Version))
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(task)
+	writeTask(w, task)
 }
 
-func updateTask(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Path[len("/tasks/"):]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+// updateTask replaces every editable field of a task. Clients should send
+// the version they read, in If-Match or in the body, so that concurrent
+// edits are rejected instead of silently overwritten.
+func (s *server) updateTask(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "")
+	if !ok {
+		return
+	}
+	task, ok := s.readTask(w, r)
+	if !ok {
 		return
 	}
 
-	var task Task
-	err = json.NewDecoder(r.Body).Decode(&task)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	expected, precondition := ifMatch(r)
+	if !precondition {
+		expected = task.Version
+	} else if expected < 0 {
+		writeConflict(w, true)
 		return
 	}
 
-	_, err = db.Exec("UPDATE tasks SET title = ?, description = ?, status = ? WHERE id = ?", task.Title, task.Description, task.Status, id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	task.ID = id
+	task, err := s.tasks.UpdateTask(r.Context(), currentUser(r), task, expected)
+	verr, invalid := err.(validationError)
+	switch {
+	case invalid:
+		writeValidationError(w, verr)
+		return
+	case err == errTaskNotFound:
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	case err == errVersionConflict:
+		writeConflict(w, precondition)
+		return
+	case err != nil:
+		internalError(w, r, err)
 		return
 	}
 
-	task.ID = id // Ensure the ID is set in the response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(task)
+	writeTask(w, task)
 }
 
-func deleteTask(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Path[len("/tasks/"):]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+func (s *server) deleteTask(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "")
+	if !ok {
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM tasks WHERE id = ?", id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	expected, _ := ifMatch(r)
+	if expected < 0 {
+		writeConflict(w, true)
 		return
 	}
 
-	rowsAffected, err := res.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		http.Error(w, "Task not found or no rows affected", http.StatusNotFound)
+	switch err := s.tasks.DeleteTask(r.Context(), currentUser(r), id, expected); {
+	case err == errTaskNotFound:
+		writeError(w, http.StatusNotFound, "Task not found or no rows affected")
+		return
+	case err == errVersionConflict:
+		writeConflict(w, true)
+		return
+	case err != nil:
+		internalError(w, r, err)
 		return
 	}
 
@@ -162,38 +399,57 @@ func deleteTask(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	initDB()
-	defer db.Close()
-
-	http.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			getTasks(w, r)
-		case "POST":
-			createTask(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// UNINDEXED_SEARCH=1 lets SQLite built without FTS5 search every task
+	// rather than an index.
+	unindexed := false
+	if v := os.Getenv("UNINDEXED_SEARCH"); v != "" {
+		var err error
+		if unindexed, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("Invalid UNINDEXED_SEARCH %q: %v", v, err)
 		}
-	})
-
-	http.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			getTask(w, r)
-		case "PUT":
-			updateTask(w, r)
-		case "DELETE":
-			deleteTask(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
+	}
+	st, err := openStore(os.Getenv("DATABASE_URL"), unindexed)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer st.Close()
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
+	s := newServer(st, st, st, st)
+	// RATE_LIMIT is the requests a second each client may make; 0 turns
+	// rate limiting off.
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT %q: %v", v, err)
+		}
+		s.limiter = newRateLimiter(rate)
+	}
+	// REMIND_BEFORE is how long before tasks fall due to remind of them,
+	// such as 24h or 90m; 0 turns reminders off.
+	if v := os.Getenv("REMIND_BEFORE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid REMIND_BEFORE %q: use a duration such as 24h", v)
+		}
+		s.schedule.remindBefore = d
+	}
+	// WEBHOOKS_ALLOW_PRIVATE=1 lets webhooks be sent to private, loopback
+	// and link-local addresses, for development only.
+	if v := os.Getenv("WEBHOOKS_ALLOW_PRIVATE"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOKS_ALLOW_PRIVATE %q: %v", v, err)
+		}
+		s.events.allowPrivate = allow
+	}
+	go s.events.run(context.Background(), eventPollInterval)
+	go s.schedule.run(context.Background(), schedulerInterval)
+
 	log.Printf("Server starting on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, s.routes()))
 }
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore keeps tasks and users in memory. It behaves like sqlStore and
+// is meant for tests and demos; everything is lost when the server stops.
+type memStore struct {
+	mu           sync.Mutex
+	tasks        map[int]Task
+	lastTask     int
+	reminded     map[int]time.Time // the due date of each task last reminded of
+	tags         map[string]string // lower-case tag to the spelling stored first
+	projects     map[int]Project
+	lastProject  int
+	users        []memUser
+	sessions     map[string]memSession
+	history      []HistoryEntry
+	webhooks     map[int]Webhook
+	lastWebhook  int
+	deliveries   []memDelivery
+	lastDelivery int
+}
+
+type memUser struct {
+	User
+	passwordHash string
+}
+
+type memDelivery struct {
+	id        int
+	webhookID int
+	eventID   int
+	attempts  int
+	next      time.Time // zero when due at once
+	lastError string
+}
+
+type memSession struct {
+	userID  int
+	expires time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		tasks:    make(map[int]Task),
+		reminded: make(map[int]time.Time),
+		tags:     make(map[string]string),
+		projects: make(map[int]Project),
+		sessions: make(map[string]memSession),
+		webhooks: make(map[int]Webhook),
+	}
+}
+
+func (m *memStore) Close() error {
+	return nil
+}
+
+// visible reports whether a task is live and user may see and edit it.
+func visible(user *User, t Task) bool {
+	return t.DeletedAt == nil && canSee(user, t)
+}
+
+// canSee is visible for deleted tasks as well as live ones.
+func canSee(user *User, t Task) bool {
+	return user.IsAdmin() || t.OwnerID == user.ID || (t.AssigneeID != nil && *t.AssigneeID == user.ID)
+}
+
+// owns reports whether user may delete and restore a task.
+func owns(user *User, t Task) bool {
+	return user.IsAdmin() || t.OwnerID == user.ID
+}
+
+// copyTask returns t with its own copies of the fields it points to, so
+// that callers cannot change what is stored.
+func copyTask(t Task) Task {
+	if t.DueDate != nil {
+		due := *t.DueDate
+		t.DueDate = &due
+	}
+	if t.AssigneeID != nil {
+		id := *t.AssigneeID
+		t.AssigneeID = &id
+	}
+	if t.ProjectID != nil {
+		id := *t.ProjectID
+		t.ProjectID = &id
+	}
+	if t.ParentID != nil {
+		id := *t.ParentID
+		t.ParentID = &id
+	}
+	if t.DeletedAt != nil {
+		at := *t.DeletedAt
+		t.DeletedAt = &at
+	}
+	t.Tags = append([]string{}, t.Tags...)
+	t.BlockedBy = append([]int{}, t.BlockedBy...)
+	return t
+}
+
+// storeTags spells tags the way they were first stored, and sorts them.
+// The caller must hold m.mu.
+func (m *memStore) storeTags(tags []string) []string {
+	stored := make([]string, len(tags))
+	for i, tag := range tags {
+		key := strings.ToLower(tag)
+		if _, ok := m.tags[key]; !ok {
+			m.tags[key] = tag
+		}
+		stored[i] = m.tags[key]
+	}
+	slices.SortFunc(stored, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	return stored
+}
+
+func (m *memStore) ListTasks(ctx context.Context, q taskQuery) ([]Task, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []Task
+	for _, t := range m.tasks {
+		if q.matches(t) {
+			matched = append(matched, t)
+		}
+	}
+	slices.SortFunc(matched, func(a, b Task) int {
+		if q.less(a, b) {
+			return -1
+		}
+		return 1
+	})
+
+	tasks := []Task{}
+	for i := q.Offset; i < len(matched) && i < q.Offset+q.Limit; i++ {
+		tasks = append(tasks, m.output(matched[i]))
+	}
+	return tasks, len(matched), nil
+}
+
+func (m *memStore) SearchTasks(ctx context.Context, q taskQuery) ([]SearchResult, int, error) {
+	terms := searchTerms(q.Text)
+	q.Text = ""
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []Task
+	for _, t := range m.tasks {
+		if q.matches(t) {
+			matched = append(matched, m.output(t))
+		}
+	}
+	results := rankMatches(matched, terms)
+	return pageResults(results, q), len(results), nil
+}
+
+func (m *memStore) GetTask(ctx context.Context, user *User, id int) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok || !visible(user, t) {
+		return Task{}, errTaskNotFound
+	}
+	return m.output(t), nil
+}
+
+func (m *memStore) CreateTask(ctx context.Context, user *User, task Task) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	task = copyTask(task)
+	if err := m.checkLinks(user, &task); err != nil {
+		return Task{}, err
+	}
+	return m.create(user, task), nil
+}
+
+// ImportTasks checks every task before storing any. That is enough, since
+// the tasks cannot refer to each other.
+func (m *memStore) ImportTasks(ctx context.Context, user *User, tasks []Task) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks = slices.Clone(tasks)
+	var errs validationError
+	for i := range tasks {
+		tasks[i] = copyTask(tasks[i])
+		if err := m.checkLinks(user, &tasks[i]); err != nil {
+			errs = append(errs, err.(validationError).at(i)...)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	created := make([]Task, len(tasks))
+	for i, task := range tasks {
+		created[i] = m.create(user, task)
+	}
+	return created, nil
+}
+
+// create stores a new task that has been checked.
+func (m *memStore) create(user *User, task Task) Task {
+	m.lastTask++
+	task.ID = m.lastTask
+	task.Tags = m.storeTags(task.Tags)
+	m.tasks[task.ID] = task
+	m.record(task.ID, user.ID, actionCreated, taskChanges(nil, m.output(task)), task.CreatedAt)
+	m.rollUp(user.ID, task.ParentID)
+	return m.output(m.tasks[task.ID])
+}
+
+func (m *memStore) UpdateTask(ctx context.Context, user *User, task Task, expected int) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.tasks[task.ID]
+	if !ok || !visible(user, current) {
+		return Task{}, errTaskNotFound
+	}
+	if expected != 0 && current.Version != expected {
+		return Task{}, errVersionConflict
+	}
+	task = copyTask(task)
+	if err := m.checkLinks(user, &task); err != nil {
+		return Task{}, err
+	}
+	if statuses := m.childStatuses(task.ID); len(statuses) > 0 {
+		task.Status = rolledUpStatus(statuses)
+	}
+	now := time.Now().UTC()
+	task.OwnerID, task.CreatedAt = current.OwnerID, current.CreatedAt
+	task.UpdatedAt = now
+	task.Version = current.Version + 1
+	task.Tags = m.storeTags(task.Tags)
+	// Dependencies on deleted tasks are kept in case they are restored.
+	for _, b := range current.BlockedBy {
+		if m.tasks[b].DeletedAt != nil {
+			task.BlockedBy = append(task.BlockedBy, b)
+		}
+	}
+	slices.Sort(task.BlockedBy)
+	m.tasks[task.ID] = task
+	before := m.output(current)
+	if changes := taskChanges(&before, m.output(task)); len(changes) > 0 {
+		m.record(task.ID, user.ID, actionUpdated, changes, now)
+	}
+
+	if !sameID(current.ProjectID, task.ProjectID) {
+		for _, id := range m.subtree(task.ID) {
+			t := m.tasks[id]
+			changes := map[string]fieldChange{"project_id": {t.ProjectID, copyTask(task).ProjectID}}
+			t.ProjectID = copyTask(task).ProjectID
+			t.UpdatedAt = now
+			t.Version++
+			m.tasks[id] = t
+			m.record(id, user.ID, actionUpdated, changes, now)
+		}
+	}
+	m.rollUp(user.ID, task.ParentID)
+	if !sameID(current.ParentID, task.ParentID) {
+		m.rollUp(user.ID, current.ParentID)
+	}
+	return m.output(m.tasks[task.ID]), nil
+}
+
+func (m *memStore) DeleteTask(ctx context.Context, user *User, id int, expected int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok || t.DeletedAt != nil || !owns(user, t) {
+		return errTaskNotFound
+	}
+	if expected != 0 && t.Version != expected {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	for _, d := range append([]int{id}, m.subtree(id)...) {
+		if sub := m.tasks[d]; sub.DeletedAt == nil {
+			sub.DeletedAt = &now
+			sub.Version++
+			m.tasks[d] = sub
+			m.record(d, user.ID, actionDeleted, map[string]fieldChange{}, now)
+		}
+	}
+	m.rollUp(user.ID, t.ParentID)
+	return nil
+}
+
+func (m *memStore) RestoreTask(ctx context.Context, user *User, id int) (Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok || t.DeletedAt == nil || !owns(user, t) {
+		return Task{}, errTaskNotFound
+	}
+	if t.ParentID != nil && m.tasks[*t.ParentID].DeletedAt != nil {
+		return Task{}, errParentDeleted
+	}
+	now := time.Now().UTC()
+	for _, r := range append([]int{id}, m.subtree(id)...) {
+		if sub := m.tasks[r]; sub.DeletedAt != nil && sub.DeletedAt.Equal(*t.DeletedAt) {
+			sub.DeletedAt = nil
+			sub.Version++
+			m.tasks[r] = sub
+			m.record(r, user.ID, actionRestored, map[string]fieldChange{}, now)
+		}
+	}
+	m.rollUp(user.ID, t.ParentID)
+	return m.output(m.tasks[id]), nil
+}
+
+func (m *memStore) TaskHistory(ctx context.Context, user *User, id int) ([]HistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok || !canSee(user, t) {
+		return nil, errTaskNotFound
+	}
+	entries := []HistoryEntry{}
+	for _, e := range m.history {
+		if e.TaskID == id {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (m *memStore) TaskEvents(ctx context.Context, user *User, after, limit int) ([]HistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []HistoryEntry{}
+	for _, e := range m.history[min(after, len(m.history)):] {
+		if len(entries) == limit {
+			break
+		}
+		if canSee(user, m.tasks[e.TaskID]) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (m *memStore) LastEventID(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.history), nil
+}
+
+func (m *memStore) Subtasks(ctx context.Context, user *User, id int) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := m.subtree(id)
+	slices.Sort(ids)
+	tasks := []Task{}
+	for _, id := range ids {
+		if t := m.tasks[id]; visible(user, t) {
+			tasks = append(tasks, m.output(t))
+		}
+	}
+	return tasks, nil
+}
+
+func (m *memStore) ProjectTasks(ctx context.Context, user *User, projectID int) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks := []Task{}
+	for _, t := range m.tasks {
+		if t.ProjectID != nil && *t.ProjectID == projectID && visible(user, t) {
+			tasks = append(tasks, m.output(t))
+		}
+	}
+	slices.SortFunc(tasks, func(a, b Task) int { return a.ID - b.ID })
+	return tasks, nil
+}
+
+func (m *memStore) DoneRecurringTasks(ctx context.Context, limit int) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks := []Task{}
+	for _, t := range m.tasks {
+		if t.Recurrence != "" && t.Status == statusDone && t.DeletedAt == nil && t.OwnerID != 0 {
+			tasks = append(tasks, m.output(t))
+		}
+	}
+	slices.SortFunc(tasks, func(a, b Task) int { return a.ID - b.ID })
+	return tasks[:min(limit, len(tasks))], nil
+}
+
+func (m *memStore) RecurTask(ctx context.Context, task Task, next *Task) (*Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.tasks[task.ID]
+	if !ok || current.DeletedAt != nil || current.Version != task.Version {
+		return nil, errVersionConflict
+	}
+	u, ok := m.user(current.OwnerID)
+	if !ok {
+		return nil, errUserNotFound
+	}
+	owner := u.User
+	var created Task
+	if next != nil {
+		created = copyTask(*next)
+		if err := m.checkLinks(&owner, &created); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	changes := map[string]fieldChange{"recurrence": {current.Recurrence, ""}}
+	current.Recurrence = ""
+	current.UpdatedAt = now
+	current.Version++
+	m.tasks[current.ID] = current
+	m.record(current.ID, owner.ID, actionUpdated, changes, now)
+	if next == nil {
+		return nil, nil
+	}
+	created = m.create(&owner, created)
+	return &created, nil
+}
+
+func (m *memStore) RemindDueTasks(ctx context.Context, from, to time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []Task
+	for _, t := range m.tasks {
+		if t.DueDate == nil || !t.DueDate.After(from) || t.DueDate.After(to) {
+			continue
+		}
+		if last, ok := m.reminded[t.ID]; ok && last.Equal(*t.DueDate) {
+			continue
+		}
+		if t.Status != statusDone && t.DeletedAt == nil && t.OwnerID != 0 {
+			due = append(due, t)
+		}
+	}
+	slices.SortFunc(due, func(a, b Task) int {
+		if c := a.DueDate.Compare(*b.DueDate); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	due = due[:min(limit, len(due))]
+	now := time.Now().UTC()
+	for _, t := range due {
+		m.reminded[t.ID] = *t.DueDate
+		m.record(t.ID, t.OwnerID, actionReminder, map[string]fieldChange{}, now)
+	}
+	return len(due), nil
+}
+
+// output returns a copy of a stored task to hand out, without its deleted
+// blockers. The caller must hold m.mu.
+func (m *memStore) output(t Task) Task {
+	t = copyTask(t)
+	t.BlockedBy = slices.DeleteFunc(t.BlockedBy, func(b int) bool { return m.tasks[b].DeletedAt != nil })
+	return t
+}
+
+// record appends an entry to the history of a task and queues it for the
+// webhooks whose owner can see the task. The caller must hold m.mu.
+func (m *memStore) record(taskID, userID int, action string, changes map[string]fieldChange, at time.Time) {
+	u, _ := m.user(userID)
+	e := HistoryEntry{
+		ID:        len(m.history) + 1,
+		TaskID:    taskID,
+		UserID:    userID,
+		Username:  u.Username,
+		Action:    action,
+		Changes:   changes,
+		CreatedAt: at,
+	}
+	m.history = append(m.history, e)
+
+	ids := make([]int, 0, len(m.webhooks))
+	for id := range m.webhooks {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		owner, ok := m.user(m.webhooks[id].OwnerID)
+		if ok && canSee(&owner.User, m.tasks[taskID]) {
+			m.lastDelivery++
+			m.deliveries = append(m.deliveries, memDelivery{id: m.lastDelivery, webhookID: id, eventID: e.ID})
+		}
+	}
+}
+
+// subtree returns the IDs of the subtasks of a task, their subtasks and so
+// on, deleted or not. The caller must hold m.mu.
+func (m *memStore) subtree(id int) []int {
+	var ids []int
+	for queue := []int{id}; len(queue) > 0; queue = queue[1:] {
+		for _, t := range m.tasks {
+			if t.ParentID != nil && *t.ParentID == queue[0] {
+				ids = append(ids, t.ID)
+				queue = append(queue, t.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// checkLinks is sqlStore's checkLinks. The caller must hold m.mu.
+func (m *memStore) checkLinks(user *User, task *Task) error {
+	var errs validationError
+	if task.ParentID != nil {
+		parent, ok := m.tasks[*task.ParentID]
+		if !ok || !visible(user, parent) {
+			errs = append(errs, fieldError{"parent_id", "must be the ID of a task you can see"})
+		} else {
+			for p := &parent; task.ID != 0; {
+				if p.ID == task.ID {
+					errs = append(errs, fieldError{"parent_id", "must not be the task itself or one of its subtasks"})
+					break
+				}
+				if p.ParentID == nil {
+					break
+				}
+				next := m.tasks[*p.ParentID]
+				p = &next
+			}
+			if task.ProjectID == nil {
+				task.ProjectID = copyTask(parent).ProjectID
+			} else if !sameID(task.ProjectID, parent.ProjectID) {
+				errs = append(errs, fieldError{"project_id", "must be the project of the parent task"})
+			}
+		}
+	}
+	if task.ProjectID != nil {
+		if _, ok := m.projects[*task.ProjectID]; !ok {
+			errs = append(errs, fieldError{"project_id", "must be the ID of an existing project"})
+		}
+	}
+	for _, id := range task.BlockedBy {
+		if id == task.ID {
+			errs = append(errs, fieldError{"blocked_by", "must not contain the task itself"})
+			continue
+		}
+		if t, ok := m.tasks[id]; !ok || !visible(user, t) {
+			errs = append(errs, fieldError{"blocked_by", fmt.Sprintf("task %d does not exist or is not visible to you", id)})
+			continue
+		}
+		if task.ID != 0 && m.blockedBy(id, task.ID) {
+			errs = append(errs, fieldError{"blocked_by", fmt.Sprintf("task %d is already blocked by this task, directly or not", id)})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// blockedBy reports whether task id waits for task blocker, directly or
+// not. The caller must hold m.mu.
+func (m *memStore) blockedBy(id, blocker int) bool {
+	seen := map[int]bool{id: true}
+	for stack := []int{id}; len(stack) > 0; {
+		t := m.tasks[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		for _, b := range t.BlockedBy {
+			if b == blocker {
+				return true
+			}
+			if !seen[b] {
+				seen[b] = true
+				stack = append(stack, b)
+			}
+		}
+	}
+	return id == blocker
+}
+
+// childStatuses returns the statuses of the live subtasks of a task. The
+// caller must hold m.mu.
+func (m *memStore) childStatuses(id int) []string {
+	var statuses []string
+	for _, t := range m.tasks {
+		if t.ParentID != nil && *t.ParentID == id && t.DeletedAt == nil {
+			statuses = append(statuses, t.Status)
+		}
+	}
+	return statuses
+}
+
+// rollUp is sqlStore's rollUp. The caller must hold m.mu.
+func (m *memStore) rollUp(userID int, id *int) {
+	for id != nil {
+		statuses := m.childStatuses(*id)
+		if len(statuses) == 0 {
+			return
+		}
+		t := m.tasks[*id]
+		status := rolledUpStatus(statuses)
+		if t.Status == status {
+			return
+		}
+		now := time.Now().UTC()
+		m.record(t.ID, userID, actionUpdated, map[string]fieldChange{"status": {t.Status, status}}, now)
+		t.Status = status
+		t.UpdatedAt = now
+		t.Version++
+		m.tasks[*id] = t
+		id = t.ParentID
+	}
+}
+
+func (m *memStore) CreateProject(ctx context.Context, p Project) (Project, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastProject++
+	p.ID = m.lastProject
+	m.projects[p.ID] = p
+	return p, nil
+}
+
+func (m *memStore) ListProjects(ctx context.Context) ([]Project, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	projects := []Project{}
+	for _, p := range m.projects {
+		projects = append(projects, p)
+	}
+	slices.SortFunc(projects, func(a, b Project) int { return a.ID - b.ID })
+	return projects, nil
+}
+
+func (m *memStore) GetProject(ctx context.Context, id int) (Project, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.projects[id]
+	if !ok {
+		return p, errProjectNotFound
+	}
+	return p, nil
+}
+
+func (m *memStore) DeleteProject(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.projects[id]; !ok {
+		return errProjectNotFound
+	}
+	delete(m.projects, id)
+	for tid, t := range m.tasks {
+		if t.ProjectID != nil && *t.ProjectID == id {
+			t.ProjectID = nil
+			m.tasks[tid] = t
+		}
+	}
+	return nil
+}
+
+func (m *memStore) CreateWebhook(ctx context.Context, hook Webhook) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastWebhook++
+	hook.ID = m.lastWebhook
+	m.webhooks[hook.ID] = hook
+	return hook, nil
+}
+
+func (m *memStore) ListWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hooks := []Webhook{}
+	for _, h := range m.webhooks {
+		if h.OwnerID == userID {
+			hook := h
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+		}
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.ID - b.ID })
+	return hooks, nil
+}
+
+func (m *memStore) DeleteWebhook(ctx context.Context, userID, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.webhooks[id]; !ok || h.OwnerID != userID {
+		return errWebhookNotFound
+	}
+	delete(m.webhooks, id)
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d memDelivery) bool { return d.webhookID == id })
+	return nil
+}
+
+func (m *memStore) DueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []delivery
+	for i, d := range m.deliveries {
+		if len(due) == limit {
+			break
+		}
+		if d.next.After(now) {
+			continue
+		}
+		m.deliveries[i].next = now.Add(lease)
+		due = append(due, delivery{
+			ID:       d.id,
+			Webhook:  m.webhooks[d.webhookID],
+			Event:    m.history[d.eventID-1],
+			Attempts: d.attempts,
+		})
+	}
+	return due, nil
+}
+
+func (m *memStore) DeliveryDone(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d memDelivery) bool { return d.id == id })
+	return nil
+}
+
+func (m *memStore) DeliveryFailed(ctx context.Context, id int, reason string, retry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.deliveries {
+		if d.id == id {
+			m.deliveries[i].attempts++
+			m.deliveries[i].lastError = reason
+			m.deliveries[i].next = retry
+		}
+	}
+	return nil
+}
+
+func (m *memStore) CreateUser(ctx context.Context, username, passwordHash string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username {
+			return User{}, errUsernameTaken
+		}
+	}
+	u := User{ID: len(m.users) + 1, Username: username, Role: roleUser, CreatedAt: time.Now().UTC()}
+	if len(m.users) == 0 {
+		u.Role = roleAdmin
+	}
+	m.users = append(m.users, memUser{u, passwordHash})
+	return u, nil
+}
+
+// user returns the account with an ID. The caller must hold m.mu.
+func (m *memStore) user(id int) (*memUser, bool) {
+	if id < 1 || id > len(m.users) {
+		return nil, false
+	}
+	return &m.users[id-1], true
+}
+
+func (m *memStore) UserExists(ctx context.Context, id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.user(id)
+	return ok, nil
+}
+
+func (m *memStore) PasswordHash(ctx context.Context, username string) (int, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username {
+			return u.ID, u.passwordHash, nil
+		}
+	}
+	return 0, "", errUserNotFound
+}
+
+func (m *memStore) ListUsers(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []User{}
+	for _, u := range m.users {
+		users = append(users, u.User)
+	}
+	return users, nil
+}
+
+func (m *memStore) SetRole(ctx context.Context, id int, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.user(id)
+	if !ok {
+		return errUserNotFound
+	}
+	u.Role = role
+	return nil
+}
+
+func (m *memStore) CreateSession(ctx context.Context, tokenHash string, userID int, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[tokenHash] = memSession{userID, expires}
+	return nil
+}
+
+func (m *memStore) SessionUser(ctx context.Context, tokenHash string) (User, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[tokenHash]
+	if !ok {
+		return User{}, time.Time{}, errSessionNotFound
+	}
+	u, _ := m.user(s.userID)
+	return u.User, s.expires, nil
+}
+
+func (m *memStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *memStore) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, s := range m.sessions {
+		if s.expires.Before(now) {
+			delete(m.sessions, hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one step of the database schema. Migrations run in order of
+// version, each in its own transaction, and are recorded in
+// schema_migrations so that each runs once. Released migrations must never
+// change; add a new one instead. SQLite and Postgres have separate lists.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations is the schema of SQLite databases.
+var migrations = []migration{
+	{1, "create tasks", execSQL(`
+		CREATE TABLE IF NOT EXISTS tasks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT NOT NULL,
+			description TEXT,
+			status TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
+	`)},
+	{2, "create users and sessions", execSQL(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at DATETIME NOT NULL
+		);
+	`)},
+	// Tasks created before there were users have no owner; only admins see them.
+	{3, "add task owners", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "tasks", "owner_id", "INTEGER REFERENCES users(id)"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_tasks_owner ON tasks(owner_id)")
+		return err
+	}},
+	// SQLite cannot add constraints to an existing table, so tasks is
+	// rebuilt. Free-form statuses are mapped onto the new enum.
+	{4, "add priority, due date, assignee, timestamps and tags", func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		return execSQL(`
+			CREATE TABLE tasks_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				title TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL DEFAULT 'todo' CHECK (status IN ('todo', 'in-progress', 'done')),
+				priority TEXT NOT NULL DEFAULT 'medium' CHECK (priority IN ('low', 'medium', 'high')),
+				due_date DATETIME,
+				owner_id INTEGER REFERENCES users(id),
+				assignee_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL
+			);
+			INSERT INTO tasks_new (id, title, description, status, owner_id, created_at, updated_at)
+			SELECT id, title, COALESCE(description, ''),
+				CASE lower(trim(COALESCE(status, '')))
+					WHEN 'done' THEN 'done'
+					WHEN 'completed' THEN 'done'
+					WHEN 'complete' THEN 'done'
+					WHEN 'closed' THEN 'done'
+					WHEN 'in-progress' THEN 'in-progress'
+					WHEN 'in progress' THEN 'in-progress'
+					WHEN 'in_progress' THEN 'in-progress'
+					WHEN 'doing' THEN 'in-progress'
+					WHEN 'started' THEN 'in-progress'
+					ELSE 'todo'
+				END,
+				owner_id, ?, ?
+			FROM tasks;
+			UPDATE sqlite_sequence SET seq = (SELECT MAX(seq) FROM sqlite_sequence WHERE name IN ('tasks', 'tasks_new'))
+			WHERE name = 'tasks_new';
+			DROP TABLE tasks;
+			ALTER TABLE tasks_new RENAME TO tasks;
+			CREATE INDEX idx_tasks_status ON tasks(status);
+			CREATE INDEX idx_tasks_owner ON tasks(owner_id);
+			CREATE INDEX idx_tasks_assignee ON tasks(assignee_id);
+			CREATE INDEX idx_tasks_due_date ON tasks(due_date);
+
+			CREATE TABLE tags (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE COLLATE NOCASE
+			);
+			CREATE TABLE task_tags (
+				task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+				tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+				PRIMARY KEY (task_id, tag_id)
+			);
+			CREATE INDEX idx_task_tags_tag ON task_tags(tag_id);
+		`, now, now)(tx)
+	}},
+	{5, "add task versions", execSQL(`
+		ALTER TABLE tasks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	`)},
+	{6, "add projects, subtasks and dependencies", execSQL(`
+		CREATE TABLE projects (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			owner_id INTEGER NOT NULL REFERENCES users(id),
+			created_at DATETIME NOT NULL
+		);
+		ALTER TABLE tasks ADD COLUMN project_id INTEGER REFERENCES projects(id) ON DELETE SET NULL;
+		ALTER TABLE tasks ADD COLUMN parent_id INTEGER REFERENCES tasks(id) ON DELETE CASCADE;
+		CREATE INDEX idx_tasks_project ON tasks(project_id);
+		CREATE INDEX idx_tasks_parent ON tasks(parent_id);
+
+		CREATE TABLE task_dependencies (
+			task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+			blocked_by_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+			PRIMARY KEY (task_id, blocked_by_id),
+			CHECK (task_id <> blocked_by_id)
+		);
+		CREATE INDEX idx_task_dependencies_blocker ON task_dependencies(blocked_by_id);
+	`)},
+	// History outlives its tasks, so task_id has no foreign key.
+	{7, "add task history and soft deletes", execSQL(`
+		ALTER TABLE tasks ADD COLUMN deleted_at DATETIME;
+		CREATE INDEX idx_tasks_deleted ON tasks(deleted_at);
+
+		CREATE TABLE task_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			action TEXT NOT NULL CHECK (action IN ('created', 'updated', 'deleted', 'restored')),
+			changes TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX idx_task_history_task ON task_history(task_id);
+		CREATE TRIGGER task_history_no_update BEFORE UPDATE ON task_history
+		BEGIN
+			SELECT RAISE(ABORT, 'task history is append-only');
+		END;
+		CREATE TRIGGER task_history_no_delete BEFORE DELETE ON task_history
+		BEGIN
+			SELECT RAISE(ABORT, 'task history is append-only');
+		END;
+	`)},
+	// last_event_id is the last task_history entry queued for a webhook.
+	{8, "create webhooks and their outbox", execSQL(`
+		CREATE TABLE webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_event_id INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX idx_webhooks_user ON webhooks(user_id);
+
+		CREATE TABLE webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+			event_id INTEGER NOT NULL REFERENCES task_history(id),
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME,
+			last_error TEXT,
+			UNIQUE (webhook_id, event_id)
+		);
+		CREATE INDEX idx_webhook_deliveries_next_attempt ON webhook_deliveries(next_attempt_at);
+	`)},
+	// reminded_due_date is the due date a reminder was last recorded for.
+	// SQLite cannot change the CHECK on task_history.action, so the table is
+	// rebuilt. It is recreated under its own name before its rows are put
+	// back, so that the foreign keys of webhook_deliveries, checked at the
+	// end, find them.
+	{9, "add recurrence and reminders", execSQL(`
+		PRAGMA defer_foreign_keys = ON;
+
+		ALTER TABLE tasks ADD COLUMN recurrence TEXT NOT NULL DEFAULT '';
+		ALTER TABLE tasks ADD COLUMN reminded_due_date DATETIME;
+
+		CREATE TEMP TABLE task_history_copy AS SELECT * FROM task_history;
+		DROP TABLE task_history;
+		CREATE TABLE task_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			action TEXT NOT NULL CHECK (action IN ('created', 'updated', 'deleted', 'restored', 'reminder')),
+			changes TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		INSERT INTO task_history SELECT id, task_id, user_id, action, changes, created_at FROM task_history_copy;
+		DROP TABLE task_history_copy;
+		CREATE INDEX idx_task_history_task ON task_history(task_id);
+		CREATE TRIGGER task_history_no_update BEFORE UPDATE ON task_history
+		BEGIN
+			SELECT RAISE(ABORT, 'task history is append-only');
+		END;
+		CREATE TRIGGER task_history_no_delete BEFORE DELETE ON task_history
+		BEGIN
+			SELECT RAISE(ABORT, 'task history is append-only');
+		END;
+	`)},
+	// Task history is queued for webhooks as it is recorded, so the history
+	// not queued yet is queued one last time.
+	{10, "queue webhook events with the task history", execSQL(`
+		INSERT INTO webhook_deliveries(webhook_id, event_id)
+			SELECT w.id, h.id FROM webhooks w
+			JOIN users u ON u.id = w.user_id
+			JOIN task_history h ON h.id > w.last_event_id
+			JOIN tasks t ON t.id = h.task_id
+			WHERE u.role = 'admin' OR t.owner_id = w.user_id OR t.assignee_id = w.user_id
+			ON CONFLICT DO NOTHING;
+		ALTER TABLE webhooks DROP COLUMN last_event_id;
+	`)},
+}
+
+// postgresMigrations is the schema of Postgres databases. Postgres support
+// came after migration 5, so its history starts with the schema as it was
+// then.
+var postgresMigrations = []migration{
+	{1, "create schema", execSQL(`
+		CREATE TABLE users (
+			id SERIAL PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE TABLE tasks (
+			id SERIAL PRIMARY KEY,
+			title TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'todo' CHECK (status IN ('todo', 'in-progress', 'done')),
+			priority TEXT NOT NULL DEFAULT 'medium' CHECK (priority IN ('low', 'medium', 'high')),
+			due_date TIMESTAMPTZ,
+			owner_id INTEGER REFERENCES users(id),
+			assignee_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1
+		);
+		CREATE INDEX idx_tasks_status ON tasks(status);
+		CREATE INDEX idx_tasks_owner ON tasks(owner_id);
+		CREATE INDEX idx_tasks_assignee ON tasks(assignee_id);
+		CREATE INDEX idx_tasks_due_date ON tasks(due_date);
+
+		CREATE TABLE tags (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL
+		);
+		CREATE UNIQUE INDEX idx_tags_name ON tags(lower(name));
+		CREATE TABLE task_tags (
+			task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+			tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			PRIMARY KEY (task_id, tag_id)
+		);
+		CREATE INDEX idx_task_tags_tag ON task_tags(tag_id);
+	`)},
+	{2, "add projects, subtasks and dependencies", execSQL(`
+		CREATE TABLE projects (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			owner_id INTEGER NOT NULL REFERENCES users(id),
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		ALTER TABLE tasks ADD COLUMN project_id INTEGER REFERENCES projects(id) ON DELETE SET NULL;
+		ALTER TABLE tasks ADD COLUMN parent_id INTEGER REFERENCES tasks(id) ON DELETE CASCADE;
+		CREATE INDEX idx_tasks_project ON tasks(project_id);
+		CREATE INDEX idx_tasks_parent ON tasks(parent_id);
+
+		CREATE TABLE task_dependencies (
+			task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+			blocked_by_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+			PRIMARY KEY (task_id, blocked_by_id),
+			CHECK (task_id <> blocked_by_id)
+		);
+		CREATE INDEX idx_task_dependencies_blocker ON task_dependencies(blocked_by_id);
+	`)},
+	{3, "add task history and soft deletes", execSQL(`
+		ALTER TABLE tasks ADD COLUMN deleted_at TIMESTAMPTZ;
+		CREATE INDEX idx_tasks_deleted ON tasks(deleted_at);
+
+		CREATE TABLE task_history (
+			id SERIAL PRIMARY KEY,
+			task_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			action TEXT NOT NULL CHECK (action IN ('created', 'updated', 'deleted', 'restored')),
+			changes TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX idx_task_history_task ON task_history(task_id);
+		CREATE FUNCTION task_history_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'task history is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER task_history_append_only BEFORE UPDATE OR DELETE ON task_history
+			FOR EACH ROW EXECUTE FUNCTION task_history_append_only();
+	`)},
+	{4, "create webhooks and their outbox", execSQL(`
+		CREATE TABLE webhooks (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_event_id INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX idx_webhooks_user ON webhooks(user_id);
+
+		CREATE TABLE webhook_deliveries (
+			id SERIAL PRIMARY KEY,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+			event_id INTEGER NOT NULL REFERENCES task_history(id),
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ,
+			last_error TEXT,
+			UNIQUE (webhook_id, event_id)
+		);
+		CREATE INDEX idx_webhook_deliveries_next_attempt ON webhook_deliveries(next_attempt_at);
+	`)},
+	{5, "index tasks for full-text search", execSQL(`
+		CREATE INDEX idx_tasks_search ON tasks USING GIN (
+			(setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', COALESCE(description, '')), 'B'))
+		);
+	`)},
+	{6, "add recurrence and reminders", execSQL(`
+		ALTER TABLE tasks ADD COLUMN recurrence TEXT NOT NULL DEFAULT '';
+		ALTER TABLE tasks ADD COLUMN reminded_due_date TIMESTAMPTZ;
+		ALTER TABLE task_history DROP CONSTRAINT task_history_action_check;
+		ALTER TABLE task_history ADD CONSTRAINT task_history_action_check
+			CHECK (action IN ('created', 'updated', 'deleted', 'restored', 'reminder'));
+	`)},
+	// Task history is queued for webhooks as it is recorded, so the history
+	// not queued yet is queued one last time.
+	{7, "queue webhook events with the task history", execSQL(`
+		INSERT INTO webhook_deliveries(webhook_id, event_id)
+			SELECT w.id, h.id FROM webhooks w
+			JOIN users u ON u.id = w.user_id
+			JOIN task_history h ON h.id > w.last_event_id
+			JOIN tasks t ON t.id = h.task_id
+			WHERE u.role = 'admin' OR t.owner_id = w.user_id OR t.assignee_id = w.user_id
+			ON CONFLICT DO NOTHING;
+		ALTER TABLE webhooks DROP COLUMN last_event_id;
+	`)},
+}
+
+// setUpFullTextSearch indexes the titles and descriptions of tasks in the
+// FTS5 table tasks_fts, kept up to date by triggers, and reports whether
+// it could: go-sqlite3 only has FTS5 when built with -tags sqlite_fts5.
+// That depends on the build rather than the database, so this is not a
+// migration. Builds without FTS5 drop the triggers, which would fail every
+// write to tasks, and the next build with it rebuilds the index.
+func setUpFullTextSearch(db *sql.DB) (bool, error) {
+	available, err := hasFTS5(db)
+	if err != nil {
+		return false, err
+	}
+	if !available {
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS tasks_fts_insert;
+			DROP TRIGGER IF EXISTS tasks_fts_delete;
+			DROP TRIGGER IF EXISTS tasks_fts_update;
+		`)
+		return false, err
+	}
+
+	var triggers int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'trigger' AND name IN ('tasks_fts_insert', 'tasks_fts_delete', 'tasks_fts_update')`).Scan(&triggers)
+	if err != nil || triggers == 3 {
+		return err == nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		DROP TRIGGER IF EXISTS tasks_fts_insert;
+		DROP TRIGGER IF EXISTS tasks_fts_delete;
+		DROP TRIGGER IF EXISTS tasks_fts_update;
+		DROP TABLE IF EXISTS tasks_fts;
+
+		CREATE VIRTUAL TABLE tasks_fts USING fts5(
+			title, description,
+			content = 'tasks', content_rowid = 'id', tokenize = 'unicode61 remove_diacritics 2'
+		);
+		CREATE TRIGGER tasks_fts_insert AFTER INSERT ON tasks BEGIN
+			INSERT INTO tasks_fts(rowid, title, description) VALUES (new.id, new.title, new.description);
+		END;
+		CREATE TRIGGER tasks_fts_delete AFTER DELETE ON tasks BEGIN
+			INSERT INTO tasks_fts(tasks_fts, rowid, title, description) VALUES ('delete', old.id, old.title, old.description);
+		END;
+		CREATE TRIGGER tasks_fts_update AFTER UPDATE OF title, description ON tasks BEGIN
+			INSERT INTO tasks_fts(tasks_fts, rowid, title, description) VALUES ('delete', old.id, old.title, old.description);
+			INSERT INTO tasks_fts(rowid, title, description) VALUES (new.id, new.title, new.description);
+		END;
+		INSERT INTO tasks_fts(tasks_fts) VALUES ('rebuild');
+	`)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Printf("Built the full-text search index\n")
+	return true, nil
+}
+
+// hasFTS5 reports whether SQLite was built with FTS5.
+func hasFTS5(db *sql.DB) (bool, error) {
+	var available bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available)
+	return available, err
+}
+
+// migrate brings the database schema up to date with migrations.
+func migrate(db *sql.DB, d dialect, migrations []migration) error {
+	timestamp := "DATETIME"
+	if d == dialectPostgres {
+		timestamp = "TIMESTAMPTZ"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(d.rebind("INSERT INTO schema_migrations(version, name, applied_at) VALUES(?, ?, ?)"), m.version, m.name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// execSQL returns a migration step that runs a script of statements.
+func execSQL(script string, args ...interface{}) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script, args...)
+		return err
+	}
+}
+
+// addColumnIfMissing adds a column to a table that may have been created
+// with it already, before migrations were tracked.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxBodySize = 1 << 20
+
+// openAPISpec describes the API. The request bodies it describes are
+// checked against it, so that it cannot drift from what the handlers
+// accept.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// schema is the part of an OpenAPI 3.0 schema object that request bodies
+// are checked against. Other keywords are documentation only.
+type schema struct {
+	Ref        string             `json:"$ref"`
+	AllOf      []*schema          `json:"allOf"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Nullable   bool               `json:"nullable"`
+	Enum       []interface{}      `json:"enum"`
+	Required   []string           `json:"required"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+}
+
+// schemas are the components of openAPISpec by name.
+var schemas = func() map[string]*schema {
+	var spec struct {
+		Components struct {
+			Schemas map[string]*schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		panic(fmt.Sprintf("openapi.json: %v", err))
+	}
+	return spec.Components.Schemas
+}()
+
+// getOpenAPI serves the OpenAPI document.
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// validate checks a decoded JSON document against the named schema.
+func validate(name string, doc interface{}) validationError {
+	return validateAt(name, doc, "")
+}
+
+// validateItem is validate for the item at index i of a list. Its errors
+// are named as fields of [i].
+func validateItem(name string, doc interface{}, i int) validationError {
+	return validateAt(name, doc, itemPath(i))
+}
+
+func validateAt(name string, doc interface{}, path string) validationError {
+	var errs validationError
+	schemas[name].check(doc, path, &errs)
+	slices.SortStableFunc(errs, func(a, b fieldError) int { return strings.Compare(a.Field, b.Field) })
+	return errs
+}
+
+// check appends to errs what is wrong with value, found at path.
+func (s *schema) check(value interface{}, path string, errs *validationError) {
+	if s.Ref != "" {
+		schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")].check(value, path, errs)
+		return
+	}
+	for _, sub := range s.AllOf {
+		sub.check(value, path, errs)
+	}
+	fail := func(format string, args ...interface{}) {
+		field := path
+		if field == "" {
+			field = "body"
+		}
+		*errs = append(*errs, fieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	if value == nil {
+		if !s.Nullable && s.Type != "" {
+			fail("must not be null")
+		}
+		return
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, value) {
+		names := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			names[i] = fmt.Sprint(v)
+		}
+		fail("must be one of %s", strings.Join(names, ", "))
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*errs = append(*errs, fieldError{joinPath(path, name), "is required"})
+			}
+		}
+		for name, prop := range s.Properties {
+			if v, ok := obj[name]; ok {
+				prop.check(v, joinPath(path, name), errs)
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if s.MinItems != nil && len(list) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(list) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, v := range list {
+				s.Items.check(v, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				fail("must not be empty")
+			} else {
+				fail("must be at least %d characters", *s.MinLength)
+			}
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		switch s.Format {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				fail("must be an RFC 3339 date and time")
+			}
+		case "uri":
+			if u, err := url.Parse(str); err != nil || !u.IsAbs() {
+				fail("must be an absolute URI")
+			}
+		}
+	case "integer", "number":
+		num, ok := value.(float64)
+		if s.Type == "integer" && (!ok || num != math.Trunc(num)) {
+			fail("must be an integer")
+			return
+		} else if !ok {
+			fail("must be a number")
+			return
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+		}
+	}
+}
+
+// joinPath returns the path of a property of the value at path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func enumContains(enum []interface{}, value interface{}) bool {
+	for _, v := range enum {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readJSON reads a request body into v after checking it against the named
+// schema of the OpenAPI spec. If it is not valid, the error has been sent
+// and false is returned.
+func readJSON(w http.ResponseWriter, r *http.Request, name string, v interface{}) bool {
+	body, ok := readBody(w, r, maxBodySize)
+	if !ok {
+		return false
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		writeError(w, http.StatusBadRequest, "Request body must be JSON: "+err.Error())
+		return false
+	}
+	if errs := validate(name, doc); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		// The schema should have caught this.
+		writeError(w, http.StatusBadRequest, "Request body does not match "+name+": "+err.Error())
+		return false
+	}
+	return true
+}
+
+// readBody reads a request body of up to limit bytes. If it cannot, the
+// error has been sent and ok is false.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit))
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "Could not read request body")
+		return nil, false
+	}
+	return body, true
+}
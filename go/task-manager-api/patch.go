@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the entity tag of a version of a task.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatch reads the If-Match header of a request. It returns the version
+// the client requires the task to be at, zero for "*", and whether the
+// header was sent at all. A tag that is not one of ours can never match,
+// so it is returned as version -1.
+func ifMatch(r *http.Request) (int, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, false
+	}
+	if header == "*" {
+		return 0, true
+	}
+	tag := strings.TrimPrefix(header, "W/")
+	version, err := strconv.Atoi(strings.Trim(tag, `"`))
+	if err != nil || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' || version < 1 {
+		return -1, true
+	}
+	return version, true
+}
+
+// writeTask sends a task with its ETag.
+func writeTask(w http.ResponseWriter, task Task) {
+	w.Header().Set("ETag", etag(task.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// writeConflict responds to a write that lost a race: 412 if the client
+// sent If-Match, 409 if it sent the version in the body.
+func writeConflict(w http.ResponseWriter, precondition bool) {
+	if precondition {
+		writeError(w, http.StatusPreconditionFailed, "Task does not match If-Match; fetch it again")
+		return
+	}
+	writeError(w, http.StatusConflict, "Task was changed by someone else; fetch it again")
+}
+
+// patchTask applies a JSON Merge Patch (RFC 7386) to a task: fields in the
+// patch replace the task's, null clears a field and absent fields are left
+// alone. The task's id, owner, timestamps and version cannot be patched.
+func (s *server) patchTask(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "")
+	if !ok {
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, _ := mime.ParseMediaType(ct); mt != "application/merge-patch+json" && mt != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/merge-patch+json")
+			return
+		}
+	}
+	var patch map[string]interface{}
+	if !readJSON(w, r, "TaskPatch", &patch) {
+		return
+	}
+
+	user := currentUser(r)
+	current, err := s.tasks.GetTask(r.Context(), user, id)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	expected, precondition := ifMatch(r)
+	if precondition && expected != 0 && expected != current.Version {
+		writeConflict(w, true)
+		return
+	}
+
+	task, err := applyMergePatch(current, patch)
+	if verr, ok := err.(validationError); ok {
+		writeValidationError(w, verr)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkTask(w, r, &task) {
+		return
+	}
+
+	// Someone may have updated the task since it was read; the version
+	// check catches that.
+	task, err = s.tasks.UpdateTask(r.Context(), user, task, current.Version)
+	verr, invalid := err.(validationError)
+	switch {
+	case invalid:
+		writeValidationError(w, verr)
+		return
+	case err == errTaskNotFound:
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	case err == errVersionConflict:
+		writeConflict(w, precondition)
+		return
+	case err != nil:
+		internalError(w, r, err)
+		return
+	}
+	writeTask(w, task)
+}
+
+// applyMergePatch returns current with patch merged into it.
+func applyMergePatch(current Task, patch map[string]interface{}) (Task, error) {
+	for _, field := range []string{"id", "owner_id", "created_at", "updated_at", "version", "deleted_at"} {
+		delete(patch, field)
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return current, err
+	}
+	var target map[string]interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return current, err
+	}
+	merged := mergePatch(target, patch)
+	if errs := validate("TaskInput", merged); len(errs) > 0 {
+		return current, errs
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return current, err
+	}
+
+	var task Task
+	if err := json.Unmarshal(data, &task); err != nil {
+		return current, err
+	}
+	task.ID, task.OwnerID, task.CreatedAt, task.UpdatedAt, task.Version = current.ID, current.OwnerID, current.CreatedAt, current.UpdatedAt, current.Version
+	return task, nil
+}
+
+// mergePatch merges patch into target as RFC 7386 describes.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
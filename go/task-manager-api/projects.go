@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxProjectNameLength = 200
+
+// Project groups tasks, such as the epics of a team.
+type Project struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	OwnerID     int       `json:"owner_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// taskTree is a task with its subtasks, and theirs.
+type taskTree struct {
+	Task
+	Subtasks []*taskTree `json:"subtasks"`
+}
+
+// projectID parses the project ID in a /projects/ path, before suffix. If
+// it is not valid, the error has been sent and ok is false.
+func projectID(w http.ResponseWriter, r *http.Request, suffix string) (id int, ok bool) {
+	id, err := strconv.Atoi(strings.TrimSuffix(r.URL.Path[len("/projects/"):], suffix))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid project ID")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *server) createProject(w http.ResponseWriter, r *http.Request) {
+	var p Project
+	if !readJSON(w, r, "ProjectInput", &p) {
+		return
+	}
+	var errs validationError
+	p.Name = strings.TrimSpace(p.Name)
+	switch {
+	case p.Name == "":
+		errs = append(errs, fieldError{"name", "is required"})
+	case utf8.RuneCountInString(p.Name) > maxProjectNameLength:
+		errs = append(errs, fieldError{"name", fmt.Sprintf("must be at most %d characters", maxProjectNameLength)})
+	}
+	if utf8.RuneCountInString(p.Description) > maxDescriptionLength {
+		errs = append(errs, fieldError{"description", fmt.Sprintf("must be at most %d characters", maxDescriptionLength)})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	p.OwnerID = currentUser(r).ID
+	p.CreatedAt = time.Now().UTC()
+	p, err := s.projects.CreateProject(r.Context(), p)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *server) getProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := s.projects.ListProjects(r.Context())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func (s *server) getProject(w http.ResponseWriter, r *http.Request) {
+	id, ok := projectID(w, r, "")
+	if !ok {
+		return
+	}
+	p, err := s.projects.GetProject(r.Context(), id)
+	if err == errProjectNotFound {
+		writeError(w, http.StatusNotFound, "Project not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// deleteProject deletes a project. Its tasks are kept. Only the owner of
+// the project and admins may delete it.
+func (s *server) deleteProject(w http.ResponseWriter, r *http.Request) {
+	id, ok := projectID(w, r, "")
+	if !ok {
+		return
+	}
+	p, err := s.projects.GetProject(r.Context(), id)
+	if err == errProjectNotFound {
+		writeError(w, http.StatusNotFound, "Project not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if u := currentUser(r); !u.IsAdmin() && p.OwnerID != u.ID {
+		writeError(w, http.StatusForbidden, "Only the owner of a project may delete it")
+		return
+	}
+	if err := s.projects.DeleteProject(r.Context(), id); err != nil && err != errProjectNotFound {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getProjectGraph returns the tasks of a project in topological order of
+// their dependencies: every task comes after the tasks blocking it.
+// Blockers outside the project, or that the caller cannot see, are listed
+// in blocked_by but do not affect the order.
+func (s *server) getProjectGraph(w http.ResponseWriter, r *http.Request) {
+	id, ok := projectID(w, r, "/graph")
+	if !ok {
+		return
+	}
+	p, err := s.projects.GetProject(r.Context(), id)
+	if err == errProjectNotFound {
+		writeError(w, http.StatusNotFound, "Project not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	tasks, err := s.tasks.ProjectTasks(r.Context(), currentUser(r), id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	ordered, err := topoSort(tasks)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"project": p,
+		"tasks":   ordered,
+	})
+}
+
+// getTaskTree returns a task with its subtasks, nested. Subtasks the
+// caller cannot see are left out with their own subtasks.
+func (s *server) getTaskTree(w http.ResponseWriter, r *http.Request) {
+	id, ok := taskID(w, r, "/tree")
+	if !ok {
+		return
+	}
+	user := currentUser(r)
+	root, err := s.tasks.GetTask(r.Context(), user, id)
+	if err == errTaskNotFound {
+		writeError(w, http.StatusNotFound, "Task not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	subtasks, err := s.tasks.Subtasks(r.Context(), user, id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildTree(root, subtasks))
+}
+
+// buildTree nests subtasks, sorted by ID, under root.
+func buildTree(root Task, subtasks []Task) *taskTree {
+	nodes := map[int]*taskTree{root.ID: {Task: root, Subtasks: []*taskTree{}}}
+	for _, t := range subtasks {
+		nodes[t.ID] = &taskTree{Task: t, Subtasks: []*taskTree{}}
+	}
+	for _, t := range subtasks {
+		if parent, ok := nodes[*t.ParentID]; ok {
+			parent.Subtasks = append(parent.Subtasks, nodes[t.ID])
+		}
+	}
+	return nodes[root.ID]
+}
+
+// topoSort orders tasks, sorted by ID, so that each comes after those of
+// its blockers that are among them. Of the tasks that are ready at any
+// point, the one with the lowest ID comes first.
+func topoSort(tasks []Task) ([]Task, error) {
+	index := make(map[int]int, len(tasks))
+	for i, t := range tasks {
+		index[t.ID] = i
+	}
+	waiting := make([]int, len(tasks))    // blockers not yet placed, by task
+	unblocks := make([][]int, len(tasks)) // tasks waiting for each task
+	for i, t := range tasks {
+		for _, b := range t.BlockedBy {
+			if j, ok := index[b]; ok {
+				waiting[i]++
+				unblocks[j] = append(unblocks[j], i)
+			}
+		}
+	}
+
+	ordered := make([]Task, 0, len(tasks))
+	placed := make([]bool, len(tasks))
+	for len(ordered) < len(tasks) {
+		next := -1
+		for i := range tasks {
+			if !placed[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("dependencies of the project's tasks form a cycle")
+		}
+		placed[next] = true
+		ordered = append(ordered, tasks[next])
+		for _, i := range unblocks[next] {
+			waiting[i]--
+		}
+	}
+	return ordered, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// sortColumns maps the values accepted by the sort parameter to the
+// expressions tasks are ordered by.
+var sortColumns = map[string]string{
+	"id":         "id",
+	"title":      "lower(title)",
+	"status":     "CASE status WHEN 'todo' THEN 0 WHEN 'in-progress' THEN 1 ELSE 2 END",
+	"priority":   "CASE priority WHEN 'low' THEN 0 WHEN 'medium' THEN 1 ELSE 2 END",
+	"due_date":   "due_date",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// taskQuery is a parsed GET /tasks request.
+type taskQuery struct {
+	UserID     int // only tasks owned by or assigned to this user; zero for all tasks
+	Statuses   []string
+	Priorities []string
+	AssigneeID int
+	ProjectID  int
+	ParentID   int  // only subtasks of this task
+	TopLevel   bool // only tasks that are not subtasks
+	Deleted    bool // only deleted tasks instead of only live ones
+	Tag        string
+	Text       string
+	Sort       string
+	Desc       bool
+	Limit      int
+	Offset     int
+}
+
+// parseTaskQuery reads the filtering, sorting and pagination parameters of
+// GET /tasks:
+//
+//	status    only tasks with this status; a comma-separated list matches any of them
+//	priority  only tasks with this priority; a comma-separated list matches any of them
+//	assignee  only tasks assigned to the user with this ID
+//	project   only tasks in the project with this ID
+//	parent    only direct subtasks of the task with this ID; "none" for tasks that are not subtasks
+//	tag       only tasks with this tag
+//	deleted   true for deleted tasks instead of live ones
+//	q         only tasks whose title or description contains this text
+//	sort      id (default), title, status, priority, due_date, created_at or updated_at
+//	order     asc (default) or desc
+//	limit     page size, 50 by default and at most 500
+//	offset    number of tasks to skip
+func parseTaskQuery(values url.Values) (taskQuery, error) {
+	q := taskQuery{Sort: "id", Limit: defaultPageSize}
+	var err error
+	if q.Statuses, err = parseList(values.Get("status"), "status", statuses); err != nil {
+		return q, err
+	}
+	if q.Priorities, err = parseList(values.Get("priority"), "priority", priorities); err != nil {
+		return q, err
+	}
+	if s := values.Get("assignee"); s != "" {
+		if q.AssigneeID, err = strconv.Atoi(s); err != nil || q.AssigneeID < 1 {
+			return q, fmt.Errorf("Invalid assignee %q: must be a user ID", s)
+		}
+	}
+	if s := values.Get("project"); s != "" {
+		if q.ProjectID, err = strconv.Atoi(s); err != nil || q.ProjectID < 1 {
+			return q, fmt.Errorf("Invalid project %q: must be a project ID", s)
+		}
+	}
+	if s := values.Get("parent"); s == "none" {
+		q.TopLevel = true
+	} else if s != "" {
+		if q.ParentID, err = strconv.Atoi(s); err != nil || q.ParentID < 1 {
+			return q, fmt.Errorf("Invalid parent %q: must be a task ID or none", s)
+		}
+	}
+	switch s := values.Get("deleted"); s {
+	case "", "false":
+	case "true":
+		q.Deleted = true
+	default:
+		return q, fmt.Errorf("Invalid deleted %q: use true or false", s)
+	}
+	q.Tag = strings.TrimSpace(values.Get("tag"))
+	q.Text = strings.TrimSpace(values.Get("q"))
+
+	if s := values.Get("sort"); s != "" {
+		if _, ok := sortColumns[s]; !ok {
+			return q, fmt.Errorf("Invalid sort %q: use id, title, status, priority, due_date, created_at or updated_at", s)
+		}
+		q.Sort = s
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("Invalid order %q: use asc or desc", values.Get("order"))
+	}
+
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, fmt.Errorf("Invalid limit %q: must be between 1 and %d", s, maxPageSize)
+		}
+		q.Limit = n
+	}
+	if s := values.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("Invalid offset %q: must be a non-negative integer", s)
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+// where returns the WHERE clause selecting the tasks q matches, with its
+// arguments. matches must agree with it.
+func (q taskQuery) where(d dialect) (string, []interface{}) {
+	conds := []string{"deleted_at IS NULL"}
+	if q.Deleted {
+		conds[0] = "deleted_at IS NOT NULL"
+	}
+	var args []interface{}
+	if q.UserID != 0 {
+		conds = append(conds, "(owner_id = ? OR assignee_id = ?)")
+		args = append(args, q.UserID, q.UserID)
+	}
+	for _, in := range []struct {
+		column string
+		values []string
+	}{{"status", q.Statuses}, {"priority", q.Priorities}} {
+		if len(in.values) == 0 {
+			continue
+		}
+		conds = append(conds, in.column+" IN (?"+strings.Repeat(", ?", len(in.values)-1)+")")
+		for _, v := range in.values {
+			args = append(args, v)
+		}
+	}
+	if q.AssigneeID != 0 {
+		conds = append(conds, "assignee_id = ?")
+		args = append(args, q.AssigneeID)
+	}
+	if q.ProjectID != 0 {
+		conds = append(conds, "project_id = ?")
+		args = append(args, q.ProjectID)
+	}
+	if q.ParentID != 0 {
+		conds = append(conds, "parent_id = ?")
+		args = append(args, q.ParentID)
+	}
+	if q.TopLevel {
+		conds = append(conds, "parent_id IS NULL")
+	}
+	if q.Tag != "" {
+		conds = append(conds, "id IN (SELECT tt.task_id FROM task_tags tt JOIN tags t ON t.id = tt.tag_id WHERE lower(t.name) = lower(?))")
+		args = append(args, q.Tag)
+	}
+	if q.Text != "" {
+		like := "%" + escapeLike(q.Text) + "%"
+		conds = append(conds, fmt.Sprintf(`(title %[1]s ? ESCAPE '\' OR description %[1]s ? ESCAPE '\')`, d.like()))
+		args = append(args, like, like)
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy returns the ORDER BY clause of q. Ties are broken by id so that
+// pages do not overlap, and tasks without a due date sort first, as
+// SQLite does by default. less must agree with it.
+func (q taskQuery) orderBy() string {
+	dir, nulls := "ASC", "FIRST"
+	if q.Desc {
+		dir, nulls = "DESC", "LAST"
+	}
+	if q.Sort == "id" {
+		return " ORDER BY id " + dir
+	}
+	return fmt.Sprintf(" ORDER BY %s %s NULLS %s, id %s", sortColumns[q.Sort], dir, nulls, dir)
+}
+
+// matches reports whether q selects a task, as where does in SQL.
+func (q taskQuery) matches(t Task) bool {
+	assigned := func(id int) bool { return t.AssigneeID != nil && *t.AssigneeID == id }
+	switch {
+	case (t.DeletedAt != nil) != q.Deleted:
+		return false
+	case q.UserID != 0 && t.OwnerID != q.UserID && !assigned(q.UserID):
+		return false
+	case len(q.Statuses) > 0 && !contains(q.Statuses, t.Status):
+		return false
+	case len(q.Priorities) > 0 && !contains(q.Priorities, t.Priority):
+		return false
+	case q.AssigneeID != 0 && !assigned(q.AssigneeID):
+		return false
+	case q.ProjectID != 0 && (t.ProjectID == nil || *t.ProjectID != q.ProjectID):
+		return false
+	case q.ParentID != 0 && (t.ParentID == nil || *t.ParentID != q.ParentID):
+		return false
+	case q.TopLevel && t.ParentID != nil:
+		return false
+	case q.Tag != "" && !slices.ContainsFunc(t.Tags, func(tag string) bool { return strings.EqualFold(tag, q.Tag) }):
+		return false
+	case q.Text != "":
+		text := strings.ToLower(q.Text)
+		return strings.Contains(strings.ToLower(t.Title), text) || strings.Contains(strings.ToLower(t.Description), text)
+	}
+	return true
+}
+
+// less reports whether a sorts before b, as orderBy does in SQL.
+func (q taskQuery) less(a, b Task) bool {
+	var c int
+	switch q.Sort {
+	case "title":
+		c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case "status":
+		c = cmp.Compare(slices.Index(statuses, a.Status), slices.Index(statuses, b.Status))
+	case "priority":
+		c = cmp.Compare(slices.Index(priorities, a.Priority), slices.Index(priorities, b.Priority))
+	case "due_date":
+		switch {
+		case a.DueDate == nil && b.DueDate == nil:
+		case a.DueDate == nil:
+			c = -1
+		case b.DueDate == nil:
+			c = 1
+		default:
+			c = a.DueDate.Compare(*b.DueDate)
+		}
+	case "created_at":
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	case "updated_at":
+		c = a.UpdatedAt.Compare(b.UpdatedAt)
+	}
+	if c == 0 {
+		c = cmp.Compare(a.ID, b.ID)
+	}
+	if q.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// parseList splits a comma-separated parameter and checks each value
+// against allowed.
+func parseList(param, name string, allowed []string) ([]string, error) {
+	var values []string
+	for _, s := range strings.Split(param, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !contains(allowed, s) {
+			return nil, fmt.Errorf("Invalid %s %q: use %s", name, s, strings.Join(allowed, ", "))
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// setPageHeaders reports the total number of matching tasks in
+// X-Total-Count and links to the neighbouring pages in Link.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, q taskQuery, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	page := func(offset int, rel string) string {
+		values := r.URL.Query()
+		values.Set("limit", strconv.Itoa(q.Limit))
+		values.Set("offset", strconv.Itoa(offset))
+		u := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+	var links []string
+	if q.Offset+q.Limit < total {
+		links = append(links, page(q.Offset+q.Limit, "next"))
+	}
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, page(prev, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	schedulerInterval   = 10 * time.Second
+	schedulerBatchSize  = 100
+	defaultRemindBefore = 24 * time.Hour
+
+	maxRecurrenceInterval = 1000
+)
+
+// rrule is a recurrence rule: the subset of RFC 5545 RRULEs made of a FREQ
+// of DAILY, WEEKLY or MONTHLY, an optional INTERVAL and an optional UNTIL,
+// such as FREQ=WEEKLY;INTERVAL=2;UNTIL=20271231. A task's due date is the
+// start of its series.
+type rrule struct {
+	freq     string
+	interval int
+	until    string    // as written, or ""
+	last     time.Time // the latest an occurrence may be due, if until is set
+}
+
+// parseRRule reads an RRULE, with or without the RRULE: prefix. Its errors
+// are worded to follow the name of the field.
+func parseRRule(text string) (rrule, error) {
+	r := rrule{interval: 1}
+	text = strings.ToUpper(strings.TrimSpace(text))
+	text = strings.TrimPrefix(text, "RRULE:")
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(text, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || value == "" {
+			return r, errors.New("must be NAME=VALUE parts separated by semicolons, such as FREQ=WEEKLY;INTERVAL=2")
+		}
+		if seen[name] {
+			return r, fmt.Errorf("must not have %s twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" {
+				return r, errors.New("must have a FREQ of DAILY, WEEKLY or MONTHLY")
+			}
+			r.freq = value
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxRecurrenceInterval {
+				return r, fmt.Errorf("must have an INTERVAL from 1 to %d", maxRecurrenceInterval)
+			}
+			r.interval = n
+		case "UNTIL":
+			if d, err := time.Parse("20060102", value); err == nil {
+				r.last = d.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			} else if t, err := time.Parse("20060102T150405Z", value); err == nil {
+				r.last = t
+			} else {
+				return r, errors.New("must have an UNTIL date, as YYYYMMDD, or UTC time, as YYYYMMDDTHHMMSSZ")
+			}
+			r.until = value
+		default:
+			return r, fmt.Errorf("has %s, which is not supported; use FREQ, INTERVAL and UNTIL", name)
+		}
+	}
+	if r.freq == "" {
+		return r, errors.New("must have a FREQ of DAILY, WEEKLY or MONTHLY")
+	}
+	return r, nil
+}
+
+// String returns the rule in the form tasks store it: FREQ, then INTERVAL
+// unless it is 1, then UNTIL.
+func (r rrule) String() string {
+	s := "FREQ=" + r.freq
+	if r.interval != 1 {
+		s += ";INTERVAL=" + strconv.Itoa(r.interval)
+	}
+	if r.until != "" {
+		s += ";UNTIL=" + r.until
+	}
+	return s
+}
+
+// next returns the first occurrence of the series starting at due that is
+// after now, so that the occurrences missed while a task was overdue are
+// skipped, or false if the series ends before it.
+func (r rrule) next(due, now time.Time) (time.Time, bool) {
+	var next time.Time
+	switch r.freq {
+	case "DAILY", "WEEKLY":
+		days := r.interval
+		if r.freq == "WEEKLY" {
+			days *= 7
+		}
+		periods := 1
+		if now.After(due) {
+			periods = int(now.Sub(due)/(time.Duration(days)*24*time.Hour)) + 1
+		}
+		next = due.AddDate(0, 0, days*periods)
+	case "MONTHLY":
+		// Months without the day of the month of due are skipped, as RFC
+		// 5545 says: monthly from the 31st is every month with a 31st.
+		k := 1
+		if months := (now.Year()-due.Year())*12 + int(now.Month()-due.Month()); months > r.interval {
+			k = months / r.interval
+		}
+		for ; ; k++ {
+			next = time.Date(due.Year(), due.Month()+time.Month(k*r.interval), due.Day(),
+				due.Hour(), due.Minute(), due.Second(), due.Nanosecond(), due.Location())
+			if next.Day() == due.Day() && next.After(now) {
+				break
+			}
+			if r.until != "" && next.After(r.last) {
+				return next, false
+			}
+		}
+	}
+	if r.until != "" && next.After(r.last) {
+		return next, false
+	}
+	return next, true
+}
+
+// nextOccurrence returns the task that follows a done recurring task: a
+// copy of its editable fields, to do, due at the next occurrence of its
+// recurrence and with the recurrence moved to it. Blockers are not copied.
+// It returns false if the series has ended.
+func nextOccurrence(t Task, now time.Time) (Task, bool) {
+	rule, err := parseRRule(t.Recurrence)
+	if err != nil || t.DueDate == nil {
+		return Task{}, false
+	}
+	due, ok := rule.next(*t.DueDate, now)
+	if !ok {
+		return Task{}, false
+	}
+	return Task{
+		Title:       t.Title,
+		Description: t.Description,
+		Status:      statusTodo,
+		Priority:    t.Priority,
+		DueDate:     &due,
+		Recurrence:  t.Recurrence,
+		Tags:        append([]string{}, t.Tags...),
+		AssigneeID:  t.AssigneeID,
+		ProjectID:   t.ProjectID,
+		ParentID:    t.ParentID,
+		BlockedBy:   []int{},
+		OwnerID:     t.OwnerID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Version:     1,
+	}, true
+}
+
+// scheduler does the work that falls due with time rather than with
+// requests: it creates the next occurrence of each recurring task once it
+// is done, and reminds of tasks about to fall due. Both are recorded in
+// the tasks' history, which event streams and webhooks are sent.
+type scheduler struct {
+	tasks        TaskRepository
+	remindBefore time.Duration // how long before tasks fall due to remind of them; 0 for never
+}
+
+func newScheduler(tasks TaskRepository) *scheduler {
+	return &scheduler{tasks: tasks, remindBefore: defaultRemindBefore}
+}
+
+// run does the work that is due every interval until ctx is done.
+func (s *scheduler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.recur(ctx)
+		s.remind(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recur creates the next occurrence of every recurring task that is done.
+func (s *scheduler) recur(ctx context.Context) {
+	done, err := s.tasks.DoneRecurringTasks(ctx, schedulerBatchSize)
+	if err != nil {
+		log.Printf("Error finding recurring tasks: %v\n", err)
+		return
+	}
+	for _, t := range done {
+		var next *Task
+		if n, ok := nextOccurrence(t, time.Now().UTC()); ok {
+			next = &n
+		}
+		created, err := s.tasks.RecurTask(ctx, t, next)
+		if verr, invalid := err.(validationError); invalid && next != nil {
+			// The project or parent can no longer be used, say because the
+			// owner no longer sees the parent. The series ends rather than
+			// failing again every time.
+			log.Printf("Ending the recurrence of task %d, whose next occurrence is invalid: %v\n", t.ID, verr)
+			created, err = s.tasks.RecurTask(ctx, t, nil)
+		}
+		switch {
+		case err == errVersionConflict || err == errTaskNotFound:
+			// The task changed since it was read; it is looked at again next time.
+		case err != nil:
+			log.Printf("Error creating the next occurrence of task %d: %v\n", t.ID, err)
+		case created != nil:
+			log.Printf("Created task %d, the next occurrence of task %d\n", created.ID, t.ID)
+		default:
+			log.Printf("Task %d was the last of its series\n", t.ID)
+		}
+	}
+}
+
+// remind records a reminder for every task that falls due within
+// remindBefore and is not done.
+func (s *scheduler) remind(ctx context.Context) {
+	if s.remindBefore <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	n, err := s.tasks.RemindDueTasks(ctx, now, now.Add(s.remindBefore), schedulerBatchSize)
+	if err != nil {
+		log.Printf("Error recording reminders: %v\n", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Reminded of %d tasks falling due\n", n)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want string // as the rule is stored, or "" if it is invalid
+	}{
+		{"FREQ=DAILY", "FREQ=DAILY"},
+		{" rrule:freq=weekly;interval=1 ", "FREQ=WEEKLY"},
+		{"FREQ=MONTHLY;UNTIL=20271231;INTERVAL=2", "FREQ=MONTHLY;INTERVAL=2;UNTIL=20271231"},
+		{"FREQ=WEEKLY;UNTIL=20271231T120000Z", "FREQ=WEEKLY;UNTIL=20271231T120000Z"},
+		{"FREQ=DAILY;INTERVAL=1000", "FREQ=DAILY;INTERVAL=1000"},
+		{"", ""},
+		{"FREQ=YEARLY", ""},
+		{"FREQ=DAILY;INTERVAL=0", ""},
+		{"FREQ=DAILY;INTERVAL=1001", ""},
+		{"FREQ=DAILY;INTERVAL=two", ""},
+		{"FREQ=DAILY;FREQ=WEEKLY", ""},
+		{"FREQ=DAILY;BYDAY=MO", ""},
+		{"FREQ=DAILY;UNTIL=2027-12-31", ""},
+		{"FREQ=DAILY;", ""},
+		{"INTERVAL=2", ""},
+	} {
+		rule, err := parseRRule(tt.text)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseRRule(%q) = %s, want an error", tt.text, rule)
+		case tt.want != "" && err != nil:
+			t.Errorf("parseRRule(%q): %v", tt.text, err)
+		case tt.want != "" && rule.String() != tt.want:
+			t.Errorf("parseRRule(%q) = %s, want %s", tt.text, rule, tt.want)
+		}
+	}
+}
+
+func TestRRuleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tt := range []struct {
+		name     string
+		rule     string
+		due, now string
+		want     string // or "" if the series has ended
+	}{
+		{"done before it is due", "FREQ=DAILY", "2026-01-10T09:00:00Z", "2026-01-09T12:00:00Z", "2026-01-11T09:00:00Z"},
+		{"done at an occurrence", "FREQ=DAILY", "2026-01-10T09:00:00Z", "2026-01-12T09:00:00Z", "2026-01-13T09:00:00Z"},
+		{"missed days", "FREQ=DAILY;INTERVAL=3", "2026-01-10T09:00:00Z", "2026-01-20T08:00:00Z", "2026-01-22T09:00:00Z"},
+		{"missed weeks", "FREQ=WEEKLY;INTERVAL=2", "2026-01-05T09:00:00Z", "2026-02-01T00:00:00Z", "2026-02-02T09:00:00Z"},
+		{"next month", "FREQ=MONTHLY", "2026-01-15T09:00:00Z", "2026-01-16T00:00:00Z", "2026-02-15T09:00:00Z"},
+		{"missed months", "FREQ=MONTHLY;INTERVAL=2", "2026-01-15T09:00:00Z", "2026-06-20T00:00:00Z", "2026-07-15T09:00:00Z"},
+		{"31st skips February", "FREQ=MONTHLY", "2026-01-31T09:00:00Z", "2026-02-01T00:00:00Z", "2026-03-31T09:00:00Z"},
+		{"31st skips April", "FREQ=MONTHLY", "2026-03-31T09:00:00Z", "2026-04-01T00:00:00Z", "2026-05-31T09:00:00Z"},
+		{"29 February", "FREQ=MONTHLY;INTERVAL=12", "2024-02-29T09:00:00Z", "2024-03-01T00:00:00Z", "2028-02-29T09:00:00Z"},
+		{"until the day of the next", "FREQ=DAILY;UNTIL=20260112", "2026-01-11T09:00:00Z", "2026-01-11T10:00:00Z", "2026-01-12T09:00:00Z"},
+		{"until the day before the next", "FREQ=DAILY;UNTIL=20260111", "2026-01-11T09:00:00Z", "2026-01-11T10:00:00Z", ""},
+		{"until the time of the next", "FREQ=WEEKLY;UNTIL=20260118T090000Z", "2026-01-11T09:00:00Z", "2026-01-12T00:00:00Z", "2026-01-18T09:00:00Z"},
+		{"until just before the next", "FREQ=WEEKLY;UNTIL=20260118T085959Z", "2026-01-11T09:00:00Z", "2026-01-12T00:00:00Z", ""},
+		{"until before the next 31st", "FREQ=MONTHLY;UNTIL=20260330", "2026-01-31T09:00:00Z", "2026-02-01T00:00:00Z", ""},
+		{"until after missed periods", "FREQ=DAILY;UNTIL=20260120", "2026-01-10T09:00:00Z", "2026-01-25T00:00:00Z", ""},
+	} {
+		rule, err := parseRRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		next, ok := rule.next(at(tt.due), at(tt.now))
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("%s: next = %v, want the series to end", tt.name, next)
+		case tt.want != "" && !ok:
+			t.Errorf("%s: the series ended, want %s", tt.name, tt.want)
+		case tt.want != "" && !next.Equal(at(tt.want)):
+			t.Errorf("%s: next = %v, want %s", tt.name, next, tt.want)
+		}
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	due := time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC)
+	now := due.Add(time.Hour)
+	project, assignee := 3, 4
+	task := Task{
+		ID: 7, Title: "Water plants", Description: "All of them", Status: statusDone, Priority: "high",
+		DueDate: &due, Recurrence: "FREQ=WEEKLY", Tags: []string{"home"},
+		AssigneeID: &assignee, ProjectID: &project, BlockedBy: []int{5}, OwnerID: 2, Version: 4,
+	}
+
+	next, ok := nextOccurrence(task, now)
+	if !ok {
+		t.Fatal("the series ended")
+	}
+	if next.ID != 0 || next.Status != statusTodo || next.Version != 1 || len(next.BlockedBy) != 0 ||
+		next.Title != task.Title || next.Description != task.Description || next.Priority != task.Priority ||
+		next.Recurrence != task.Recurrence || *next.AssigneeID != assignee || *next.ProjectID != project || next.OwnerID != task.OwnerID {
+		t.Errorf("next occurrence %+v", next)
+	}
+	if !next.DueDate.Equal(due.AddDate(0, 0, 7)) || !next.CreatedAt.Equal(now) {
+		t.Errorf("next occurrence due %v, created %v", next.DueDate, next.CreatedAt)
+	}
+	next.Tags[0] = "changed"
+	if task.Tags[0] != "home" {
+		t.Error("the next occurrence shares its tags with the task")
+	}
+
+	task.Recurrence = "FREQ=WEEKLY;UNTIL=20260116"
+	if _, ok := nextOccurrence(task, now); ok {
+		t.Error("an occurrence after UNTIL was created")
+	}
+	task.Recurrence, task.DueDate = "FREQ=WEEKLY", nil
+	if _, ok := nextOccurrence(task, now); ok {
+		t.Error("an occurrence of a task without a due date was created")
+	}
+}
+
+func TestSchedulerRecur(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		ctx := context.Background()
+		due := time.Now().UTC().Truncate(time.Second).Add(-71 * time.Hour)
+		task := api.createTask(api.bob, `{"title":"Water plants","status":"done","due_date":"`+due.Format(time.RFC3339)+`","recurrence":"FREQ=DAILY"}`)
+
+		// Two servers find the task done at once; only the first one to
+		// move its recurrence creates the next occurrence.
+		done, err := api.s.tasks.DoneRecurringTasks(ctx, schedulerBatchSize)
+		if err != nil || len(done) != 1 || done[0].ID != task.ID {
+			t.Fatalf("done recurring tasks = %+v, %v", done, err)
+		}
+		next, ok := nextOccurrence(done[0], time.Now().UTC())
+		if !ok {
+			t.Fatal("the series ended")
+		}
+		created, err := api.s.tasks.RecurTask(ctx, done[0], &next)
+		if err != nil || created == nil {
+			t.Fatalf("RecurTask = %+v, %v", created, err)
+		}
+		if _, err := api.s.tasks.RecurTask(ctx, done[0], &next); err != errVersionConflict {
+			t.Errorf("RecurTask of a task that has changed: %v, want errVersionConflict", err)
+		}
+		newScheduler(api.s.tasks).recur(ctx)
+
+		var list []Task
+		api.expectJSON(api.alice, "GET", "/tasks?sort=id", "", http.StatusOK, &list)
+		if len(list) != 2 || list[1].ID != created.ID {
+			t.Fatalf("tasks = %+v, want the task and one next occurrence", list)
+		}
+		if list[0].Recurrence != "" || list[1].Recurrence != "FREQ=DAILY" || list[1].Status != statusTodo {
+			t.Errorf("recurrences %q and %q, next occurrence %s", list[0].Recurrence, list[1].Recurrence, list[1].Status)
+		}
+		// Three days are missed, and the next occurrence is the one after now.
+		if !list[1].DueDate.Equal(due.AddDate(0, 0, 3)) {
+			t.Errorf("next occurrence due %v, want %v", list[1].DueDate, due.AddDate(0, 0, 3))
+		}
+
+		// Once it is done, the scheduler creates the one after it.
+		api.expect(api.bob, "PATCH", "/tasks/"+strconv.Itoa(created.ID), `{"status":"done"}`, http.StatusOK)
+		newScheduler(api.s.tasks).recur(ctx)
+		api.expectJSON(api.alice, "GET", "/tasks?sort=id", "", http.StatusOK, &list)
+		if len(list) != 3 || !list[2].DueDate.Equal(due.AddDate(0, 0, 4)) {
+			t.Errorf("tasks = %+v, want a third occurrence due %v", list, due.AddDate(0, 0, 4))
+		}
+	})
+}
+
+func TestSchedulerRemind(t *testing.T) {
+	forEachStore(t, func(t *testing.T, api *testAPI) {
+		ctx := context.Background()
+		soon := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		later := time.Now().UTC().Add(72 * time.Hour).Format(time.RFC3339)
+		task := api.createTask(api.bob, `{"title":"Pay rent","due_date":"`+soon+`"}`)
+		api.createTask(api.bob, `{"title":"Done already","status":"done","due_date":"`+soon+`"}`)
+		api.createTask(api.bob, `{"title":"Not yet","due_date":"`+later+`"}`)
+
+		reminders := func() int {
+			t.Helper()
+			var history []HistoryEntry
+			api.expectJSON(api.bob, "GET", "/tasks/"+strconv.Itoa(task.ID)+"/history", "", http.StatusOK, &history)
+			n := 0
+			for _, e := range history {
+				if e.Action == actionReminder {
+					n++
+				}
+			}
+			return n
+		}
+
+		s := newScheduler(api.s.tasks)
+		s.remind(ctx)
+		s.remind(ctx)
+		if n := reminders(); n != 1 {
+			t.Fatalf("%d reminders after two rounds, want 1", n)
+		}
+		if n, err := api.s.tasks.RemindDueTasks(ctx, time.Now().UTC(), time.Now().UTC().Add(defaultRemindBefore), schedulerBatchSize); err != nil || n != 0 {
+			t.Errorf("RemindDueTasks reminded of %d more tasks, %v", n, err)
+		}
+
+		// A new due date is reminded of once too.
+		sooner := time.Now().UTC().Add(30 * time.Minute).Format(time.RFC3339)
+		api.expect(api.bob, "PATCH", "/tasks/"+strconv.Itoa(task.ID), `{"due_date":"`+sooner+`"}`, http.StatusOK)
+		s.remind(ctx)
+		s.remind(ctx)
+		if n := reminders(); n != 2 {
+			t.Errorf("%d reminders after the due date changed, want 2", n)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errTaskNotFound    = errors.New("task not found")
+	errVersionConflict = errors.New("task was changed by someone else")
+	errUserNotFound    = errors.New("user not found")
+	errUsernameTaken   = errors.New("username already taken")
+	errSessionNotFound = errors.New("session not found")
+	errProjectNotFound = errors.New("project not found")
+	errParentDeleted   = errors.New("parent task is deleted")
+	errWebhookNotFound = errors.New("webhook not found")
+)
+
+// TaskRepository stores tasks. Methods that take a user only find the
+// tasks that user may see: every task for admins, the ones they own or are
+// assigned otherwise.
+//
+// Methods that save a task check its project, parent and blockers, and
+// return a validationError if they do not exist, are not visible to the
+// user, or would make a cycle. They keep the status of every task with
+// subtasks rolled up from theirs, and record every change they make, by
+// user, in the history of the tasks changed.
+//
+// Deleted tasks are kept, but only TaskHistory and RestoreTask find them,
+// and ListTasks if asked to.
+type TaskRepository interface {
+	// ListTasks returns one page of the tasks q matches and the number of
+	// tasks it matches in all.
+	ListTasks(ctx context.Context, q taskQuery) ([]Task, int, error)
+	// SearchTasks is ListTasks for tasks with a word in their title or
+	// description starting with each word of q.Text, best match first.
+	SearchTasks(ctx context.Context, q taskQuery) ([]SearchResult, int, error)
+	// GetTask returns a task, or errTaskNotFound.
+	GetTask(ctx context.Context, user *User, id int) (Task, error)
+	// CreateTask stores a new task and returns it with its ID.
+	CreateTask(ctx context.Context, user *User, task Task) (Task, error)
+	// ImportTasks stores new tasks in one go: if any is invalid, none is
+	// stored, and the fields of every problem are named after the index of
+	// its task, as [i].field.
+	ImportTasks(ctx context.Context, user *User, tasks []Task) ([]Task, error)
+	// UpdateTask overwrites the editable fields of the task with task's ID
+	// and bumps its version. Unless expected is zero the task must still be
+	// at version expected, or errVersionConflict is returned.
+	UpdateTask(ctx context.Context, user *User, task Task, expected int) (Task, error)
+	// DeleteTask deletes a task the user owns, or any task for admins.
+	// Unless expected is zero the task must still be at version expected.
+	// Its subtasks are deleted with it.
+	DeleteTask(ctx context.Context, user *User, id int, expected int) error
+	// RestoreTask undeletes a task the user owns, or any task for admins,
+	// with the subtasks deleted with it. It returns errParentDeleted if the
+	// task's parent is deleted.
+	RestoreTask(ctx context.Context, user *User, id int) (Task, error)
+	// TaskHistory returns the history of a task the user can see, deleted
+	// or not, oldest first.
+	TaskHistory(ctx context.Context, user *User, id int) ([]HistoryEntry, error)
+	// Subtasks returns the subtasks of a task, their subtasks and so on,
+	// by ID.
+	Subtasks(ctx context.Context, user *User, id int) ([]Task, error)
+	// ProjectTasks returns the tasks of a project by ID.
+	ProjectTasks(ctx context.Context, user *User, projectID int) ([]Task, error)
+	// TaskEvents returns up to limit entries of the history of the tasks the
+	// user can see, deleted or not, recorded after entry after, oldest first.
+	// Entries are numbered in the order their changes were committed, so an
+	// entry with a lower ID never shows up after a later one was returned.
+	TaskEvents(ctx context.Context, user *User, after, limit int) ([]HistoryEntry, error)
+	// LastEventID returns the ID of the latest history entry of any task,
+	// or 0.
+	LastEventID(ctx context.Context) (int, error)
+
+	// DoneRecurringTasks returns up to limit live tasks with an owner and a
+	// recurrence that are done, by ID.
+	DoneRecurringTasks(ctx context.Context, limit int) ([]Task, error)
+	// RecurTask moves the recurrence of a done task to next, its next
+	// occurrence, which it creates, or removes it if next is nil. Both are
+	// recorded as made by the task's owner. It returns errVersionConflict if
+	// the task changed since it was read.
+	RecurTask(ctx context.Context, task Task, next *Task) (*Task, error)
+	// RemindDueTasks records a reminder in the history of up to limit live
+	// tasks with an owner that are not done and fall due after from and no
+	// later than to, as made by their owner, and returns how many. A task
+	// is only reminded of once for each due date.
+	RemindDueTasks(ctx context.Context, from, to time.Time, limit int) (int, error)
+}
+
+// ProjectRepository stores projects. Every user can see every project.
+type ProjectRepository interface {
+	// CreateProject stores a new project and returns it with its ID.
+	CreateProject(ctx context.Context, p Project) (Project, error)
+	// ListProjects returns every project by ID.
+	ListProjects(ctx context.Context) ([]Project, error)
+	// GetProject returns a project, or errProjectNotFound.
+	GetProject(ctx context.Context, id int) (Project, error)
+	// DeleteProject deletes a project, or returns errProjectNotFound. Its
+	// tasks are kept, without a project.
+	DeleteProject(ctx context.Context, id int) error
+}
+
+// UserRepository stores accounts and their sessions.
+type UserRepository interface {
+	// CreateUser stores a new account, or returns errUsernameTaken. The
+	// first account becomes an admin, even if two are created at once.
+	CreateUser(ctx context.Context, username, passwordHash string) (User, error)
+	// UserExists reports whether there is an account with an ID.
+	UserExists(ctx context.Context, id int) (bool, error)
+	// PasswordHash returns the ID and password hash of an account, or
+	// errUserNotFound.
+	PasswordHash(ctx context.Context, username string) (int, string, error)
+	// ListUsers returns every account by ID.
+	ListUsers(ctx context.Context) ([]User, error)
+	// SetRole changes the role of an account, or returns errUserNotFound.
+	SetRole(ctx context.Context, id int, role string) error
+
+	// CreateSession stores a session under the hash of its token.
+	CreateSession(ctx context.Context, tokenHash string, userID int, expires time.Time) error
+	// SessionUser returns the account a session belongs to and when the
+	// session expires, or errSessionNotFound.
+	SessionUser(ctx context.Context, tokenHash string) (User, time.Time, error)
+	// DeleteSession revokes a session. Revoking one that does not exist is
+	// not an error.
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// DeleteExpiredSessions removes the sessions that expired before now.
+	DeleteExpiredSessions(ctx context.Context, now time.Time) error
+}
+
+// WebhookRepository stores webhooks and the outbox of events waiting to be
+// sent to them. Every entry of task history is added to the outbox of each
+// webhook whose owner can see the task changed, in the transaction that
+// records it.
+type WebhookRepository interface {
+	// CreateWebhook stores a new webhook and returns it with its ID. It is
+	// sent the changes made from then on.
+	CreateWebhook(ctx context.Context, hook Webhook) (Webhook, error)
+	// ListWebhooks returns the webhooks of a user by ID.
+	ListWebhooks(ctx context.Context, userID int) ([]Webhook, error)
+	// DeleteWebhook deletes a webhook of a user, with the events waiting to
+	// be sent to it, or returns errWebhookNotFound.
+	DeleteWebhook(ctx context.Context, userID, id int) error
+
+	// DueDeliveries returns up to limit deliveries that are due at now and
+	// postpones them until now+lease, so that two servers sharing the
+	// database do not send them both.
+	DueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]delivery, error)
+	// DeliveryDone removes a delivery from the outbox.
+	DeliveryDone(ctx context.Context, id int) error
+	// DeliveryFailed records a failed attempt at a delivery and when to try
+	// again.
+	DeliveryFailed(ctx context.Context, id int, reason string, retry time.Time) error
+}
+
+// store is a backend holding tasks, users, projects and webhooks.
+type store interface {
+	TaskRepository
+	UserRepository
+	ProjectRepository
+	WebhookRepository
+	Close() error
+}
+
+// openStore opens the backend a DATABASE_URL names:
+//
+//	(empty)                  SQLite in ./tasks.db
+//	sqlite:<path>            SQLite in path
+//	postgres://...           PostgreSQL; postgresql:// works too
+//	memory:                  in memory, lost when the server stops
+//
+// SQLite only indexes searches in builds with -tags sqlite_fts5, and fails
+// to open in other builds unless unindexedSearch allows searching without.
+func openStore(url string, unindexedSearch bool) (store, error) {
+	switch {
+	case url == "":
+		return openSQLite("./tasks.db", unindexedSearch)
+	case strings.HasPrefix(url, "sqlite:"):
+		return openSQLite(strings.TrimPrefix(url, "sqlite:"), unindexedSearch)
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return openPostgres(url)
+	case url == "memory:":
+		return newMemStore(), nil
+	}
+	return nil, fmt.Errorf("unsupported DATABASE_URL %q: use sqlite:<path>, postgres://... or memory:", url)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxSearchTerms = 20
+	snippetWords   = 16 // words of the description shown around a match
+
+	// The database marks matches with these control characters rather than
+	// with tags, so that the text can be escaped before they become tags.
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+var matchTags = strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>")
+
+// SearchResult is a task found by a search, with how well it matched and
+// where. The highlights are HTML: the title and an extract of the
+// description, escaped, with the matching words wrapped in <mark> and
+// </mark>, the only tags they hold.
+type SearchResult struct {
+	Task
+	Rank      float64   `json:"rank"` // higher is better; only comparable within one search
+	Highlight highlight `json:"highlight"`
+}
+
+type highlight struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// searchTasks finds the tasks the caller can see with a word in their title
+// or description starting with each word of q, best match first. The other
+// parameters of GET /tasks filter and paginate the results; sort and order
+// are ignored.
+func (s *server) searchTasks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseTaskQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch terms := searchTerms(q.Text); {
+	case len(terms) == 0:
+		writeError(w, http.StatusBadRequest, "Parameter q must contain a word to search for")
+		return
+	case len(terms) > maxSearchTerms:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Parameter q must have at most %d words", maxSearchTerms))
+		return
+	}
+	if u := currentUser(r); !u.IsAdmin() {
+		q.UserID = u.ID
+	}
+
+	results, total, err := s.tasks.SearchTasks(r.Context(), q)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	setPageHeaders(w, r, q, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// searchTerms splits search text into lower-case words. Anything but
+// letters and digits separates words, so no text is a syntax error.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ftsQuery returns an SQLite FTS5 query for the tasks with a word starting
+// with each term.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// tsQuery is ftsQuery for Postgres' to_tsquery.
+func tsQuery(terms []string) string {
+	prefixes := make([]string, len(terms))
+	for i, term := range terms {
+		prefixes[i] = term + ":*"
+	}
+	return strings.Join(prefixes, " & ")
+}
+
+// rankMatches searches tasks without a full-text index. It returns the
+// tasks with a word starting with every term, ranked by how many words
+// match, those in the title counting ten times as much, best first.
+func rankMatches(tasks []Task, terms []string) []SearchResult {
+	results := []SearchResult{}
+	for _, t := range tasks {
+		title, description := wordsOf(t.Title), wordsOf(t.Description)
+		found := make(map[string]bool)
+		hits := func(text string, words []span) int {
+			n := 0
+			for _, w := range words {
+				if term := matchingTerm(text[w.start:w.end], terms); term != "" {
+					found[term] = true
+					n++
+				}
+			}
+			return n
+		}
+		rank := 10*hits(t.Title, title) + hits(t.Description, description)
+		if !allFound(found, terms) {
+			continue
+		}
+		results = append(results, SearchResult{
+			Task: t,
+			Rank: float64(rank),
+			Highlight: highlight{
+				Title:       mark(t.Title, title, terms, 0, len(t.Title)),
+				Description: snippet(t.Description, description, terms),
+			},
+		})
+	}
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		if c := cmp.Compare(b.Rank, a.Rank); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return results
+}
+
+// pageResults returns the page of results q asks for.
+func pageResults(results []SearchResult, q taskQuery) []SearchResult {
+	from := min(q.Offset, len(results))
+	return results[from:min(from+q.Limit, len(results))]
+}
+
+// span is a word of a text, by byte offsets.
+type span struct{ start, end int }
+
+// wordsOf returns the runs of letters and digits in text.
+func wordsOf(text string) []span {
+	var words []span
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			words = append(words, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, span{start, len(text)})
+	}
+	return words
+}
+
+// matchingTerm returns the first of terms that word starts with, or "".
+func matchingTerm(word string, terms []string) string {
+	word = strings.ToLower(word)
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return term
+		}
+	}
+	return ""
+}
+
+func allFound(found map[string]bool, terms []string) bool {
+	for _, term := range terms {
+		if !found[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// mark returns text[start:end] HTML-escaped, with the words starting with a
+// term wrapped in <mark> and </mark>.
+func mark(text string, words []span, terms []string, start, end int) string {
+	var b strings.Builder
+	pos := start
+	for _, w := range words {
+		if w.start < start || w.end > end || matchingTerm(text[w.start:w.end], terms) == "" {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:w.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[w.start:w.end]) + "</mark>")
+		pos = w.end
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	return b.String()
+}
+
+// markMatches turns a highlight the database made with matchStart and
+// matchEnd into one made by mark. Text that held those characters
+// itself gets stray <mark> or </mark> tags, but never any other markup.
+func markMatches(highlighted string) string {
+	return matchTags.Replace(html.EscapeString(highlighted))
+}
+
+// snippet returns up to snippetWords words of text around its first match,
+// marked, with an ellipsis where text was cut.
+func snippet(text string, words []span, terms []string) string {
+	if len(words) <= snippetWords {
+		return mark(text, words, terms, 0, len(text))
+	}
+	first := slices.IndexFunc(words, func(w span) bool { return matchingTerm(text[w.start:w.end], terms) != "" })
+	from := max(0, min(first-snippetWords/4, len(words)-snippetWords))
+	to := from + snippetWords
+	s := mark(text, words, terms, words[from].start, words[to-1].end)
+	if from > 0 {
+		s = "…" + s
+	}
+	if to < len(words) {
+		s += "…"
+	}
+	return s
+}
@@ -0,0 +1,1336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect is the flavour of SQL a database speaks. Queries are written
+// for SQLite and rewritten where Postgres differs.
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+// rebind rewrites the ? placeholders of a query into the dialect's.
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// like returns the operator for a case-insensitive LIKE.
+func (d dialect) like() string {
+	if d == dialectPostgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn runs queries written with ? placeholders on a database or
+// transaction.
+type conn struct {
+	q       querier
+	dialect dialect
+}
+
+func (c conn) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c conn) Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c conn) QueryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+// sqlStore keeps tasks and users in SQLite or Postgres. It implements
+// TaskRepository and UserRepository.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+	fts     bool // whether SQLite has the tasks_fts index
+}
+
+// openSQLite opens and migrates the SQLite database at path. Unless
+// unindexedSearch is set, SQLite must have been built with FTS5.
+func openSQLite(path string, unindexedSearch bool) (store, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	available, err := hasFTS5(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !available && !unindexedSearch {
+		db.Close()
+		return nil, errors.New("SQLite was built without FTS5, which indexes searches: " +
+			"build with -tags sqlite_fts5, or set UNINDEXED_SEARCH=1 to search without an index")
+	}
+	if err := migrate(db, dialectSQLite, migrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+	fts, err := setUpFullTextSearch(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("setting up full-text search: %w", err)
+	}
+	if !fts {
+		log.Printf("SQLite was built without FTS5, so searches are not indexed; build with -tags sqlite_fts5 to index them\n")
+	}
+	return &sqlStore{db: db, dialect: dialectSQLite, fts: fts}, nil
+}
+
+// openPostgres opens and migrates the Postgres database at url.
+func openPostgres(url string) (store, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, dialectPostgres, postgresMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+	return &sqlStore{db: db, dialect: dialectPostgres}, nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) conn() conn {
+	return conn{s.db, s.dialect}
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.
+func (s *sqlStore) inTx(ctx context.Context, fn func(c conn) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(conn{tx, s.dialect}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// historyLock is the Postgres advisory lock held by transactions that
+// record task history.
+const historyLock = 0x7461736b
+
+// inHistoryTx is inTx for transactions that record task history. IDs of
+// history entries must follow the order in which their transactions
+// commit, so that a reader who has seen an entry never misses an earlier
+// one: SQLite lets one transaction write at a time, and on Postgres they
+// take historyLock first, before locking any rows, and hold it until they
+// commit.
+func (s *sqlStore) inHistoryTx(ctx context.Context, fn func(c conn) error) error {
+	return s.inTx(ctx, func(c conn) error {
+		if s.dialect == dialectPostgres {
+			if _, err := c.Exec(ctx, "SELECT pg_advisory_xact_lock(?)", historyLock); err != nil {
+				return err
+			}
+		}
+		return fn(c)
+	})
+}
+
+// visibleScope returns a condition limiting a query to the live tasks user
+// may see and edit, with its arguments: all of them for admins, the ones
+// they own or are assigned otherwise.
+func visibleScope(user *User) (string, []interface{}) {
+	scope, args := seenBy(user)
+	return "deleted_at IS NULL AND " + scope, args
+}
+
+// ownerScope is like visibleScope, but leaves out tasks the user is only
+// assigned. Only owners and admins may delete a task.
+func ownerScope(user *User) (string, []interface{}) {
+	scope, args := ownedBy(user)
+	return "deleted_at IS NULL AND " + scope, args
+}
+
+// seenBy is visibleScope for deleted tasks as well as live ones.
+func seenBy(user *User) (string, []interface{}) {
+	if user.IsAdmin() {
+		return "1 = 1", nil
+	}
+	return "(owner_id = ? OR assignee_id = ?)", []interface{}{user.ID, user.ID}
+}
+
+// ownedBy is ownerScope for deleted tasks as well as live ones.
+func ownedBy(user *User) (string, []interface{}) {
+	if user.IsAdmin() {
+		return "1 = 1", nil
+	}
+	return "owner_id = ?", []interface{}{user.ID}
+}
+
+func (s *sqlStore) ListTasks(ctx context.Context, q taskQuery) ([]Task, int, error) {
+	c := s.conn()
+	where, args := q.where(s.dialect)
+
+	var total int
+	if err := c.QueryRow(ctx, "SELECT COUNT(*) FROM tasks"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	tasks, err := loadTasks(ctx, c, "SELECT "+taskColumns+" FROM tasks"+where+q.orderBy()+" LIMIT ? OFFSET ?",
+		append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tasks, total, nil
+}
+
+// pgSearchVector is the document Postgres searches tasks in, with titles
+// weighted above descriptions. It must match the idx_tasks_search index.
+const pgSearchVector = "(setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', COALESCE(description, '')), 'B'))"
+
+// SearchTasks uses the FTS5 index of SQLite, weighting words in titles ten
+// times as much as in descriptions, or Postgres' full-text search, which
+// weights them similarly. Without FTS5, it falls back to searchLike.
+func (s *sqlStore) SearchTasks(ctx context.Context, q taskQuery) ([]SearchResult, int, error) {
+	terms := searchTerms(q.Text)
+	q.Text = ""
+	where, args := q.where(s.dialect)
+	var from, columns, match string
+	switch {
+	case s.dialect == dialectPostgres:
+		from = "tasks, to_tsquery('simple', ?) query"
+		where += " AND " + pgSearchVector + " @@ query"
+		columns = "ts_rank(" + pgSearchVector + ", query) AS search_rank, " +
+			"ts_headline('simple', title, query, 'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', HighlightAll=true'), " +
+			"ts_headline('simple', COALESCE(description, ''), query, 'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MinWords=" +
+			strconv.Itoa(snippetWords/2) + ", MaxWords=" + strconv.Itoa(snippetWords) + "')"
+		match = tsQuery(terms)
+	case s.fts:
+		// bm25 is lower for better matches. The auxiliary functions only
+		// work in a query of the FTS table itself.
+		from = `tasks JOIN (
+				SELECT rowid AS match_id, -bm25(tasks_fts, 10.0, 1.0) AS search_rank,
+					highlight(tasks_fts, 0, char(2), char(3)) AS title_highlight,
+					snippet(tasks_fts, 1, char(2), char(3), '…', ` + strconv.Itoa(snippetWords) + `) AS description_highlight
+				FROM tasks_fts WHERE tasks_fts MATCH ?
+			) m ON m.match_id = tasks.id`
+		columns = "search_rank, COALESCE(title_highlight, ''), COALESCE(description_highlight, '')"
+		match = ftsQuery(terms)
+	default:
+		return s.searchLike(ctx, q, terms)
+	}
+	args = append([]interface{}{match}, args...)
+
+	c := s.conn()
+	var total int
+	if err := c.QueryRow(ctx, "SELECT COUNT(*) FROM "+from+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := c.Query(ctx, "SELECT "+taskColumns+", "+columns+" FROM "+from+where+" ORDER BY search_rank DESC, id LIMIT ? OFFSET ?",
+		append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		if r.Task, err = scanTask(rows, &r.Rank, &r.Highlight.Title, &r.Highlight.Description); err != nil {
+			return nil, 0, err
+		}
+		r.Highlight.Title, r.Highlight.Description = markMatches(r.Highlight.Title), markMatches(r.Highlight.Description)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	tasks := make([]Task, len(results))
+	for i := range results {
+		tasks[i] = results[i].Task
+	}
+	if err := loadDetails(ctx, c, tasks); err != nil {
+		return nil, 0, err
+	}
+	for i := range results {
+		results[i].Task = tasks[i]
+	}
+	return results, total, nil
+}
+
+// searchLike searches without an index: the tasks with every term
+// somewhere in their title or description are ranked by rankMatches.
+func (s *sqlStore) searchLike(ctx context.Context, q taskQuery, terms []string) ([]SearchResult, int, error) {
+	where, args := q.where(s.dialect)
+	for _, term := range terms {
+		like := "%" + escapeLike(term) + "%"
+		where += fmt.Sprintf(` AND (title %[1]s ? ESCAPE '\' OR description %[1]s ? ESCAPE '\')`, s.dialect.like())
+		args = append(args, like, like)
+	}
+	tasks, err := loadTasks(ctx, s.conn(), "SELECT "+taskColumns+" FROM tasks"+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	results := rankMatches(tasks, terms)
+	return pageResults(results, q), len(results), nil
+}
+
+func (s *sqlStore) GetTask(ctx context.Context, user *User, id int) (Task, error) {
+	scope, args := visibleScope(user)
+	return loadTask(ctx, s.conn(), id, scope, args...)
+}
+
+func (s *sqlStore) CreateTask(ctx context.Context, user *User, task Task) (Task, error) {
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		var err error
+		task, err = createTask(ctx, c, user, task)
+		return err
+	})
+	return task, err
+}
+
+func (s *sqlStore) ImportTasks(ctx context.Context, user *User, tasks []Task) ([]Task, error) {
+	created := make([]Task, 0, len(tasks))
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		// Every task is tried, so that all problems are reported at once.
+		var errs validationError
+		for i, task := range tasks {
+			task, err := createTask(ctx, c, user, task)
+			if verr, ok := err.(validationError); ok {
+				errs = append(errs, verr.at(i)...)
+				continue
+			} else if err != nil {
+				return err
+			}
+			created = append(created, task)
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// createTask is CreateTask in a transaction.
+func createTask(ctx context.Context, c conn, user *User, task Task) (Task, error) {
+	if err := checkLinks(ctx, c, user, &task); err != nil {
+		return task, err
+	}
+	err := c.QueryRow(ctx, `INSERT INTO tasks(title, description, status, priority, due_date, recurrence, assignee_id, project_id, parent_id,
+		owner_id, created_at, updated_at, version)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		task.Title, task.Description, task.Status, task.Priority, task.DueDate, task.Recurrence, task.AssigneeID, task.ProjectID, task.ParentID,
+		task.OwnerID, task.CreatedAt, task.UpdatedAt, task.Version).Scan(&task.ID)
+	if err != nil {
+		return task, err
+	}
+	if err := saveTags(ctx, c, task.ID, task.Tags); err != nil {
+		return task, err
+	}
+	if err := saveBlockers(ctx, c, task.ID, task.BlockedBy); err != nil {
+		return task, err
+	}
+	if task, err = loadTask(ctx, c, task.ID, "1 = 1"); err != nil {
+		return task, err
+	}
+	if err := recordHistory(ctx, c, task.ID, user.ID, actionCreated, taskChanges(nil, task), task.CreatedAt); err != nil {
+		return task, err
+	}
+	return task, rollUp(ctx, c, user.ID, task.ParentID)
+}
+
+func (s *sqlStore) UpdateTask(ctx context.Context, user *User, task Task, expected int) (Task, error) {
+	scope, args := visibleScope(user)
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		current, err := loadTask(ctx, c, task.ID, scope, args...)
+		if err != nil {
+			return err
+		}
+		if expected != 0 && current.Version != expected {
+			return errVersionConflict
+		}
+		if err := checkLinks(ctx, c, user, &task); err != nil {
+			return err
+		}
+		statuses, err := childStatuses(ctx, c, task.ID)
+		if err != nil {
+			return err
+		}
+		if len(statuses) > 0 {
+			task.Status = rolledUpStatus(statuses)
+		}
+
+		now := time.Now().UTC()
+		// The version is checked again in case the task changed since it
+		// was read.
+		res, err := c.Exec(ctx, `UPDATE tasks SET title = ?, description = ?, status = ?, priority = ?, due_date = ?, recurrence = ?,
+			assignee_id = ?, project_id = ?, parent_id = ?, updated_at = ?, version = version + 1
+			WHERE id = ? AND version = ?`,
+			task.Title, task.Description, task.Status, task.Priority, task.DueDate, task.Recurrence,
+			task.AssigneeID, task.ProjectID, task.ParentID, now, task.ID, current.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errVersionConflict
+		}
+		if err := saveTags(ctx, c, task.ID, task.Tags); err != nil {
+			return err
+		}
+		if err := saveBlockers(ctx, c, task.ID, task.BlockedBy); err != nil {
+			return err
+		}
+		if task, err = loadTask(ctx, c, task.ID, "1 = 1"); err != nil {
+			return err
+		}
+		if changes := taskChanges(&current, task); len(changes) > 0 {
+			if err := recordHistory(ctx, c, task.ID, user.ID, actionUpdated, changes, now); err != nil {
+				return err
+			}
+		}
+
+		// Subtasks follow their parent into another project.
+		if !sameID(current.ProjectID, task.ProjectID) {
+			subtasks, err := subtree(ctx, c, task.ID)
+			if err != nil {
+				return err
+			}
+			for _, t := range subtasks {
+				_, err := c.Exec(ctx, "UPDATE tasks SET project_id = ?, updated_at = ?, version = version + 1 WHERE id = ?", task.ProjectID, now, t.ID)
+				if err != nil {
+					return err
+				}
+				changes := map[string]fieldChange{"project_id": {t.ProjectID, task.ProjectID}}
+				if err := recordHistory(ctx, c, t.ID, user.ID, actionUpdated, changes, now); err != nil {
+					return err
+				}
+			}
+		}
+		if err := rollUp(ctx, c, user.ID, task.ParentID); err != nil {
+			return err
+		}
+		if !sameID(current.ParentID, task.ParentID) {
+			if err := rollUp(ctx, c, user.ID, current.ParentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return task, err
+}
+
+func (s *sqlStore) DeleteTask(ctx context.Context, user *User, id int, expected int) error {
+	scope, args := ownerScope(user)
+	return s.inHistoryTx(ctx, func(c conn) error {
+		current, err := loadTask(ctx, c, id, scope, args...)
+		if err != nil {
+			return err
+		}
+		if expected != 0 && current.Version != expected {
+			return errVersionConflict
+		}
+		now := time.Now().UTC()
+		res, err := c.Exec(ctx, "UPDATE tasks SET deleted_at = ?, version = version + 1 WHERE id = ? AND version = ?", now, id, current.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errVersionConflict
+		}
+		if err := recordHistory(ctx, c, id, user.ID, actionDeleted, map[string]fieldChange{}, now); err != nil {
+			return err
+		}
+
+		subtasks, err := subtree(ctx, c, id)
+		if err != nil {
+			return err
+		}
+		for _, t := range subtasks {
+			if t.DeletedAt != nil {
+				continue
+			}
+			if _, err := c.Exec(ctx, "UPDATE tasks SET deleted_at = ?, version = version + 1 WHERE id = ?", now, t.ID); err != nil {
+				return err
+			}
+			if err := recordHistory(ctx, c, t.ID, user.ID, actionDeleted, map[string]fieldChange{}, now); err != nil {
+				return err
+			}
+		}
+		return rollUp(ctx, c, user.ID, current.ParentID)
+	})
+}
+
+func (s *sqlStore) RestoreTask(ctx context.Context, user *User, id int) (Task, error) {
+	scope, args := ownedBy(user)
+	var task Task
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		deleted, err := loadTask(ctx, c, id, "deleted_at IS NOT NULL AND "+scope, args...)
+		if err != nil {
+			return err
+		}
+		if deleted.ParentID != nil {
+			if _, err := loadTask(ctx, c, *deleted.ParentID, "deleted_at IS NULL"); err == errTaskNotFound {
+				return errParentDeleted
+			} else if err != nil {
+				return err
+			}
+		}
+
+		// Subtasks deleted before the task stay deleted.
+		subtasks, err := subtree(ctx, c, id)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, t := range append([]Task{deleted}, subtasks...) {
+			if t.DeletedAt == nil || !t.DeletedAt.Equal(*deleted.DeletedAt) {
+				continue
+			}
+			if _, err := c.Exec(ctx, "UPDATE tasks SET deleted_at = NULL, version = version + 1 WHERE id = ?", t.ID); err != nil {
+				return err
+			}
+			if err := recordHistory(ctx, c, t.ID, user.ID, actionRestored, map[string]fieldChange{}, now); err != nil {
+				return err
+			}
+		}
+		if err := rollUp(ctx, c, user.ID, deleted.ParentID); err != nil {
+			return err
+		}
+		task, err = loadTask(ctx, c, id, "1 = 1")
+		return err
+	})
+	return task, err
+}
+
+func (s *sqlStore) TaskHistory(ctx context.Context, user *User, id int) ([]HistoryEntry, error) {
+	c := s.conn()
+	scope, args := seenBy(user)
+	if _, err := loadTask(ctx, c, id, scope, args...); err != nil {
+		return nil, err
+	}
+	return loadHistory(ctx, c, "h.task_id = ? ORDER BY h.id", id)
+}
+
+func (s *sqlStore) TaskEvents(ctx context.Context, user *User, after, limit int) ([]HistoryEntry, error) {
+	scope, args := seenBy(user)
+	return loadHistory(ctx, s.conn(), "h.id > ? AND h.task_id IN (SELECT id FROM tasks WHERE "+scope+") ORDER BY h.id LIMIT ?",
+		append(append([]interface{}{after}, args...), limit)...)
+}
+
+func (s *sqlStore) LastEventID(ctx context.Context) (int, error) {
+	var id int
+	err := s.conn().QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM task_history").Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) DoneRecurringTasks(ctx context.Context, limit int) ([]Task, error) {
+	return loadTasks(ctx, s.conn(), "SELECT "+taskColumns+` FROM tasks
+		WHERE recurrence <> '' AND status = ? AND deleted_at IS NULL AND owner_id IS NOT NULL
+		ORDER BY id LIMIT ?`, statusDone, limit)
+}
+
+func (s *sqlStore) RecurTask(ctx context.Context, task Task, next *Task) (*Task, error) {
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		owner, err := loadUser(ctx, c, task.OwnerID)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		res, err := c.Exec(ctx, `UPDATE tasks SET recurrence = '', updated_at = ?, version = version + 1
+			WHERE id = ? AND version = ? AND deleted_at IS NULL`, now, task.ID, task.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errVersionConflict
+		}
+		changes := map[string]fieldChange{"recurrence": {task.Recurrence, ""}}
+		if err := recordHistory(ctx, c, task.ID, owner.ID, actionUpdated, changes, now); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		created, err := createTask(ctx, c, &owner, *next)
+		if err != nil {
+			return err
+		}
+		next = &created
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (s *sqlStore) RemindDueTasks(ctx context.Context, from, to time.Time, limit int) (int, error) {
+	reminded := 0
+	err := s.inHistoryTx(ctx, func(c conn) error {
+		rows, err := c.Query(ctx, `SELECT id, owner_id, due_date FROM tasks
+			WHERE due_date > ? AND due_date <= ? AND status <> ? AND deleted_at IS NULL AND owner_id IS NOT NULL
+			AND (reminded_due_date IS NULL OR reminded_due_date <> due_date)
+			ORDER BY due_date, id LIMIT ?`, from, to, statusDone, limit)
+		if err != nil {
+			return err
+		}
+		type due struct {
+			id, owner int
+			date      time.Time
+		}
+		var tasks []due
+		for rows.Next() {
+			var d due
+			if err := rows.Scan(&d.id, &d.owner, &d.date); err != nil {
+				rows.Close()
+				return err
+			}
+			tasks = append(tasks, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		for _, d := range tasks {
+			// Another server may have reminded of the task since it was read.
+			res, err := c.Exec(ctx, `UPDATE tasks SET reminded_due_date = due_date
+				WHERE id = ? AND due_date = ? AND (reminded_due_date IS NULL OR reminded_due_date <> due_date)`, d.id, d.date)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+			if err := recordHistory(ctx, c, d.id, d.owner, actionReminder, map[string]fieldChange{}, now); err != nil {
+				return err
+			}
+			reminded++
+		}
+		return nil
+	})
+	return reminded, err
+}
+
+// loadHistory returns the history entries matching a condition, which may
+// be followed by ORDER BY and LIMIT clauses.
+func loadHistory(ctx context.Context, c conn, cond string, args ...interface{}) ([]HistoryEntry, error) {
+	rows, err := c.Query(ctx, `SELECT h.id, h.task_id, h.user_id, u.username, h.action, h.changes, h.created_at
+		FROM task_history h JOIN users u ON u.id = h.user_id
+		WHERE `+cond, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		var changes string
+		if err := rows.Scan(&e.ID, &e.TaskID, &e.UserID, &e.Username, &e.Action, &changes, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, fmt.Errorf("history entry %d: %w", e.ID, err)
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// recordHistory appends an entry to the history of a task, in a
+// transaction begun with inHistoryTx, and queues it for the webhooks whose
+// owner can see the task. The outbox is thus written with the change.
+func recordHistory(ctx context.Context, c conn, taskID, userID int, action string, changes map[string]fieldChange, at time.Time) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	var id int
+	err = c.QueryRow(ctx, "INSERT INTO task_history(task_id, user_id, action, changes, created_at) VALUES(?, ?, ?, ?, ?) RETURNING id",
+		taskID, userID, action, string(data), at).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = c.Exec(ctx, `INSERT INTO webhook_deliveries(webhook_id, event_id)
+		SELECT w.id, ? FROM webhooks w
+		JOIN users u ON u.id = w.user_id
+		JOIN tasks t ON t.id = ?
+		WHERE u.role = ? OR t.owner_id = w.user_id OR t.assignee_id = w.user_id`, id, taskID, roleAdmin)
+	return err
+}
+
+// subtree returns the subtasks of a task, their subtasks and so on,
+// deleted or not.
+func subtree(ctx context.Context, c conn, id int) ([]Task, error) {
+	return loadTasks(ctx, c, `WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM tasks WHERE parent_id = ?
+			UNION SELECT t.id FROM tasks t JOIN subtree ON t.parent_id = subtree.id
+		)
+		SELECT `+taskColumns+` FROM tasks WHERE id IN (SELECT id FROM subtree) ORDER BY id`, id)
+}
+
+func (s *sqlStore) Subtasks(ctx context.Context, user *User, id int) ([]Task, error) {
+	scope, args := visibleScope(user)
+	return loadTasks(ctx, s.conn(), `WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM tasks WHERE parent_id = ?
+			UNION SELECT t.id FROM tasks t JOIN subtree ON t.parent_id = subtree.id
+		)
+		SELECT `+taskColumns+` FROM tasks WHERE id IN (SELECT id FROM subtree) AND `+scope+` ORDER BY id`,
+		append([]interface{}{id}, args...)...)
+}
+
+func (s *sqlStore) ProjectTasks(ctx context.Context, user *User, projectID int) ([]Task, error) {
+	scope, args := visibleScope(user)
+	return loadTasks(ctx, s.conn(), "SELECT "+taskColumns+" FROM tasks WHERE project_id = ? AND "+scope+" ORDER BY id",
+		append([]interface{}{projectID}, args...)...)
+}
+
+// checkLinks checks the project, parent and blockers of a task about to be
+// saved by user, and gives a subtask without a project its parent's.
+// Problems are returned as a validationError.
+func checkLinks(ctx context.Context, c conn, user *User, task *Task) error {
+	var errs validationError
+	scope, args := visibleScope(user)
+	if task.ParentID != nil {
+		parent, err := loadTask(ctx, c, *task.ParentID, scope, args...)
+		if err == errTaskNotFound {
+			errs = append(errs, fieldError{"parent_id", "must be the ID of a task you can see"})
+		} else if err != nil {
+			return err
+		} else if task.ID != 0 {
+			// The new parent must not be the task or one of its subtasks.
+			var cycle bool
+			err := c.QueryRow(ctx, `WITH RECURSIVE ancestors(id) AS (
+					SELECT CAST(? AS INTEGER)
+					UNION SELECT t.parent_id FROM tasks t JOIN ancestors ON t.id = ancestors.id WHERE t.parent_id IS NOT NULL
+				)
+				SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = ?)`, parent.ID, task.ID).Scan(&cycle)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				errs = append(errs, fieldError{"parent_id", "must not be the task itself or one of its subtasks"})
+			}
+		}
+		if err == nil {
+			if task.ProjectID == nil {
+				task.ProjectID = parent.ProjectID
+			} else if !sameID(task.ProjectID, parent.ProjectID) {
+				errs = append(errs, fieldError{"project_id", "must be the project of the parent task"})
+			}
+		}
+	}
+	if task.ProjectID != nil {
+		var exists bool
+		if err := c.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = ?)", *task.ProjectID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs = append(errs, fieldError{"project_id", "must be the ID of an existing project"})
+		}
+	}
+	for _, id := range task.BlockedBy {
+		if id == task.ID {
+			errs = append(errs, fieldError{"blocked_by", "must not contain the task itself"})
+			continue
+		}
+		if _, err := loadTask(ctx, c, id, scope, args...); err == errTaskNotFound {
+			errs = append(errs, fieldError{"blocked_by", fmt.Sprintf("task %d does not exist or is not visible to you", id)})
+			continue
+		} else if err != nil {
+			return err
+		}
+		if task.ID == 0 {
+			continue
+		}
+		// A new task cannot block anything yet, but an existing one can:
+		// the blocker must not already wait for it.
+		var cycle bool
+		err := c.QueryRow(ctx, `WITH RECURSIVE reach(id) AS (
+				SELECT CAST(? AS INTEGER)
+				UNION SELECT d.blocked_by_id FROM task_dependencies d JOIN reach ON d.task_id = reach.id
+			)
+			SELECT EXISTS (SELECT 1 FROM reach WHERE id = ?)`, id, task.ID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			errs = append(errs, fieldError{"blocked_by", fmt.Sprintf("task %d is already blocked by this task, directly or not", id)})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// childStatuses returns the statuses of the live subtasks of a task.
+func childStatuses(ctx context.Context, c conn, id int) ([]string, error) {
+	rows, err := c.Query(ctx, "SELECT status FROM tasks WHERE parent_id = ? AND deleted_at IS NULL", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var statuses []string
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
+// rollUp recomputes the status of task id from its subtasks', then that of
+// its parent and so on up, stopping at the first that does not change.
+// The changes are recorded as made by user userID.
+func rollUp(ctx context.Context, c conn, userID int, id *int) error {
+	for id != nil {
+		statuses, err := childStatuses(ctx, c, *id)
+		if err != nil || len(statuses) == 0 {
+			return err
+		}
+		var status string
+		var parent sql.NullInt64
+		if err := c.QueryRow(ctx, "SELECT status, parent_id FROM tasks WHERE id = ?", *id).Scan(&status, &parent); err != nil {
+			return err
+		}
+		rolled := rolledUpStatus(statuses)
+		if rolled == status {
+			return nil
+		}
+		now := time.Now().UTC()
+		if _, err := c.Exec(ctx, "UPDATE tasks SET status = ?, updated_at = ?, version = version + 1 WHERE id = ?", rolled, now, *id); err != nil {
+			return err
+		}
+		if err := recordHistory(ctx, c, *id, userID, actionUpdated, map[string]fieldChange{"status": {status, rolled}}, now); err != nil {
+			return err
+		}
+		id = nullID(parent)
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateProject(ctx context.Context, p Project) (Project, error) {
+	err := s.conn().QueryRow(ctx, "INSERT INTO projects(name, description, owner_id, created_at) VALUES(?, ?, ?, ?) RETURNING id",
+		p.Name, p.Description, p.OwnerID, p.CreatedAt).Scan(&p.ID)
+	return p, err
+}
+
+func (s *sqlStore) ListProjects(ctx context.Context) ([]Project, error) {
+	rows, err := s.conn().Query(ctx, "SELECT id, name, description, owner_id, created_at FROM projects ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.OwnerID, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.CreatedAt = p.CreatedAt.UTC()
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+func (s *sqlStore) GetProject(ctx context.Context, id int) (Project, error) {
+	var p Project
+	err := s.conn().QueryRow(ctx, "SELECT id, name, description, owner_id, created_at FROM projects WHERE id = ?", id).
+		Scan(&p.ID, &p.Name, &p.Description, &p.OwnerID, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return p, errProjectNotFound
+	}
+	p.CreatedAt = p.CreatedAt.UTC()
+	return p, err
+}
+
+func (s *sqlStore) DeleteProject(ctx context.Context, id int) error {
+	res, err := s.conn().Exec(ctx, "DELETE FROM projects WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProjectNotFound
+	}
+	return nil
+}
+
+// CreateWebhook starts the webhook's outbox at the latest history entry.
+func (s *sqlStore) CreateWebhook(ctx context.Context, hook Webhook) (Webhook, error) {
+	err := s.conn().QueryRow(ctx, `INSERT INTO webhooks(user_id, url, secret, created_at)
+		VALUES(?, ?, ?, ?) RETURNING id`,
+		hook.OwnerID, hook.URL, hook.Secret, hook.CreatedAt).Scan(&hook.ID)
+	return hook, err
+}
+
+func (s *sqlStore) ListWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	rows, err := s.conn().Query(ctx, "SELECT id, url, user_id, created_at FROM webhooks WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.URL, &h.OwnerID, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.CreatedAt = h.CreatedAt.UTC()
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) DeleteWebhook(ctx context.Context, userID, id int) error {
+	res, err := s.conn().Exec(ctx, "DELETE FROM webhooks WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DueDeliveries(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]delivery, error) {
+	var due []delivery
+	err := s.inTx(ctx, func(c conn) error {
+		rows, err := c.Query(ctx, `SELECT d.id, d.attempts, d.event_id, w.id, w.url, w.secret, w.user_id, w.created_at
+			FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.next_attempt_at IS NULL OR d.next_attempt_at <= ?
+			ORDER BY d.id LIMIT ?`, now, limit)
+		if err != nil {
+			return err
+		}
+		var candidates []delivery
+		for rows.Next() {
+			var d delivery
+			err := rows.Scan(&d.ID, &d.Attempts, &d.Event.ID, &d.Webhook.ID, &d.Webhook.URL, &d.Webhook.Secret, &d.Webhook.OwnerID, &d.Webhook.CreatedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			candidates = append(candidates, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		events := map[int]HistoryEntry{}
+		for _, d := range candidates {
+			// Another server may have taken the delivery since it was read.
+			res, err := c.Exec(ctx, `UPDATE webhook_deliveries SET next_attempt_at = ?
+				WHERE id = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)`, now.Add(lease), d.ID, now)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+			if _, ok := events[d.Event.ID]; !ok {
+				entries, err := loadHistory(ctx, c, "h.id = ?", d.Event.ID)
+				if err != nil {
+					return err
+				}
+				if len(entries) == 1 {
+					events[d.Event.ID] = entries[0]
+				}
+			}
+			d.Event = events[d.Event.ID]
+			due = append(due, d)
+		}
+		return nil
+	})
+	return due, err
+}
+
+func (s *sqlStore) DeliveryDone(ctx context.Context, id int) error {
+	_, err := s.conn().Exec(ctx, "DELETE FROM webhook_deliveries WHERE id = ?", id)
+	return err
+}
+
+func (s *sqlStore) DeliveryFailed(ctx context.Context, id int, reason string, retry time.Time) error {
+	_, err := s.conn().Exec(ctx, "UPDATE webhook_deliveries SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		reason, retry, id)
+	return err
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, username, passwordHash string) (User, error) {
+	u := User{Username: username, CreatedAt: time.Now().UTC()}
+	err := s.inTx(ctx, func(c conn) error {
+		// SQLite runs the INSERT below atomically, but Postgres would let
+		// two concurrent first sign-ups both see an empty table.
+		if s.dialect == dialectPostgres {
+			if _, err := c.Exec(ctx, "LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+				return err
+			}
+		}
+		return c.QueryRow(ctx, `INSERT INTO users(username, password_hash, role, created_at)
+			VALUES(?, ?, CASE WHEN EXISTS (SELECT 1 FROM users) THEN ? ELSE ? END, ?) RETURNING id, role`,
+			u.Username, passwordHash, roleUser, roleAdmin, u.CreatedAt).Scan(&u.ID, &u.Role)
+	})
+	if isUniqueViolation(err) {
+		return u, errUsernameTaken
+	}
+	return u, err
+}
+
+func (s *sqlStore) UserExists(ctx context.Context, id int) (bool, error) {
+	var exists bool
+	err := s.conn().QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// loadUser returns an account, or errUserNotFound.
+func loadUser(ctx context.Context, c conn, id int) (User, error) {
+	var u User
+	err := c.QueryRow(ctx, "SELECT id, username, role, created_at FROM users WHERE id = ?", id).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return u, errUserNotFound
+	}
+	u.CreatedAt = u.CreatedAt.UTC()
+	return u, err
+}
+
+func (s *sqlStore) PasswordHash(ctx context.Context, username string) (int, string, error) {
+	var id int
+	var hash string
+	err := s.conn().QueryRow(ctx, "SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		return 0, "", errUserNotFound
+	}
+	return id, hash, err
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.conn().Query(ctx, "SELECT id, username, role, created_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = u.CreatedAt.UTC()
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) SetRole(ctx context.Context, id int, role string) error {
+	res, err := s.conn().Exec(ctx, "UPDATE users SET role = ? WHERE id = ?", role, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateSession(ctx context.Context, tokenHash string, userID int, expires time.Time) error {
+	_, err := s.conn().Exec(ctx, "INSERT INTO sessions(token_hash, user_id, expires_at) VALUES(?, ?, ?)", tokenHash, userID, expires)
+	return err
+}
+
+func (s *sqlStore) SessionUser(ctx context.Context, tokenHash string) (User, time.Time, error) {
+	var u User
+	var expires time.Time
+	err := s.conn().QueryRow(ctx, `SELECT u.id, u.username, u.role, u.created_at, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ?`, tokenHash).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt, &expires)
+	if err == sql.ErrNoRows {
+		return u, expires, errSessionNotFound
+	}
+	u.CreatedAt = u.CreatedAt.UTC()
+	return u, expires, err
+}
+
+func (s *sqlStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.conn().Exec(ctx, "DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	_, err := s.conn().Exec(ctx, "DELETE FROM sessions WHERE expires_at < ?", now)
+	return err
+}
+
+// taskColumns lists the columns scanTask reads, in order.
+const taskColumns = "id, title, description, status, priority, due_date, recurrence, assignee_id, project_id, parent_id, COALESCE(owner_id, 0), created_at, updated_at, version, deleted_at"
+
+// scanTask reads a row of taskColumns, followed by any columns for extra.
+// Tags are loaded separately.
+func scanTask(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Task, error) {
+	var t Task
+	var due, deleted sql.NullTime
+	var assignee, project, parent sql.NullInt64
+	err := row.Scan(append([]interface{}{&t.ID, &t.Title, &t.Description, &t.Status, &t.Priority, &due, &t.Recurrence, &assignee, &project, &parent,
+		&t.OwnerID, &t.CreatedAt, &t.UpdatedAt, &t.Version, &deleted}, extra...)...)
+	if err != nil {
+		return t, err
+	}
+	if due.Valid {
+		d := due.Time.UTC()
+		t.DueDate = &d
+	}
+	if deleted.Valid {
+		d := deleted.Time.UTC()
+		t.DeletedAt = &d
+	}
+	t.AssigneeID, t.ProjectID, t.ParentID = nullID(assignee), nullID(project), nullID(parent)
+	t.CreatedAt, t.UpdatedAt = t.CreatedAt.UTC(), t.UpdatedAt.UTC()
+	t.Tags = []string{}
+	t.BlockedBy = []int{}
+	return t, nil
+}
+
+// nullID returns the ID in a nullable column.
+func nullID(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	id := int(n.Int64)
+	return &id
+}
+
+// loadTasks runs a query selecting taskColumns and reads the tasks with
+// their tags and blockers.
+func loadTasks(ctx context.Context, c conn, query string, args ...interface{}) ([]Task, error) {
+	rows, err := c.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := loadDetails(ctx, c, tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// loadTask reads a task and its tags. Only tasks matching scope are found;
+// others give errTaskNotFound.
+func loadTask(ctx context.Context, c conn, id int, scope string, args ...interface{}) (Task, error) {
+	task, err := scanTask(c.QueryRow(ctx, "SELECT "+taskColumns+" FROM tasks WHERE id = ? AND "+scope,
+		append([]interface{}{id}, args...)...))
+	if err == sql.ErrNoRows {
+		return task, errTaskNotFound
+	} else if err != nil {
+		return task, err
+	}
+	tasks := []Task{task}
+	if err := loadDetails(ctx, c, tasks); err != nil {
+		return task, err
+	}
+	return tasks[0], nil
+}
+
+// loadDetails fills in the tags and blockers of tasks, a page at a time
+// so as to stay within the databases' limits on parameters.
+func loadDetails(ctx context.Context, c conn, tasks []Task) error {
+	for len(tasks) > 0 {
+		n := min(len(tasks), maxPageSize)
+		if err := loadTags(ctx, c, tasks[:n]); err != nil {
+			return err
+		}
+		if err := loadBlockers(ctx, c, tasks[:n]); err != nil {
+			return err
+		}
+		tasks = tasks[n:]
+	}
+	return nil
+}
+
+// loadBlockers fills in the live blockers of tasks.
+func loadBlockers(ctx context.Context, c conn, tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Task, len(tasks))
+	args := make([]interface{}, len(tasks))
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+		args[i] = tasks[i].ID
+	}
+	// NOT EXISTS rather than a join, here and in saveBlockers, keeps SQLite
+	// from scanning every live task.
+	rows, err := c.Query(ctx, `SELECT d.task_id, d.blocked_by_id FROM task_dependencies d
+		WHERE d.task_id IN (?`+strings.Repeat(", ?", len(tasks)-1)+`)
+		AND NOT EXISTS (SELECT 1 FROM tasks t WHERE t.id = d.blocked_by_id AND t.deleted_at IS NOT NULL)
+		ORDER BY d.blocked_by_id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, blocker int
+		if err := rows.Scan(&id, &blocker); err != nil {
+			return err
+		}
+		byID[id].BlockedBy = append(byID[id].BlockedBy, blocker)
+	}
+	return rows.Err()
+}
+
+// saveBlockers replaces the live blockers of a task. Dependencies on
+// deleted tasks are kept in case they are restored.
+func saveBlockers(ctx context.Context, c conn, taskID int, blockers []int) error {
+	_, err := c.Exec(ctx, `DELETE FROM task_dependencies WHERE task_id = ?
+		AND NOT EXISTS (SELECT 1 FROM tasks t WHERE t.id = blocked_by_id AND t.deleted_at IS NOT NULL)`, taskID)
+	if err != nil {
+		return err
+	}
+	for _, id := range blockers {
+		if _, err := c.Exec(ctx, "INSERT INTO task_dependencies(task_id, blocked_by_id) VALUES(?, ?)", taskID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTags fills in the tags of tasks.
+func loadTags(ctx context.Context, c conn, tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Task, len(tasks))
+	args := make([]interface{}, len(tasks))
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+		args[i] = tasks[i].ID
+	}
+	rows, err := c.Query(ctx, `SELECT tt.task_id, t.name FROM task_tags tt JOIN tags t ON t.id = tt.tag_id
+		WHERE tt.task_id IN (?`+strings.Repeat(", ?", len(tasks)-1)+`) ORDER BY lower(t.name)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		byID[id].Tags = append(byID[id].Tags, name)
+	}
+	return rows.Err()
+}
+
+// saveTags replaces the tags of a task, creating tags that do not exist
+// yet. Tags are matched regardless of case; the first spelling stored wins.
+func saveTags(ctx context.Context, c conn, taskID int, tags []string) error {
+	if _, err := c.Exec(ctx, "DELETE FROM task_tags WHERE task_id = ?", taskID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := c.Exec(ctx, "INSERT INTO tags(name) VALUES(?) ON CONFLICT DO NOTHING", tag); err != nil {
+			return err
+		}
+		// Postgres cannot infer the type of a bare parameter in a SELECT list.
+		if _, err := c.Exec(ctx, "INSERT INTO task_tags(task_id, tag_id) SELECT CAST(? AS INTEGER), id FROM tags WHERE lower(name) = lower(?)", taskID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a database's complaint about a
+// duplicate key.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case errors.As(err, &pqErr):
+		return pqErr.Code == "23505"
+	}
+	return false
+}
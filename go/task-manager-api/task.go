@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	statusTodo       = "todo"
+	statusInProgress = "in-progress"
+	statusDone       = "done"
+
+	priorityLow    = "low"
+	priorityMedium = "medium"
+	priorityHigh   = "high"
+
+	maxTitleLength       = 200
+	maxDescriptionLength = 10000
+	maxTagLength         = 50
+	maxTags              = 20
+)
+
+var (
+	statuses   = []string{statusTodo, statusInProgress, statusDone}
+	priorities = []string{priorityLow, priorityMedium, priorityHigh}
+)
+
+// fieldError describes what is wrong with one field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a request.
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// at returns the errors of the item at index i of a list, named as fields
+// of [i].
+func (e validationError) at(i int) validationError {
+	errs := make(validationError, len(e))
+	for j, f := range e {
+		errs[j] = fieldError{joinPath(itemPath(i), f.Field), f.Message}
+	}
+	return errs
+}
+
+// itemPath names the item at index i of a list in a request body.
+func itemPath(i int) string {
+	return fmt.Sprintf("[%d]", i)
+}
+
+// isControlInText reports whether r is a control character that has no
+// place in text, unlike tabs and line breaks. Search highlights rely on
+// there being none: the database marks matches with some.
+func isControlInText(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// normalize fills in defaults and tidies the fields of a task a client sent,
+// then checks them. It does not check that the assignee exists.
+func (t *Task) normalize() validationError {
+	var errs validationError
+	t.Title = strings.TrimSpace(t.Title)
+	switch {
+	case t.Title == "":
+		errs = append(errs, fieldError{"title", "is required"})
+	case utf8.RuneCountInString(t.Title) > maxTitleLength:
+		errs = append(errs, fieldError{"title", fmt.Sprintf("must be at most %d characters", maxTitleLength)})
+	case strings.ContainsFunc(t.Title, unicode.IsControl):
+		errs = append(errs, fieldError{"title", "must not contain control characters"})
+	}
+	switch {
+	case utf8.RuneCountInString(t.Description) > maxDescriptionLength:
+		errs = append(errs, fieldError{"description", fmt.Sprintf("must be at most %d characters", maxDescriptionLength)})
+	case strings.ContainsFunc(t.Description, isControlInText):
+		errs = append(errs, fieldError{"description", "must not contain control characters other than tabs and line breaks"})
+	}
+
+	if t.Status == "" {
+		t.Status = statusTodo
+	}
+	if !contains(statuses, t.Status) {
+		errs = append(errs, fieldError{"status", "must be one of " + strings.Join(statuses, ", ")})
+	}
+	if t.Priority == "" {
+		t.Priority = priorityMedium
+	}
+	if !contains(priorities, t.Priority) {
+		errs = append(errs, fieldError{"priority", "must be one of " + strings.Join(priorities, ", ")})
+	}
+
+	// Tags are unique regardless of case; the first spelling wins.
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, tag := range t.Tags {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "":
+			errs = append(errs, fieldError{"tags", "must not contain empty tags"})
+			continue
+		case utf8.RuneCountInString(tag) > maxTagLength:
+			errs = append(errs, fieldError{"tags", fmt.Sprintf("must be at most %d characters each", maxTagLength)})
+			continue
+		case seen[strings.ToLower(tag)]:
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		errs = append(errs, fieldError{"tags", fmt.Sprintf("must have at most %d tags", maxTags)})
+	}
+	sort.Strings(tags)
+	t.Tags = tags
+
+	blockers := []int{}
+	for _, id := range t.BlockedBy {
+		if id < 1 {
+			errs = append(errs, fieldError{"blocked_by", "must contain task IDs"})
+		} else if !slices.Contains(blockers, id) {
+			blockers = append(blockers, id)
+		}
+	}
+	sort.Ints(blockers)
+	t.BlockedBy = blockers
+
+	if t.DueDate != nil {
+		due := t.DueDate.UTC()
+		t.DueDate = &due
+	}
+
+	if t.Recurrence = strings.TrimSpace(t.Recurrence); t.Recurrence != "" {
+		rule, err := parseRRule(t.Recurrence)
+		switch {
+		case err != nil:
+			errs = append(errs, fieldError{"recurrence", err.Error()})
+		case t.DueDate == nil:
+			errs = append(errs, fieldError{"recurrence", "needs a due_date to count from"})
+		default:
+			t.Recurrence = rule.String()
+		}
+	}
+	return errs
+}
+
+// rolledUpStatus returns the status of a task whose subtasks have
+// statuses: done once they all are, todo until one of them is started, and
+// in-progress in between.
+func rolledUpStatus(statuses []string) string {
+	done, todo := 0, 0
+	for _, s := range statuses {
+		switch s {
+		case statusDone:
+			done++
+		case statusTodo:
+			todo++
+		}
+	}
+	switch {
+	case done == len(statuses):
+		return statusDone
+	case todo == len(statuses):
+		return statusTodo
+	}
+	return statusInProgress
+}
+
+// sameID reports whether two optional IDs are equal.
+func sameID(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	deliveryBatchSize = 50
+
+	// Failed deliveries are retried after 10s, 20s, 40s... up to an hour
+	// apart, and given up on after maxDeliveryAttempts attempts, about a
+	// day after the first.
+	retryBaseDelay      = 10 * time.Second
+	retryMaxDelay       = time.Hour
+	maxDeliveryAttempts = 30
+)
+
+// errPrivateAddress is the error of a webhook request to an address that
+// is not public.
+var errPrivateAddress = errors.New("webhooks are not sent to private, loopback or link-local addresses")
+
+// reservedPrefixes are the special-purpose ranges that IsGlobalUnicast and
+// IsPrivate let through, such as shared CGNAT space and NAT64, which can
+// reach private IPv4 addresses.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// Webhook is a URL that is sent the changes to the tasks its owner can see,
+// as POST requests with a taskEvent as the body.
+//
+// Every request has an X-Webhook-Timestamp header with the Unix time it
+// was sent at, and an X-Webhook-Signature header of "sha256=" and the hex
+// HMAC-SHA256, keyed with the webhook's secret, of the timestamp, a "." and
+// the body. Any 2xx response acknowledges the event; other responses,
+// redirects included, are retried with exponential backoff. Events may
+// arrive more than once and out of order; their IDs tell them apart. Only
+// public addresses are sent to.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // only sent when the webhook is created
+	OwnerID   int       `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// delivery is an event waiting in the outbox to be sent to a webhook.
+type delivery struct {
+	ID       int
+	Webhook  Webhook
+	Event    HistoryEntry
+	Attempts int // failed attempts so far
+}
+
+// webhookID parses the webhook ID in a /webhooks/ path. If it is not
+// valid, the error has been sent and ok is false.
+func webhookID(w http.ResponseWriter, r *http.Request) (id int, ok bool) {
+	id, err := strconv.Atoi(r.URL.Path[len("/webhooks/"):])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// createWebhook registers a webhook for the caller. Its secret is generated
+// and only returned now.
+func (s *server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if !readJSON(w, r, "WebhookInput", &hook) {
+		return
+	}
+	hook.URL = strings.TrimSpace(hook.URL)
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeValidationError(w, validationError{{"url", "must be an absolute http or https URL"}})
+		return
+	}
+	if !s.events.allowPrivate && !publicHost(r.Context(), u.Hostname()) {
+		writeValidationError(w, validationError{{"url", "must not be a private, loopback or link-local address"}})
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	hook.Secret = secret
+	hook.OwnerID = currentUser(r).ID
+	hook.CreatedAt = time.Now().UTC()
+	hook, err = s.webhooks.CreateWebhook(r.Context(), hook)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	log.Printf("User %d registered webhook %d for %s\n", hook.OwnerID, hook.ID, u.Host)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// getWebhooks lists the caller's webhooks, without their secrets.
+func (s *server) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.webhooks.ListWebhooks(r.Context(), currentUser(r).ID)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// deleteWebhook deletes one of the caller's webhooks. Events not yet sent
+// to it are dropped.
+func (s *server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	err := s.webhooks.DeleteWebhook(r.Context(), currentUser(r).ID, id)
+	if err == errWebhookNotFound {
+		writeError(w, http.StatusNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publicAddr reports whether webhooks may be sent to addr: a global
+// unicast address that is neither private nor reserved. Cloud metadata
+// services, such as 169.254.169.254, are at link-local addresses.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicHost reports whether the host of a webhook URL is a public
+// address, or a name that only resolves to public addresses. A name that
+// does not resolve yet is let through; dialPublic checks it again on
+// every delivery.
+func publicHost(ctx context.Context, host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return publicAddr(addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic refuses connections to addresses that are not public. It is
+// the Control of the dialer webhooks are sent with, so it sees the address
+// a host name resolved to when it is dialed, however it resolved before.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addr) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, addr)
+	}
+	return nil
+}
+
+// deliver sends the deliveries that are due, each webhook's in order.
+func (n *notifier) deliver(ctx context.Context) {
+	now := time.Now().UTC()
+	// Deliveries are leased for longer than it takes to send them all.
+	due, err := n.hooks.DueDeliveries(ctx, now, deliveryBatchSize, deliveryBatchSize*webhookTimeout)
+	if err != nil {
+		log.Printf("Error reading the webhook outbox: %v\n", err)
+		return
+	}
+	byHook := map[int][]delivery{}
+	for _, d := range due {
+		byHook[d.Webhook.ID] = append(byHook[d.Webhook.ID], d)
+	}
+
+	var wg sync.WaitGroup
+	for _, deliveries := range byHook {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, d := range deliveries {
+				n.attempt(ctx, d)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// attempt sends a delivery once and records the outcome.
+func (n *notifier) attempt(ctx context.Context, d delivery) {
+	err := n.send(ctx, d)
+	if err == nil {
+		if err := n.hooks.DeliveryDone(ctx, d.ID); err != nil {
+			log.Printf("Error recording webhook delivery %d: %v\n", d.ID, err)
+		}
+		return
+	}
+
+	attempts := d.Attempts + 1
+	if attempts >= maxDeliveryAttempts {
+		log.Printf("Giving up on sending event %d to webhook %d after %d attempts: %v\n", d.Event.ID, d.Webhook.ID, attempts, err)
+		err = n.hooks.DeliveryDone(ctx, d.ID)
+	} else {
+		err = n.hooks.DeliveryFailed(ctx, d.ID, err.Error(), time.Now().UTC().Add(retryDelay(attempts)))
+	}
+	if err != nil {
+		log.Printf("Error recording webhook delivery %d: %v\n", d.ID, err)
+	}
+}
+
+// send posts the event of a delivery to its webhook, signed.
+func (n *notifier) send(ctx context.Context, d delivery) error {
+	body, err := json.Marshal(newTaskEvent(d.Event))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-manager-api-webhooks")
+	req.Header.Set("X-Webhook-Event", "task."+d.Event.Action)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signPayload(d.Webhook.Secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of a webhook request.
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay returns how long to wait after a delivery failed attempts
+// times.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}